@@ -0,0 +1,314 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive zips the workspace copied to the Windows build servers.
+package archive
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options select the files zipped by Create.
+type Options struct {
+	// Excludes are local paths left out.
+	Excludes []string
+	// Includes, when not empty, are the glob patterns of the only files
+	// zipped, see isIncluded.
+	Includes []string
+	// Symlinks is how symlinks are handled: "skip" or empty leaves them
+	// out, "follow" zips the files and directories they point to in their
+	// place and "error" fails.
+	Symlinks string
+	Limits   Limits
+}
+
+// Limits guard against archives too large to copy before the copy times
+// out. Sizes are in bytes, and not checked when 0.
+type Limits struct {
+	// WarnFileSize is the size above which files are logged, or left out
+	// with SkipLargeFiles.
+	WarnFileSize   int64
+	SkipLargeFiles bool
+	// MaxSize is the size of the compressed archive above which zipping
+	// fails, before anything is uploaded.
+	MaxSize int64
+}
+
+// Create zips the directory fullpath into a temp file, selecting the files
+// with opts, and returns the path of the temp file. Modification times and
+// the read-only attribute of the files are kept.
+func Create(ctx context.Context, fullpath string, opts Options) (string, error) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer f.Close()
+
+	cw := &countingWriter{w: f}
+	zipW := zip.NewWriter(cw)
+	defer zipW.Close()
+
+	z := &zipper{ctx: ctx, w: zipW, size: cw, opts: opts}
+	ancestors := map[string]bool{}
+	if real, err := filepath.EvalSymlinks(fullpath); err == nil {
+		ancestors[real] = true
+	}
+	if err := z.walk(fullpath, "", ancestors); err != nil {
+		return "", fmt.Errorf("failed to walk directory: %v", err)
+	}
+	if len(opts.Includes) > 0 && z.files == 0 {
+		return "", fmt.Errorf("no file of %s matches the includes %q", fullpath, opts.Includes)
+	}
+
+	return f.Name(), ctx.Err()
+}
+
+// zipper adds the files of a directory tree to a zip archive.
+type zipper struct {
+	ctx   context.Context
+	w     *zip.Writer
+	size  *countingWriter
+	opts  Options
+	files int
+	// largest are the largest files zipped, by decreasing size.
+	largest []zippedFile
+}
+
+type zippedFile struct {
+	name string
+	size int64
+}
+
+// maxLargestFiles is the number of largest files reported when the archive
+// is too large.
+const maxLargestFiles = 5
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// walk zips the directory dir as rel in the archive. ancestors are the
+// real paths of the directories being zipped, to detect symlink loops.
+func (z *zipper) walk(dir string, rel string, ancestors map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		for _, exclude := range z.opts.Excludes {
+			if samePath(path, exclude) {
+				log.Printf("Skipping excluded path: %q", path)
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return z.ctx.Err()
+			}
+		}
+
+		if fi.IsDir() {
+			// Skip
+			return z.ctx.Err()
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.Join(rel, name)
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			switch z.opts.Symlinks {
+			case "follow":
+				return z.followSymlink(path, name, ancestors)
+			case "error":
+				return fmt.Errorf("%q is a symlink, see --symlinks", path)
+			}
+			log.Printf("Skipping symlink: %q", path)
+			return z.ctx.Err()
+		}
+
+		return z.addFile(path, name, fi)
+	})
+}
+
+// followSymlink zips the file or directory the symlink path points to as
+// name.
+func (z *zipper) followSymlink(path string, name string, ancestors map[string]bool) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve symlink %q: %v", path, err)
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return z.addFile(target, name, fi)
+	}
+	if ancestors[target] {
+		return fmt.Errorf("symlink %q loops to %q", path, target)
+	}
+	nested := map[string]bool{target: true}
+	for a := range ancestors {
+		nested[a] = true
+	}
+	return z.walk(target, name, nested)
+}
+
+// addFile zips the file path with info fi as name, unless it is not
+// included. The modification time is kept, in UTC as the zip format stores
+// local times, and so is the read-only attribute, for the extraction on the
+// instances to restore them.
+func (z *zipper) addFile(path string, name string, fi os.FileInfo) error {
+	if !isIncluded(filepath.ToSlash(name), z.opts.Includes) {
+		return z.ctx.Err()
+	}
+	limits := z.opts.Limits
+	if limits.WarnFileSize > 0 && fi.Size() > limits.WarnFileSize {
+		if limits.SkipLargeFiles {
+			log.Printf("Skipping large file %q of %s", path, formatSize(fi.Size()))
+			return z.ctx.Err()
+		}
+		log.Printf("Warning: large file %q of %s slows down the workspace copy", path, formatSize(fi.Size()))
+	}
+	z.files++
+
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Method = zip.Deflate
+	header.Modified = fi.ModTime().UTC()
+	w, err := z.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(w, path); err != nil {
+		return err
+	}
+	z.addLargest(zippedFile{name: name, size: fi.Size()})
+	if limits.MaxSize > 0 && z.size.n > limits.MaxSize {
+		var largest []string
+		for _, f := range z.largest {
+			largest = append(largest, fmt.Sprintf("%s (%s)", f.name, formatSize(f.size)))
+		}
+		return fmt.Errorf("the workspace archive exceeds %s after %d files, the largest are: %s", formatSize(limits.MaxSize), z.files, strings.Join(largest, ", "))
+	}
+	return z.ctx.Err()
+}
+
+// addLargest records f if it is one of the largest files zipped.
+func (z *zipper) addLargest(f zippedFile) {
+	i := sort.Search(len(z.largest), func(i int) bool { return z.largest[i].size < f.size })
+	if i >= maxLargestFiles {
+		return
+	}
+	z.largest = append(z.largest, zippedFile{})
+	copy(z.largest[i+1:], z.largest[i:])
+	z.largest[i] = f
+	if len(z.largest) > maxLargestFiles {
+		z.largest = z.largest[:maxLargestFiles]
+	}
+}
+
+// formatSize formats a size in bytes with a binary unit, e.g. 1.5 GiB.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGT"[exp])
+}
+
+// ParseSize parses a size in bytes with an optional binary unit suffix, e.g.
+// 500MB or 2G for 500 MiB or 2 GiB.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMGT"); i >= 0 && i == len(value)-1 {
+		multiplier = int64(1) << (10 * uint(strings.IndexByte("KMGT", value[i])+1))
+		value = value[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500MB", s)
+	}
+	return n * multiplier, nil
+}
+
+// isIncluded reports whether the slash separated path rel, relative to the
+// zipped directory, or one of its parent directories matches one of the
+// includes glob patterns. All paths are included when includes is empty.
+func isIncluded(rel string, includes []string) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range includes {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// samePath reports whether the local paths a and b are the same, relative
+// paths being resolved from the current directory.
+func samePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
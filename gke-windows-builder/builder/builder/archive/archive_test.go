@@ -0,0 +1,306 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	t.Parallel()
+
+	abs, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, path := range map[string]string{
+		"relative": "testdata",
+		"absolute": abs,
+	} {
+		t.Run(name, func(t *testing.T) {
+			zf, err := Create(context.Background(), path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.OpenReader(zf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+
+			expected := map[string]string{
+				"file-a.txt":                          "hello world",
+				"file-b.txt":                          "foo bar",
+				filepath.Join("subdir", "file-d.txt"): "bar baz",
+			}
+
+			for _, f := range zr.File {
+				expectedData, ok := expected[f.Name]
+				if !ok {
+					t.Fatalf("unexpected file %q found in archive", f.Name)
+				}
+
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ad, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actualData := string(ad)
+				// We'll trim space to make testing simpler
+				actualData = strings.TrimSpace(actualData)
+
+				if actualData != expectedData {
+					t.Fatalf("expected data from %s to be %q, got %q", f.Name, expectedData, actualData)
+				}
+			}
+
+			if len(expected) != len(zr.File) {
+				t.Fatalf("expected archive to have %d files, had %d", len(expected), len(zr.File))
+			}
+		})
+	}
+}
+
+func TestCreate_cancelled_context(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := Create(ctx, "testdata", Options{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestCreate_excludes(t *testing.T) {
+	t.Parallel()
+
+	zf, err := Create(context.Background(), "testdata", Options{Excludes: []string{filepath.Join("testdata", "subdir")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(zf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, "subdir") {
+			t.Errorf("expected excluded file %q not to be in the archive", f.Name)
+		}
+	}
+	if len(zr.File) != 2 {
+		t.Fatalf("expected archive to have 2 files, had %d", len(zr.File))
+	}
+}
+
+func TestCreate_includes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		includes []string
+		expected []string
+	}{
+		{includes: []string{"file-a.txt"}, expected: []string{"file-a.txt"}},
+		{includes: []string{"subdir"}, expected: []string{"subdir/file-d.txt"}},
+		{includes: []string{"file-[ab].txt", "subdir/*.txt"}, expected: []string{"file-a.txt", "file-b.txt", "subdir/file-d.txt"}},
+	}
+	for _, test := range tests {
+		zf, err := Create(context.Background(), "testdata", Options{Includes: test.includes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.OpenReader(zf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, filepath.ToSlash(f.Name))
+		}
+		zr.Close()
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("expected includes %q to zip %q, got %q", test.includes, test.expected, names)
+		}
+	}
+
+	if _, err := Create(context.Background(), "testdata", Options{Includes: []string{"*.exe"}}); err == nil {
+		t.Errorf("expected an error when nothing matches the includes")
+	}
+}
+
+func TestCreate_symlinks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(testdata, filepath.Join(dir, "vendor")); err != nil {
+		t.Fatal(err)
+	}
+
+	zf, err := Create(context.Background(), dir, Options{Symlinks: "follow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(zf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, filepath.ToSlash(f.Name))
+	}
+	zr.Close()
+	sort.Strings(names)
+	expected := []string{"vendor/file-a.txt", "vendor/file-b.txt", "vendor/file-c.txt", "vendor/subdir/file-d.txt"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected the symlinks to be followed into %q, got %q", expected, names)
+	}
+
+	if _, err := Create(context.Background(), dir, Options{Symlinks: "error"}); err == nil {
+		t.Errorf("expected an error for a symlink with symlinks=error")
+	}
+
+	if err := os.Symlink(dir, filepath.Join(dir, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(context.Background(), dir, Options{Symlinks: "follow"}); err == nil || !strings.Contains(err.Error(), "loops") {
+		t.Errorf("expected a symlink loop error, got %v", err)
+	}
+}
+
+func TestCreate_attributes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	for name, mode := range map[string]os.FileMode{"rw.txt": 0644, "ro.txt": 0444} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zf, err := Create(context.Background(), dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(zf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if !f.Modified.Equal(mtime) {
+			t.Errorf("expected %s to keep its modification time %v, got %v", f.Name, mtime, f.Modified)
+		}
+		if readOnly := f.ExternalAttrs&0x01 != 0; readOnly != (f.Name == "ro.txt") {
+			t.Errorf("unexpected read-only attribute %v of %s", readOnly, f.Name)
+		}
+	}
+}
+
+func TestCreate_limits(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Random content, so the archive is as large as the files.
+	for name, size := range map[string]int{"small.txt": 10, "large.bin": 64 * 1024, "larger.bin": 128 * 1024} {
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zf, err := Create(context.Background(), dir, Options{Limits: Limits{WarnFileSize: 1024, SkipLargeFiles: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(zf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "small.txt" {
+		t.Errorf("expected only small.txt to be zipped, got %d files", len(zr.File))
+	}
+	zr.Close()
+
+	_, err = Create(context.Background(), dir, Options{Limits: Limits{MaxSize: 100 * 1024}})
+	if err == nil || !strings.Contains(err.Error(), "larger.bin (128.0 KiB)") {
+		t.Errorf("expected an error listing larger.bin, got %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"500MB":  500 << 20,
+		"2G":     2 << 30,
+		"1.5GB":  -1,
+		"10 KiB": 10 << 10,
+		"MB":     -1,
+		"-1":     -1,
+	} {
+		size, err := ParseSize(s)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("expected an error parsing %q, got %d", s, size)
+			}
+			continue
+		}
+		if err != nil || size != expected {
+			t.Errorf("expected %q to be %d, got %d, %v", s, expected, size, err)
+		}
+	}
+}
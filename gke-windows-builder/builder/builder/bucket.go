@@ -15,30 +15,25 @@
 package builder
 
 import (
-	"archive/zip"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
-	"path/filepath"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"gke-windows-builder/builder/builder/archive"
 )
 
 // Create the GCS bucket if it doesn't exist. The bucket is used to copy workspace over to Windows instances.
-func NewGCSBucketIfNotExists(ctx context.Context, projectID string, workspaceBucket string, workspaceBucketLocation string) error {
+// A created bucket gets labels and is recorded in inv, which may be nil.
+func NewGCSBucketIfNotExists(ctx context.Context, client StorageClient, projectID string, workspaceBucket string, workspaceBucketLocation string, labels map[string]string, inv *Inventory) error {
 	if workspaceBucket == "" {
 		log.Printf("No bucket name specified, skip creating the bucket")
 		return nil
 	}
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return fmt.Errorf("Storage client creation failed: %+v", err)
-	}
-	defer client.Close()
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
@@ -54,23 +49,23 @@ func NewGCSBucketIfNotExists(ctx context.Context, projectID string, workspaceBuc
 				},
 			},
 		},
+		Labels: labels,
 	}
 
 	if workspaceBucketLocation != "" {
 		attrs.Location = workspaceBucketLocation
 	}
 
-	bkt := client.Bucket(workspaceBucket)
-
 	// Retrieve the bucket's metadata to find if it already exists and
 	// that the code has access to the bucket
-	if _, err := bkt.Attrs(ctx); err == nil {
+	if _, err := client.GetBucketAttrs(ctx, workspaceBucket); err == nil {
 		log.Printf("%v bucket already exists", workspaceBucket)
 		return nil
 	} else if err == storage.ErrBucketNotExist {
 		// The bucket does not exist. Try to create it
-		if err := bkt.Create(ctx, projectID, attrs); err == nil {
+		if err := client.CreateBucket(ctx, projectID, workspaceBucket, attrs); err == nil {
 			log.Printf("Bucket %v is setup", workspaceBucket)
+			inv.AddBucket(workspaceBucket)
 			return nil
 		} else {
 			return fmt.Errorf("Create bucket(%q) with error: %+v", workspaceBucket, err)
@@ -82,106 +77,67 @@ func NewGCSBucketIfNotExists(ctx context.Context, projectID string, workspaceBuc
 
 func writeZipToBucket(
 	ctx context.Context,
+	client StorageClient,
 	bucket string,
 	object string,
 	inputPath string,
+	opts archive.Options,
+	metadata map[string]string,
 ) (string, error) {
-	zp, err := createZip(ctx, inputPath)
+	zp, err := archive.Create(ctx, inputPath, opts)
 	if err != nil {
 		return "", err
 	}
 
-	return writeToBucket(ctx, bucket, object, zp)
+	return writeToBucket(ctx, client, bucket, object, zp, metadata)
 }
 
 func writeToBucket(
 	ctx context.Context,
+	client StorageClient,
 	bucket string,
 	object string,
 	inputPath string,
+	metadata map[string]string,
 ) (string, error) {
-
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return "", err
-	}
-	defer client.Close()
-
-	bkt := client.Bucket(bucket)
-
 	f, err := os.Open(inputPath)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	obj := bkt.Object(object)
-	w := obj.NewWriter(ctx)
-	defer w.Close()
-
-	if _, err := io.Copy(w, f); err != nil {
+	if err := client.WriteObject(ctx, bucket, object, f, metadata); err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("gs://%s/%s", bucket, object), nil
 }
 
-func createZip(ctx context.Context, fullpath string) (string, error) {
-	f, err := ioutil.TempFile("", "")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %v", err)
-	}
-	defer f.Close()
-
-	zipW := zip.NewWriter(f)
-	defer zipW.Close()
-
-	err = filepath.Walk(fullpath, func(path string, info os.FileInfo, err error) error {
-		fi, err := os.Lstat(path)
-		if err != nil {
-			return err
-		}
-
-		if fi.IsDir() {
-			// Skip
-			return ctx.Err()
-		}
-
-		if fi.Mode()&os.ModeSymlink != 0 {
-			log.Printf("Skipping symlink: %q", path)
-			return ctx.Err()
-		}
-
-		trimmedPath := path
-		if filepath.HasPrefix(trimmedPath, fullpath) {
-			trimmedPath = trimmedPath[len(fullpath)+1:]
-		}
-
-		w, err := zipW.Create(trimmedPath)
-		if err != nil {
-			return err
-		}
-		if err := copyFile(w, path); err != nil {
-			return err
-		}
+// objectMediaURL returns the Cloud Storage JSON API URL that downloads object.
+func objectMediaURL(bucket string, object string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", bucket, url.PathEscape(object))
+}
 
-		return ctx.Err()
-	})
+// objectUploadURL returns the Cloud Storage JSON API URL that uploads object
+// in a single request.
+func objectUploadURL(bucket string, object string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s", bucket, url.QueryEscape(object))
+}
 
+// readObjectToFile downloads object to the local file path.
+func readObjectToFile(ctx context.Context, c StorageClient, bucket string, object string, path string) error {
+	r, err := c.ReadObject(ctx, bucket, object)
 	if err != nil {
-		return "", fmt.Errorf("failed to walk directory: %v", err)
+		return fmt.Errorf("Failed to read gs://%s/%s: %+v", bucket, object, err)
 	}
-
-	return f.Name(), ctx.Err()
-}
-
-func copyFile(w io.Writer, path string) error {
-	f, err := os.Open(path)
+	defer r.Close()
+	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	_, err = io.Copy(w, f)
-	return err
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to download gs://%s/%s to %s: %+v", bucket, object, path, err)
+	}
+	return f.Close()
 }
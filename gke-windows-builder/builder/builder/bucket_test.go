@@ -15,13 +15,11 @@
 package builder
 
 import (
-	"archive/zip"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -29,78 +27,6 @@ import (
 	"cloud.google.com/go/storage"
 )
 
-func TestCreateZip(t *testing.T) {
-	t.Parallel()
-
-	abs, err := filepath.Abs("testdata")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	for name, path := range map[string]string{
-		"relative": "testdata",
-		"absolute": abs,
-	} {
-		t.Run(name, func(t *testing.T) {
-			zf, err := createZip(context.Background(), path)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			zr, err := zip.OpenReader(zf)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer zr.Close()
-
-			expected := map[string]string{
-				"file-a.txt":                          "hello world",
-				"file-b.txt":                          "foo bar",
-				filepath.Join("subdir", "file-d.txt"): "bar baz",
-			}
-
-			for _, f := range zr.File {
-				expectedData, ok := expected[f.Name]
-				if !ok {
-					t.Fatalf("unexpected file %q found in archive", f.Name)
-				}
-
-				r, err := f.Open()
-				if err != nil {
-					t.Fatal(err)
-				}
-
-				ad, err := ioutil.ReadAll(r)
-				if err != nil {
-					t.Fatal(err)
-				}
-				actualData := string(ad)
-				// We'll trim space to make testing simpler
-				actualData = strings.TrimSpace(actualData)
-
-				if actualData != expectedData {
-					t.Fatalf("expected data from %s to be %q, got %q", f.Name, expectedData, actualData)
-				}
-			}
-
-			if len(expected) != len(zr.File) {
-				t.Fatalf("expected archive to have %d files, had %d", len(expected), len(zr.File))
-			}
-		})
-	}
-}
-
-func TestCreateZip_cancelled_context(t *testing.T) {
-	t.Parallel()
-
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-
-	if _, err := createZip(ctx, "testdata"); err == nil {
-		t.Fatal("expected an error")
-	}
-}
-
 func bucketTestsInfo(t *testing.T) (
 	bucket string,
 	object string,
@@ -121,11 +47,19 @@ func TestWriteToBucket(t *testing.T) {
 
 	bucket, object := bucketTestsInfo(t)
 
+	client, err := NewStorageClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
 	gsURL, err := writeToBucket(
 		context.Background(),
+		client,
 		bucket,
 		object,
 		"testdata/file-a.txt",
+		nil,
 	)
 	if err != nil {
 		t.Fatal(err)
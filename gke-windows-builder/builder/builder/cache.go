@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+const (
+	// dockerCacheDeviceName is the device name of the docker data disk, the
+	// setup script finds the disk by it.
+	dockerCacheDeviceName = "docker-cache"
+	// dockerCacheVersionLabel labels the snapshots of the docker data disk
+	// with the Windows version they cache the layers of.
+	dockerCacheVersionLabel = "docker-cache-version"
+)
+
+// dockerCacheLabels returns the labels of the docker cache snapshots of the
+// version of bs.
+func (bs *WindowsBuildServerConfig) dockerCacheLabels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range bs.GetLabelsMap() {
+		labels[k] = v
+	}
+	labels[dockerCacheVersionLabel] = strings.ToLower(*bs.ImageVersion)
+	return labels
+}
+
+// dockerCacheSnapshots returns the ready docker cache snapshots of the
+// version of bs, the latest first.
+func dockerCacheSnapshots(c ComputeClient, projectID string, bs *WindowsBuildServerConfig) ([]*compute.Snapshot, error) {
+	var filters []string
+	for k, v := range bs.dockerCacheLabels() {
+		filters = append(filters, fmt.Sprintf("(labels.%s eq %s)", k, v))
+	}
+	sort.Strings(filters)
+	snapshots, err := c.ListSnapshots(projectID, strings.Join(filters, " "))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list docker cache snapshots: %+v", err)
+	}
+	var ready []*compute.Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Status == "READY" {
+			ready = append(ready, snapshot)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].CreationTimestamp > ready[j].CreationTimestamp
+	})
+	return ready, nil
+}
+
+// dockerCacheDisk returns the docker data disk of a new instance name,
+// seeded from the latest docker cache snapshot of its version if any.
+func (s *Server) dockerCacheDisk(bs *WindowsBuildServerConfig, name string) (*compute.AttachedDisk, error) {
+	disk := &compute.AttachedDisk{
+		AutoDelete: true,
+		DeviceName: dockerCacheDeviceName,
+		Type:       "PERSISTENT",
+		InitializeParams: &compute.AttachedDiskInitializeParams{
+			DiskName:   fmt.Sprintf("%s-docker", name),
+			DiskType:   computeUrlPrefix + s.projectID + "/zones/" + s.zone + "/diskTypes/" + *bs.BootDiskType,
+			DiskSizeGb: bs.DockerCacheDiskSizeGB,
+		},
+	}
+	snapshots, err := dockerCacheSnapshots(s.compute, s.projectID, bs)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		log.Printf("Found no docker cache snapshot for version %s, starting with an empty cache", *bs.ImageVersion)
+		return disk, nil
+	}
+	log.Printf("Seeding the docker cache of version %s from snapshot %s", *bs.ImageVersion, snapshots[0].Name)
+	disk.InitializeParams.SourceSnapshot = snapshots[0].SelfLink
+	if snapshots[0].DiskSizeGb > disk.InitializeParams.DiskSizeGb {
+		disk.InitializeParams.DiskSizeGb = snapshots[0].DiskSizeGb
+	}
+	return disk, nil
+}
+
+// SnapshotDockerCache snapshots the docker data disk of the instance for the
+// next builds of its version, and deletes the older snapshots.
+func (p *GCEProvider) SnapshotDockerCache(ctx context.Context, s *Server, bs *WindowsBuildServerConfig) error {
+	var disk string
+	for _, d := range s.Instance.Disks {
+		if d.DeviceName == dockerCacheDeviceName {
+			disk = d.Source[strings.LastIndex(d.Source, "/")+1:]
+		}
+	}
+	if disk == "" {
+		return fmt.Errorf("Instance %s has no docker cache disk", s.Instance.Name)
+	}
+	older, err := dockerCacheSnapshots(s.compute, s.projectID, bs)
+	if err != nil {
+		return err
+	}
+
+	name := strings.ToLower(fmt.Sprintf("%sdocker-cache-%s-%d-%s", *bs.InstanceNamePrefix, *bs.ImageVersion, time.Now().Unix(), RandStringRunes(4)))
+	name = repeatedDashesRE.ReplaceAllString(invalidNameCharsRE.ReplaceAllString(name, "-"), "-")
+	log.Printf("Creating docker cache snapshot %s of disk %s", name, disk)
+	op, err := s.compute.CreateSnapshot(s.projectID, s.zone, disk, &compute.Snapshot{
+		Name:   name,
+		Labels: bs.dockerCacheLabels(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to snapshot disk %s: %+v", disk, err)
+	}
+	if err := s.waitForComputeOperation(op); err != nil {
+		return err
+	}
+
+	for _, snapshot := range older {
+		log.Printf("Deleting older docker cache snapshot %s", snapshot.Name)
+		if _, err := s.compute.DeleteSnapshot(s.projectID, snapshot.Name); err != nil {
+			log.Printf("Could not delete snapshot: %s, with error: %v", snapshot.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	computebeta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// ComputeClient is the subset of the Compute Engine API used by the builder.
+type ComputeClient interface {
+	GetInstance(projectID string, zone string, name string) (*compute.Instance, error)
+	ListInstances(projectID string, zone string, filter string) ([]*compute.Instance, error)
+	InsertInstance(projectID string, zone string, instance *compute.Instance) (*compute.Operation, error)
+	DeleteInstance(projectID string, zone string, name string) (*compute.Operation, error)
+	StartInstance(projectID string, zone string, name string) (*compute.Operation, error)
+	StopInstance(projectID string, zone string, name string) (*compute.Operation, error)
+	SuspendInstance(projectID string, zone string, name string) (*compute.Operation, error)
+	ResumeInstance(projectID string, zone string, name string) (*compute.Operation, error)
+	SetInstanceMetadata(projectID string, zone string, name string, metadata *compute.Metadata) (*compute.Operation, error)
+	ListSnapshots(projectID string, filter string) ([]*compute.Snapshot, error)
+	CreateSnapshot(projectID string, zone string, disk string, snapshot *compute.Snapshot) (*compute.Operation, error)
+	DeleteSnapshot(projectID string, name string) (*compute.Operation, error)
+	GetSerialPortOutput(projectID string, zone string, name string, port int64) (string, error)
+	GetZoneOperation(projectID string, zone string, name string) (*compute.Operation, error)
+	ListFirewalls(projectID string) ([]*compute.Firewall, error)
+}
+
+// StorageClient is the subset of the Cloud Storage API used by the builder.
+type StorageClient interface {
+	GetBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error)
+	CreateBucket(ctx context.Context, projectID string, bucket string, attrs *storage.BucketAttrs) error
+	// WriteObject writes the content of r to object, with custom metadata.
+	WriteObject(ctx context.Context, bucket string, object string, r io.Reader, metadata map[string]string) error
+	ReadObject(ctx context.Context, bucket string, object string) (io.ReadCloser, error)
+	DeleteObject(ctx context.Context, bucket string, object string) error
+	Close() error
+}
+
+// gceComputeClient implements ComputeClient with the Compute Engine API.
+type gceComputeClient struct {
+	service *compute.Service
+	// beta serves the calls only in the beta API, suspend and resume.
+	beta *computebeta.Service
+}
+
+// NewComputeClient creates a ComputeClient using application default credentials.
+func NewComputeClient(ctx context.Context) (ComputeClient, error) {
+	service, err := newGCEService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	beta, err := newGCEBetaService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gceComputeClient{service: service, beta: beta}, nil
+}
+
+func (c *gceComputeClient) GetInstance(projectID string, zone string, name string) (*compute.Instance, error) {
+	return c.service.Instances.Get(projectID, zone, name).Do()
+}
+
+func (c *gceComputeClient) ListInstances(projectID string, zone string, filter string) ([]*compute.Instance, error) {
+	var instances []*compute.Instance
+	err := c.service.Instances.List(projectID, zone).Filter(filter).Pages(context.Background(), func(l *compute.InstanceList) error {
+		instances = append(instances, l.Items...)
+		return nil
+	})
+	return instances, err
+}
+
+func (c *gceComputeClient) InsertInstance(projectID string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+	return c.service.Instances.Insert(projectID, zone, instance).Do()
+}
+
+func (c *gceComputeClient) DeleteInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	return c.service.Instances.Delete(projectID, zone, name).Do()
+}
+
+func (c *gceComputeClient) StartInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	return c.service.Instances.Start(projectID, zone, name).Do()
+}
+
+func (c *gceComputeClient) StopInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	return c.service.Instances.Stop(projectID, zone, name).Do()
+}
+
+func (c *gceComputeClient) SuspendInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	op, err := c.beta.Instances.Suspend(projectID, zone, name).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &compute.Operation{Name: op.Name, Status: op.Status}, nil
+}
+
+func (c *gceComputeClient) ResumeInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	op, err := c.beta.Instances.Resume(projectID, zone, name, &computebeta.InstancesResumeRequest{}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &compute.Operation{Name: op.Name, Status: op.Status}, nil
+}
+
+func (c *gceComputeClient) SetInstanceMetadata(projectID string, zone string, name string, metadata *compute.Metadata) (*compute.Operation, error) {
+	return c.service.Instances.SetMetadata(projectID, zone, name, metadata).Do()
+}
+
+func (c *gceComputeClient) ListSnapshots(projectID string, filter string) ([]*compute.Snapshot, error) {
+	var snapshots []*compute.Snapshot
+	err := c.service.Snapshots.List(projectID).Filter(filter).Pages(context.Background(), func(l *compute.SnapshotList) error {
+		snapshots = append(snapshots, l.Items...)
+		return nil
+	})
+	return snapshots, err
+}
+
+func (c *gceComputeClient) CreateSnapshot(projectID string, zone string, disk string, snapshot *compute.Snapshot) (*compute.Operation, error) {
+	return c.service.Disks.CreateSnapshot(projectID, zone, disk, snapshot).Do()
+}
+
+func (c *gceComputeClient) DeleteSnapshot(projectID string, name string) (*compute.Operation, error) {
+	return c.service.Snapshots.Delete(projectID, name).Do()
+}
+
+func (c *gceComputeClient) GetSerialPortOutput(projectID string, zone string, name string, port int64) (string, error) {
+	output, err := c.service.Instances.GetSerialPortOutput(projectID, zone, name).Port(port).Do()
+	if err != nil {
+		return "", err
+	}
+	return output.Contents, nil
+}
+
+func (c *gceComputeClient) GetZoneOperation(projectID string, zone string, name string) (*compute.Operation, error) {
+	return c.service.ZoneOperations.Get(projectID, zone, name).Do()
+}
+
+func (c *gceComputeClient) ListFirewalls(projectID string) ([]*compute.Firewall, error) {
+	var firewalls []*compute.Firewall
+	err := c.service.Firewalls.List(projectID).Pages(context.Background(), func(l *compute.FirewallList) error {
+		firewalls = append(firewalls, l.Items...)
+		return nil
+	})
+	return firewalls, err
+}
+
+// gcsStorageClient implements StorageClient with the Cloud Storage API.
+type gcsStorageClient struct {
+	client *storage.Client
+}
+
+// NewStorageClient creates a StorageClient using application default credentials.
+func NewStorageClient(ctx context.Context) (StorageClient, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStorageClient{client: client}, nil
+}
+
+func (c *gcsStorageClient) GetBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error) {
+	return c.client.Bucket(bucket).Attrs(ctx)
+}
+
+func (c *gcsStorageClient) CreateBucket(ctx context.Context, projectID string, bucket string, attrs *storage.BucketAttrs) error {
+	return c.client.Bucket(bucket).Create(ctx, projectID, attrs)
+}
+
+func (c *gcsStorageClient) WriteObject(ctx context.Context, bucket string, object string, r io.Reader, metadata map[string]string) error {
+	w := c.client.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.Metadata = metadata
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *gcsStorageClient) ReadObject(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	return c.client.Bucket(bucket).Object(object).NewReader(ctx)
+}
+
+func (c *gcsStorageClient) DeleteObject(ctx context.Context, bucket string, object string) error {
+	return c.client.Bucket(bucket).Object(object).Delete(ctx)
+}
+
+func (c *gcsStorageClient) Close() error {
+	return c.client.Close()
+}
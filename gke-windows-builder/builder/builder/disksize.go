@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	// osDiskGB is the disk used by Windows with docker installed, for the
+	// core and full image variants.
+	osDiskGB     = 20
+	osFullDiskGB = 30
+	// buildScratchGB is left for the layers written by the docker build.
+	buildScratchGB = 10
+	// workspaceCopies counts the workspace zip, its extracted files and the
+	// build context docker build sends to the daemon.
+	workspaceCopies = 3
+)
+
+// baseImageDiskGB is the disk used to pull the Windows base images, their
+// downloaded and extracted layers, by base image and Windows version. The
+// other base images are assumed to be built on servercore.
+var baseImageDiskGB = map[string]map[string]int64{
+	"nanoserver": {"ltsc2019": 1, "ltsc2022": 1, "20H2": 1, "2004": 1},
+	"servercore": {"ltsc2019": 9, "ltsc2022": 8, "20H2": 8, "2004": 8},
+	"server":     {"ltsc2022": 16},
+	"windows":    {"ltsc2019": 20, "20H2": 20, "2004": 20},
+}
+
+// DiskEstimate is the estimated disk space, in GB, a build server needs to
+// build a version.
+type DiskEstimate struct {
+	OSGB         int64
+	BaseImagesGB int64
+	WorkspaceGB  int64
+	BuildGB      int64
+}
+
+// TotalGB returns the estimated disk space of the build.
+func (e DiskEstimate) TotalGB() int64 {
+	return e.OSGB + e.BaseImagesGB + e.WorkspaceGB + e.BuildGB
+}
+
+func (e DiskEstimate) String() string {
+	return fmt.Sprintf("%dGB: Windows %dGB, base images %dGB, workspace %dGB, build %dGB", e.TotalGB(), e.OSGB, e.BaseImagesGB, e.WorkspaceGB, e.BuildGB)
+}
+
+// EstimateDiskSize estimates the disk space needed to build the Dockerfile at
+// path for version on an instance of imageVariant, core or full, with a
+// workspace of workspaceBytes.
+func EstimateDiskSize(path string, version string, imageVariant string, workspaceBytes int64) (DiskEstimate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return DiskEstimate{}, fmt.Errorf("Failed to read Dockerfile: %+v", err)
+	}
+	e := DiskEstimate{OSGB: osDiskGB, BuildGB: buildScratchGB}
+	if imageVariant == "full" {
+		e.OSGB = osFullDiskGB
+	}
+	const gb = 1 << 30
+	e.WorkspaceGB = (workspaceCopies*workspaceBytes + gb - 1) / gb
+
+	// Multi-stage builds pull all their base images.
+	for _, base := range dockerfileBaseImages(string(data)) {
+		e.BaseImagesGB += baseImageDiskGB[base][version]
+	}
+	return e, nil
+}
+
+// dockerfileBaseImages returns the Windows base images, e.g. servercore, the
+// FROM lines of a Dockerfile pull, skipping the earlier build stages.
+func dockerfileBaseImages(data string) []string {
+	bases := map[string]bool{}
+	stages := map[string]bool{}
+	for _, in := range parseDockerfile(data) {
+		if in.command != "FROM" {
+			continue
+		}
+		image, _ := fromImage(in.args)
+		image = strings.ToLower(image)
+		switch {
+		case stages[image] || image == "scratch" || strings.Contains(image, "host-process-containers-base-image"):
+		case strings.Contains(image, "nanoserver"):
+			bases["nanoserver"] = true
+		case strings.Contains(image, "windows/server:") || strings.HasSuffix(image, "windows/server"):
+			bases["server"] = true
+		case strings.Contains(image, "microsoft.com/windows:") || strings.HasSuffix(image, "microsoft.com/windows"):
+			bases["windows"] = true
+		default:
+			bases["servercore"] = true
+		}
+		if fields := strings.Fields(in.args); len(fields) >= 3 && strings.EqualFold(fields[len(fields)-2], "AS") {
+			stages[strings.ToLower(fields[len(fields)-1])] = true
+		}
+	}
+	var sorted []string
+	for base := range bases {
+		sorted = append(sorted, base)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimateDiskSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name           string
+		dockerfile     string
+		version        string
+		imageVariant   string
+		workspaceBytes int64
+		expected       DiskEstimate
+	}{
+		{
+			name:       "servercore",
+			dockerfile: "ARG WINDOWS_VERSION\nFROM mcr.microsoft.com/windows/servercore:${WINDOWS_VERSION}\n",
+			version:    "ltsc2019",
+			expected:   DiskEstimate{OSGB: 20, BaseImagesGB: 9, BuildGB: 10},
+		},
+		{
+			name:           "multi-stage",
+			dockerfile:     "ARG WINDOWS_VERSION\nFROM mcr.microsoft.com/dotnet/framework/sdk:4.8-windowsservercore-${WINDOWS_VERSION} AS build\nFROM mcr.microsoft.com/windows/nanoserver:${WINDOWS_VERSION}\nCOPY --from=build /app /app\n",
+			version:        "ltsc2022",
+			workspaceBytes: 5 << 30,
+			expected:       DiskEstimate{OSGB: 20, BaseImagesGB: 9, WorkspaceGB: 15, BuildGB: 10},
+		},
+		{
+			name:         "windows",
+			dockerfile:   "ARG WINDOWS_VERSION\nFROM mcr.microsoft.com/windows:${WINDOWS_VERSION}\n",
+			version:      "ltsc2019",
+			imageVariant: "full",
+			expected:     DiskEstimate{OSGB: 30, BaseImagesGB: 20, BuildGB: 10},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			if err := ioutil.WriteFile(path, []byte(tc.dockerfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			e, err := EstimateDiskSize(path, tc.version, tc.imageVariant, tc.workspaceBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// versionTags lists the base image tags, or tag prefixes, built for each
+// Windows version. Base images pinned to one of them only run on that version.
+var versionTags = map[string][]string{
+	"ltsc2019": {"ltsc2019", "1809", "10.0.17763"},
+	"ltsc2022": {"ltsc2022", "10.0.20348"},
+	"20H2":     {"20H2", "10.0.19042"},
+	"2004":     {"2004", "10.0.19041"},
+}
+
+var (
+	windowsVersionArgRE = regexp.MustCompile(`\$\{?WINDOWS_VERSION\b`)
+	// Commands and instructions that only work in Linux containers.
+	linuxOnlyRE = regexp.MustCompile(`(?i)\b(apt-get|apt|apk|yum|dnf|chmod|chown)\s|/bin/(ba)?sh\b`)
+)
+
+// DockerfileProblems are the findings of ValidateDockerfile. Errors make the
+// build fail on the Windows instances, Warnings likely do.
+type DockerfileProblems struct {
+	Errors   []string
+	Warnings []string
+}
+
+// dockerInstruction is a Dockerfile instruction with its continuation lines joined.
+type dockerInstruction struct {
+	line    int
+	command string
+	args    string
+}
+
+// ValidateDockerfile checks that the Dockerfile at path builds a different
+// image for each Windows version, by consuming the WINDOWS_VERSION build arg
+// in a FROM line, and doesn't use Linux-only syntax.
+func ValidateDockerfile(path string, versions []string) (*DockerfileProblems, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Dockerfile: %+v", err)
+	}
+	p := &DockerfileProblems{}
+	instructions := parseDockerfile(string(data))
+
+	var globalArg, usesArg bool
+	var froms int
+	for _, in := range instructions {
+		switch in.command {
+		case "ARG":
+			if froms == 0 && strings.HasPrefix(in.args, "WINDOWS_VERSION") {
+				globalArg = true
+			}
+		case "FROM":
+			froms++
+			if windowsVersionArgRE.MatchString(in.args) {
+				usesArg = true
+			}
+			if strings.Contains(strings.ToLower(in.args), "--platform=linux") {
+				p.Errors = append(p.Errors, fmt.Sprintf("line %d: FROM selects a Linux platform, Windows instances can only build Windows images", in.line))
+			}
+			if msg := checkPinnedTag(in.args, versions); msg != "" {
+				p.Errors = append(p.Errors, fmt.Sprintf("line %d: %s", in.line, msg))
+			}
+		case "RUN":
+			if strings.HasPrefix(in.args, "--mount") || strings.HasPrefix(in.args, "--network") || strings.HasPrefix(in.args, "--security") {
+				p.Errors = append(p.Errors, fmt.Sprintf("line %d: RUN flags need BuildKit, which Docker on Windows doesn't support", in.line))
+			}
+			if strings.Contains(in.args, "<<") {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("line %d: RUN heredocs need BuildKit, which Docker on Windows doesn't support", in.line))
+			}
+			if linuxOnlyRE.MatchString(in.args) {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("line %d: RUN looks like a Linux command: %s", in.line, in.args))
+			}
+		case "SHELL":
+			if strings.Contains(in.args, "/bin/") {
+				p.Errors = append(p.Errors, fmt.Sprintf("line %d: SHELL is a Linux shell: %s", in.line, in.args))
+			}
+		}
+	}
+
+	switch {
+	case froms == 0:
+		p.Errors = append(p.Errors, "no FROM instruction")
+	case !usesArg:
+		p.Errors = append(p.Errors, "no FROM line uses ${WINDOWS_VERSION}, all versions would be built from the same base image")
+	case !globalArg:
+		p.Errors = append(p.Errors, "FROM uses ${WINDOWS_VERSION} but no ARG WINDOWS_VERSION is declared before the first FROM")
+	}
+	return p, nil
+}
+
+// DockerfileVersions returns the Windows versions, among versions, that the
+// Dockerfile at path builds for: all of them when its FROM lines use
+// ${WINDOWS_VERSION}, except those excluded by base images pinned to the tag
+// of a Windows version.
+func DockerfileVersions(path string, versions []string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Dockerfile: %+v", err)
+	}
+	var usesArg, pinned bool
+	supported := map[string]bool{}
+	for _, ver := range versions {
+		supported[ver] = true
+	}
+	for _, in := range parseDockerfile(string(data)) {
+		if in.command != "FROM" {
+			continue
+		}
+		if windowsVersionArgRE.MatchString(in.args) {
+			usesArg = true
+			continue
+		}
+		_, tag := fromImage(in.args)
+		for other := range versionTags {
+			if !tagMatchesVersion(tag, other) {
+				continue
+			}
+			pinned = true
+			for ver := range supported {
+				if !tagMatchesVersion(tag, ver) {
+					delete(supported, ver)
+				}
+			}
+		}
+	}
+	if !usesArg && !pinned {
+		return nil, fmt.Errorf("Failed to infer the Windows versions: no FROM line uses ${WINDOWS_VERSION} or a Windows version tag")
+	}
+	var inferred []string
+	for _, ver := range versions {
+		if supported[ver] {
+			inferred = append(inferred, ver)
+		}
+	}
+	if len(inferred) == 0 {
+		return nil, fmt.Errorf("Failed to infer the Windows versions: the base images are pinned to none of %s, or to different versions", strings.Join(versions, ","))
+	}
+	return inferred, nil
+}
+
+// fromImage returns the image of the arguments of a FROM line, and its tag
+// if any.
+func fromImage(args string) (string, string) {
+	var image string
+	for _, f := range strings.Fields(args) {
+		if !strings.HasPrefix(f, "--") {
+			image = f
+			break
+		}
+	}
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image, image[i+1:]
+}
+
+// checkPinnedTag returns a problem if the image of a FROM line is pinned to
+// a tag of one Windows version while other versions are built.
+func checkPinnedTag(args string, versions []string) string {
+	image, tag := fromImage(args)
+	if tag == "" {
+		return ""
+	}
+	for _, ver := range versions {
+		if tagMatchesVersion(tag, ver) {
+			continue
+		}
+		for other := range versionTags {
+			if tagMatchesVersion(tag, other) {
+				return fmt.Sprintf("%s is pinned to Windows %s, it can't be used to build Windows %s", image, other, ver)
+			}
+		}
+	}
+	return ""
+}
+
+// tagMatchesVersion reports if tag is a tag of ver, alone, as a prefix, or as
+// the suffix of the tags of images like mcr.microsoft.com/dotnet/sdk.
+func tagMatchesVersion(tag string, ver string) bool {
+	lower := strings.ToLower(tag)
+	for _, t := range versionTags[ver] {
+		t = strings.ToLower(t)
+		if lower == t || strings.HasPrefix(lower, t+"-") || strings.HasPrefix(lower, t+".") || strings.HasSuffix(lower, "-"+t) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDockerfile splits a Dockerfile into instructions, skipping comments
+// and joining lines continued with the escape character.
+func parseDockerfile(data string) []dockerInstruction {
+	escape := `\`
+	var instructions []dockerInstruction
+	var current string
+	start := 0
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if current == "" && strings.HasPrefix(strings.ToLower(trimmed), "# escape=") {
+			escape = strings.TrimSpace(trimmed[len("# escape="):])
+			continue
+		}
+		if strings.HasPrefix(trimmed, "#") || (current == "" && trimmed == "") {
+			continue
+		}
+		if current == "" {
+			start = n + 1
+		}
+		if strings.HasSuffix(trimmed, escape) {
+			current += strings.TrimSuffix(trimmed, escape) + " "
+			continue
+		}
+		current += trimmed
+		parts := strings.SplitN(current, " ", 2)
+		in := dockerInstruction{line: start, command: strings.ToUpper(parts[0])}
+		if len(parts) == 2 {
+			in.args = strings.TrimSpace(parts[1])
+		}
+		instructions = append(instructions, in)
+		current = ""
+	}
+	return instructions
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDockerfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versions := []string{"ltsc2019", "ltsc2022"}
+	for _, tc := range []struct {
+		name       string
+		dockerfile string
+		errors     []string
+		warnings   []string
+	}{
+		{
+			name:       "example",
+			dockerfile: "# escape=`\nARG WINDOWS_VERSION\nFROM mcr.microsoft.com/windows/servercore:${WINDOWS_VERSION}\nRUN Set-Content C:\\greeting.txt `\n  \"Hello\"\n",
+		},
+		{
+			name:       "no build arg",
+			dockerfile: "FROM mcr.microsoft.com/windows/servercore:ltsc2019\n",
+			errors:     []string{"pinned to Windows ltsc2019", "no FROM line uses ${WINDOWS_VERSION}"},
+		},
+		{
+			name:       "arg after FROM",
+			dockerfile: "FROM mcr.microsoft.com/windows/nanoserver:$WINDOWS_VERSION\nARG WINDOWS_VERSION\n",
+			errors:     []string{"no ARG WINDOWS_VERSION is declared before the first FROM"},
+		},
+		{
+			name:       "linux",
+			dockerfile: "ARG WINDOWS_VERSION\nFROM --platform=linux/amd64 debian:${WINDOWS_VERSION}\nSHELL [\"/bin/sh\", \"-c\"]\nRUN --mount=type=cache,target=/var apt-get install -y curl\n",
+			errors:     []string{"line 2: FROM selects a Linux platform", "line 3: SHELL is a Linux shell", "line 4: RUN flags need BuildKit"},
+			warnings:   []string{"line 4: RUN looks like a Linux command"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1))
+			if err := ioutil.WriteFile(path, []byte(tc.dockerfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			p, err := ValidateDockerfile(path, versions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkProblems(t, "errors", p.Errors, tc.errors)
+			checkProblems(t, "warnings", p.Warnings, tc.warnings)
+		})
+	}
+}
+
+func checkProblems(t *testing.T, kind string, got []string, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d %s, got %q", len(want), kind, got)
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("expected %s %q to contain %q", kind, got[i], want[i])
+		}
+	}
+}
+
+func TestDockerfileVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versions := []string{"2004", "20H2", "ltsc2019", "ltsc2022"}
+	for _, tc := range []struct {
+		name       string
+		dockerfile string
+		expected   string
+		err        string
+	}{
+		{
+			name:       "build arg",
+			dockerfile: "ARG WINDOWS_VERSION\nFROM mcr.microsoft.com/windows/servercore:${WINDOWS_VERSION}\n",
+			expected:   "2004,20H2,ltsc2019,ltsc2022",
+		},
+		{
+			name:       "pinned builder stage",
+			dockerfile: "FROM mcr.microsoft.com/dotnet/sdk:6.0-windowsservercore-ltsc2022 AS build\nARG WINDOWS_VERSION\nFROM mcr.microsoft.com/windows/nanoserver:$WINDOWS_VERSION\nCOPY --from=build /app /app\n",
+			expected:   "ltsc2022",
+		},
+		{
+			name:       "pinned build number",
+			dockerfile: "FROM mcr.microsoft.com/windows/servercore:10.0.17763.2237\n",
+			expected:   "ltsc2019",
+		},
+		{
+			name:       "different pins",
+			dockerfile: "FROM mcr.microsoft.com/windows/servercore:ltsc2019 AS a\nFROM mcr.microsoft.com/windows/servercore:ltsc2022\n",
+			err:        "pinned to none of",
+		},
+		{
+			name:       "no version",
+			dockerfile: "FROM mcr.microsoft.com/windows/servercore:latest\n",
+			err:        "no FROM line uses",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1))
+			if err := ioutil.WriteFile(path, []byte(tc.dockerfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := DockerfileVersions(path, versions)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != tc.expected {
+				t.Errorf("expected versions %s, got %s", tc.expected, strings.Join(got, ","))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportIndex is the index.json written next to the images exported with
+// Orchestrator.ExportTo, to import them in disconnected environments.
+type ExportIndex struct {
+	// Image is the multi-arch image the versions are built for.
+	Image   string          `json:"image"`
+	BuildID string          `json:"buildId,omitempty"`
+	Time    time.Time       `json:"time"`
+	Images  []ExportedImage `json:"images"`
+}
+
+// ExportedImage is the image of a Windows version in an ExportIndex.
+type ExportedImage struct {
+	Version string `json:"version"`
+	// Tag is the single-arch tag of the image in Tarball.
+	Tag string `json:"tag"`
+	// Tarball is the gs:// URL of the docker save tarball of the image.
+	Tarball string `json:"tarball"`
+	// Inspect is the gs:// URL of the docker image inspect output, with the
+	// OS version and architecture of the image.
+	Inspect string `json:"inspect"`
+}
+
+// ParseGCSURL returns the bucket and the object name prefix of a
+// gs://bucket/path/ URL. The prefix is empty or ends with a slash.
+func ParseGCSURL(u string) (string, string, error) {
+	if !strings.HasPrefix(u, "gs://") {
+		return "", "", fmt.Errorf("%q is not a gs:// URL", u)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("%q has no bucket", u)
+	}
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	return parts[0], prefix, nil
+}
+
+// Export the image of version ver built on r to ExportTo.
+func (o *Orchestrator) exportImage(r *RemoteWindowsServer, ver string) error {
+	bucket, prefix, err := ParseGCSURL(o.ExportTo)
+	if err != nil {
+		return err
+	}
+	if r.Storage == nil {
+		return fmt.Errorf("Images are exported by the build instances, %s can't upload to gs://%s", *r.Hostname, bucket)
+	}
+	tarball, inspect := prefix+ver+".tar", prefix+ver+".json"
+	log.Printf("Exporting the image of %s to gs://%s/%s", ver, bucket, tarball)
+	if err := o.uploadImage(r, ver, bucket, tarball, inspect); err != nil {
+		return err
+	}
+	o.exportMu.Lock()
+	defer o.exportMu.Unlock()
+	o.exported = append(o.exported, ExportedImage{
+		Version: ver,
+		Tag:     fmt.Sprint(o.ContainerImageName, "_", ver),
+		Tarball: fmt.Sprintf("gs://%s/%s", bucket, tarball),
+		Inspect: fmt.Sprintf("gs://%s/%s", bucket, inspect),
+	})
+	return nil
+}
+
+// Write the index.json of the exported images to ExportTo.
+func (o *Orchestrator) writeExportIndex(ctx context.Context) error {
+	bucket, prefix, err := ParseGCSURL(o.ExportTo)
+	if err != nil {
+		return err
+	}
+	o.exportMu.Lock()
+	images := append([]ExportedImage(nil), o.exported...)
+	o.exportMu.Unlock()
+	sort.Slice(images, func(i, j int) bool { return images[i].Version < images[j].Version })
+
+	data, err := json.MarshalIndent(&ExportIndex{
+		Image:   o.ContainerImageName,
+		BuildID: o.ServerConfig.BuildID,
+		Time:    time.Now().UTC(),
+		Images:  images,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing the index of the exported images to gs://%s/%sindex.json", bucket, prefix)
+	if err := o.Storage.WriteObject(ctx, bucket, prefix+"index.json", bytes.NewReader(data), nil); err != nil {
+		return fmt.Errorf("Failed to write gs://%s/%sindex.json: %+v", bucket, prefix, err)
+	}
+	return nil
+}
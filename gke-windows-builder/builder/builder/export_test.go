@@ -0,0 +1,42 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import "testing"
+
+func TestParseGCSURL(t *testing.T) {
+	for _, tc := range []struct {
+		url    string
+		bucket string
+		prefix string
+		err    bool
+	}{
+		{url: "gs://bucket", bucket: "bucket"},
+		{url: "gs://bucket/", bucket: "bucket"},
+		{url: "gs://bucket/path", bucket: "bucket", prefix: "path/"},
+		{url: "gs://bucket/path/to/", bucket: "bucket", prefix: "path/to/"},
+		{url: "bucket/path", err: true},
+		{url: "gs:///path", err: true},
+	} {
+		bucket, prefix, err := ParseGCSURL(tc.url)
+		if (err != nil) != tc.err {
+			t.Errorf("ParseGCSURL(%q) returned error %v", tc.url, err)
+			continue
+		}
+		if bucket != tc.bucket || prefix != tc.prefix {
+			t.Errorf("ParseGCSURL(%q) = %q, %q, expected %q, %q", tc.url, bucket, prefix, tc.bucket, tc.prefix)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides in-memory implementations of the builder's
+// ComputeClient, StorageClient and RemoteExecutor interfaces. They simulate
+// the instance lifecycle, workspace upload and remote command results so the
+// builder can be exercised without creating any cloud resources.
+package fake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const computeUrlPrefix = "https://www.googleapis.com/compute/v1/projects/"
+
+// Password is the password every fake instance resets its user to.
+const Password = "fake-password"
+
+// ComputeClient keeps instances in memory. Operations complete immediately.
+type ComputeClient struct {
+	mu sync.Mutex
+	// Instances are the existing instances by name.
+	Instances map[string]*compute.Instance
+	// Firewalls are returned by ListFirewalls. When empty, a rule allowing
+	// WinRM ingress on the project's default network is returned.
+	Firewalls []*compute.Firewall
+	// MissingImages lists image URLs for which instance creation fails with a 404.
+	MissingImages map[string]bool
+	// Inserted lists the inserted instances, in order.
+	Inserted []*compute.Instance
+	// Deleted lists the names of deleted instances.
+	Deleted []string
+	// Stopped lists the names of stopped instances, in order.
+	Stopped []string
+	// Suspended lists the names of suspended instances, in order.
+	Suspended []string
+	// Snapshots are the existing snapshots by name.
+	Snapshots    map[string]*compute.Snapshot
+	nextIP       int
+	nextSnapshot int
+}
+
+// NewComputeClient returns a ComputeClient configured from fixture, which may be nil.
+func NewComputeClient(fixture *Fixture) *ComputeClient {
+	c := &ComputeClient{
+		Instances:     map[string]*compute.Instance{},
+		Snapshots:     map[string]*compute.Snapshot{},
+		MissingImages: map[string]bool{},
+	}
+	if fixture != nil {
+		for _, image := range fixture.MissingImages {
+			c.MissingImages[image] = true
+		}
+		c.Firewalls = fixture.Firewalls
+	}
+	return c
+}
+
+func (c *ComputeClient) GetInstance(projectID string, zone string, name string) (*compute.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	return inst, nil
+}
+
+var filterTermRE = regexp.MustCompile(`\(([a-zA-Z0-9_.-]+) eq "?([^")]*)"?\)`)
+
+// ListInstances returns the instances matching every term of filter, e.g.
+// (status eq RUNNING|TERMINATED) (name eq windows-builder-.*)
+// (labels.team eq windows). As in the Compute Engine API, values are regular
+// expressions matching the whole field. The status term defaults to RUNNING,
+// terms on other fields are ignored.
+func (c *ComputeClient) ListInstances(projectID string, zone string, filter string) ([]*compute.Instance, error) {
+	terms := map[string]*regexp.Regexp{"status": regexp.MustCompile("^RUNNING$")}
+	for _, m := range filterTermRE.FindAllStringSubmatch(filter, -1) {
+		re, err := regexp.Compile("^(" + m[2] + ")$")
+		if err != nil {
+			return nil, err
+		}
+		terms[m[1]] = re
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var instances []*compute.Instance
+	for _, inst := range c.Instances {
+		if instanceMatches(inst, terms) {
+			instances = append(instances, inst)
+		}
+	}
+	return instances, nil
+}
+
+// instanceMatches returns true if the status, name and labels of inst match
+// their terms. A missing label matches no term.
+func instanceMatches(inst *compute.Instance, terms map[string]*regexp.Regexp) bool {
+	for field, re := range terms {
+		var value string
+		switch {
+		case field == "status":
+			value = inst.Status
+		case field == "name":
+			value = inst.Name
+		case strings.HasPrefix(field, "labels."):
+			v, ok := inst.Labels[strings.TrimPrefix(field, "labels.")]
+			if !ok {
+				return false
+			}
+			value = v
+		default:
+			continue
+		}
+		if !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *ComputeClient) InsertInstance(projectID string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range instance.Disks {
+		image := strings.TrimPrefix(d.InitializeParams.SourceImage, computeUrlPrefix)
+		if c.MissingImages[image] {
+			return nil, notFound("projects/%s", image)
+		}
+	}
+	c.nextIP++
+	instance.Status = "RUNNING"
+	ni := instance.NetworkInterfaces[0]
+	ni.NetworkIP = fmt.Sprintf("10.0.0.%d", c.nextIP)
+	if ni.Network == "" && ni.Subnetwork != "" {
+		// Assume an auto mode network, where subnetworks are named after their network.
+		project := strings.Split(strings.TrimPrefix(ni.Subnetwork, computeUrlPrefix), "/")[0]
+		ni.Network = computeUrlPrefix + project + "/global/networks/" + ni.Subnetwork[strings.LastIndex(ni.Subnetwork, "/")+1:]
+	}
+	for _, ac := range ni.AccessConfigs {
+		ac.NatIP = fmt.Sprintf("203.0.113.%d", c.nextIP)
+	}
+	for _, d := range instance.Disks {
+		d.Source = fmt.Sprintf("%s%s/zones/%s/disks/%s", computeUrlPrefix, projectID, zone, d.InitializeParams.DiskName)
+	}
+	c.Instances[instance.Name] = instance
+	c.Inserted = append(c.Inserted, instance)
+	return &compute.Operation{Name: "insert-" + instance.Name, Status: "DONE"}, nil
+}
+
+func (c *ComputeClient) DeleteInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.Instances[name]; !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	delete(c.Instances, name)
+	c.Deleted = append(c.Deleted, name)
+	return &compute.Operation{Name: "delete-" + name, Status: "DONE"}, nil
+}
+
+// StartInstance starts a stopped instance, which gets a new external IP.
+func (c *ComputeClient) StartInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	c.nextIP++
+	for _, ac := range inst.NetworkInterfaces[0].AccessConfigs {
+		ac.NatIP = fmt.Sprintf("203.0.113.%d", c.nextIP)
+	}
+	inst.Status = "RUNNING"
+	return &compute.Operation{Name: "start-" + name, Status: "DONE"}, nil
+}
+
+func (c *ComputeClient) StopInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	inst.Status = "TERMINATED"
+	c.Stopped = append(c.Stopped, name)
+	return &compute.Operation{Name: "stop-" + name, Status: "DONE"}, nil
+}
+
+// SuspendInstance suspends an instance, which keeps its external IP.
+func (c *ComputeClient) SuspendInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	inst.Status = "SUSPENDED"
+	c.Suspended = append(c.Suspended, name)
+	return &compute.Operation{Name: "suspend-" + name, Status: "DONE"}, nil
+}
+
+func (c *ComputeClient) ResumeInstance(projectID string, zone string, name string) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	inst.Status = "RUNNING"
+	return &compute.Operation{Name: "resume-" + name, Status: "DONE"}, nil
+}
+
+func (c *ComputeClient) SetInstanceMetadata(projectID string, zone string, name string, metadata *compute.Metadata) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return nil, notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	inst.Metadata = metadata
+	return &compute.Operation{Name: "setMetadata-" + name, Status: "DONE"}, nil
+}
+
+var labelFilterRE = regexp.MustCompile(`\(labels\.([^ ]+) eq "?([^")]+)"?\)`)
+
+// ListSnapshots returns the snapshots with the labels of filter.
+func (c *ComputeClient) ListSnapshots(projectID string, filter string) ([]*compute.Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var snapshots []*compute.Snapshot
+	for _, snapshot := range c.Snapshots {
+		matches := true
+		for _, m := range labelFilterRE.FindAllStringSubmatch(filter, -1) {
+			if snapshot.Labels[m[1]] != m[2] {
+				matches = false
+			}
+		}
+		if matches {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// CreateSnapshot creates a ready snapshot of a disk of an instance.
+func (c *ComputeClient) CreateSnapshot(projectID string, zone string, disk string, snapshot *compute.Snapshot) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	source := fmt.Sprintf("%s%s/zones/%s/disks/%s", computeUrlPrefix, projectID, zone, disk)
+	for _, inst := range c.Instances {
+		for _, d := range inst.Disks {
+			if d.Source == source {
+				c.nextSnapshot++
+				snapshot.SelfLink = computeUrlPrefix + projectID + "/global/snapshots/" + snapshot.Name
+				snapshot.SourceDisk = source
+				snapshot.DiskSizeGb = d.InitializeParams.DiskSizeGb
+				snapshot.Status = "READY"
+				// Snapshots created in the same second still sort by creation.
+				snapshot.CreationTimestamp = fmt.Sprintf("2021-01-01T00:00:%02d.000-07:00", c.nextSnapshot)
+				c.Snapshots[snapshot.Name] = snapshot
+				return &compute.Operation{Name: "createSnapshot-" + disk, Status: "DONE"}, nil
+			}
+		}
+	}
+	return nil, notFound("projects/%s/zones/%s/disks/%s", projectID, zone, disk)
+}
+
+func (c *ComputeClient) DeleteSnapshot(projectID string, name string) (*compute.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.Snapshots[name]; !ok {
+		return nil, notFound("projects/%s/global/snapshots/%s", projectID, name)
+	}
+	delete(c.Snapshots, name)
+	return &compute.Operation{Name: "deleteSnapshot-" + name, Status: "DONE"}, nil
+}
+
+// windowsKeys is the password reset request written to the windows-keys metadata.
+type windowsKeys struct {
+	UserName string `json:"userName"`
+	Modulus  string `json:"modulus"`
+	Exponent string `json:"exponent"`
+}
+
+// GetSerialPortOutput answers the password reset request found in the
+// windows-keys metadata like the GCE guest agent does, with Password.
+func (c *ComputeClient) GetSerialPortOutput(projectID string, zone string, name string, port int64) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, ok := c.Instances[name]
+	if !ok {
+		return "", notFound("projects/%s/zones/%s/instances/%s", projectID, zone, name)
+	}
+	var keys windowsKeys
+	for _, item := range inst.Metadata.Items {
+		if item.Key == "windows-keys" {
+			if err := json.Unmarshal([]byte(*item.Value), &keys); err != nil {
+				return "", err
+			}
+		}
+	}
+	if keys.Modulus == "" {
+		return "", nil
+	}
+	modulus, err := base64.StdEncoding.DecodeString(keys.Modulus)
+	if err != nil {
+		return "", err
+	}
+	exponent, err := base64.StdEncoding.DecodeString(keys.Exponent)
+	if err != nil {
+		return "", err
+	}
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, []byte(Password), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := json.Marshal(map[string]interface{}{
+		"userName":          keys.UserName,
+		"passwordFound":     true,
+		"encryptedPassword": base64.StdEncoding.EncodeToString(encrypted),
+		"modulus":           keys.Modulus,
+		"exponent":          keys.Exponent,
+	})
+	return string(response) + "\n", err
+}
+
+func (c *ComputeClient) GetZoneOperation(projectID string, zone string, name string) (*compute.Operation, error) {
+	return &compute.Operation{Name: name, Status: "DONE"}, nil
+}
+
+func (c *ComputeClient) ListFirewalls(projectID string) ([]*compute.Firewall, error) {
+	if len(c.Firewalls) > 0 {
+		return c.Firewalls, nil
+	}
+	return []*compute.Firewall{
+		{
+			Name:         "allow-winrm-ingress",
+			Network:      computeUrlPrefix + projectID + "/global/networks/default",
+			Direction:    "INGRESS",
+			SourceRanges: []string{"0.0.0.0/0"},
+			Allowed: []*compute.FirewallAllowed{
+				{IPProtocol: "tcp", Ports: []string{"5986"}},
+			},
+		},
+	}, nil
+}
+
+func notFound(format string, a ...interface{}) error {
+	return &googleapi.Error{
+		Code:    404,
+		Message: fmt.Sprintf("The resource '%s' was not found", fmt.Sprintf(format, a...)),
+	}
+}
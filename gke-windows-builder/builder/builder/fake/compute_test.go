@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"sort"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestListInstances(t *testing.T) {
+	c := NewComputeClient(nil)
+	for _, inst := range []*compute.Instance{
+		{Name: "windows-builder-ltsc2019-1", Status: "RUNNING", Labels: map[string]string{"builder_version": "ltsc2019", "team": "windows"}},
+		{Name: "windows-builder-ltsc2019-2", Status: "TERMINATED", Labels: map[string]string{"builder_version": "ltsc2019", "team": "windows"}},
+		{Name: "windows-builder-ltsc2022-1", Status: "RUNNING", Labels: map[string]string{"builder_version": "ltsc2022"}},
+		{Name: "other-ltsc2019", Status: "RUNNING", Labels: map[string]string{"builder_version": "ltsc2019"}},
+	} {
+		c.Instances[inst.Name] = inst
+	}
+
+	for filter, expected := range map[string][]string{
+		"": {"other-ltsc2019", "windows-builder-ltsc2019-1", "windows-builder-ltsc2022-1"},
+		"(status eq RUNNING|TERMINATED) (name eq windows-builder-.*) (labels.builder_version eq ltsc2019)": {"windows-builder-ltsc2019-1", "windows-builder-ltsc2019-2"},
+		"(status eq RUNNING) (labels.team eq windows)":                                                     {"windows-builder-ltsc2019-1"},
+		"(status eq RUNNING) (labels.builder_version eq ltsc)":                                             nil,
+		"(status eq RUNNING) (name eq windows-builder-)":                                                   nil,
+		"(status eq RUNNING) (labels.missing eq .*)":                                                       nil,
+	} {
+		instances, err := c.ListInstances("test-project", "us-central1-f", filter)
+		if err != nil {
+			t.Fatalf("ListInstances(%q) failed: %v", filter, err)
+		}
+		var names []string
+		for _, inst := range instances {
+			names = append(names, inst.Name)
+		}
+		sort.Strings(names)
+		if len(names) != len(expected) {
+			t.Errorf("ListInstances(%q) = %v, expected %v", filter, names, expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != expected[i] {
+				t.Errorf("ListInstances(%q) = %v, expected %v", filter, names, expected)
+				break
+			}
+		}
+	}
+
+	if _, err := c.ListInstances("test-project", "us-central1-f", "(name eq windows-builder-[)"); err == nil {
+		t.Errorf("expected an error for an invalid regular expression")
+	}
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	c := NewComputeClient(&Fixture{MissingImages: []string{"windows-cloud/global/images/family/windows-2004-core"}})
+	newInstance := func(name string, image string) *compute.Instance {
+		return &compute.Instance{
+			Name: name,
+			Disks: []*compute.AttachedDisk{{InitializeParams: &compute.AttachedDiskInitializeParams{
+				DiskName:    name,
+				SourceImage: computeUrlPrefix + image,
+			}}},
+			NetworkInterfaces: []*compute.NetworkInterface{{
+				Subnetwork:    computeUrlPrefix + "test-project/regions/us-central1/subnetworks/default",
+				AccessConfigs: []*compute.AccessConfig{{}},
+			}},
+		}
+	}
+
+	if _, err := c.InsertInstance("test-project", "us-central1-f", newInstance("missing", "windows-cloud/global/images/family/windows-2004-core")); err == nil {
+		t.Errorf("expected an error for a missing image")
+	}
+	if _, err := c.InsertInstance("test-project", "us-central1-f", newInstance("builder", "windows-cloud/global/images/family/windows-2019-core")); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := c.GetInstance("test-project", "us-central1-f", "builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ni := inst.NetworkInterfaces[0]
+	if inst.Status != "RUNNING" || ni.NetworkIP == "" || ni.AccessConfigs[0].NatIP == "" {
+		t.Errorf("expected a running instance with addresses, got status %s, %+v", inst.Status, ni)
+	}
+	if ni.Network != computeUrlPrefix+"test-project/global/networks/default" {
+		t.Errorf("expected the network of the auto mode subnetwork, got %q", ni.Network)
+	}
+
+	if _, err := c.StopInstance("test-project", "us-central1-f", "builder"); err != nil || inst.Status != "TERMINATED" {
+		t.Errorf("expected the instance to be stopped, got %s, %v", inst.Status, err)
+	}
+	natIP := ni.AccessConfigs[0].NatIP
+	if _, err := c.StartInstance("test-project", "us-central1-f", "builder"); err != nil || inst.Status != "RUNNING" {
+		t.Errorf("expected the instance to be started, got %s, %v", inst.Status, err)
+	}
+	if ni.AccessConfigs[0].NatIP == natIP {
+		t.Errorf("expected a started instance to get a new external IP")
+	}
+	if _, err := c.SuspendInstance("test-project", "us-central1-f", "builder"); err != nil || inst.Status != "SUSPENDED" {
+		t.Errorf("expected the instance to be suspended, got %s, %v", inst.Status, err)
+	}
+	if _, err := c.ResumeInstance("test-project", "us-central1-f", "builder"); err != nil || inst.Status != "RUNNING" {
+		t.Errorf("expected the instance to be resumed, got %s, %v", inst.Status, err)
+	}
+	if _, err := c.DeleteInstance("test-project", "us-central1-f", "builder"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetInstance("test-project", "us-central1-f", "builder"); err == nil {
+		t.Errorf("expected the deleted instance to be gone")
+	}
+	if len(c.Inserted) != 1 || len(c.Stopped) != 1 || len(c.Suspended) != 1 || len(c.Deleted) != 1 {
+		t.Errorf("unexpected recorded calls: %d inserted, %d stopped, %d suspended, %d deleted", len(c.Inserted), len(c.Stopped), len(c.Suspended), len(c.Deleted))
+	}
+}
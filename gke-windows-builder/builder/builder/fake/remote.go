@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/encoding/unicode"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Fixture describes how the fakes behave. A sample fixture:
+//
+//	{
+//	  "missingImages": ["windows-cloud/global/images/family/windows-2004-core"],
+//	  "commands": [
+//	    {"match": "docker build -t gcr.io/project/image:tag_ltsc2022", "exitCode": 1, "output": "no space left on device"},
+//	    {"match": "docker push", "output": "pushed", "duration": "2s"}
+//	  ]
+//	}
+type Fixture struct {
+	// MissingImages lists image URLs, e.g. windows-cloud/global/images/family/windows-2004-core,
+	// whose instances fail to be created with a 404 like obsolete image families.
+	MissingImages []string `json:"missingImages"`
+	// Firewalls are returned by the fake ComputeClient's ListFirewalls.
+	Firewalls []*compute.Firewall `json:"firewalls"`
+	// Commands are matched in order against each remote command, the first
+	// match decides its result. Unmatched commands succeed with no output.
+	Commands []CommandResult `json:"commands"`
+	// CopyError, when set, makes the WinRM copy fallback fail with this message.
+	CopyError string `json:"copyError"`
+}
+
+// CommandResult is the simulated result of the remote commands containing Match.
+type CommandResult struct {
+	Match    string `json:"match"`
+	ExitCode int    `json:"exitCode"`
+	Output   string `json:"output"`
+	// Duration is how long the command appears to run, e.g. "30s".
+	Duration string `json:"duration"`
+}
+
+// LoadFixture reads a JSON Fixture from path.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f Fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Failed to parse fixture %s: %+v", path, err)
+	}
+	for _, c := range f.Commands {
+		if c.Duration == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(c.Duration); err != nil {
+			return nil, fmt.Errorf("Invalid duration for command %q in fixture %s: %+v", c.Match, path, err)
+		}
+	}
+	return &f, nil
+}
+
+// Remote simulates the build servers. It records the commands run on all of
+// them and answers them from its Fixture.
+type Remote struct {
+	fixture *Fixture
+	// Storage, when set, gets the objects the commands upload with the Cloud
+	// Storage JSON API.
+	Storage *StorageClient
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// NewRemote returns a Remote configured from fixture, which may be nil.
+func NewRemote(fixture *Fixture) *Remote {
+	if fixture == nil {
+		fixture = &Fixture{}
+	}
+	return &Remote{fixture: fixture}
+}
+
+// Executor returns the RemoteExecutor for the server at hostname.
+func (f *Remote) Executor(hostname string) *Executor {
+	return &Executor{hostname: hostname, remote: f}
+}
+
+// Commands returns the recorded commands as "hostname: command", with
+// encoded PowerShell commands decoded.
+func (f *Remote) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// CommandsContaining returns the recorded commands that contain substr.
+func (f *Remote) CommandsContaining(substr string) []string {
+	var commands []string
+	for _, c := range f.Commands() {
+		if strings.Contains(c, substr) {
+			commands = append(commands, c)
+		}
+	}
+	return commands
+}
+
+// Executor is the RemoteExecutor of a single simulated server.
+type Executor struct {
+	hostname string
+	remote   *Remote
+}
+
+// Run records command and returns the result of the first matching
+// CommandResult of the fixture, whose output is written to stdout. The
+// uploads of successful commands are written to the Storage of the Remote.
+func (e *Executor) Run(ctx context.Context, command string, path string, timeout time.Duration, stdout io.Writer, stderr io.Writer) error {
+	command = decodePowershell(command)
+	e.remote.mu.Lock()
+	e.remote.commands = append(e.remote.commands, e.hostname+": "+command)
+	e.remote.mu.Unlock()
+
+	if err := e.result(ctx, command, timeout, stdout); err != nil {
+		return err
+	}
+	return e.upload(command)
+}
+
+var uploadRE = regexp.MustCompile(`https://storage\.googleapis\.com/upload/storage/v1/b/([^/]+)/o\?uploadType=media&name=([^'"\s]+)`)
+
+// upload writes the objects uploaded by command to the Storage of the Remote.
+func (e *Executor) upload(command string) error {
+	if e.remote.Storage == nil {
+		return nil
+	}
+	for _, m := range uploadRE.FindAllStringSubmatch(command, -1) {
+		object, err := url.QueryUnescape(m[2])
+		if err != nil {
+			return err
+		}
+		if err := e.remote.Storage.WriteObject(context.Background(), m[1], object, strings.NewReader("uploaded from "+e.hostname), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// result returns the result of the first CommandResult matching command.
+func (e *Executor) result(ctx context.Context, command string, timeout time.Duration, stdout io.Writer) error {
+	for _, r := range e.remote.fixture.Commands {
+		if !strings.Contains(command, r.Match) {
+			continue
+		}
+		if r.Output != "" {
+			fmt.Fprintln(stdout, r.Output)
+		}
+		if r.Duration != "" {
+			d, _ := time.ParseDuration(r.Duration)
+			timedOut := d > timeout
+			if timedOut {
+				d = timeout
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("command aborted: %w", ctx.Err())
+			case <-time.After(d):
+			}
+			if timedOut {
+				return fmt.Errorf("command timed out after %v", timeout)
+			}
+		}
+		if r.ExitCode != 0 {
+			return fmt.Errorf("command failed with exit-code:%d", r.ExitCode)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Copy fails with the fixture's CopyError if set.
+func (e *Executor) Copy(inputPath string, remotePath string, timeout time.Duration) error {
+	if e.remote.fixture.CopyError != "" {
+		return errors.New(e.remote.fixture.CopyError)
+	}
+	return nil
+}
+
+// decodePowershell returns the script wrapped by winrm.Powershell, or command
+// unchanged if it is not an encoded PowerShell command.
+func decodePowershell(command string) string {
+	const prefix = "powershell.exe -EncodedCommand "
+	if !strings.HasPrefix(command, prefix) {
+		return command
+	}
+	encoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(command, prefix))
+	if err != nil {
+		return command
+	}
+	decoded, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder().Bytes(encoded)
+	if err != nil {
+		return command
+	}
+	return string(decoded)
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masterzen/winrm"
+)
+
+func TestLoadFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fixture.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+		"missingImages": ["windows-cloud/global/images/family/windows-2004-core"],
+		"commands": [{"match": "docker push", "output": "pushed", "duration": "2s"}],
+		"copyError": "copy failed"
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := LoadFixture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.MissingImages) != 1 || len(f.Commands) != 1 || f.Commands[0].Duration != "2s" || f.CopyError != "copy failed" {
+		t.Errorf("unexpected fixture %+v", f)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"commands": [{"match": "docker push", "duration": "soon"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFixture(path); err == nil {
+		t.Errorf("expected an error for an invalid duration")
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	r := NewRemote(&Fixture{
+		Commands: []CommandResult{
+			{Match: "docker build", ExitCode: 1, Output: "no space left on device"},
+			{Match: "docker push", Duration: "1h"},
+		},
+	})
+	r.Storage = NewStorageClient()
+	r.Storage.CreateBucket(context.Background(), "test-project", "test-bucket", nil)
+	e := r.Executor("10.0.0.1")
+
+	var stdout bytes.Buffer
+	if err := e.Run(context.Background(), winrm.Powershell("docker build -t image ."), "C:\\", time.Minute, &stdout, ioutil.Discard); err == nil {
+		t.Errorf("expected docker build to fail")
+	}
+	if !strings.Contains(stdout.String(), "no space left on device") {
+		t.Errorf("expected the output of the fixture, got %q", stdout.String())
+	}
+	if err := e.Run(context.Background(), "docker push image", "C:\\", 10*time.Millisecond, ioutil.Discard, ioutil.Discard); err == nil {
+		t.Errorf("expected docker push to time out")
+	}
+	upload := "Invoke-RestMethod -Uri 'https://storage.googleapis.com/upload/storage/v1/b/test-bucket/o?uploadType=media&name=logs%2Fbuild.log'"
+	if err := e.Run(context.Background(), upload, "C:\\", time.Minute, ioutil.Discard, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Storage.Buckets["test-bucket"]["logs/build.log"]; !ok {
+		t.Errorf("expected the upload to be written to storage, got %v", r.Storage.Buckets["test-bucket"])
+	}
+
+	if commands := r.CommandsContaining("docker build -t image ."); len(commands) != 1 || commands[0] != "10.0.0.1: docker build -t image ." {
+		t.Errorf("expected the decoded PowerShell command to be recorded, got %q", r.Commands())
+	}
+	if len(r.Commands()) != 3 {
+		t.Errorf("expected 3 recorded commands, got %q", r.Commands())
+	}
+}
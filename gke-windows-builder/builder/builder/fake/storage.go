@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// StorageClient keeps buckets and objects in memory.
+type StorageClient struct {
+	mu sync.Mutex
+	// Buckets maps bucket names to their objects' contents by name.
+	Buckets map[string]map[string][]byte
+	// BucketLabels maps bucket names to the labels they were created with.
+	BucketLabels map[string]map[string]string
+	// ObjectMetadata maps "bucket/object" to the metadata of the objects.
+	ObjectMetadata map[string]map[string]string
+}
+
+// NewStorageClient returns an empty StorageClient.
+func NewStorageClient() *StorageClient {
+	return &StorageClient{
+		Buckets:        map[string]map[string][]byte{},
+		BucketLabels:   map[string]map[string]string{},
+		ObjectMetadata: map[string]map[string]string{},
+	}
+}
+
+func (c *StorageClient) GetBucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.Buckets[bucket]; !ok {
+		return nil, storage.ErrBucketNotExist
+	}
+	return &storage.BucketAttrs{Name: bucket, Labels: c.BucketLabels[bucket]}, nil
+}
+
+func (c *StorageClient) CreateBucket(ctx context.Context, projectID string, bucket string, attrs *storage.BucketAttrs) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Buckets[bucket] = map[string][]byte{}
+	if attrs != nil {
+		c.BucketLabels[bucket] = attrs.Labels
+	}
+	return nil
+}
+
+func (c *StorageClient) WriteObject(ctx context.Context, bucket string, object string, r io.Reader, metadata map[string]string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.Buckets[bucket]; !ok {
+		return storage.ErrBucketNotExist
+	}
+	c.Buckets[bucket][object] = data
+	c.ObjectMetadata[bucket+"/"+object] = metadata
+	return nil
+}
+
+func (c *StorageClient) ReadObject(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.Buckets[bucket][object]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *StorageClient) DeleteObject(ctx context.Context, bucket string, object string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.Buckets[bucket][object]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	delete(c.Buckets[bucket], object)
+	return nil
+}
+
+func (c *StorageClient) Close() error {
+	return nil
+}
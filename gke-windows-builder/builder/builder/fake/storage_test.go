@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestStorageClient(t *testing.T) {
+	ctx := context.Background()
+	c := NewStorageClient()
+	if _, err := c.GetBucketAttrs(ctx, "test-bucket"); err != storage.ErrBucketNotExist {
+		t.Errorf("expected ErrBucketNotExist, got %v", err)
+	}
+	if err := c.WriteObject(ctx, "test-bucket", "object", strings.NewReader("data"), nil); err != storage.ErrBucketNotExist {
+		t.Errorf("expected writing to a missing bucket to fail, got %v", err)
+	}
+
+	if err := c.CreateBucket(ctx, "test-project", "test-bucket", &storage.BucketAttrs{Labels: map[string]string{"team": "windows"}}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := c.GetBucketAttrs(ctx, "test-bucket")
+	if err != nil || attrs.Labels["team"] != "windows" {
+		t.Errorf("expected the bucket labels, got %+v, %v", attrs, err)
+	}
+
+	if err := c.WriteObject(ctx, "test-bucket", "object", strings.NewReader("data"), map[string]string{"version": "ltsc2019"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.ReadObject(ctx, "test-bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	if string(data) != "data" || c.ObjectMetadata["test-bucket/object"]["version"] != "ltsc2019" {
+		t.Errorf("unexpected object %q with metadata %v", data, c.ObjectMetadata["test-bucket/object"])
+	}
+
+	if err := c.DeleteObject(ctx, "test-bucket", "object"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadObject(ctx, "test-bucket", "object"); err != storage.ErrObjectNotExist {
+		t.Errorf("expected ErrObjectNotExist after the delete, got %v", err)
+	}
+	if err := c.DeleteObject(ctx, "test-bucket", "object"); err != storage.ErrObjectNotExist {
+		t.Errorf("expected deleting a missing object to fail, got %v", err)
+	}
+}
@@ -15,7 +15,6 @@
 package builder
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -27,7 +26,8 @@ import (
 	"fmt"
 	"log"
 	random "math/rand"
-	"os/exec"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -35,198 +35,342 @@ import (
 
 	"cloud.google.com/go/compute/metadata"
 	"golang.org/x/oauth2/google"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 )
 
 const (
 	computeUrlPrefix = "https://www.googleapis.com/compute/v1/projects/"
+	// DefaultInstanceNameTemplate is the default InstanceNameTemplate. The
+	// placeholders are {prefix}, the InstanceNamePrefix, {version}, the
+	// Windows version, {buildid}, the first 8 characters of the BuildID,
+	// {rand}, 8 random characters, and {uuid}, a random UUID.
+	DefaultInstanceNameTemplate = "{prefix}{version}-{buildid}-{rand}"
+	// windowsVersionLabel labels the instances with the Windows version they
+	// build, only instances of the same version are reused. Earlier releases
+	// labeled reusable instances with it already, keep its name so that
+	// they are still reused.
+	windowsVersionLabel = "builder_version"
+	// legacyInstanceNameSuffix matches the UUID that followed the
+	// InstanceNamePrefix in the names of the instances created before
+	// InstanceNameTemplate, still reused with the default template.
+	legacyInstanceNameSuffix = `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`
 )
 
-// Setup the Winrm, disable the Windows Defender, install the docker if needed
-// Note: it'll restart the instance to make it effective
 var (
-	setupScriptPS1 = `
-# Disable Windows Defender service
-# Windows Defender may scan the C:\ProgramData\Docker\ folder, make it locked from docker build.
-# https://github.com/docker/for-win/issues/2117
-if ((Get-WindowsFeature -Name 'Windows-Defender').Installed) {
-	Write-Host "Disabling Windows Defender service"
-	Set-MpPreference -DisableRealtimeMonitoring $true
-	Uninstall-WindowsFeature -Name 'Windows-Defender'
-	Restart-Computer -Force
-}
-
-# Writes $Message to the console. Terminates the script if $Fatal is set.
-function Test-ContainersFeatureInstalled {
-	return (Get-WindowsFeature Containers).Installed
-}
-# After this function returns, the computer must be restarted to complete
-# the installation!
-function Install-ContainersFeature {
-	Write-Host "Installing Windows 'Containers' feature"
-	Install-WindowsFeature Containers
-}
-function Test-DockerIsInstalled {
-	$service = Get-Service -Name docker -ErrorAction SilentlyContinue
-	return ($service -ne $null)
-}
-function Test-DockerIsRunning {
-	return ((Get-Service docker).Status -eq 'Running')
-}
-# Installs Docker EE via the DockerMsftProvider. Ensure that the Windows
-# Containers feature is installed before calling this function; otherwise,
-# a restart may be needed after this function returns.
-function Install-Docker {
-	# Based on https://learn.microsoft.com/virtualization/windowscontainers/quick-start/set-up-environment?tabs=dockerce#windows-server-1
-	Write-Host "Installing latest Docker CE version"
-	$scriptFile = "$env:Temp\install-docker-ce.ps1"
-	Invoke-WebRequest -UseBasicParsing "https://raw.githubusercontent.com/microsoft/Windows-Containers/Main/helpful_tools/Install-DockerCE/install-docker-ce.ps1" -o $scriptFile
-	.$scriptFile
-	Remove-Item $scriptFile
-}
-if (-not (Test-ContainersFeatureInstalled)) {
-	Install-ContainersFeature
-	Write-Host 'Restarting computer after enabling Windows Containers feature'
-	Restart-Computer -Force
-	# Restart-Computer does not stop the rest of the script from executing.
-	exit 0
-}
-if (-not (Test-DockerIsInstalled)) {
-	Install-Docker
-}
-# For some reason the docker service may not be started automatically on the
-# first reboot, although it seems to work fine on subsequent reboots.
-Restart-Service docker
-Start-Sleep 5
-if (-not (Test-DockerIsRunning)) {
-	throw "docker service failed to start or stay running"
-}
-
-# Setup Winrm
-winrm set winrm/config/service/auth '@{Basic="true"}'
-
-Write-Host 'Windows instance setup is completed'
-`
+	instanceNameRE     = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	invalidNameCharsRE = regexp.MustCompile(`[^a-z0-9-]+`)
+	repeatedDashesRE   = regexp.MustCompile(`-{2,}`)
 )
 
-// Server encapsulates a GCE Instance.
+// Server is a Windows machine of a Provider, a GCE instance by default.
+// Providers return a Server with Name or Instance, and Data, set, and
+// External or Pinned for machines the build must not delete. The
+// orchestrator sets Provider and the connection of RemoteWindowsServer.
 type Server struct {
-	context   *context.Context
-	projectID string
-	zone      string
-	service   *compute.Service
-	instance  *compute.Instance
+	// Name identifies a machine that isn't a GCE instance, e.g. in logs.
+	Name string
+	// Data is the state of the machine kept by its Provider.
+	Data interface{}
+	// Instance is the GCE instance of a GCEProvider, nil for other providers.
+	Instance *compute.Instance
+	// External is set for a machine the builder doesn't own, e.g. a
+	// RemoteHost. Only its workspace folder is removed after the build, it is
+	// neither set up, resynced, stopped nor deleted.
+	External bool
+	// Pinned is set for a machine picked by name, e.g. of UseInstances, which
+	// may be stopped or suspended after the build but is never deleted.
+	Pinned bool
+	// Provider is the Provider that returned the machine, it is set by the
+	// orchestrator.
+	Provider Provider
+
+	projectID     string
+	zone          string
+	compute       ComputeClient
+	useInternalIP bool
 	RemoteWindowsServer
 }
 
-// getProject gets the project ID.
-func GetProject() (string, error) {
-	// Get projectID from GCE metadata.
-	if metadata.OnGCE() {
-		// Use the GCE Metadata service.
-		projectID, err := metadata.ProjectID()
-		if err != nil {
-			return "", fmt.Errorf("Failed to get project ID from instance metadata with error: %+v", err)
-		}
-		return projectID, nil
-	}
-	// Shell out to gcloud.
-	cmd := exec.Command("gcloud", "config", "get-value", "project")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("Failed to shell out to gcloud: %+v", err)
+// GCEProvider provides GCE instances created from the configured images.
+type GCEProvider struct {
+	Compute   ComputeClient
+	ProjectID string
+}
+
+// NewGCEProvider returns a GCEProvider creating instances in projectID.
+func NewGCEProvider(c ComputeClient, projectID string) *GCEProvider {
+	return &GCEProvider{Compute: c, ProjectID: projectID}
+}
+
+// Create starts a new GCE instance.
+func (p *GCEProvider) Create(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	s := &Server{projectID: p.ProjectID, zone: *bs.Zone, compute: p.Compute, useInternalIP: bs.UseInternalIP}
+	if err := s.newInstance(bs); err != nil {
+		log.Printf("Failed to start Windows VM: %+v", err)
+		return nil, err
 	}
-	projectID := strings.TrimSuffix(out.String(), "\n")
-	return projectID, nil
+	s.ClientCert = bs.WinRMClientCert
+	s.ClientKey = bs.WinRMClientKey
+	return s, nil
 }
 
-// NewServer creates a new Windows server on GCE.
-func NewServer(ctx context.Context, bs *WindowsBuildServerConfig, projectID string) (*Server, error) {
-	s := &Server{projectID: projectID, zone: *bs.Zone}
-	var err error
-	if err = s.newGCEService(ctx); err != nil {
-		log.Printf("Failed to start GCE service to create servers: %+v", err)
+// FindExisting picks one of the running instances with the labels, name
+// prefix and network of bs, or one of the instances named by
+// bs.UseInstances.
+func (p *GCEProvider) FindExisting(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	if len(bs.UseInstances) > 0 {
+		return p.findNamed(ctx, bs)
+	}
+	namePrefix, nameRE := bs.reusableInstanceNames()
+	status := "RUNNING"
+	if bs.StopInstances || bs.SuspendInstances {
+		status = "RUNNING|TERMINATED|SUSPENDED"
+	}
+	instances, err := p.Compute.ListInstances(p.ProjectID, *bs.Zone, buildListInstancesFilter(status, bs.GetLabelsMap(), &namePrefix))
+	if err != nil {
+		log.Printf("Failed to list relevant instances: %v", err)
 		return nil, err
 	}
-	if err = s.newInstance(bs); err != nil {
+
+	foundInstancesList := []*compute.Instance{}
+
+	// Filter by network and subnetwork, and check the version label again as
+	// list filters are regular expressions.
+	version := strings.ToLower(*bs.ImageVersion)
+	for _, instance := range instances {
+		if instance.Labels[windowsVersionLabel] != version || !nameRE.MatchString(instance.Name) {
+			continue
+		}
+		if instance.NetworkInterfaces[0].Network == ProjectNetworkUrl(bs.NetworkConfig) &&
+			instance.NetworkInterfaces[0].Subnetwork == InstanceSubnetworkUrl(bs.NetworkConfig) {
+			foundInstancesList = append(foundInstancesList, instance)
+		}
+	}
+
+	if len(foundInstancesList) == 0 {
+		log.Printf("Found no relevant instances")
+		return nil, nil
+	}
+
+	// Prefer running instances, which are ready to build.
+	var running []*compute.Instance
+	for _, instance := range foundInstancesList {
+		if instance.Status == "RUNNING" {
+			running = append(running, instance)
+		}
+	}
+	if len(running) > 0 {
+		foundInstancesList = running
+	}
+
+	random.Seed(time.Now().Unix())
+	chosenInstance := foundInstancesList[random.Intn(len(foundInstancesList))]
+
+	log.Printf("Found %d relevant instances for version: %s, chose %s", len(foundInstancesList), *bs.ImageVersion, chosenInstance.Name)
+
+	s := &Server{projectID: p.ProjectID, zone: *bs.Zone, compute: p.Compute, useInternalIP: bs.UseInternalIP}
+	if err := s.existingInstance(chosenInstance.Name); err != nil {
 		log.Printf("Failed to start Windows VM: %+v", err)
 		return nil, err
 	}
-	err = s.resetPasswordAndPopulateRemoteServer(bs.UseInternalIP)
-	if err != nil {
+	if err := p.wake(ctx, s); err != nil {
 		return nil, err
 	}
-
 	return s, nil
 }
 
-func existingServer(ctx context.Context, zone string, projectID string, name string, useInternalIP bool) (*Server, error) {
-	s := &Server{projectID: projectID, zone: zone}
-	var err error
-	if err = s.newGCEService(ctx); err != nil {
-		log.Printf("Failed to start GCE service to create servers: %+v", err)
-		return nil, err
+// findNamed picks one of the instances named by bs.UseInstances, preferring
+// running ones. Unlike the instances found by their labels, it fails when
+// none of them can be used rather than have a new instance created.
+func (p *GCEProvider) findNamed(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	var usable, running []*compute.Instance
+	for _, name := range bs.UseInstances {
+		instance, err := p.Compute.GetInstance(p.ProjectID, *bs.Zone, name)
+		if err != nil {
+			log.Printf("Skipping instance %s: %v", name, err)
+			continue
+		}
+		// Instances set up by hand may have no version label.
+		if v, ok := instance.Labels[windowsVersionLabel]; ok && v != strings.ToLower(*bs.ImageVersion) {
+			log.Printf("Skipping instance %s of version %s", name, v)
+			continue
+		}
+		switch instance.Status {
+		case "RUNNING":
+			running = append(running, instance)
+			usable = append(usable, instance)
+		case "TERMINATED", "SUSPENDED":
+			usable = append(usable, instance)
+		default:
+			log.Printf("Skipping instance %s in status %s", name, instance.Status)
+		}
 	}
-	if err = s.existingInstance(name); err != nil {
-		log.Printf("Failed to start Windows VM: %+v", err)
-		return nil, err
+	if len(running) > 0 {
+		usable = running
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("None of the instances %s can be used for version %s", strings.Join(bs.UseInstances, ", "), *bs.ImageVersion)
 	}
 
-	err = s.resetPasswordAndPopulateRemoteServer(useInternalIP)
-	if err != nil {
+	random.Seed(time.Now().Unix())
+	s := &Server{projectID: p.ProjectID, zone: *bs.Zone, compute: p.Compute, useInternalIP: bs.UseInternalIP, Pinned: true}
+	s.Instance = usable[random.Intn(len(usable))]
+	log.Printf("Using instance %s for version: %s", s.Instance.Name, *bs.ImageVersion)
+	if err := p.wake(ctx, s); err != nil {
 		return nil, err
 	}
-
 	return s, nil
 }
 
-func FindExistingInstance(ctx context.Context, bs *WindowsBuildServerConfig, projectID string) (*Server, error) {
-	s := &Server{projectID: projectID, zone: *bs.Zone}
-	var err error
-	if err = s.newGCEService(ctx); err != nil {
-		log.Printf("Failed to start GCE service to create servers: %+v", err)
-		return nil, err
+// wake starts or resumes the instance if it is stopped or suspended.
+func (p *GCEProvider) wake(ctx context.Context, s *Server) error {
+	switch s.Instance.Status {
+	case "SUSPENDED":
+		return p.Resume(ctx, s)
+	case "TERMINATED":
+		return p.Start(ctx, s)
 	}
+	return nil
+}
 
-	instanceList, err := s.service.Instances.
-		List(projectID, *bs.Zone).
-		Filter(buildListInstancesFilter(bs.GetLabelsMap(), bs.InstanceNamePrefix)).
-		Do()
+// Start starts a stopped instance and refreshes it, as it gets a new
+// ephemeral IP.
+func (p *GCEProvider) Start(ctx context.Context, s *Server) error {
+	log.Printf("Starting stopped instance %s", s.Instance.Name)
+	op, err := s.compute.StartInstance(s.projectID, s.zone, s.Instance.Name)
+	if err != nil {
+		return fmt.Errorf("Failed to start instance %s: %+v", s.Instance.Name, err)
+	}
+	if err := s.waitForComputeOperation(op); err != nil {
+		return err
+	}
+	return s.refreshInstance()
+}
 
+// Stop stops the instance, keeping its disks.
+func (p *GCEProvider) Stop(ctx context.Context, s *Server) error {
+	op, err := s.compute.StopInstance(s.projectID, s.zone, s.Instance.Name)
 	if err != nil {
-		log.Printf("Failed to list relevant instances: %v", err)
-		return nil, err
+		log.Printf("Could not stop instance: %s, with error: %v", s.Instance.Name, err)
+		return err
 	}
+	if err := s.waitForComputeOperation(op); err != nil {
+		return err
+	}
+	log.Printf("Instance: %s stopped successfully", s.Instance.Name)
+	return nil
+}
 
-	foundInstancesList := []*compute.Instance{}
+// Resume resumes a suspended instance and refreshes it, as it gets a new
+// ephemeral IP.
+func (p *GCEProvider) Resume(ctx context.Context, s *Server) error {
+	log.Printf("Resuming suspended instance %s", s.Instance.Name)
+	op, err := s.compute.ResumeInstance(s.projectID, s.zone, s.Instance.Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resume instance %s: %+v", s.Instance.Name, err)
+	}
+	if err := s.waitForComputeOperation(op); err != nil {
+		return err
+	}
+	return s.refreshInstance()
+}
 
-	// Filter by network and subnetwork
-	for instance := range instanceList.Items {
-		//log.Printf("Network %s", instanceList.Items[instance].NetworkInterfaces[0].Network)
-		//log.Printf("Subnetwork %s", instanceList.Items[instance].NetworkInterfaces[0].Subnetwork)
-		if instanceList.Items[instance].NetworkInterfaces[0].Network == ProjectNetworkUrl(bs.NetworkConfig) &&
-			instanceList.Items[instance].NetworkInterfaces[0].Subnetwork == InstanceSubnetworkUrl(bs.NetworkConfig) {
-			foundInstancesList = append(foundInstancesList, instanceList.Items[instance])
-		}
+// Suspend suspends the instance, keeping its memory and disks.
+func (p *GCEProvider) Suspend(ctx context.Context, s *Server) error {
+	op, err := s.compute.SuspendInstance(s.projectID, s.zone, s.Instance.Name)
+	if err != nil {
+		log.Printf("Could not suspend instance: %s, with error: %v", s.Instance.Name, err)
+		return err
+	}
+	if err := s.waitForComputeOperation(op); err != nil {
+		return err
 	}
+	log.Printf("Instance: %s suspended successfully", s.Instance.Name)
+	return nil
+}
 
-	if len(foundInstancesList) == 0 {
-		log.Printf("Found no relevant instances")
-		return nil, nil
+// Delete deletes the instance.
+func (p *GCEProvider) Delete(ctx context.Context, s *Server) error {
+	return s.DeleteInstance()
+}
+
+// Credentials resets the password of the builder user of the instance,
+// unless it authenticates with a client certificate.
+func (p *GCEProvider) Credentials(ctx context.Context, s *Server) (string, string, error) {
+	username := "builder"
+	if s.ClientCert != nil {
+		return username, "", nil
+	}
+	password, err := s.resetWindowsPassword(username)
+	if err != nil {
+		log.Printf("Failed to reset Windows password: %+v", err)
+		return "", "", err
 	}
+	return username, password, nil
+}
 
-	random.Seed(time.Now().Unix())
-	chosenInstance := foundInstancesList[random.Intn(len(foundInstancesList))]
+// IP returns the external IP of the instance, or its internal IP when bs
+// was set to use internal IPs.
+func (p *GCEProvider) IP(ctx context.Context, s *Server) (string, error) {
+	return s.getIP(s.useInternalIP)
+}
 
-	log.Printf("Found %d relevant instances for version: %s, chose %s", len(foundInstancesList), *bs.ImageVersion, chosenInstance.Name)
+// getProject gets the project ID.
+func GetProject() (string, error) {
+	// Get projectID from GCE metadata.
+	if metadata.OnGCE() {
+		// Use the GCE Metadata service.
+		projectID, err := metadata.ProjectID()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get project ID from instance metadata with error: %+v", err)
+		}
+		return projectID, nil
+	}
+	// Use the project of the application default credentials, e.g. of a
+	// service account key file.
+	creds, err := google.FindDefaultCredentials(context.Background(), compute.CloudPlatformScope)
+	if err == nil && creds.ProjectID != "" {
+		return creds.ProjectID, nil
+	}
+	for _, env := range []string{"GOOGLE_CLOUD_PROJECT", "CLOUDSDK_CORE_PROJECT"} {
+		if projectID := os.Getenv(env); projectID != "" {
+			return projectID, nil
+		}
+	}
+	return "", errors.New("Failed to find the project ID in the instance metadata, the application default credentials, GOOGLE_CLOUD_PROJECT or CLOUDSDK_CORE_PROJECT")
+}
+
+// NewServer creates a new Windows server on GCE.
+func NewServer(ctx context.Context, c ComputeClient, bs *WindowsBuildServerConfig, projectID string) (*Server, error) {
+	p := NewGCEProvider(c, projectID)
+	s, err := p.Create(ctx, bs)
+	if err != nil {
+		return nil, err
+	}
+	s.Provider = p
+	if err := connectServer(ctx, p, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	return existingServer(ctx, *bs.Zone, projectID, chosenInstance.Name, bs.UseInternalIP)
+// FindExistingInstance returns a running GCE instance to reuse, or nil.
+func FindExistingInstance(ctx context.Context, c ComputeClient, bs *WindowsBuildServerConfig, projectID string) (*Server, error) {
+	p := NewGCEProvider(c, projectID)
+	s, err := p.FindExisting(ctx, bs)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	s.Provider = p
+	if err := connectServer(ctx, p, s); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func buildListInstancesFilter(labels map[string]string, instanceNamePrefix *string) string {
-	filters := []string{"(status eq RUNNING)"}
+func buildListInstancesFilter(status string, labels map[string]string, instanceNamePrefix *string) string {
+	filters := []string{fmt.Sprintf("(status eq %s)", status)}
 
 	if instanceNamePrefix != nil {
 		filters = append(filters, fmt.Sprintf("(name eq %s.*)", *instanceNamePrefix))
@@ -253,16 +397,141 @@ func newGCEService(ctx context.Context) (*compute.Service, error) {
 	return service, nil
 }
 
-// newGCEService creates a new Compute service.
-func (s *Server) newGCEService(ctx context.Context) error {
-	service, err := newGCEService(ctx)
-	s.service = service
-	return err
+func newGCEBetaService(ctx context.Context) (*computebeta.Service, error) {
+	client, err := google.DefaultClient(ctx, compute.ComputeScope)
+	if err != nil {
+		log.Printf("Failed to create Google Default Client: %v", err)
+		return nil, err
+	}
+	service, err := computebeta.New(client)
+	if err != nil {
+		log.Printf("Failed to create Compute beta Service: %v", err)
+		return nil, err
+	}
+	return service, nil
+}
+
+// getScheduling returns the scheduling options of the instance. Preemptible
+// instances can't be restarted or migrated by GCE.
+func (bs *WindowsBuildServerConfig) getScheduling() *compute.Scheduling {
+	scheduling := &compute.Scheduling{
+		AutomaticRestart:  bs.AutomaticRestart,
+		OnHostMaintenance: bs.OnHostMaintenance,
+	}
+	if bs.ProvisioningModel == "PREEMPTIBLE" {
+		automaticRestart := false
+		scheduling.AutomaticRestart = &automaticRestart
+		scheduling.OnHostMaintenance = "TERMINATE"
+		scheduling.Preemptible = true
+	}
+	return scheduling
+}
+
+// resourcePolicyUrl returns the URL of a resource policy given by name, in the
+// project and region of the instance, or by projects/PROJECT/regions/REGION/resourcePolicies/NAME path.
+func resourcePolicyUrl(projectID string, zone string, policy string) (string, error) {
+	if strings.HasPrefix(policy, "projects/") {
+		return computeUrlPrefix + strings.TrimPrefix(policy, "projects/"), nil
+	}
+	i := strings.LastIndex(zone, "-")
+	if i <= 0 {
+		return "", fmt.Errorf("Failed to get the region of the resource policy %s, invalid zone %q", policy, zone)
+	}
+	return computeUrlPrefix + projectID + "/regions/" + zone[:i] + "/resourcePolicies/" + policy, nil
+}
+
+// instanceName renders the InstanceNameTemplate. Values are lowercased and
+// characters that GCE doesn't allow in names are replaced by dashes, empty
+// values like a missing BuildID leave no double dashes behind.
+func (bs *WindowsBuildServerConfig) instanceName() (string, error) {
+	id := uuid.New()
+	name := bs.renderInstanceName(-1, map[string]string{
+		"{buildid}": bs.BuildID,
+		"{rand}":    strings.Replace(id, "-", "", -1)[:8],
+		"{uuid}":    id,
+	})
+	name = strings.Trim(repeatedDashesRE.ReplaceAllString(name, "-"), "-")
+	if !instanceNameRE.MatchString(name) {
+		return "", fmt.Errorf("Instance name %q of template %q is not a valid GCE instance name, it must start with a letter and have at most 63 lowercase letters, digits or dashes", name, bs.instanceNameTemplate())
+	}
+	return name, nil
+}
+
+// instanceNameStablePrefix returns the start of the names of the instances
+// of this version, up to the first placeholder that differs between builds.
+// It narrows the instances considered for reuse.
+func (bs *WindowsBuildServerConfig) instanceNameStablePrefix() string {
+	template := bs.instanceNameTemplate()
+	end := len(template)
+	for _, p := range []string{"{buildid}", "{rand}", "{uuid}"} {
+		if i := strings.Index(template, p); i >= 0 && i < end {
+			end = i
+		}
+	}
+	return repeatedDashesRE.ReplaceAllString(bs.renderInstanceName(end, nil), "-")
+}
+
+// reusableInstanceNames returns the name prefix to list the instances
+// considered for reuse by, and the regular expression their names must match:
+// instanceNameStablePrefix, and with the default template, also the
+// {prefix}{uuid} names of the instances of earlier releases.
+func (bs *WindowsBuildServerConfig) reusableInstanceNames() (string, *regexp.Regexp) {
+	prefix := bs.instanceNameStablePrefix()
+	pattern := regexp.QuoteMeta(prefix) + ".*"
+	if bs.instanceNameTemplate() == DefaultInstanceNameTemplate && bs.InstanceNamePrefix != nil {
+		prefix = *bs.InstanceNamePrefix
+		pattern += "|" + regexp.QuoteMeta(prefix) + legacyInstanceNameSuffix
+	}
+	return prefix, regexp.MustCompile("^(" + pattern + ")$")
+}
+
+// renderInstanceName replaces the placeholders of the first end bytes of the
+// template, all of it if end is negative, by their sanitized values.
+func (bs *WindowsBuildServerConfig) renderInstanceName(end int, values map[string]string) string {
+	template := bs.instanceNameTemplate()
+	if end >= 0 {
+		template = template[:end]
+	}
+	var prefix, version string
+	if bs.InstanceNamePrefix != nil {
+		prefix = *bs.InstanceNamePrefix
+	}
+	if bs.ImageVersion != nil {
+		version = *bs.ImageVersion
+	}
+	sanitize := func(s string) string {
+		return invalidNameCharsRE.ReplaceAllString(strings.ToLower(s), "-")
+	}
+	buildID := sanitize(values["{buildid}"])
+	if len(buildID) > 8 {
+		buildID = buildID[:8]
+	}
+	return strings.NewReplacer(
+		"{prefix}", prefix,
+		"{version}", sanitize(version),
+		"{buildid}", buildID,
+		"{rand}", values["{rand}"],
+		"{uuid}", values["{uuid}"],
+	).Replace(template)
+}
+
+func (bs *WindowsBuildServerConfig) instanceNameTemplate() string {
+	if bs.InstanceNameTemplate == "" {
+		return DefaultInstanceNameTemplate
+	}
+	return bs.InstanceNameTemplate
 }
 
 // newInstance starts a Windows VM on GCE and returns host, username, password.
 func (s *Server) newInstance(bs *WindowsBuildServerConfig) error {
-	name := *bs.InstanceNamePrefix + uuid.New()
+	name, err := bs.instanceName()
+	if err != nil {
+		return err
+	}
+	setupScript, err := bs.Scripts.Render(SetupScript, SetupScriptData{Version: *bs.ImageVersion})
+	if err != nil {
+		return err
+	}
 
 	machineType := *bs.MachineType
 	if machineType == "" {
@@ -301,7 +570,7 @@ func (s *Server) newInstance(bs *WindowsBuildServerConfig) error {
 			Items: []*compute.MetadataItems{
 				&compute.MetadataItems{
 					Key:   "windows-startup-script-ps1",
-					Value: &setupScriptPS1,
+					Value: &setupScript,
 				},
 			},
 		},
@@ -318,7 +587,94 @@ func (s *Server) newInstance(bs *WindowsBuildServerConfig) error {
 				},
 			},
 		},
-		Labels: bs.GetLabelsMap(),
+		Labels:     bs.GetLabelsMap(),
+		Scheduling: bs.getScheduling(),
+	}
+
+	if bs.DefenderMode != "" {
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "defender-mode",
+			Value: &bs.DefenderMode,
+		})
+	}
+	if skipSteps := bs.skipSetupSteps(); skipSteps != "" {
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "skip-setup-steps",
+			Value: &skipSteps,
+		})
+	}
+	if bs.InstallWindowsUpdates {
+		installUpdates := "true"
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "install-windows-updates",
+			Value: &installUpdates,
+		})
+	}
+	if len(bs.InstallPackages) > 0 {
+		var packages []string
+		for _, p := range bs.InstallPackages {
+			packages = append(packages, p.String())
+		}
+		installPackages := strings.Join(packages, ",")
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "install-packages",
+			Value: &installPackages,
+		})
+	}
+	if bs.WinRMClientCert != nil {
+		clientCert := string(bs.WinRMClientCert)
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "winrm-client-cert",
+			Value: &clientCert,
+		})
+	}
+	minTLSVersion := bs.WinRMTLS.VersionName()
+	instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+		Key:   "winrm-min-tls-version",
+		Value: &minTLSVersion,
+	})
+	if len(bs.WinRMTLS.CipherSuites) > 0 {
+		cipherSuites := strings.Join(bs.WinRMTLS.CipherSuites, ",")
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "winrm-cipher-suites",
+			Value: &cipherSuites,
+		})
+	}
+	if bs.DockerDaemonConfig != "" {
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "docker-daemon-config",
+			Value: &bs.DockerDaemonConfig,
+		})
+	}
+	if len(bs.TrustedCACerts) > 0 {
+		caCerts, registries := string(bs.TrustedCACerts), strings.Join(bs.TrustedCARegistries, ",")
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "trusted-ca-certs",
+			Value: &caCerts,
+		}, &compute.MetadataItems{
+			Key:   "trusted-ca-registries",
+			Value: &registries,
+		})
+	}
+
+	if bs.DockerCacheSnapshots {
+		disk, err := s.dockerCacheDisk(bs, name)
+		if err != nil {
+			return err
+		}
+		instance.Disks = append(instance.Disks, disk)
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "docker-cache-disk",
+			Value: &disk.DeviceName,
+		})
+	}
+
+	if bs.PlacementPolicy != "" {
+		policy, err := resourcePolicyUrl(s.projectID, s.zone, bs.PlacementPolicy)
+		if err != nil {
+			return err
+		}
+		instance.ResourcePolicies = []string{policy}
 	}
 
 	subnetUrl := InstanceSubnetworkUrl(bs.NetworkConfig)
@@ -327,7 +683,7 @@ func (s *Server) newInstance(bs *WindowsBuildServerConfig) error {
 		instance.NetworkInterfaces[0].Subnetwork = subnetUrl
 	}
 
-	op, err := s.service.Instances.Insert(s.projectID, s.zone, instance).Do()
+	op, err := s.compute.InsertInstance(s.projectID, s.zone, instance)
 	if err != nil {
 		log.Printf("GCE Instances insert call failed: %v", err)
 		return err
@@ -338,54 +694,63 @@ func (s *Server) newInstance(bs *WindowsBuildServerConfig) error {
 		return err
 	}
 
-	etag := op.Header.Get("Etag")
-	inst, err := s.service.Instances.Get(s.projectID, s.zone, name).IfNoneMatch(etag).Do()
+	inst, err := s.compute.GetInstance(s.projectID, s.zone, name)
 	if err != nil {
 		log.Printf("Could not get GCE Instance details after creation: %v", err)
 		return err
 	}
 	log.Printf("Successfully created instance: %s, version: %s", inst.Name, *bs.ImageVersion)
-	s.instance = inst
+	s.Instance = inst
 	return nil
 }
 
 func (s *Server) existingInstance(name string) error {
-	inst, err := s.service.Instances.Get(s.projectID, s.zone, name).Do()
+	inst, err := s.compute.GetInstance(s.projectID, s.zone, name)
 	if err != nil {
 		log.Printf("Could not get provided existing GCE Instance details: %v", err)
 		return err
 	}
 	log.Printf("Successfully retrieved instance: %s", inst.Name)
-	s.instance = inst
+	s.Instance = inst
 	return nil
 }
 
 // refreshInstance refreshes latest info from GCE into struct.
 func (s *Server) refreshInstance() error {
-	inst, err := s.service.Instances.Get(s.projectID, s.zone, s.instance.Name).Do()
+	inst, err := s.compute.GetInstance(s.projectID, s.zone, s.Instance.Name)
 	if err != nil {
 		log.Printf("Could not refresh instance: %v", err)
 		return err
 	}
-	s.instance = inst
+	s.Instance = inst
 	return nil
 }
 
+// instanceStatus returns the current GCE status of the instance of s.
+func (s *Server) instanceStatus() (string, error) {
+	if err := s.refreshInstance(); err != nil {
+		return "", err
+	}
+	return s.Instance.Status, nil
+}
+
 // DeleteInstance stops a Windows VM on GCE.
-func (s *Server) DeleteInstance() {
-	_, err := s.service.Instances.Delete(s.projectID, s.zone, s.instance.Name).Do()
+func (s *Server) DeleteInstance() error {
+	_, err := s.compute.DeleteInstance(s.projectID, s.zone, s.Instance.Name)
 	if err != nil {
-		log.Printf("Could not delete instance: %s, with error: %v", *s.RemoteWindowsServer.Hostname, err)
+		log.Printf("Could not delete instance: %s, with error: %v", s.Instance.Name, err)
+		return err
 	}
-	log.Printf("Instance: %s shut down successfully", *s.RemoteWindowsServer.Hostname)
+	log.Printf("Instance: %s shut down successfully", s.Instance.Name)
+	return nil
 }
 
 func (s *Server) GetInstanceName() string {
-	if s.instance == nil {
-		return ""
+	if s.Instance == nil {
+		return s.Name
 	}
 
-	return s.instance.Name
+	return s.Instance.Name
 }
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -398,41 +763,13 @@ func RandStringRunes(n int) string {
 	return string(b)
 }
 
-func (s *Server) resetPasswordAndPopulateRemoteServer(useInternalIP bool) error {
-	// Reset password
-	username := "builder"
-	password, err := s.resetWindowsPassword(username)
-	if err != nil {
-		log.Printf("Failed to reset Windows password: %+v", err)
-		return err
-	}
-	// Get IP address.
-	ip, err := s.getIP(useInternalIP)
-	if err != nil {
-		log.Printf("Failed to get IP address: %+v", err)
-		return err
-	}
-
-	workspaceFolder := fmt.Sprintf(`C:\%s`, RandStringRunes(5))
-
-	// Set and return Remote.
-	s.RemoteWindowsServer = RemoteWindowsServer{
-		Hostname:        &ip,
-		Username:        &username,
-		Password:        &password,
-		WorkspaceFolder: &workspaceFolder,
-	}
-
-	return nil
-}
-
 // getIP gets the IP for an instance (external or internal if using shared VPCs).
 func (s *Server) getIP(useInternalIP bool) (string, error) {
 	err := s.refreshInstance()
 	if err != nil {
 		log.Printf("Error refreshing instance: %+v", err)
 	}
-	for _, ni := range s.instance.NetworkInterfaces {
+	for _, ni := range s.Instance.NetworkInterfaces {
 		if useInternalIP {
 			return ni.NetworkIP, nil
 		}
@@ -495,7 +832,7 @@ func (s *Server) resetWindowsPassword(username string) (string, error) {
 	//Write key to instance metadata and wait for op to complete
 	log.Print("Writing Windows instance metadata for password reset")
 	var found bool
-	for _, mdi := range s.instance.Metadata.Items {
+	for _, mdi := range s.Instance.Metadata.Items {
 		if mdi.Key == "windows-keys" {
 			log.Print("Altering current key")
 
@@ -506,13 +843,13 @@ func (s *Server) resetWindowsPassword(username string) (string, error) {
 	}
 
 	if !found {
-		s.instance.Metadata.Items = append(s.instance.Metadata.Items, &compute.MetadataItems{Key: "windows-keys", Value: &dstring})
+		s.Instance.Metadata.Items = append(s.Instance.Metadata.Items, &compute.MetadataItems{Key: "windows-keys", Value: &dstring})
 	}
 
-	op, err := s.service.Instances.SetMetadata(s.projectID, s.zone, s.instance.Name, &compute.Metadata{
-		Fingerprint: s.instance.Metadata.Fingerprint,
-		Items:       s.instance.Metadata.Items,
-	}).Do()
+	op, err := s.compute.SetInstanceMetadata(s.projectID, s.zone, s.Instance.Name, &compute.Metadata{
+		Fingerprint: s.Instance.Metadata.Fingerprint,
+		Items:       s.Instance.Metadata.Items,
+	})
 	if err != nil {
 		log.Printf("Failed to set instance metadata: %v", err)
 		return "", err
@@ -528,12 +865,12 @@ func (s *Server) resetWindowsPassword(username string) (string, error) {
 	timeout := time.Now().Add(time.Minute * 5)
 	hash := sha1.New()
 	for time.Now().Before(timeout) {
-		output, err := s.service.Instances.GetSerialPortOutput(s.projectID, s.zone, s.instance.Name).Port(4).Do()
+		output, err := s.compute.GetSerialPortOutput(s.projectID, s.zone, s.Instance.Name, 4)
 		if err != nil {
 			log.Printf("Unable to get serial port output: %v", err)
 			return "", err
 		}
-		responses := strings.Split(output.Contents, "\n")
+		responses := strings.Split(output, "\n")
 		for _, response := range responses {
 			var wpr WindowsPasswordResponse
 			if err := json.Unmarshal([]byte(response), &wpr); err != nil {
@@ -565,7 +902,7 @@ func (s *Server) waitForComputeOperation(op *compute.Operation) error {
 	log.Printf("Waiting for %+v to complete", op.Name)
 	timeout := time.Now().Add(300 * time.Second)
 	for time.Now().Before(timeout) {
-		newop, err := s.service.ZoneOperations.Get(s.projectID, s.zone, op.Name).Do()
+		newop, err := s.compute.GetZoneOperation(s.projectID, s.zone, op.Name)
 		if err != nil {
 			log.Printf("Failed to update operation status: %v", err)
 			return err
@@ -574,11 +911,11 @@ func (s *Server) waitForComputeOperation(op *compute.Operation) error {
 			if newop.Error == nil || len(newop.Error.Errors) == 0 {
 				return nil
 			}
-			//Operation Error
+			var opErrors []string
 			for _, opError := range newop.Error.Errors {
-				fmt.Printf("Operation Error. Code: %s, Location: %s, Message: %s :", opError.Code, opError.Location, opError.Message)
+				opErrors = append(opErrors, fmt.Sprintf("code: %s, location: %s, message: %s", opError.Code, opError.Location, opError.Message))
 			}
-			return fmt.Errorf("Compute operation %s completed with errors", op.Name)
+			return fmt.Errorf("Compute operation %s completed with errors: %s", op.Name, strings.Join(opErrors, "; "))
 		}
 		time.Sleep(1 * time.Second)
 	}
@@ -16,10 +16,22 @@ package builder
 
 import (
 	"context"
+	"regexp"
+	"strings"
 	"testing"
+
+	"gke-windows-builder/builder/builder/fake"
+
+	"golang.org/x/oauth2/google"
+	compute "google.golang.org/api/compute/v1"
 )
 
 func TestNewGCEService(t *testing.T) {
+	// This test needs application default credentials, skip it if there are none.
+	if _, err := google.FindDefaultCredentials(context.Background()); err != nil {
+		t.Skipf("No application default credentials, skipping...")
+	}
+
 	c, err := newGCEService(context.Background())
 	if err != nil {
 		t.Errorf("cannot create compute client, %s", err)
@@ -29,3 +41,302 @@ func TestNewGCEService(t *testing.T) {
 		t.Error("compute client was nil")
 	}
 }
+
+func TestNewServer(t *testing.T) {
+	project, zone, prefix, labels := "test-project", "us-central1-f", "windows-builder-", "team=windows"
+	network, subnet, region, networkProject := "default", "default", "us-central1", ""
+	version, image := "ltsc2019", "windows-cloud/global/images/family/windows-2019-core"
+	machineType, diskType, serviceAccount := "", "pd-ssd", "builder"
+
+	c := fake.NewComputeClient(nil)
+	s, err := NewServer(context.Background(), c, &WindowsBuildServerConfig{
+		InstanceNamePrefix:    &prefix,
+		ImageVersion:          &version,
+		ImageURL:              &image,
+		Zone:                  &zone,
+		NetworkConfig:         NewInstanceNetworkConfig(&project, &network, &networkProject, &subnet, &region),
+		Labels:                &labels,
+		MachineType:           &machineType,
+		BootDiskType:          &diskType,
+		BootDiskSizeGB:        100,
+		ServiceAccount:        &serviceAccount,
+		ExternalNAT:           true,
+		DockerDaemonConfig:    `{"data-root": "D:\\docker"}`,
+		SkipDockerInstall:     true,
+		SkipWinRMConfig:       true,
+		InstallWindowsUpdates: true,
+		TrustedCACerts:        []byte("ca-certs"),
+		TrustedCARegistries:   []string{"registry.example.com:5000", "gcr.io"},
+		InstallPackages:       []InstallPackage{{Manager: "choco", Name: "git"}, {Manager: "winget", Name: "Microsoft.DotNet.SDK.8", Version: "8.0.100"}},
+	}, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := c.Instances[s.GetInstanceName()]
+	if inst == nil {
+		t.Fatalf("instance %q was not created", s.GetInstanceName())
+	}
+	if inst.Labels["team"] != "windows" {
+		t.Errorf("expected label team=windows, got %v", inst.Labels)
+	}
+	if email := inst.ServiceAccounts[0].Email; email != "builder@test-project.iam.gserviceaccount.com" {
+		t.Errorf("unexpected service account %q", email)
+	}
+	var daemonConfig, skipSteps, updates, caCerts, caRegistries, packages string
+	for _, item := range inst.Metadata.Items {
+		switch item.Key {
+		case "docker-daemon-config":
+			daemonConfig = *item.Value
+		case "trusted-ca-certs":
+			caCerts = *item.Value
+		case "trusted-ca-registries":
+			caRegistries = *item.Value
+		case "skip-setup-steps":
+			skipSteps = *item.Value
+		case "install-windows-updates":
+			updates = *item.Value
+		case "install-packages":
+			packages = *item.Value
+		}
+	}
+	if daemonConfig != `{"data-root": "D:\\docker"}` {
+		t.Errorf("expected the Docker daemon configuration in metadata, got %q", daemonConfig)
+	}
+	if skipSteps != "docker-install,winrm-config" {
+		t.Errorf("expected docker install and WinRM config to be skipped, got %q", skipSteps)
+	}
+	if updates != "true" {
+		t.Errorf("expected Windows updates to be installed, got %q", updates)
+	}
+	if caCerts != "ca-certs" || caRegistries != "registry.example.com:5000,gcr.io" {
+		t.Errorf("expected the trusted CA certificates in metadata, got %q for %q", caCerts, caRegistries)
+	}
+	if packages != "choco:git,winget:Microsoft.DotNet.SDK.8@8.0.100" {
+		t.Errorf("expected the packages to install in metadata, got %q", packages)
+	}
+	if *s.Password != fake.Password {
+		t.Errorf("expected password to be reset to %q, got %q", fake.Password, *s.Password)
+	}
+	if *s.Hostname != inst.NetworkInterfaces[0].AccessConfigs[0].NatIP {
+		t.Errorf("expected hostname to be the external IP, got %q", *s.Hostname)
+	}
+}
+
+func TestNewServer_clientCert(t *testing.T) {
+	project, zone, prefix, labels := "test-project", "us-central1-f", "windows-builder-", ""
+	network, subnet, region, networkProject := "default", "default", "us-central1", ""
+	version, image := "ltsc2019", "windows-cloud/global/images/family/windows-2019-core"
+	machineType, diskType, serviceAccount := "", "pd-ssd", "default"
+
+	c := fake.NewComputeClient(nil)
+	s, err := NewServer(context.Background(), c, &WindowsBuildServerConfig{
+		InstanceNamePrefix: &prefix,
+		ImageVersion:       &version,
+		ImageURL:           &image,
+		Zone:               &zone,
+		NetworkConfig:      NewInstanceNetworkConfig(&project, &network, &networkProject, &subnet, &region),
+		Labels:             &labels,
+		MachineType:        &machineType,
+		BootDiskType:       &diskType,
+		ServiceAccount:     &serviceAccount,
+		ExternalNAT:        true,
+		WinRMClientCert:    []byte("client-cert"),
+		WinRMClientKey:     []byte("client-key"),
+		WinRMTLS:           WinRMTLS{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+	}, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := c.Instances[s.GetInstanceName()]
+	var clientCert, minTLSVersion, cipherSuites string
+	for _, item := range inst.Metadata.Items {
+		switch item.Key {
+		case "winrm-client-cert":
+			clientCert = *item.Value
+		case "winrm-min-tls-version":
+			minTLSVersion = *item.Value
+		case "winrm-cipher-suites":
+			cipherSuites = *item.Value
+		case "windows-keys":
+			t.Errorf("expected the password not to be reset")
+		}
+	}
+	if clientCert != "client-cert" {
+		t.Errorf("expected the client certificate in metadata, got %q", clientCert)
+	}
+	if minTLSVersion != "1.2" || cipherSuites != "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+		t.Errorf("expected the TLS configuration in metadata, got %q, %q", minTLSVersion, cipherSuites)
+	}
+	if *s.Username != "builder" || *s.Password != "" || string(s.ClientKey) != "client-key" {
+		t.Errorf("expected the builder user to authenticate with the client key, got %q, %q, %q", *s.Username, *s.Password, s.ClientKey)
+	}
+}
+
+func TestGetScheduling(t *testing.T) {
+	automaticRestart := true
+	bs := &WindowsBuildServerConfig{
+		AutomaticRestart:  &automaticRestart,
+		OnHostMaintenance: "MIGRATE",
+		ProvisioningModel: "STANDARD",
+	}
+	if s := bs.getScheduling(); !*s.AutomaticRestart || s.OnHostMaintenance != "MIGRATE" || s.Preemptible {
+		t.Errorf("unexpected standard scheduling %+v", s)
+	}
+
+	bs.ProvisioningModel = "PREEMPTIBLE"
+	if s := bs.getScheduling(); *s.AutomaticRestart || s.OnHostMaintenance != "TERMINATE" || !s.Preemptible {
+		t.Errorf("unexpected preemptible scheduling %+v", s)
+	}
+}
+
+func TestResourcePolicyUrl(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{"compact", "https://www.googleapis.com/compute/v1/projects/test-project/regions/us-central1/resourcePolicies/compact"},
+		{"projects/other/regions/us-east1/resourcePolicies/spread", "https://www.googleapis.com/compute/v1/projects/other/regions/us-east1/resourcePolicies/spread"},
+	} {
+		if got, err := resourcePolicyUrl("test-project", "us-central1-f", tc.policy); err != nil || got != tc.want {
+			t.Errorf("resourcePolicyUrl(%q) = %q, %v, want %q", tc.policy, got, err, tc.want)
+		}
+	}
+
+	for _, zone := range []string{"uscentral1", "-f", ""} {
+		if _, err := resourcePolicyUrl("test-project", zone, "compact"); err == nil {
+			t.Errorf("expected resourcePolicyUrl to fail for zone %q", zone)
+		}
+	}
+}
+
+func TestInstanceName(t *testing.T) {
+	prefix, version := "windows-builder-", "20H2"
+	for _, tc := range []struct {
+		template, buildID, expected, stablePrefix string
+	}{
+		{"", "1b2c3d4e-aaaa-bbbb-cccc-dddddddddddd", `^windows-builder-20h2-1b2c3d4e-[0-9a-f]{8}$`, "windows-builder-20h2-"},
+		{"", "", `^windows-builder-20h2-[0-9a-f]{8}$`, "windows-builder-20h2-"},
+		{"{prefix}{uuid}", "", `^windows-builder-[0-9a-f-]{36}$`, "windows-builder-"},
+		{"ci-{buildid}-{version}", "Build_42", `^ci-build-42-20h2$`, "ci-"},
+	} {
+		bs := &WindowsBuildServerConfig{InstanceNamePrefix: &prefix, ImageVersion: &version, InstanceNameTemplate: tc.template, BuildID: tc.buildID}
+		name, err := bs.instanceName()
+		if err != nil {
+			t.Fatalf("instanceName of template %q failed: %v", tc.template, err)
+		}
+		if !regexp.MustCompile(tc.expected).MatchString(name) {
+			t.Errorf("instanceName of template %q = %q, expected to match %s", tc.template, name, tc.expected)
+		}
+		if actual := bs.instanceNameStablePrefix(); actual != tc.stablePrefix || !strings.HasPrefix(name, actual) {
+			t.Errorf("instanceNameStablePrefix of template %q = %q, expected %q", tc.template, actual, tc.stablePrefix)
+		}
+	}
+
+	bs := &WindowsBuildServerConfig{InstanceNamePrefix: &prefix, ImageVersion: &version, InstanceNameTemplate: "{uuid}-{uuid}"}
+	if name, err := bs.instanceName(); err == nil {
+		t.Errorf("expected the too long name %q to be rejected", name)
+	}
+}
+
+func TestFindExistingInstance_legacyNames(t *testing.T) {
+	project, zone, prefix, labels := "test-project", "us-central1-f", "windows-builder-", ""
+	network, subnet, region, networkProject := "default", "default", "us-central1", ""
+	version, image := "ltsc2019", "windows-cloud/global/images/family/windows-2019-core"
+	machineType, diskType, serviceAccount := "", "pd-ssd", "default"
+	config := func(template string) *WindowsBuildServerConfig {
+		return &WindowsBuildServerConfig{
+			InstanceNamePrefix:   &prefix,
+			InstanceNameTemplate: template,
+			ImageVersion:         &version,
+			ImageURL:             &image,
+			Zone:                 &zone,
+			NetworkConfig:        NewInstanceNetworkConfig(&project, &network, &networkProject, &subnet, &region),
+			Labels:               &labels,
+			MachineType:          &machineType,
+			BootDiskType:         &diskType,
+			BootDiskSizeGB:       100,
+			ServiceAccount:       &serviceAccount,
+			ExternalNAT:          true,
+			ReuseInstance:        true,
+		}
+	}
+
+	c := fake.NewComputeClient(nil)
+	if _, err := NewServer(context.Background(), c, config("{prefix}custom-{rand}"), project); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := FindExistingInstance(context.Background(), c, config(""), project); err != nil || s != nil {
+		t.Fatalf("expected an instance of another template not to be reused, got %v, %v", s, err)
+	}
+	legacy, err := NewServer(context.Background(), c, config("{prefix}{uuid}"), project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := FindExistingInstance(context.Background(), c, config(""), project)
+	if err != nil || s == nil || s.GetInstanceName() != legacy.GetInstanceName() {
+		t.Fatalf("expected the {prefix}{uuid} instance %s to be reused with the default template, got %v, %v", legacy.GetInstanceName(), s, err)
+	}
+	if s, err := FindExistingInstance(context.Background(), c, config("{prefix}{version}-{rand}"), project); err != nil || s != nil {
+		t.Errorf("expected the {prefix}{uuid} instance to be reused with the default template only, got %v, %v", s, err)
+	}
+}
+
+func TestFindExistingInstance_legacyLabel(t *testing.T) {
+	project, zone, prefix, labels := "test-project", "us-central1-f", "windows-builder-", ""
+	network, subnet, region, networkProject := "default", "default", "us-central1", ""
+	version, image := "ltsc2019", "windows-cloud/global/images/family/windows-2019-core"
+	networkConfig := NewInstanceNetworkConfig(&project, &network, &networkProject, &subnet, &region)
+	bs := &WindowsBuildServerConfig{
+		InstanceNamePrefix: &prefix,
+		ImageVersion:       &version,
+		ImageURL:           &image,
+		Zone:               &zone,
+		NetworkConfig:      networkConfig,
+		Labels:             &labels,
+		ReuseInstance:      true,
+	}
+
+	// Instances of earlier releases are named {prefix}{uuid} and labeled
+	// builder_version when reusable.
+	c := fake.NewComputeClient(nil)
+	for name, v := range map[string]string{
+		"windows-builder-0b6a8f6e-4d2c-4f7e-9b1a-2c3d4e5f6a7b": "ltsc2019",
+		"windows-builder-1c7b9a7f-5e3d-4a8f-8c2b-3d4e5f6a7b8c": "ltsc2022",
+	} {
+		c.Instances[name] = &compute.Instance{
+			Name:   name,
+			Status: "RUNNING",
+			Labels: map[string]string{"builder_version": v},
+			NetworkInterfaces: []*compute.NetworkInterface{{
+				Network:    ProjectNetworkUrl(networkConfig),
+				Subnetwork: InstanceSubnetworkUrl(networkConfig),
+			}},
+		}
+	}
+
+	s, err := NewGCEProvider(c, project).FindExisting(context.Background(), bs)
+	if err != nil || s == nil || s.GetInstanceName() != "windows-builder-0b6a8f6e-4d2c-4f7e-9b1a-2c3d4e5f6a7b" {
+		t.Fatalf("expected the ltsc2019 instance of an earlier release to be reused, got %v, %v", s, err)
+	}
+}
+
+// failedOperationCompute completes every operation with a quota error.
+type failedOperationCompute struct {
+	*fake.ComputeClient
+}
+
+func (c failedOperationCompute) GetZoneOperation(projectID string, zone string, name string) (*compute.Operation, error) {
+	return &compute.Operation{Name: name, Status: "DONE", Error: &compute.OperationError{
+		Errors: []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED", Message: "Quota 'CPUS' exceeded"}},
+	}}, nil
+}
+
+func TestWaitForComputeOperation_errors(t *testing.T) {
+	s := &Server{projectID: "test-project", zone: "us-central1-f", compute: failedOperationCompute{fake.NewComputeClient(nil)}}
+	err := s.waitForComputeOperation(&compute.Operation{Name: "operation-1"})
+	if err == nil || !strings.Contains(err.Error(), "QUOTA_EXCEEDED") || !strings.Contains(err.Error(), "Quota 'CPUS' exceeded") {
+		t.Errorf("expected the operation errors in the returned error, got %v", err)
+	}
+}
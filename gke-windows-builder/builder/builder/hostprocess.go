@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/masterzen/winrm"
+)
+
+// HostProcessAnnotation is set to "true" on the images validated as
+// HostProcess container images, as a label of the single-arch images and an
+// annotation of the OCI image index.
+const HostProcessAnnotation = "com.google.gke-windows-builder.hostprocess"
+
+// DefaultHostProcessBaseImage is the base image of HostProcess container
+// images, which holds no Windows files as HostProcess containers run on the
+// host.
+const DefaultHostProcessBaseImage = "mcr.microsoft.com/oss/kubernetes/windows-host-process-containers-base-image:v1.0.0"
+
+// Check that the image of version ver built on r follows the HostProcess
+// conventions: built FROM the HostProcess base image, with an entrypoint
+// that doesn't point to the host file system, and no USER nor VOLUME.
+func (o *Orchestrator) validateHostProcessImage(r *RemoteWindowsServer, ver string) error {
+	base := o.HostProcessBaseImage
+	if base == "" {
+		base = DefaultHostProcessBaseImage
+	}
+	if o.BaseImageMirror != "" && strings.HasPrefix(base, "mcr.microsoft.com/") {
+		base = strings.TrimSuffix(o.BaseImageMirror, "/") + strings.TrimPrefix(base, "mcr.microsoft.com")
+	}
+	validateScript := fmt.Sprintf(`
+$ErrorActionPreference = "Stop"
+$base = '%s'
+docker image inspect $base *> $null
+if ($LASTEXITCODE -ne 0) {
+	docker pull $base
+	if ($LASTEXITCODE -ne 0) {
+		throw "docker pull $base failed with exit code $LASTEXITCODE"
+	}
+}
+$image = (docker image inspect '%s' | Out-String | ConvertFrom-Json)[0]
+$baseImage = (docker image inspect $base | Out-String | ConvertFrom-Json)[0]
+$problems = @()
+if ($image.RootFS.Layers[0] -ne $baseImage.RootFS.Layers[0]) {
+	$problems += "it is not built FROM $base, HostProcess containers run on the host and need no Windows base image"
+}
+$entrypoint = @($image.Config.Entrypoint) + @($image.Config.Cmd) | Where-Object { $_ }
+if (-not $entrypoint) {
+	$problems += "it has no ENTRYPOINT nor CMD"
+}
+foreach ($arg in $entrypoint) {
+	if ($arg -match '(^|\s)[A-Za-z]:\\(?!hpc\\)') {
+		$problems += "ENTRYPOINT or CMD '$arg' is an absolute path of the host, " + 'use a path relative to the container or under $env:CONTAINER_SANDBOX_MOUNT_POINT'
+	}
+}
+if ($image.Config.User) {
+	$problems += "USER $($image.Config.User) is ignored, the user of HostProcess containers is the runAsUserName of the pod"
+}
+if ($image.Config.Volumes) {
+	$problems += "VOLUME is not supported by HostProcess containers"
+}
+if ($problems) {
+	throw ("The image is not a HostProcess container image:" + [Environment]::NewLine + ($problems -join [Environment]::NewLine))
+}
+Write-Host "The image is a HostProcess container image"
+`, base, fmt.Sprint(o.ContainerImageName, "_", ver))
+
+	log.Printf("Validating the image of %s as a HostProcess container image", ver)
+	return r.RunCommand(winrm.Powershell(validateScript), *r.WorkspaceFolder, o.CommandTimeout)
+}
+
+// Push the image of version ver built on r, left unpushed by the build script
+// until it is validated.
+func (o *Orchestrator) pushImage(r *RemoteWindowsServer, ver string) error {
+	image, err := ParseImageReference(o.ContainerImageName)
+	if err != nil {
+		return err
+	}
+	pushScript := fmt.Sprintf(`
+$ErrorActionPreference = "Stop"
+%s
+docker push %s
+if ($LASTEXITCODE -ne 0) {
+	throw "docker push failed with exit code $LASTEXITCODE"
+}
+`, registryLogin(r, image.Registry), fmt.Sprint(o.ContainerImageName, "_", ver))
+
+	log.Printf("Pushing the image of %s", ver)
+	return r.RunCommand(winrm.Powershell(pushScript), *r.WorkspaceFolder, o.CommandTimeout)
+}
@@ -0,0 +1,392 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	artifactregistry "google.golang.org/api/artifactregistry/v1beta2"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	compute "google.golang.org/api/compute/v1"
+	iam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	storagev1 "google.golang.org/api/storage/v1"
+)
+
+// IAMClient tests the IAM permissions of one identity with testIamPermissions.
+// The Test methods return the subset of permissions the identity has.
+type IAMClient interface {
+	TestProjectPermissions(ctx context.Context, projectID string, permissions []string) ([]string, error)
+	TestBucketPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error)
+	// TestRepositoryPermissions tests the permissions on an Artifact Registry
+	// repository, projects/PROJECT/locations/LOCATION/repositories/REPOSITORY.
+	TestRepositoryPermissions(ctx context.Context, repository string, permissions []string) ([]string, error)
+	// TestServiceAccountPermissions tests the permissions on a service
+	// account, projects/PROJECT/serviceAccounts/EMAIL.
+	TestServiceAccountPermissions(ctx context.Context, serviceAccount string, permissions []string) ([]string, error)
+	// TestSubnetworkPermissions tests the permissions on a subnetwork,
+	// projects/PROJECT/regions/REGION/subnetworks/NAME.
+	TestSubnetworkPermissions(ctx context.Context, subnetwork string, permissions []string) ([]string, error)
+	GetProjectNumber(ctx context.Context, projectID string) (int64, error)
+}
+
+// gcpIAMClient implements IAMClient with the Cloud Resource Manager, Cloud
+// Storage, Artifact Registry, IAM and Compute Engine APIs.
+type gcpIAMClient struct {
+	projects        *cloudresourcemanager.Service
+	buckets         *storagev1.Service
+	repositories    *artifactregistry.Service
+	serviceAccounts *iam.Service
+	subnetworks     *compute.Service
+}
+
+// NewIAMClient creates an IAMClient testing the permissions of the
+// application default credentials or, if serviceAccount is not empty, of
+// serviceAccount impersonated by them.
+func NewIAMClient(ctx context.Context, serviceAccount string) (IAMClient, error) {
+	var opts []option.ClientOption
+	if serviceAccount != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: serviceAccount,
+			Scopes:          []string{cloudresourcemanager.CloudPlatformScope},
+		})
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	}
+	projects, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := storagev1.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	repositories, err := artifactregistry.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	serviceAccounts, err := iam.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	subnetworks, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpIAMClient{
+		projects:        projects,
+		buckets:         buckets,
+		repositories:    repositories,
+		serviceAccounts: serviceAccounts,
+		subnetworks:     subnetworks,
+	}, nil
+}
+
+func (c *gcpIAMClient) TestProjectPermissions(ctx context.Context, projectID string, permissions []string) ([]string, error) {
+	resp, err := c.projects.Projects.TestIamPermissions(projectID, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+func (c *gcpIAMClient) TestBucketPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error) {
+	resp, err := c.buckets.Buckets.TestIamPermissions(bucket, permissions).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+func (c *gcpIAMClient) TestRepositoryPermissions(ctx context.Context, repository string, permissions []string) ([]string, error) {
+	resp, err := c.repositories.Projects.Locations.Repositories.TestIamPermissions(repository, &artifactregistry.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+func (c *gcpIAMClient) TestServiceAccountPermissions(ctx context.Context, serviceAccount string, permissions []string) ([]string, error) {
+	resp, err := c.serviceAccounts.Projects.ServiceAccounts.TestIamPermissions(serviceAccount, &iam.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+func (c *gcpIAMClient) TestSubnetworkPermissions(ctx context.Context, subnetwork string, permissions []string) ([]string, error) {
+	parts := strings.Split(subnetwork, "/")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("Invalid subnetwork %q", subnetwork)
+	}
+	resp, err := c.subnetworks.Subnetworks.TestIamPermissions(parts[1], parts[3], parts[5], &compute.TestPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+func (c *gcpIAMClient) GetProjectNumber(ctx context.Context, projectID string) (int64, error) {
+	project, err := c.projects.Projects.Get(projectID).Context(ctx).Do()
+	if err != nil {
+		return 0, err
+	}
+	return project.ProjectNumber, nil
+}
+
+// IAMRequirements lists the IAM permissions an identity needs, by resource.
+type IAMRequirements struct {
+	Projects     map[string][]string
+	Buckets      map[string][]string
+	Repositories map[string][]string
+	// ServiceAccounts are keyed by projects/PROJECT/serviceAccounts/EMAIL,
+	// where EMAIL is default for the Compute Engine default service account
+	// of PROJECT.
+	ServiceAccounts map[string][]string
+	Subnetworks     map[string][]string
+}
+
+func newIAMRequirements() *IAMRequirements {
+	return &IAMRequirements{
+		Projects:        map[string][]string{},
+		Buckets:         map[string][]string{},
+		Repositories:    map[string][]string{},
+		ServiceAccounts: map[string][]string{},
+		Subnetworks:     map[string][]string{},
+	}
+}
+
+// addBucket adds permissions on bucket, or on projectID when the bucket
+// doesn't exist yet and can't be tested.
+func (r *IAMRequirements) addBucket(bucket string, exists bool, projectID string, permissions ...string) {
+	if exists {
+		r.Buckets[bucket] = append(r.Buckets[bucket], permissions...)
+	} else {
+		r.Projects[projectID] = append(r.Projects[projectID], permissions...)
+	}
+}
+
+// Artifact Registry hosts, LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE.
+var artifactRegistryImageRE = regexp.MustCompile(`^([a-z0-9-]+)-docker\.pkg\.dev/([^/]+)/([^/:@]+)/`)
+
+// artifactRegistryRepository returns the Artifact Registry repository
+// resource name of image, or "" if image is not in Artifact Registry.
+func artifactRegistryRepository(image string) string {
+	m := artifactRegistryImageRE.FindStringSubmatch(image)
+	if m == nil {
+		return ""
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/repositories/%s", m[2], m[1], m[3])
+}
+
+// RequiredPermissions returns the permissions the build needs, for the
+// identity running the builder and for the service account of the
+// instances. bucketExists tells whether the workspace bucket exists already.
+// Only the permissions on the project, buckets and Artifact Registry
+// repositories are listed.
+func (o *Orchestrator) RequiredPermissions(bucketExists bool) (builder *IAMRequirements, instances *IAMRequirements) {
+	builder, instances = newIAMRequirements(), newIAMRequirements()
+
+	// Only the projects of versions building on new or reused instances,
+	// rather than remote hosts or use-instance ones, need to create them.
+	instanceProjects := map[string]bool{}
+	for ver := range o.Versions {
+		if _, ok := o.RemoteHosts[ver]; !ok && len(o.UseInstances[ver]) == 0 {
+			instanceProjects[o.workerProject(ver)] = true
+		}
+	}
+	for project := range instanceProjects {
+		o.addInstancePermissions(builder, project)
+	}
+
+	if !bucketExists {
+		builder.Projects[o.ProjectID] = append(builder.Projects[o.ProjectID], "storage.buckets.create")
+	}
+	builder.addBucket(o.WorkspaceBucket, bucketExists, o.ProjectID, "storage.objects.create", "storage.objects.delete")
+	instances.addBucket(o.WorkspaceBucket, bucketExists, o.ProjectID, "storage.objects.get")
+	if o.TarballDir != "" {
+		builder.addBucket(o.WorkspaceBucket, bucketExists, o.ProjectID, "storage.objects.get")
+		instances.addBucket(o.WorkspaceBucket, bucketExists, o.ProjectID, "storage.objects.create")
+	}
+	if o.ExportTo != "" {
+		if bucket, _, err := ParseGCSURL(o.ExportTo); err == nil {
+			instances.Buckets[bucket] = append(instances.Buckets[bucket], "storage.objects.create")
+			builder.Buckets[bucket] = append(builder.Buckets[bucket], "storage.objects.create")
+		}
+	}
+	if o.BaseImageTarball != "" {
+		if bucket, _, err := ParseGCSURL(o.BaseImageTarball); err == nil {
+			instances.Buckets[bucket] = append(instances.Buckets[bucket], "storage.objects.get")
+		}
+	}
+
+	if repository := artifactRegistryRepository(o.ContainerImageName); repository != "" && !o.SkipPush {
+		push := []string{"artifactregistry.repositories.downloadArtifacts", "artifactregistry.repositories.uploadArtifacts"}
+		instances.Repositories[repository] = push
+		if o.ManifestMediaType == "oci" {
+			builder.Repositories[repository] = push
+		}
+	}
+	return builder, instances
+}
+
+// Add the permissions needed to create the instances in project to builder.
+// The network is the one of project unless it is a Shared VPC. Acting as the
+// service account and using the subnetwork are tested on them, since they are
+// often granted there rather than on the project.
+func (o *Orchestrator) addInstancePermissions(builder *IAMRequirements, project string) {
+	bs := &o.ServerConfig
+	builder.Projects[project] = append(builder.Projects[project],
+		"compute.instances.create",
+		"compute.instances.delete",
+		"compute.instances.get",
+		"compute.instances.list",
+		"compute.instances.getSerialPortOutput",
+		"compute.instances.setMetadata",
+		"compute.instances.setServiceAccount",
+		"compute.instances.setLabels",
+		"compute.disks.create",
+		"compute.zoneOperations.get",
+	)
+	serviceAccount := "projects/" + project + "/serviceAccounts/default"
+	if email := bs.GetServiceAccountEmail(project); email != "default" {
+		serviceAccount = "projects/-/serviceAccounts/" + email
+	}
+	builder.ServiceAccounts[serviceAccount] = append(builder.ServiceAccounts[serviceAccount], "iam.serviceAccounts.actAs")
+
+	subnetProject := project
+	nc := bs.NetworkConfig
+	if nc != nil && nc.NetworkProject != nil && *nc.NetworkProject != "" && *nc.NetworkProject != o.ProjectID {
+		subnetProject = *nc.NetworkProject
+	}
+	subnetPermissions := []string{"compute.subnetworks.use"}
+	if bs.ExternalNAT {
+		subnetPermissions = append(subnetPermissions, "compute.subnetworks.useExternalIp")
+	}
+	if nc != nil && nc.Subnet != nil && *nc.Subnet != "" && nc.Region != nil && *nc.Region != "" {
+		subnetwork := fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", subnetProject, *nc.Region, *nc.Subnet)
+		builder.Subnetworks[subnetwork] = append(builder.Subnetworks[subnetwork], subnetPermissions...)
+	} else {
+		builder.Projects[subnetProject] = append(builder.Projects[subnetProject], subnetPermissions...)
+	}
+	if bs.StopInstances {
+		builder.Projects[project] = append(builder.Projects[project], "compute.instances.start", "compute.instances.stop")
+	}
+	if bs.SuspendInstances {
+		builder.Projects[project] = append(builder.Projects[project], "compute.instances.suspend", "compute.instances.resume")
+	}
+	if bs.DockerCacheSnapshots {
+		builder.Projects[project] = append(builder.Projects[project],
+			"compute.disks.createSnapshot",
+			"compute.snapshots.create",
+			"compute.snapshots.delete",
+			"compute.snapshots.list",
+			"compute.snapshots.useReadOnly",
+		)
+	}
+}
+
+// CheckIAMPermissions tests the permissions of req with c and returns the
+// missing ones, each followed by the resource it is missing on, sorted.
+func CheckIAMPermissions(ctx context.Context, c IAMClient, req *IAMRequirements) ([]string, error) {
+	var missing []string
+	check := func(kind string, resource string, permissions []string, test func(context.Context, string, []string) ([]string, error)) error {
+		permissions = uniqueSorted(permissions)
+		granted, err := test(ctx, resource, permissions)
+		if err != nil {
+			return fmt.Errorf("Failed to test the permissions on %s %s: %+v", kind, resource, err)
+		}
+		has := map[string]bool{}
+		for _, p := range granted {
+			has[p] = true
+		}
+		for _, p := range permissions {
+			if !has[p] {
+				missing = append(missing, fmt.Sprintf("%s on %s %s", p, kind, resource))
+			}
+		}
+		return nil
+	}
+	for project, permissions := range req.Projects {
+		if err := check("project", project, permissions, c.TestProjectPermissions); err != nil {
+			return nil, err
+		}
+	}
+	for bucket, permissions := range req.Buckets {
+		if err := check("bucket", bucket, permissions, c.TestBucketPermissions); err != nil {
+			return nil, err
+		}
+	}
+	for repository, permissions := range req.Repositories {
+		if err := check("repository", repository, permissions, c.TestRepositoryPermissions); err != nil {
+			return nil, err
+		}
+	}
+	for serviceAccount, permissions := range req.ServiceAccounts {
+		if parts := strings.Split(serviceAccount, "/"); len(parts) == 4 && parts[3] == "default" {
+			email, err := DefaultServiceAccountEmail(ctx, c, parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get the default service account of project %s: %+v", parts[1], err)
+			}
+			serviceAccount = "projects/-/serviceAccounts/" + email
+		}
+		if err := check("service account", serviceAccount, permissions, c.TestServiceAccountPermissions); err != nil {
+			return nil, err
+		}
+	}
+	for subnetwork, permissions := range req.Subnetworks {
+		if err := check("subnetwork", subnetwork, permissions, c.TestSubnetworkPermissions); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// DefaultServiceAccountEmail returns the email of the Compute Engine default
+// service account of the project.
+func DefaultServiceAccountEmail(ctx context.Context, c IAMClient, projectID string) (string, error) {
+	number, err := c.GetProjectNumber(ctx, projectID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-compute@developer.gserviceaccount.com", number), nil
+}
+
+func uniqueSorted(values []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// FormatMissingPermissions formats the missing permissions of identity, one
+// per line.
+func FormatMissingPermissions(identity string, missing []string) string {
+	return fmt.Sprintf("%s is missing %d permissions:\n  %s", identity, len(missing), strings.Join(missing, "\n  "))
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// testIAMClient grants all the permissions except those in denied, by resource.
+type testIAMClient struct {
+	denied map[string][]string
+}
+
+func (c *testIAMClient) test(resource string, permissions []string) ([]string, error) {
+	var granted []string
+	for _, p := range permissions {
+		denied := false
+		for _, d := range c.denied[resource] {
+			denied = denied || d == p
+		}
+		if !denied {
+			granted = append(granted, p)
+		}
+	}
+	return granted, nil
+}
+
+func (c *testIAMClient) TestProjectPermissions(ctx context.Context, projectID string, permissions []string) ([]string, error) {
+	return c.test(projectID, permissions)
+}
+
+func (c *testIAMClient) TestBucketPermissions(ctx context.Context, bucket string, permissions []string) ([]string, error) {
+	return c.test(bucket, permissions)
+}
+
+func (c *testIAMClient) TestRepositoryPermissions(ctx context.Context, repository string, permissions []string) ([]string, error) {
+	return c.test(repository, permissions)
+}
+
+func (c *testIAMClient) TestServiceAccountPermissions(ctx context.Context, serviceAccount string, permissions []string) ([]string, error) {
+	return c.test(serviceAccount, permissions)
+}
+
+func (c *testIAMClient) TestSubnetworkPermissions(ctx context.Context, subnetwork string, permissions []string) ([]string, error) {
+	return c.test(subnetwork, permissions)
+}
+
+func (c *testIAMClient) GetProjectNumber(ctx context.Context, projectID string) (int64, error) {
+	return 123, nil
+}
+
+func TestRequiredPermissions(t *testing.T) {
+	o, _, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ContainerImageName = "us-docker.pkg.dev/test-project/repo/app:v1"
+	o.ExportTo = "gs://exports/app/"
+	o.ServerConfig.StopInstances = true
+
+	builderReq, instancesReq := o.RequiredPermissions(true)
+	if !contains(builderReq.Projects[o.ProjectID], "compute.instances.stop") {
+		t.Errorf("expected the builder to need compute.instances.stop, got %v", builderReq.Projects[o.ProjectID])
+	}
+	if contains(builderReq.Projects[o.ProjectID], "storage.buckets.create") {
+		t.Errorf("expected no storage.buckets.create for an existing bucket")
+	}
+	if contains(builderReq.Projects[o.ProjectID], "iam.serviceAccounts.actAs") || contains(builderReq.Projects[o.ProjectID], "compute.subnetworks.use") {
+		t.Errorf("expected actAs and subnetworks.use to be tested on their resources, got %v", builderReq.Projects[o.ProjectID])
+	}
+	if serviceAccount := "projects/test-project/serviceAccounts/default"; !contains(builderReq.ServiceAccounts[serviceAccount], "iam.serviceAccounts.actAs") {
+		t.Errorf("expected the builder to need iam.serviceAccounts.actAs on %s, got %v", serviceAccount, builderReq.ServiceAccounts)
+	}
+	subnetwork := "projects/test-project/regions/us-central1/subnetworks/default"
+	if !reflect.DeepEqual(builderReq.Subnetworks[subnetwork], []string{"compute.subnetworks.use", "compute.subnetworks.useExternalIp"}) {
+		t.Errorf("expected the builder to need to use %s, got %v", subnetwork, builderReq.Subnetworks)
+	}
+	if !reflect.DeepEqual(instancesReq.Buckets["exports"], []string{"storage.objects.create"}) {
+		t.Errorf("expected the instances to need storage.objects.create on the export bucket, got %v", instancesReq.Buckets)
+	}
+	repository := "projects/test-project/locations/us/repositories/repo"
+	if len(instancesReq.Repositories[repository]) != 2 {
+		t.Errorf("expected the instances to need to push to %s, got %v", repository, instancesReq.Repositories)
+	}
+
+	builderReq, _ = o.RequiredPermissions(false)
+	if !contains(builderReq.Projects[o.ProjectID], "storage.buckets.create") || len(builderReq.Buckets[o.WorkspaceBucket]) != 0 {
+		t.Errorf("expected the workspace bucket permissions to be tested on the project, got %+v", builderReq)
+	}
+
+	o.WorkerProjects = []string{"worker-project"}
+	builderReq, _ = o.RequiredPermissions(true)
+	if !contains(builderReq.Projects["worker-project"], "compute.instances.create") || len(builderReq.Subnetworks["projects/worker-project/regions/us-central1/subnetworks/default"]) == 0 {
+		t.Errorf("expected the instance permissions on the worker project, got %v and %v", builderReq.Projects["worker-project"], builderReq.Subnetworks)
+	}
+	if contains(builderReq.Projects[o.ProjectID], "compute.instances.create") {
+		t.Errorf("expected no instance permissions on the project of the build, got %v", builderReq.Projects[o.ProjectID])
+	}
+
+	o.UseInstances = map[string][]string{"ltsc2019": {"builder-2019"}}
+	builderReq, _ = o.RequiredPermissions(true)
+	if len(builderReq.Projects["worker-project"]) != 0 || len(builderReq.ServiceAccounts) != 0 || len(builderReq.Subnetworks) != 0 {
+		t.Errorf("expected no instance permissions when all the versions use existing instances, got %+v", builderReq)
+	}
+}
+
+func TestCheckIAMPermissions(t *testing.T) {
+	c := &testIAMClient{denied: map[string][]string{
+		"test-project": {"compute.instances.create"},
+		"bucket":       {"storage.objects.get"},
+	}}
+	req := newIAMRequirements()
+	req.Projects["test-project"] = []string{"compute.instances.create", "compute.instances.delete", "compute.instances.create"}
+	req.Buckets["bucket"] = []string{"storage.objects.get", "storage.objects.create"}
+	req.ServiceAccounts["projects/test-project/serviceAccounts/default"] = []string{"iam.serviceAccounts.actAs"}
+	req.Subnetworks["projects/test-project/regions/us-central1/subnetworks/default"] = []string{"compute.subnetworks.use"}
+	c.denied["projects/-/serviceAccounts/123-compute@developer.gserviceaccount.com"] = []string{"iam.serviceAccounts.actAs"}
+
+	missing, err := CheckIAMPermissions(context.Background(), c, req)
+	if err != nil {
+		t.Fatalf("CheckIAMPermissions failed: %v", err)
+	}
+	expected := []string{
+		"compute.instances.create on project test-project",
+		"iam.serviceAccounts.actAs on service account projects/-/serviceAccounts/123-compute@developer.gserviceaccount.com",
+		"storage.objects.get on bucket bucket",
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected missing %v, got %v", expected, missing)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
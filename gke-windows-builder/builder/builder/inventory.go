@@ -0,0 +1,269 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Inventory records the cloud resources a build created or used, for audit
+// and for cleaning them up afterwards. The builder doesn't create firewall
+// rules, it only checks that one allows WinRM.
+type Inventory struct {
+	ProjectID string    `json:"projectId"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+
+	Instances []*InventoryInstance `json:"instances"`
+	Disks     []*InventoryDisk     `json:"disks"`
+	Buckets   []*InventoryBucket   `json:"buckets"`
+	Objects   []*InventoryObject   `json:"objects"`
+	Images    []*InventoryImage    `json:"images"`
+
+	mu sync.Mutex
+}
+
+// InventoryInstance is a GCE instance used by the build.
+type InventoryInstance struct {
+	Name string `json:"name"`
+	// Project is set when the instance is in another project than the
+	// inventory, a worker project.
+	Project string    `json:"project,omitempty"`
+	Zone    string    `json:"zone"`
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	// Reused is set when the instance existed before the build.
+	Reused bool `json:"reused"`
+	// Deleted is set when the build deleted the instance.
+	Deleted bool `json:"deleted"`
+	// Stopped is set when the build stopped or suspended the instance for
+	// later reuse.
+	Stopped bool `json:"stopped,omitempty"`
+}
+
+// InventoryDisk is the boot disk of an instance, deleted with it.
+type InventoryDisk struct {
+	Name       string    `json:"name"`
+	Project    string    `json:"project,omitempty"`
+	Zone       string    `json:"zone"`
+	Instance   string    `json:"instance"`
+	AutoDelete bool      `json:"autoDelete"`
+	Time       time.Time `json:"time"`
+}
+
+// InventoryBucket is a GCS bucket created by the build.
+type InventoryBucket struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// InventoryObject is a GCS object written by the build.
+type InventoryObject struct {
+	Bucket string    `json:"bucket"`
+	Name   string    `json:"name"`
+	Time   time.Time `json:"time"`
+}
+
+// InventoryImage is a container image or manifest pushed by the build.
+type InventoryImage struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// NewInventory returns an empty Inventory of a build starting now.
+func NewInventory(projectID string) *Inventory {
+	return &Inventory{ProjectID: projectID, StartTime: time.Now()}
+}
+
+// AddInstance records an instance of version ver, and its boot disk if the
+// build created it. Nil inventories record nothing, like all methods below.
+func (inv *Inventory) AddInstance(s *Server, ver string, reused bool) {
+	if inv == nil || s == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	now := time.Now()
+	var project string
+	if s.projectID != inv.ProjectID {
+		project = s.projectID
+	}
+	inv.Instances = append(inv.Instances, &InventoryInstance{
+		Name:    s.GetInstanceName(),
+		Project: project,
+		Zone:    s.zone,
+		Version: ver,
+		Time:    now,
+		Reused:  reused,
+	})
+	if reused || s.Instance == nil {
+		return
+	}
+	for _, d := range s.Instance.Disks {
+		if !d.Boot || d.InitializeParams == nil {
+			continue
+		}
+		inv.Disks = append(inv.Disks, &InventoryDisk{
+			Name:       d.InitializeParams.DiskName,
+			Project:    project,
+			Zone:       s.zone,
+			Instance:   s.GetInstanceName(),
+			AutoDelete: d.AutoDelete,
+			Time:       now,
+		})
+	}
+}
+
+// DeleteInstance records that the instance name was deleted.
+func (inv *Inventory) DeleteInstance(name string) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for _, i := range inv.Instances {
+		if i.Name == name {
+			i.Deleted = true
+		}
+	}
+}
+
+// StopInstance records that the instance name was stopped.
+func (inv *Inventory) StopInstance(name string) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for _, i := range inv.Instances {
+		if i.Name == name {
+			i.Stopped = true
+		}
+	}
+}
+
+// AddBucket records a created bucket.
+func (inv *Inventory) AddBucket(name string) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.Buckets = append(inv.Buckets, &InventoryBucket{Name: name, Time: time.Now()})
+}
+
+// AddObject records a written object.
+func (inv *Inventory) AddObject(bucket string, name string) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.Objects = append(inv.Objects, &InventoryObject{Bucket: bucket, Name: name, Time: time.Now()})
+}
+
+// AddImage records a pushed image.
+func (inv *Inventory) AddImage(name string) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.Images = append(inv.Images, &InventoryImage{Name: name, Time: time.Now()})
+}
+
+// Write sets the end time of the build and writes the inventory to path as JSON.
+func (inv *Inventory) Write(path string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.EndTime = time.Now()
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write inventory %s: %+v", path, err)
+	}
+	return nil
+}
+
+// LoadInventory reads an Inventory written by Write.
+func LoadInventory(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inv Inventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("Failed to parse inventory %s: %+v", path, err)
+	}
+	return &inv, nil
+}
+
+// Cleanup deletes the instances and objects of the inventory that are left.
+// Instances reused or stopped by the build are kept unless deleteReused is set. Buckets
+// expire their objects by themselves and pushed images are the build
+// results, so both are kept. With dryRun, it only logs what it would delete.
+func (inv *Inventory) Cleanup(ctx context.Context, c ComputeClient, s StorageClient, deleteReused bool, dryRun bool) error {
+	var failed int
+	for _, i := range inv.Instances {
+		if i.Deleted || ((i.Reused || i.Stopped) && !deleteReused) {
+			continue
+		}
+		log.Printf("Deleting instance %s in %s", i.Name, i.Zone)
+		if dryRun {
+			continue
+		}
+		project := inv.ProjectID
+		if i.Project != "" {
+			project = i.Project
+		}
+		if _, err := c.DeleteInstance(project, i.Zone, i.Name); err != nil && !isNotFoundErr(err) {
+			log.Printf("Error deleting instance %s: %+v", i.Name, err)
+			failed++
+		}
+	}
+	for _, o := range inv.Objects {
+		log.Printf("Deleting object gs://%s/%s", o.Bucket, o.Name)
+		if dryRun {
+			continue
+		}
+		if err := s.DeleteObject(ctx, o.Bucket, o.Name); err != nil && err != storage.ErrObjectNotExist {
+			log.Printf("Error deleting object gs://%s/%s: %+v", o.Bucket, o.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Failed to delete %d resources", failed)
+	}
+	return nil
+}
+
+// Check if the error is a GCE API not found error.
+func isNotFoundErr(err error) bool {
+	var gceAPIErr *googleapi.Error
+	return errors.As(err, &gceAPIErr) && gceAPIErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	o, c, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.ReuseInstance = true
+	o.Inventory = NewInventory(o.ProjectID)
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	inv := o.Inventory
+	if len(inv.Instances) != 1 || inv.Instances[0].Reused || inv.Instances[0].Deleted {
+		t.Fatalf("expected one created instance kept for reuse, got %+v", inv.Instances)
+	}
+	if len(inv.Disks) != 1 || inv.Disks[0].Name != inv.Instances[0].Name+"-pd" {
+		t.Errorf("expected the boot disk of the instance, got %+v", inv.Disks)
+	}
+	if len(inv.Objects) != 1 || inv.Objects[0].Bucket != "test-bucket" {
+		t.Errorf("expected the workspace object, got %+v", inv.Objects)
+	}
+	if len(inv.Images) != 2 {
+		t.Errorf("expected the single-arch image and the manifest, got %+v", inv.Images)
+	}
+
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	if err := inv.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loaded.Cleanup(context.Background(), c, o.Storage, false, false); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if len(c.Instances) != 0 {
+		t.Errorf("expected the created instance to be deleted, %d remaining", len(c.Instances))
+	}
+	if err := loaded.Cleanup(context.Background(), c, o.Storage, false, false); err != nil {
+		t.Errorf("expected a second cleanup to ignore deleted resources, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// junitClassName is the classname of the test cases of the JUnit report.
+const junitClassName = "gke-windows-builder"
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results as a JUnit XML report to path, with a test
+// case per version, for CI systems to show the status of each version, and a
+// manifest test case failed when the multi-arch manifest was not pushed.
+// Versions skipped for an expired GCE image, and the manifest of a build not
+// pushing, are reported as skipped.
+func (res *Results) WriteJUnit(path string) error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	end := res.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	suite := junitTestSuite{
+		Name:      res.Image,
+		Time:      junitSeconds(end.Sub(res.StartTime).Seconds()),
+		Timestamp: res.StartTime.UTC().Format("2006-01-02T15:04:05"),
+	}
+	for _, v := range res.Versions {
+		tc := junitTestCase{Name: v.Version, Classname: junitClassName, Time: junitSeconds(v.Seconds)}
+		switch v.Status {
+		case VersionFailed:
+			message := strings.SplitN(v.Error, "\n", 2)[0]
+			tc.Failure = &junitMessage{Message: message, Text: v.Error}
+			suite.Failures++
+		case VersionSkipped:
+			tc.Skipped = &junitMessage{Message: "The GCE image of the version doesn't exist anymore"}
+			suite.Skipped++
+		}
+		if v.Image != "" {
+			tc.SystemOut = v.Image
+			if v.Previous {
+				tc.SystemOut += " (built by a previous build)"
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	manifest := junitTestCase{Name: "manifest", Classname: junitClassName, Time: junitSeconds(0)}
+	switch {
+	case res.SkipPush:
+		manifest.Skipped = &junitMessage{Message: "The images are not pushed"}
+		suite.Skipped++
+	case !res.ManifestPushed:
+		manifest.Failure = &junitMessage{Message: "The multi-arch manifest was not pushed"}
+		suite.Failures++
+	default:
+		manifest.SystemOut = res.Image
+	}
+	suite.Cases = append(suite.Cases, manifest)
+	suite.Tests = len(suite.Cases)
+	report := junitTestSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write JUnit report %s: %+v", path, err)
+	}
+	return nil
+}
+
+// junitSeconds formats seconds for the time attributes of JUnit reports.
+func junitSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
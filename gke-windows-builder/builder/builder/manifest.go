@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// OCIIndex is an OCI image index.
+// https://github.com/opencontainers/image-spec/blob/main/image-index.md
+type OCIIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []OCIDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// OCIDescriptor references a single-arch manifest from an index.
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// OCIPlatform describes the platform a manifest in an index runs on.
+type OCIPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	OSVersion    string `json:"os.version,omitempty"`
+}
+
+// imageManifest holds the parts of a single-arch manifest needed to find its config.
+type imageManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+// NewOCIIndexDescriptor fetches the single-arch image source and returns a
+// descriptor for it, with the platform read from the image config.
+func NewOCIIndexDescriptor(ctx context.Context, c *RegistryClient, source *ImageReference) (*OCIDescriptor, error) {
+	m, err := c.GetManifest(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if m.MediaType != DockerManifestMediaType && m.MediaType != OCIManifestMediaType {
+		return nil, fmt.Errorf("%s is not a single-arch image, media type: %s", source, m.MediaType)
+	}
+	var im imageManifest
+	if err := json.Unmarshal(m.Body, &im); err != nil {
+		return nil, fmt.Errorf("Failed to decode manifest of %s: %+v", source, err)
+	}
+	configBlob, err := c.GetBlob(ctx, source, im.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var platform OCIPlatform
+	if err := json.Unmarshal(configBlob, &platform); err != nil {
+		return nil, fmt.Errorf("Failed to decode image config of %s: %+v", source, err)
+	}
+	return &OCIDescriptor{
+		MediaType: m.MediaType,
+		Digest:    m.Digest,
+		Size:      int64(len(m.Body)),
+		Platform:  &platform,
+	}, nil
+}
+
+// CreateOCIIndex assembles an OCI image index from the single-arch sources
+// and pushes it as target. Sources that do not exist in the registry are
+// skipped, in line with `docker manifest create`.
+func CreateOCIIndex(ctx context.Context, target string, sources []string, annotations map[string]string) error {
+	return createOCIIndex(ctx, NewRegistryClient(ctx), target, sources, annotations)
+}
+
+func createOCIIndex(ctx context.Context, c *RegistryClient, target string, sources []string, annotations map[string]string) error {
+	targetRef, err := ParseImageReference(target)
+	if err != nil {
+		return err
+	}
+
+	index := OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     OCIIndexMediaType,
+		Annotations:   annotations,
+	}
+	for _, source := range sources {
+		sourceRef, err := ParseImageReference(source)
+		if err != nil {
+			return err
+		}
+		d, err := NewOCIIndexDescriptor(ctx, c, sourceRef)
+		if errors.Is(err, ErrManifestNotFound) {
+			log.Printf("Image %s not found, skipping it in the index", source)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, *d)
+	}
+	if len(index.Manifests) == 0 {
+		return fmt.Errorf("None of the images %v were found, cannot create index %s", sources, target)
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	digest, err := c.PutManifest(ctx, targetRef, OCIIndexMediaType, body)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pushed OCI image index %s@%s with %d manifests", target, digest, len(index.Manifests))
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Layer media types of Windows base images. Foreign (non-distributable)
+// layers are downloaded from their URLs rather than from the registry.
+const (
+	dockerLayerMediaType           = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	dockerForeignLayerMediaType    = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	ociNondistributableLayerPrefix = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+)
+
+// mirrorDescriptor is a descriptor of a manifest, config or layer. Unknown
+// fields of the manifests are kept through the raw JSON maps below.
+type mirrorDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	URLs      []string `json:"urls,omitempty"`
+}
+
+// MirrorImage copies the image or image index source to target and returns
+// the digest of the copy. Foreign layers, like those of older Windows base
+// images, are copied into the target repository as regular layers so that
+// pulling the copy needs no access to the source. This changes the digests
+// of the manifests that have foreign layers.
+func MirrorImage(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference) (string, error) {
+	m, err := c.GetManifest(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	body := m.Body
+	switch m.MediaType {
+	case DockerManifestListMediaType, OCIIndexMediaType:
+		body, err = mirrorIndex(ctx, c, source, target, m.Body)
+	case DockerManifestMediaType, OCIManifestMediaType:
+		body, err = mirrorManifest(ctx, c, source, target, m.Body)
+	default:
+		return "", fmt.Errorf("%s has an unsupported media type: %s", source, m.MediaType)
+	}
+	if err != nil {
+		return "", err
+	}
+	return c.PutManifest(ctx, target, m.MediaType, body)
+}
+
+// mirrorIndex mirrors each manifest of an index by digest and returns the
+// index updated with the digests of the copies.
+func mirrorIndex(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference, body []byte) ([]byte, error) {
+	var index map[string]json.RawMessage
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("Failed to decode index %s: %+v", source, err)
+	}
+	var manifests []map[string]json.RawMessage
+	if err := json.Unmarshal(index["manifests"], &manifests); err != nil {
+		return nil, fmt.Errorf("Failed to decode manifests of index %s: %+v", source, err)
+	}
+	changed := false
+	for _, raw := range manifests {
+		var d mirrorDescriptor
+		if err := unmarshalDescriptor(raw, &d); err != nil {
+			return nil, err
+		}
+		childSource := &ImageReference{Registry: source.Registry, Repository: source.Repository, Digest: d.Digest}
+		childTarget := &ImageReference{Registry: target.Registry, Repository: target.Repository}
+		m, err := c.GetManifest(ctx, childSource)
+		if err != nil {
+			return nil, err
+		}
+		childBody, err := mirrorManifest(ctx, c, childSource, childTarget, m.Body)
+		if err != nil {
+			return nil, err
+		}
+		childTarget.Digest = sha256Digest(childBody)
+		if _, err := c.PutManifest(ctx, childTarget, m.MediaType, childBody); err != nil {
+			return nil, err
+		}
+		if childTarget.Digest == d.Digest {
+			continue
+		}
+		log.Printf("Mirrored %s as %s", childSource, childTarget)
+		changed = true
+		d.Digest = childTarget.Digest
+		d.Size = int64(len(childBody))
+		if err := marshalDescriptor(raw, &d); err != nil {
+			return nil, err
+		}
+	}
+	if !changed {
+		return body, nil
+	}
+	var err error
+	if index["manifests"], err = json.Marshal(manifests); err != nil {
+		return nil, err
+	}
+	return json.Marshal(index)
+}
+
+// mirrorManifest copies the config and layers of a single-arch manifest and
+// returns the manifest updated for the copied foreign layers.
+func mirrorManifest(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference, body []byte) ([]byte, error) {
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("Failed to decode manifest %s: %+v", source, err)
+	}
+	var config mirrorDescriptor
+	if err := json.Unmarshal(manifest["config"], &config); err != nil {
+		return nil, fmt.Errorf("Failed to decode config of manifest %s: %+v", source, err)
+	}
+	if err := mirrorBlob(ctx, c, source, target, &config); err != nil {
+		return nil, err
+	}
+
+	var layers []map[string]json.RawMessage
+	if err := json.Unmarshal(manifest["layers"], &layers); err != nil {
+		return nil, fmt.Errorf("Failed to decode layers of manifest %s: %+v", source, err)
+	}
+	changed := false
+	for _, raw := range layers {
+		var d mirrorDescriptor
+		if err := unmarshalDescriptor(raw, &d); err != nil {
+			return nil, err
+		}
+		if err := mirrorBlob(ctx, c, source, target, &d); err != nil {
+			return nil, err
+		}
+		if !isForeignLayer(d.MediaType) {
+			continue
+		}
+		if d.MediaType == dockerForeignLayerMediaType {
+			d.MediaType = dockerLayerMediaType
+		} else {
+			d.MediaType = strings.Replace(d.MediaType, ".nondistributable", "", 1)
+		}
+		d.URLs = nil
+		delete(raw, "urls")
+		if err := marshalDescriptor(raw, &d); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	if !changed {
+		return body, nil
+	}
+	var err error
+	if manifest["layers"], err = json.Marshal(layers); err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest)
+}
+
+// mirrorBlob copies the blob d to the target repository unless it is
+// already there. Foreign layers are downloaded from their URLs.
+func mirrorBlob(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference, d *mirrorDescriptor) error {
+	exists, err := c.BlobExists(ctx, target, d.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var r io.ReadCloser
+	if isForeignLayer(d.MediaType) && len(d.URLs) > 0 {
+		log.Printf("Copying foreign layer %s from %s", d.Digest, d.URLs[0])
+		r, err = c.openURL(ctx, d.URLs[0])
+	} else {
+		log.Printf("Copying blob %s of %s", d.Digest, source)
+		r, err = c.OpenBlob(ctx, source, d.Digest)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return c.PutBlob(ctx, target, d.Digest, d.Size, r)
+}
+
+func isForeignLayer(mediaType string) bool {
+	return mediaType == dockerForeignLayerMediaType || strings.HasPrefix(mediaType, ociNondistributableLayerPrefix)
+}
+
+// openURL streams a foreign layer, which is served without authentication.
+func (c *RegistryClient) openURL(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to download %s, status: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// unmarshalDescriptor decodes the descriptor fields of raw into d.
+func unmarshalDescriptor(raw map[string]json.RawMessage, d *mirrorDescriptor) error {
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, d)
+}
+
+// marshalDescriptor writes the descriptor fields of d back into raw.
+func marshalDescriptor(raw map[string]json.RawMessage, d *mirrorDescriptor) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		raw[k] = v
+	}
+	return nil
+}
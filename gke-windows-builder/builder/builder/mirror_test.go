@@ -0,0 +1,193 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is an in-memory registry serving the parts of the Docker
+// Registry HTTP API V2 used by RegistryClient, and foreign layers under /foreign/.
+// When token is set, the API requires it as a Bearer token, served by /token.
+type testRegistry struct {
+	mu        sync.Mutex
+	manifests map[string]*RegistryManifest // by repository@reference
+	blobs     map[string][]byte            // by repository@digest
+	foreign   map[string][]byte            // by digest
+	token     string
+	scopes    []string // of the token requests
+}
+
+func newTestRegistry() (*testRegistry, *httptest.Server) {
+	r := &testRegistry{
+		manifests: map[string]*RegistryManifest{},
+		blobs:     map[string][]byte{},
+		foreign:   map[string][]byte{},
+	}
+	return r, httptest.NewTLSServer(r)
+}
+
+func (r *testRegistry) putManifest(repo string, refs []string, mediaType string, body []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest := sha256Digest(body)
+	for _, ref := range append(refs, digest) {
+		r.manifests[repo+"@"+ref] = &RegistryManifest{MediaType: mediaType, Digest: digest, Body: body}
+	}
+	return digest
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/foreign/") {
+		w.Write(r.foreign[strings.TrimPrefix(path, "/foreign/")])
+		return
+	}
+	if path == "/token" {
+		r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+		fmt.Fprintf(w, `{"token": %q}`, r.token)
+		return
+	}
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="test-registry"`, req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		if req.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(req.Body)
+			digest := sha256Digest(body)
+			r.manifests[parts[0]+"@"+parts[1]] = &RegistryManifest{MediaType: req.Header.Get("Content-Type"), Digest: digest, Body: body}
+			r.manifests[parts[0]+"@"+digest] = r.manifests[parts[0]+"@"+parts[1]]
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		m, ok := r.manifests[parts[0]+"@"+parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.MediaType)
+		w.Header().Set("Docker-Content-Digest", m.Digest)
+		w.Write(m.Body)
+	case strings.HasSuffix(path, "/blobs/uploads/") && req.Method == http.MethodPost:
+		w.Header().Set("Location", "/v2/"+path+"upload-1")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(path, "/blobs/uploads/") && req.Method == http.MethodPut:
+		repo := strings.SplitN(path, "/blobs/uploads/", 2)[0]
+		body, _ := ioutil.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if sha256Digest(body) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[repo+"@"+digest] = body
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		b, ok := r.blobs[parts[0]+"@"+parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestMirrorImage(t *testing.T) {
+	reg, s := newTestRegistry()
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "https://")
+	c := &RegistryClient{httpClient: s.Client(), tokens: map[string]string{}}
+
+	config := []byte(`{"architecture":"amd64","os":"windows"}`)
+	base, layer := []byte("base layer"), []byte("update layer")
+	reg.blobs["windows/servercore@"+sha256Digest(config)] = config
+	reg.blobs["windows/servercore@"+sha256Digest(layer)] = layer
+	reg.foreign[sha256Digest(base)] = base
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,
+		"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":%q},
+		"layers":[
+			{"mediaType":%q,"size":%d,"digest":%q,"urls":[%q]},
+			{"mediaType":%q,"size":%d,"digest":%q}
+		]}`,
+		DockerManifestMediaType, len(config), sha256Digest(config),
+		dockerForeignLayerMediaType, len(base), sha256Digest(base), s.URL+"/foreign/"+sha256Digest(base),
+		dockerLayerMediaType, len(layer), sha256Digest(layer))
+	manifestDigest := reg.putManifest("windows/servercore", nil, DockerManifestMediaType, []byte(manifest))
+	list := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[
+		{"mediaType":%q,"size":%d,"digest":%q,"platform":{"architecture":"amd64","os":"windows","os.version":"10.0.20348.1"}}]}`,
+		DockerManifestListMediaType, DockerManifestMediaType, len(manifest), manifestDigest)
+	reg.putManifest("windows/servercore", []string{"ltsc2022"}, DockerManifestListMediaType, []byte(list))
+
+	source := &ImageReference{Registry: host, Repository: "windows/servercore", Tag: "ltsc2022"}
+	target := &ImageReference{Registry: host, Repository: "mirror/windows/servercore", Tag: "ltsc2022"}
+	digest, err := MirrorImage(context.Background(), c, source, target)
+	if err != nil {
+		t.Fatalf("MirrorImage failed: %v", err)
+	}
+
+	copied, err := c.GetManifest(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Digest != digest || copied.MediaType != DockerManifestListMediaType {
+		t.Errorf("unexpected copied index %s %s, expected digest %s", copied.MediaType, copied.Digest, digest)
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(copied.Body, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Platform.OSVersion != "10.0.20348.1" {
+		t.Fatalf("expected the platform to be kept, got %+v", index.Manifests)
+	}
+	if index.Manifests[0].Digest == manifestDigest {
+		t.Errorf("expected the manifest with a foreign layer to get a new digest")
+	}
+
+	child, err := c.GetManifest(context.Background(), &ImageReference{Registry: host, Repository: target.Repository, Digest: index.Manifests[0].Digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Layers []mirrorDescriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(child.Body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].MediaType != dockerLayerMediaType || len(m.Layers[0].URLs) != 0 {
+		t.Errorf("expected the foreign layer to become a regular layer, got %+v", m.Layers[0])
+	}
+	for _, b := range [][]byte{config, base, layer} {
+		if _, ok := reg.blobs["mirror/windows/servercore@"+sha256Digest(b)]; !ok {
+			t.Errorf("expected blob %q to be copied", b)
+		}
+	}
+}
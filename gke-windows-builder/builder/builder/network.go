@@ -15,11 +15,8 @@
 package builder
 
 import (
-	"context"
 	"fmt"
 	"log"
-
-	"google.golang.org/api/compute/v1"
 )
 
 // InstanceNetworkConfig stores configuration information about the network
@@ -86,18 +83,12 @@ func InstanceSubnetworkUrl(netConfig *InstanceNetworkConfig) string {
 // controlling the builder VMs. Returns an error if user action is required to
 // configure the firewall rules, or nil if the firewall rules are set up
 // properly.
-func CheckProjectFirewalls(ctx context.Context, netConfig *InstanceNetworkConfig) error {
-	var err error
-	var gceService *compute.Service
-	if gceService, err = newGCEService(ctx); err != nil {
-		return fmt.Errorf("Failed to start GCE service for setup: %+v", err)
-	}
-
+func CheckProjectFirewalls(c ComputeClient, netConfig *InstanceNetworkConfig) error {
 	networkUrl := ProjectNetworkUrl(netConfig)
 	project := *netConfig.NetworkProject
 
 	log.Printf("Checking WinRM firewall rule is present for project %s, network %s", project, networkUrl)
-	if !winRMIngressIsAllowed(gceService, project, networkUrl) {
+	if !winRMIngressIsAllowed(c, project, networkUrl) {
 		return fmt.Errorf("Project %s does not have a firewall rule to allow WinRM ingress. Please run:\n  gcloud compute firewall-rules create --project=%s allow-winrm-ingress --allow=tcp:5986 --direction=INGRESS --network=%s", project, project, networkUrl)
 	}
 
@@ -106,13 +97,13 @@ func CheckProjectFirewalls(ctx context.Context, netConfig *InstanceNetworkConfig
 
 // Returns true if the network referenced by networkUrl has a firewall rule
 // configured that allows ingress from all source IP addresses on tcp:5986.
-func winRMIngressIsAllowed(service *compute.Service, networkProject string, networkUrl string) bool {
-	firewalls, err := service.Firewalls.List(networkProject).Do()
+func winRMIngressIsAllowed(c ComputeClient, networkProject string, networkUrl string) bool {
+	firewalls, err := c.ListFirewalls(networkProject)
 	if err != nil {
 		log.Printf("firewall list failed: %+v", err)
 		return false
 	}
-	for _, rule := range firewalls.Items {
+	for _, rule := range firewalls {
 		for _, allowed := range rule.Allowed {
 			if rule.Network == networkUrl && rule.Direction == "INGRESS" && allowed.IPProtocol == "tcp" && len(rule.SourceRanges) > 0 && rule.SourceRanges[0] == "0.0.0.0/0" && !rule.Disabled {
 				for _, port := range allowed.Ports {
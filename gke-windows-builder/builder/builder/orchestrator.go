@@ -0,0 +1,886 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gke-windows-builder/builder/builder/archive"
+
+	"github.com/masterzen/winrm"
+	"google.golang.org/api/googleapi"
+)
+
+// Orchestrator brings up a Windows build server per version, builds the
+// single-arch containers on them in parallel and combines the results into a
+// multi-arch container.
+type Orchestrator struct {
+	ProjectID          string
+	ContainerImageName string
+	// Versions maps each Windows version to build to its GCE image family.
+	Versions map[string]string
+	// ManifestVersions are the versions whose single-arch images were pushed
+	// by an earlier build, added to the multi-arch manifest without being
+	// built again.
+	ManifestVersions []string
+	// ServerConfig is the template for each version's build server.
+	// ImageVersion and ImageURL are set per version.
+	ServerConfig  WindowsBuildServerConfig
+	WorkspacePath string
+	// WorkspaceIncludes, when set, are the glob patterns of the paths of the
+	// workspace to copy, e.g. bin/*.exe, instead of all of it. The
+	// Dockerfile and .dockerignore are always copied.
+	WorkspaceIncludes []string
+	// WorkspaceExcludes are local files or directories left out of the
+	// copied workspace, e.g. the results of an earlier build kept in it.
+	WorkspaceExcludes []string
+	// WorkspaceSymlinks is how symlinks of the workspace are copied: skip
+	// (the default), follow or error.
+	WorkspaceSymlinks string
+	// WorkspaceLimits warn about or skip large files of the workspace and
+	// fail the copy of a workspace too large.
+	WorkspaceLimits archive.Limits
+	// LogsDir, when set, gets the full remote output of each version in
+	// build-<version>.log. It is left out of the copied workspace.
+	LogsDir         string
+	WorkspaceBucket string
+	BuildArgs       []string
+	// NoCache and Pull pass --no-cache and --pull to docker build, for clean
+	// rebuilds with refreshed base images.
+	NoCache bool
+	Pull    bool
+	// SkipPush leaves the single-arch images on the build servers instead of
+	// pushing them, and skips the multi-arch manifest, e.g. to only produce
+	// tarballs with TarballDir.
+	SkipPush bool
+	// TarballDir, when set, gets a docker save tarball of the image of each
+	// version, <version>.tar, staged in WorkspaceBucket. It is left out of
+	// the copied workspace.
+	TarballDir string
+	// ExportTo, when set, is a gs://bucket/path/ URL the image of each
+	// version is exported to as <version>.tar, with the docker image inspect
+	// output in <version>.json and an index.json of all versions.
+	ExportTo string
+	// ImageLabels are set with --label on the single-arch images, e.g. the
+	// OCI source revision or licenses.
+	ImageLabels map[string]string
+	// BaseImageMirror, when set, replaces mcr.microsoft.com in the FROM lines
+	// of the Dockerfile on the build servers.
+	BaseImageMirror string
+	// BaseImageTarball, when set, is the gs:// URL of a docker save tarball
+	// of the base images, loaded on the build servers before the build so
+	// they need no access to mcr.microsoft.com. A {version} placeholder is
+	// replaced with the Windows version.
+	BaseImageTarball string
+	// HostProcess validates the single-arch images as HostProcess container
+	// images on the build servers before pushing them, and marks them with
+	// HostProcessAnnotation.
+	HostProcess bool
+	// HostProcessBaseImage is the base image the HostProcess images must be
+	// built FROM, DefaultHostProcessBaseImage when empty.
+	HostProcessBaseImage string
+	// Scripts, when set, override the default PowerShell scripts run on the
+	// build servers, see LoadScripts.
+	Scripts             *Scripts
+	ManifestMediaType   string
+	ManifestAnnotations map[string]string
+	SetupTimeout        time.Duration
+	// ManifestAttemptDelay, when set, is how long the creation of the
+	// multi-arch manifest on a build server runs before it is also attempted
+	// on the next one, the first to succeed cancelling the others. Else the
+	// next server is only tried after an attempt failed.
+	ManifestAttemptDelay time.Duration
+	// ReadyPollInterval and ReadyPollMaxInterval set the backoff of the
+	// readiness checks of the build servers, see RemoteWindowsServer.
+	ReadyPollInterval    time.Duration
+	ReadyPollMaxInterval time.Duration
+	CopyTimeout          time.Duration
+	CommandTimeout       time.Duration
+	// PerVersionTimeout, when set, bounds the build of each version. A version
+	// running late has its remote command aborted and its server released,
+	// the other versions keep building. Run still fails without pushing the
+	// manifest, the version is recorded as failed in Results.
+	PerVersionTimeout time.Duration
+	// RemoteIdleTimeout, when set, aborts the docker build and push of a
+	// version when they write no output for that long, e.g. a hung pull.
+	RemoteIdleTimeout time.Duration
+	// MaxClockSkew, when set, is the largest clock skew of the build servers
+	// to their time source accepted after resyncing them, before any
+	// registry authentication. Remote hosts are not resynced.
+	MaxClockSkew time.Duration
+
+	// StorageLabels are added to the custom metadata of the workspace
+	// objects, next to the build ID, image and Windows version.
+	StorageLabels map[string]string
+
+	// Inventory, when set, records the resources created and used by Run.
+	Inventory *Inventory
+	// Results, when set, records the outcome of each version built by Run.
+	Results *Results
+
+	Compute ComputeClient
+	Storage StorageClient
+	// Provider creates the build machines, a GCEProvider of Compute and
+	// ProjectID is used when nil.
+	Provider Provider
+	// RemoteHosts are the existing Windows hosts that build the versions
+	// they are keyed by, instead of machines of the Provider.
+	RemoteHosts map[string]*RemoteHost
+	// WorkerProjects, when set, are the projects the instances of the
+	// versions are created in instead of ProjectID, assigned round-robin in
+	// the sorted order of the versions, to spread them across the quotas of
+	// the projects. The workspace bucket and the registry stay in ProjectID.
+	WorkerProjects []string
+	// UseInstances are the names of the existing instances that build the
+	// versions, by version, instead of new or reused ones.
+	UseInstances map[string][]string
+	// NewRemoteExecutor creates the executor used to reach a build server.
+	// WinRM is used when nil.
+	NewRemoteExecutor func(r *RemoteWindowsServer) RemoteExecutor
+
+	exportMu sync.Mutex
+	exported []ExportedImage
+}
+
+// NewOrchestrator returns an Orchestrator building image for versions, which
+// map Windows versions to GCE image families, e.g. ltsc2019 to
+// windows-cloud/global/images/family/windows-2019-core, on GCE instances of
+// projectID in zone, with the defaults of the builder flags.
+// The workspace is copied from workspacePath via the {projectID}_builder_tmp
+// bucket, see NewGCSBucketIfNotExists.
+func NewOrchestrator(projectID string, zone string, image string, versions map[string]string, workspacePath string, c ComputeClient, s StorageClient) *Orchestrator {
+	return &Orchestrator{
+		ProjectID:            projectID,
+		ContainerImageName:   image,
+		Versions:             versions,
+		ServerConfig:         NewWindowsBuildServerConfig(projectID, zone),
+		WorkspacePath:        workspacePath,
+		WorkspaceBucket:      projectID + "_builder_tmp",
+		ManifestMediaType:    "docker",
+		SetupTimeout:         20 * time.Minute,
+		ManifestAttemptDelay: 2 * time.Minute,
+		CopyTimeout:          5 * time.Minute,
+		CommandTimeout:       10 * time.Minute,
+		Compute:              c,
+		Storage:              s,
+	}
+}
+
+// builderServerStatus contains builder server and associated error.
+type builderServerStatus struct {
+	s   *Server
+	err error
+}
+
+// Run is the main building process.
+func (o *Orchestrator) Run(ctx context.Context) error {
+	var bss []builderServerStatus
+	o.exported = nil
+	defer func() {
+		o.shutdownBuildServers(bss)
+	}()
+	if o.SkipPush {
+		o.Results.SetSkipPush()
+	}
+
+	if err := o.buildSingleArchContainers(ctx, &bss); err != nil {
+		return err
+	}
+	if o.ExportTo != "" {
+		if err := o.writeExportIndex(ctx); err != nil {
+			return err
+		}
+	}
+	if o.SkipPush {
+		log.Printf("Skipping the multi-arch manifest, no image was pushed")
+		return nil
+	}
+	if err := o.buildMultiArchContainer(ctx, bss); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Bring up Windows Build Servers & build single-arch containers in parallel
+func (o *Orchestrator) buildSingleArchContainers(ctx context.Context, bss *[]builderServerStatus) error {
+	ch := make(chan builderServerStatus, len(o.Versions))
+	wg := sync.WaitGroup{}
+	for ver, imageFamily := range o.Versions {
+		wg.Add(1)
+		go func(ver string, imageFamily string) {
+			defer wg.Done()
+			start := time.Now()
+			status := o.buildSingleArchContainer(ctx, ver, imageFamily)
+			o.recordResult(ver, status, time.Since(start))
+			ch <- status
+		}(ver, imageFamily)
+	}
+	// Wait until all builder server statuses returned.
+	wg.Wait()
+	chLen := len(ch)
+	if chLen != len(o.Versions) {
+		return fmt.Errorf("Unexpected discrepancy happened, the number of builder server statuses in channel is not equal to the number of versions")
+	}
+	for i := 0; i < chLen; i++ {
+		*bss = append(*bss, <-ch)
+	}
+	// If any fatal error happens, exit the process
+	for _, bs := range *bss {
+		if bs.err != nil {
+			return fmt.Errorf("Error happened when building single-arch containers: %+v", bs.err)
+		}
+	}
+	return nil
+}
+
+// Record the outcome of the build of version ver, which took duration, in the
+// results.
+func (o *Orchestrator) recordResult(ver string, status builderServerStatus, duration time.Duration) {
+	image := fmt.Sprint(o.ContainerImageName, "_", ver)
+	switch {
+	case status.err != nil:
+		o.Results.SetVersion(ver, image, VersionFailed, duration, status.err)
+	case status.s == nil:
+		o.Results.SetVersion(ver, image, VersionSkipped, duration, nil)
+	default:
+		o.Results.SetVersion(ver, image, VersionSucceeded, duration, nil)
+	}
+}
+
+// Build multi-arch container on any available server, trying the next one
+// when an attempt fails or runs for longer than ManifestAttemptDelay.
+// If the versions include an obsolete image version, it's still working fine, as `docker manifest create` command is resilient for non-existing containers.
+// E.g. `docker manifest create container container_1909 container_2019` works if container_1909 doesn't exist. The resulting multi-arch container will have the only manifest of container_2019.
+func (o *Orchestrator) buildMultiArchContainer(ctx context.Context, bss []builderServerStatus) error {
+	if o.ManifestMediaType == "oci" {
+		return o.createOCIIndex(ctx)
+	}
+
+	var servers []*RemoteWindowsServer
+	for _, bs := range bss {
+		if bs.s != nil {
+			servers = append(servers, &bs.s.RemoteWindowsServer)
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(servers))
+	var started, running int
+	startNext := func() {
+		r := servers[started]
+		started++
+		running++
+		go func() {
+			err := o.createMultiArchContainerOnRemote(ctx, r)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Error executing createMultiArchContainerOnRemote on instance: %v, with error: %+v", *r.Hostname, err)
+			}
+			errs <- err
+		}()
+	}
+	for started < len(servers) || running > 0 {
+		if running == 0 {
+			startNext()
+			continue
+		}
+		var delay <-chan time.Time
+		var timer *time.Timer
+		if o.ManifestAttemptDelay > 0 && started < len(servers) {
+			timer = time.NewTimer(o.ManifestAttemptDelay)
+			delay = timer.C
+		}
+		var created bool
+		select {
+		case err := <-errs:
+			running--
+			created = err == nil
+			if !created && started < len(servers) {
+				startNext()
+			}
+		case <-delay:
+			log.Printf("The multi-arch manifest is not created after %v, also trying on the next instance", o.ManifestAttemptDelay)
+			startNext()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if created {
+			// Wait for the other attempts to stop before their instances
+			// are shut down.
+			cancel()
+			for ; running > 0; running-- {
+				<-errs
+			}
+			o.Inventory.AddImage(o.ContainerImageName)
+			o.Results.SetManifestPushed()
+			return nil
+		}
+	}
+	return fmt.Errorf("Failed to create the final multi-arch manifest")
+}
+
+// Assemble and push an OCI image index from the single-arch images directly
+// from the builder, no Windows instance is involved.
+func (o *Orchestrator) createOCIIndex(ctx context.Context) error {
+	sources := o.manifestSources()
+	annotations := o.ManifestAnnotations
+	if o.HostProcess {
+		annotations = map[string]string{HostProcessAnnotation: "true"}
+		for k, v := range o.ManifestAnnotations {
+			annotations[k] = v
+		}
+	}
+	if err := CreateOCIIndex(ctx, o.ContainerImageName, sources, annotations); err != nil {
+		return err
+	}
+	o.Inventory.AddImage(o.ContainerImageName)
+	o.Results.SetManifestPushed()
+	return nil
+}
+
+func (o *Orchestrator) shutdownBuildServers(bss []builderServerStatus) {
+	if o.ServerConfig.SuspendInstances {
+		log.Printf("Suspending instances for reuse")
+	} else if o.ServerConfig.StopInstances {
+		log.Printf("Stopping instances for reuse")
+	} else if o.ServerConfig.ReuseInstance {
+		log.Printf("Keeping instances for reuse")
+	} else {
+		log.Printf("Deleting created instances")
+	}
+	wg := sync.WaitGroup{}
+	for _, bsc := range bss {
+		if bsc.s != nil {
+			wg.Add(1)
+			go func(bsc builderServerStatus) {
+				defer wg.Done()
+				o.releaseBuildServer(bsc.s)
+			}(bsc)
+		}
+	}
+	wg.Wait()
+}
+
+// Clean up the workspace of a server kept for reuse or of a remote host, or
+// delete it.
+func (o *Orchestrator) releaseBuildServer(s *Server) {
+	parked := o.ServerConfig.StopInstances || o.ServerConfig.SuspendInstances
+	reused := o.ServerConfig.ReuseInstance || s.Pinned
+	if reused || parked || s.External {
+		if s.WorkspaceFolder != nil {
+			s.RemoteWindowsServer.CleanFolder()
+		}
+	}
+	if s.External || (reused && !parked) {
+		return
+	}
+	if p, ok := s.Provider.(SuspendResumeProvider); ok && o.ServerConfig.SuspendInstances {
+		if err := p.Suspend(context.Background(), s); err == nil {
+			o.Inventory.StopInstance(s.GetInstanceName())
+		}
+		return
+	}
+	if p, ok := s.Provider.(StartStopProvider); ok && o.ServerConfig.StopInstances {
+		if err := p.Stop(context.Background(), s); err == nil {
+			o.Inventory.StopInstance(s.GetInstanceName())
+		}
+		return
+	}
+	if s.Pinned {
+		return
+	}
+	if err := s.Provider.Delete(context.Background(), s); err == nil {
+		o.Inventory.DeleteInstance(s.GetInstanceName())
+	}
+}
+
+// providerFor returns the Provider of the machine that builds version ver.
+func (o *Orchestrator) providerFor(ver string) Provider {
+	if host, ok := o.RemoteHosts[ver]; ok {
+		return &remoteHostProvider{host: host}
+	}
+	if o.Provider != nil {
+		return o.Provider
+	}
+	return NewGCEProvider(o.Compute, o.workerProject(ver))
+}
+
+// workerProject returns the project of the instance that builds version ver.
+func (o *Orchestrator) workerProject(ver string) string {
+	if len(o.WorkerProjects) == 0 {
+		return o.ProjectID
+	}
+	var versions []string
+	for v := range o.Versions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	for i, v := range versions {
+		if v == ver {
+			return o.WorkerProjects[i%len(o.WorkerProjects)]
+		}
+	}
+	return o.WorkerProjects[0]
+}
+
+// Brings up a Windows Server Instance, build single-arch container and return the buider status.
+// If that status's err is nil, the server is still running.
+// If err is non-nil, then the server has been stopped.
+// So please be aware of cleaning up the running instances after calling this function.
+func (o *Orchestrator) buildSingleArchContainer(ctx context.Context, ver string, imageFamily string) builderServerStatus {
+	var s *Server
+	var err error
+	var deadline time.Time
+	if o.PerVersionTimeout > 0 {
+		deadline = time.Now().Add(o.PerVersionTimeout)
+	}
+
+	bsc := o.ServerConfig
+	bsc.ImageVersion = &ver
+	bsc.ImageURL = &imageFamily
+	bsc.UseInstances = o.UseInstances[ver]
+	bsc.Scripts = o.Scripts
+
+	p := o.providerFor(ver)
+	if project := o.workerProject(ver); project != o.ProjectID && o.RemoteHosts[ver] == nil && o.Provider == nil {
+		// Without a Shared VPC, the network is the one of the worker project.
+		if nc := bsc.NetworkConfig; nc != nil && nc.NetworkProject != nil && *nc.NetworkProject == o.ProjectID {
+			netConfig := *nc
+			netConfig.NetworkProject = &project
+			bsc.NetworkConfig = &netConfig
+		}
+		log.Printf("Building Windows %s in project %s", ver, project)
+	}
+	if host, ok := o.RemoteHosts[ver]; ok {
+		log.Printf("Building Windows %s on remote host %s", ver, host.Hostname)
+		s, err = p.Create(ctx, &bsc)
+	} else if len(bsc.UseInstances) > 0 {
+		log.Printf("Looking for one of the instances %s to use", strings.Join(bsc.UseInstances, ", "))
+		if s, err = p.FindExisting(ctx, &bsc); s == nil {
+			if err == nil {
+				err = fmt.Errorf("None of the instances %s was found", strings.Join(bsc.UseInstances, ", "))
+			}
+			return builderServerStatus{nil, err}
+		}
+	} else if bsc.ReuseInstance {
+		log.Printf("Looking for an exiting %s instance to reuse", ver)
+		s, err = p.FindExisting(ctx, &bsc)
+	}
+
+	if s == nil {
+		s, err = p.Create(ctx, &bsc)
+		if err != nil {
+			if isImageNotFoundErr(err, imageFamily) {
+				log.Printf("Failed to create Windows %[1]s instance, it may be expired, so skip it to continue without stamping Windows %[1]s manifest", ver)
+				return builderServerStatus{nil, nil}
+			}
+			return builderServerStatus{nil, err}
+		}
+		o.Inventory.AddInstance(s, ver, false)
+	} else if !s.External {
+		o.Inventory.AddInstance(s, ver, true)
+	}
+	s.Provider = p
+	s.WinRMTLS = bsc.WinRMTLS
+	s.Scripts = o.Scripts
+	if err = connectServer(ctx, p, s); err != nil {
+		return builderServerStatus{s, err}
+	}
+
+	r := &s.RemoteWindowsServer
+	if o.NewRemoteExecutor != nil {
+		r.Executor = o.NewRemoteExecutor(r)
+	}
+	r.Deadline = deadline
+	defer func() { r.Deadline = time.Time{} }()
+	r.ObjectMetadata = o.objectMetadata(ver)
+	if o.LogsDir != "" {
+		f, err := o.createBuildLog(ver)
+		if err != nil {
+			return builderServerStatus{s, err}
+		}
+		defer f.Close()
+		r.Output = f
+		defer func() { r.Output = nil }()
+	}
+
+	r.ReadyPollInterval = o.ReadyPollInterval
+	r.ReadyPollMaxInterval = o.ReadyPollMaxInterval
+	if s.compute != nil && s.Instance != nil {
+		r.InstanceStatus = s.instanceStatus
+	}
+	log.Printf("Waiting for Windows %s instance: %s (%s) to become available", ver, *r.Hostname, s.GetInstanceName())
+	err = r.WaitForServerBeReady(o.SetupTimeout)
+	if err != nil {
+		log.Printf("Error setup Windows %s instance: %s with error: %+v", ver, *r.Hostname, err)
+		return o.checkPerVersionTimeout(s, ver, deadline, err)
+	}
+
+	// Remote hosts keep the time configuration of their owners.
+	if o.MaxClockSkew > 0 && !s.External {
+		if err = r.SyncClock(o.MaxClockSkew); err != nil {
+			log.Printf("Error checking the clock of %v : %+v", *r.Hostname, err)
+			return o.checkPerVersionTimeout(s, ver, deadline, err)
+		}
+	}
+
+	// Remote hosts are set up by their owners.
+	if bsc.DefenderMode == "exclude" && !bsc.SkipDefenderRemoval && !s.External {
+		err = r.ExcludeWorkspaceFromDefender()
+		if err != nil {
+			log.Printf("Error excluding workspace from Windows Defender on %v : %+v", *r.Hostname, err)
+			return o.checkPerVersionTimeout(s, ver, deadline, err)
+		}
+	}
+
+	if o.BaseImageTarball != "" {
+		if s.External {
+			err = fmt.Errorf("Base image tarballs are downloaded with the service account of GCE instances, remote host %s has none", *r.Hostname)
+		} else {
+			err = o.loadBaseImages(r, ver)
+		}
+		if err != nil {
+			log.Printf("Error loading the base images on %v : %+v", *r.Hostname, err)
+			return o.checkPerVersionTimeout(s, ver, deadline, err)
+		}
+	}
+
+	r.WorkspaceBucket = &o.WorkspaceBucket
+	if !s.External {
+		// Remote hosts can't get the access tokens to download from the
+		// bucket, they are copied to over WinRM.
+		r.Storage = o.Storage
+	}
+	r.Inventory = o.Inventory
+	r.WorkspaceExcludes = nil
+	r.WorkspaceIncludes = nil
+	r.WorkspaceSymlinks = o.WorkspaceSymlinks
+	r.WorkspaceLimits = o.WorkspaceLimits
+	if len(o.WorkspaceIncludes) > 0 {
+		r.WorkspaceIncludes = append([]string{"Dockerfile", ".dockerignore"}, o.WorkspaceIncludes...)
+	}
+	for _, dir := range append([]string{o.LogsDir, o.TarballDir}, o.WorkspaceExcludes...) {
+		if dir != "" {
+			r.WorkspaceExcludes = append(r.WorkspaceExcludes, dir)
+		}
+	}
+	// Copy workspace to remote machine
+	log.Printf("Copying local workspace to remote machine: %v", *r.Hostname)
+	err = r.Copy(o.WorkspacePath, o.CopyTimeout)
+	if err != nil {
+		log.Printf("Error copying workspace to %v : %+v", *r.Hostname, err)
+		return o.checkPerVersionTimeout(s, ver, deadline, err)
+	}
+
+	err = o.buildSingleArchContainerOnRemote(r, ver)
+	if err != nil {
+		log.Printf("Error building single arch container on remote %v : %+v", *r.Hostname, err)
+		return o.checkPerVersionTimeout(s, ver, deadline, err)
+	}
+	if o.HostProcess {
+		if err = o.validateHostProcessImage(r, ver); err != nil {
+			log.Printf("Error validating the HostProcess image of %v : %+v", *r.Hostname, err)
+			return o.checkPerVersionTimeout(s, ver, deadline, err)
+		}
+		if !o.SkipPush {
+			if err = o.pushImage(r, ver); err != nil {
+				log.Printf("Error pushing the image of %v : %+v", *r.Hostname, err)
+				return o.checkPerVersionTimeout(s, ver, deadline, err)
+			}
+		}
+	}
+	if !o.SkipPush {
+		o.Inventory.AddImage(fmt.Sprint(o.ContainerImageName, "_", ver))
+	}
+	if o.TarballDir != "" {
+		if err = o.saveImageTarball(ctx, r, ver); err != nil {
+			log.Printf("Error saving the image tarball of %v : %+v", *r.Hostname, err)
+			return o.checkPerVersionTimeout(s, ver, deadline, err)
+		}
+	}
+	if o.ExportTo != "" {
+		if err = o.exportImage(r, ver); err != nil {
+			log.Printf("Error exporting the image of %v : %+v", *r.Hostname, err)
+			return o.checkPerVersionTimeout(s, ver, deadline, err)
+		}
+	}
+	if cp, ok := p.(DockerCacheProvider); ok && bsc.DockerCacheSnapshots && !s.External {
+		o.snapshotDockerCache(ctx, cp, s, &bsc)
+	}
+	return builderServerStatus{s, nil}
+}
+
+// Save the image of version ver built on r to <TarballDir>/<ver>.tar, with
+// docker save on r and through WorkspaceBucket.
+func (o *Orchestrator) saveImageTarball(ctx context.Context, r *RemoteWindowsServer, ver string) error {
+	if r.Storage == nil {
+		return fmt.Errorf("Image tarballs are staged in the workspace bucket, which %s can't upload to", *r.Hostname)
+	}
+	object := fmt.Sprintf("windows-builder-image-%s-%d.tar", ver, time.Now().UnixNano())
+	r.Inventory.AddObject(*r.WorkspaceBucket, object)
+	log.Printf("Saving the image of %s to gs://%s/%s", ver, *r.WorkspaceBucket, object)
+	if err := o.uploadImage(r, ver, *r.WorkspaceBucket, object, ""); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(o.TarballDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(o.TarballDir, ver+".tar")
+	if err := readObjectToFile(ctx, o.Storage, *r.WorkspaceBucket, object, path); err != nil {
+		return err
+	}
+	log.Printf("Saved the image of %s to %s", ver, path)
+	if err := o.Storage.DeleteObject(ctx, *r.WorkspaceBucket, object); err != nil {
+		log.Printf("Could not delete gs://%s/%s: %+v", *r.WorkspaceBucket, object, err)
+	}
+	return nil
+}
+
+// Load the BaseImageTarball of version ver with docker load on r.
+func (o *Orchestrator) loadBaseImages(r *RemoteWindowsServer, ver string) error {
+	tarball := strings.Replace(o.BaseImageTarball, "{version}", ver, -1)
+	bucket, object, err := ParseGCSURL(tarball)
+	if err != nil {
+		return err
+	}
+	object = strings.TrimSuffix(object, "/")
+	if object == "" {
+		return fmt.Errorf("%q names no object", tarball)
+	}
+	loadScript := fmt.Sprintf(`
+$ErrorActionPreference = "Stop"
+$ProgressPreference = 'SilentlyContinue'
+$token = %s
+$file = "$env:TEMP\base-images.tar"
+Invoke-WebRequest -UseBasicParsing -Headers @{Authorization = "Bearer $token"} -Uri '%s' -OutFile $file
+docker load -i $file
+$status = $LASTEXITCODE
+Remove-Item -Path $file -Force
+if ($status -ne 0) {
+	throw "docker load failed with exit code $status"
+}
+`, metadataTokenPS1, objectMediaURL(bucket, object))
+
+	log.Printf("Loading the base images of %s from %s", ver, tarball)
+	return r.RunCommand(winrm.Powershell(loadScript), "C:\\", o.CommandTimeout)
+}
+
+// Upload a docker save tarball of the image of version ver built on r to
+// object of bucket, and the docker image inspect output to inspectObject
+// unless it is empty.
+func (o *Orchestrator) uploadImage(r *RemoteWindowsServer, ver string, bucket string, object string, inspectObject string) error {
+	tag := fmt.Sprint(o.ContainerImageName, "_", ver)
+	inspectScript := ""
+	if inspectObject != "" {
+		inspectScript = fmt.Sprintf(`docker image inspect %s | Set-Content -Path image.json
+Invoke-RestMethod -Method Post -InFile image.json -ContentType 'application/json' -Headers @{Authorization = "Bearer $token"} -Uri '%s'
+Remove-Item -Path image.json -Force`, tag, objectUploadURL(bucket, inspectObject))
+	}
+	uploadScript := fmt.Sprintf(`
+$ErrorActionPreference = "Stop"
+docker save -o image.tar %s
+if ($LASTEXITCODE -ne 0) {
+	throw "docker save failed with exit code $LASTEXITCODE"
+}
+$token = %s
+Invoke-RestMethod -Method Post -InFile image.tar -ContentType 'application/x-tar' -Headers @{Authorization = "Bearer $token"} -Uri '%s'
+Remove-Item -Path image.tar -Force
+%s
+`, tag, metadataTokenPS1, objectUploadURL(bucket, object), inspectScript)
+
+	return r.RunCommand(winrm.Powershell(uploadScript), *r.WorkspaceFolder, o.CommandTimeout)
+}
+
+// Snapshot the docker data of s for the next builds of its version. Failures
+// are only logged, the version was built.
+func (o *Orchestrator) snapshotDockerCache(ctx context.Context, p DockerCacheProvider, s *Server, bs *WindowsBuildServerConfig) {
+	r := &s.RemoteWindowsServer
+	// Stop docker and flush the disk for a consistent snapshot.
+	if err := r.RunCommand(winrm.Powershell("Stop-Service docker; Write-VolumeCache D"), "C:\\", o.CommandTimeout); err != nil {
+		log.Printf("Error stopping docker on %v before the docker cache snapshot: %+v", *r.Hostname, err)
+		return
+	}
+	if err := p.SnapshotDockerCache(ctx, s, bs); err != nil {
+		log.Printf("Error snapshotting the docker cache of %s: %+v", s.GetInstanceName(), err)
+	}
+	if err := r.RunCommand(winrm.Powershell("Start-Service docker"), "C:\\", o.CommandTimeout); err != nil {
+		log.Printf("Error starting docker on %v after the docker cache snapshot: %+v", *r.Hostname, err)
+	}
+}
+
+// If the build of version ver failed because it ran past its deadline,
+// release its server right away rather than when all versions are done.
+func (o *Orchestrator) checkPerVersionTimeout(s *Server, ver string, deadline time.Time, err error) builderServerStatus {
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return builderServerStatus{s, err}
+	}
+	log.Printf("Windows %s build exceeded the per-version timeout of %v, releasing instance %s", ver, o.PerVersionTimeout, s.GetInstanceName())
+	s.RemoteWindowsServer.Deadline = time.Time{}
+	o.releaseBuildServer(s)
+	return builderServerStatus{nil, fmt.Errorf("Windows %s build timed out after %v: %+v", ver, o.PerVersionTimeout, err)}
+}
+
+// Create the log file of version ver in LogsDir.
+func (o *Orchestrator) createBuildLog(ver string) (*os.File, error) {
+	if err := os.MkdirAll(o.LogsDir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create logs directory %s: %+v", o.LogsDir, err)
+	}
+	path := filepath.Join(o.LogsDir, fmt.Sprintf("build-%s.log", ver))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create build log %s: %+v", path, err)
+	}
+	log.Printf("Writing the Windows %s build output to %s", ver, path)
+	return f, nil
+}
+
+// objectMetadata returns the custom metadata of the workspace objects of
+// version ver.
+func (o *Orchestrator) objectMetadata(ver string) map[string]string {
+	metadata := map[string]string{
+		"image":           o.ContainerImageName,
+		"windows-version": ver,
+	}
+	if o.ServerConfig.BuildID != "" {
+		metadata["build-id"] = o.ServerConfig.BuildID
+	}
+	for k, v := range o.StorageLabels {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// registryLogin returns the command that logs docker on r in to the registry
+// host, if it isn't logged in already.
+func registryLogin(r *RemoteWindowsServer, host string) string {
+	if r.RegistryLoggedIn {
+		return ""
+	}
+	return dockerAuthScript(host)
+}
+
+// Check if the error is image not found error.
+func isImageNotFoundErr(err error, imageFamily string) bool {
+	var gceAPIErr *googleapi.Error
+	if errors.As(err, &gceAPIErr) {
+		// Image not found error sample:
+		// googleapi: Error 404: The resource 'projects/windows-cloud/global/images/family/windows-1809-core-for-containers' was not found
+		if gceAPIErr.Code == 404 && strings.Contains(gceAPIErr.Message, imageFamily) {
+			return true
+		}
+	}
+	return false
+}
+
+// The single-arch images of the manifest list, e.g. demo:cloudbuild_ltsc2019
+// and demo:cloudbuild_1909 for demo:cloudbuild.
+func (o *Orchestrator) manifestSources() []string {
+	var sources []string
+	for ver := range o.Versions {
+		sources = append(sources, fmt.Sprint(o.ContainerImageName, "_", ver))
+	}
+	for _, ver := range o.ManifestVersions {
+		if _, ok := o.Versions[ver]; !ok {
+			sources = append(sources, fmt.Sprint(o.ContainerImageName, "_", ver))
+		}
+	}
+	return sources
+}
+
+func (o *Orchestrator) buildSingleArchContainerOnRemote(r *RemoteWindowsServer, version string) error {
+	image, err := ParseImageReference(o.ContainerImageName)
+	if err != nil {
+		return err
+	}
+	authScript := registryLogin(r, image.Registry)
+	buildargs := ""
+	if o.NoCache {
+		buildargs += "--no-cache "
+	}
+	if o.Pull {
+		buildargs += "--pull "
+	}
+	for _, arg := range o.BuildArgs {
+		buildargs += "--build-arg " + arg + " "
+	}
+	labels := map[string]string{}
+	for k, v := range o.ImageLabels {
+		labels[k] = v
+	}
+	if o.HostProcess {
+		labels[HostProcessAnnotation] = "true"
+	}
+	var labelKeys []string
+	for k := range labels {
+		labelKeys = append(labelKeys, k)
+	}
+	sort.Strings(labelKeys)
+	for _, k := range labelKeys {
+		// Quote the labels for PowerShell, values may contain spaces.
+		buildargs += "--label '" + strings.ReplaceAll(k+"="+labels[k], "'", "''") + "' "
+	}
+	rewriteFromScript := ""
+	if o.BaseImageMirror != "" {
+		mirror := strings.TrimSuffix(o.BaseImageMirror, "/")
+		rewriteFromScript = fmt.Sprintf(`(Get-Content Dockerfile) -replace '^(\s*FROM\s+(--\S+\s+)*)mcr\.microsoft\.com/', '${1}%s/' | Set-Content Dockerfile`, mirror)
+		if registry := strings.ToLower(strings.Split(mirror, "/")[0]); registry != image.Registry {
+			rewriteFromScript += "\n\t" + registryLogin(r, registry)
+		}
+	}
+	buildSingleArchContainerScript, err := o.Scripts.Render(BuildScript, BuildScriptData{
+		Image:       fmt.Sprint(o.ContainerImageName, "_", version),
+		Version:     version,
+		BuildArgs:   buildargs,
+		Login:       authScript,
+		RewriteFrom: rewriteFromScript,
+		// HostProcess images are pushed once validated.
+		Push: !o.SkipPush && !o.HostProcess,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Start to build single-arch container with commands: %s", buildSingleArchContainerScript)
+	r.IdleTimeout = o.RemoteIdleTimeout
+	defer func() { r.IdleTimeout = 0 }()
+	return r.RunCommand(winrm.Powershell(buildSingleArchContainerScript), *r.WorkspaceFolder, o.CommandTimeout)
+}
+
+func (o *Orchestrator) createMultiArchContainerOnRemote(ctx context.Context, r *RemoteWindowsServer) error {
+	image, err := ParseImageReference(o.ContainerImageName)
+	if err != nil {
+		return err
+	}
+	createMultiarchContainerScript, err := o.Scripts.Render(ManifestScript, ManifestScriptData{
+		Image:   o.ContainerImageName,
+		Sources: o.manifestSources(),
+		Login:   registryLogin(r, image.Registry),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Start to create multi-arch container with commands: %s", createMultiarchContainerScript)
+	return r.RunCommandContext(ctx, winrm.Powershell(createMultiarchContainerScript), *r.WorkspaceFolder, o.CommandTimeout)
+}
@@ -0,0 +1,932 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gke-windows-builder/builder/builder/fake"
+)
+
+var (
+	_ ComputeClient = &fake.ComputeClient{}
+	_ StorageClient = &fake.StorageClient{}
+)
+
+func newTestOrchestrator(t *testing.T, versions map[string]string, fixture *fake.Fixture) (*Orchestrator, *fake.ComputeClient, *fake.Remote) {
+	t.Helper()
+
+	project, zone, prefix, labels := "test-project", "us-central1-f", "windows-builder-", ""
+	network, subnet, region, networkProject := "default", "default", "us-central1", ""
+	machineType, diskType, serviceAccount := "", "pd-standard", "default"
+
+	c := fake.NewComputeClient(fixture)
+	s := fake.NewStorageClient()
+	if err := NewGCSBucketIfNotExists(context.Background(), s, project, "test-bucket", "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	remote := fake.NewRemote(fixture)
+
+	o := &Orchestrator{
+		ProjectID:          project,
+		ContainerImageName: "gcr.io/test-project/image:tag",
+		Versions:           versions,
+		ServerConfig: WindowsBuildServerConfig{
+			InstanceNamePrefix: &prefix,
+			Zone:               &zone,
+			NetworkConfig:      NewInstanceNetworkConfig(&project, &network, &networkProject, &subnet, &region),
+			Labels:             &labels,
+			MachineType:        &machineType,
+			BootDiskType:       &diskType,
+			BootDiskSizeGB:     75,
+			ServiceAccount:     &serviceAccount,
+			ExternalNAT:        true,
+		},
+		WorkspacePath:     "testdata",
+		WorkspaceBucket:   "test-bucket",
+		ManifestMediaType: "docker",
+		SetupTimeout:      time.Minute,
+		CopyTimeout:       time.Minute,
+		CommandTimeout:    time.Minute,
+		Compute:           c,
+		Storage:           s,
+		NewRemoteExecutor: func(r *RemoteWindowsServer) RemoteExecutor {
+			return remote.Executor(*r.Hostname)
+		},
+	}
+	return o, c, remote
+}
+
+func TestOrchestratorRun(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, ver := range []string{"ltsc2019", "ltsc2022"} {
+		if builds := remote.CommandsContaining("docker build -t gcr.io/test-project/image:tag_" + ver); len(builds) != 1 {
+			t.Errorf("expected one build of %s, got %d", ver, len(builds))
+		}
+	}
+	manifests := remote.CommandsContaining("docker manifest create")
+	if len(manifests) != 1 {
+		t.Fatalf("expected the manifest to be created once, got %d times", len(manifests))
+	}
+	for _, ver := range []string{"ltsc2019", "ltsc2022"} {
+		if !strings.Contains(manifests[0], "gcr.io/test-project/image:tag_"+ver) {
+			t.Errorf("expected manifest to include %s: %s", ver, manifests[0])
+		}
+	}
+	for _, tool := range []string{"gcloud", "gsutil"} {
+		if commands := remote.CommandsContaining(tool); len(commands) != 0 {
+			t.Errorf("expected the instances not to need %s, got %q", tool, commands)
+		}
+	}
+	if len(c.Instances) != 0 || len(c.Deleted) != 2 {
+		t.Errorf("expected both instances to be deleted, %d remaining, %d deleted", len(c.Instances), len(c.Deleted))
+	}
+}
+
+func TestNewOrchestrator(t *testing.T) {
+	c, s, remote := fake.NewComputeClient(nil), fake.NewStorageClient(), fake.NewRemote(nil)
+	o := NewOrchestrator("test-project", "europe-west1-b", "gcr.io/test-project/image:tag", map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, "testdata", c, s)
+	o.NewRemoteExecutor = func(r *RemoteWindowsServer) RemoteExecutor {
+		return remote.Executor(*r.Hostname)
+	}
+	if err := NewGCSBucketIfNotExists(context.Background(), s, o.ProjectID, o.WorkspaceBucket, "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if region := *o.ServerConfig.NetworkConfig.Region; region != "europe-west1" {
+		t.Errorf("expected the region of the zone, got %q", region)
+	}
+	if builds := remote.CommandsContaining("docker build -t gcr.io/test-project/image:tag_ltsc2019"); len(builds) != 1 {
+		t.Errorf("expected one build, got %d", len(builds))
+	}
+}
+
+func TestOrchestratorRun_imageNotFound(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"1809":     "windows-cloud/global/images/family/windows-1809-core-for-containers",
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, &fake.Fixture{
+		MissingImages: []string{"windows-cloud/global/images/family/windows-1809-core-for-containers"},
+	})
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("expected obsolete version to be skipped, Run failed: %v", err)
+	}
+	if builds := remote.CommandsContaining("docker build"); len(builds) != 1 {
+		t.Errorf("expected one build, got %d", len(builds))
+	}
+	if len(c.Deleted) != 1 {
+		t.Errorf("expected one instance to be deleted, got %d", len(c.Deleted))
+	}
+}
+
+func TestOrchestratorRun_buildFailure(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, &fake.Fixture{
+		Commands: []fake.CommandResult{{Match: "tag_ltsc2022", ExitCode: 1}},
+	})
+
+	if err := o.Run(context.Background()); err == nil {
+		t.Fatal("expected Run to fail")
+	}
+	if manifests := remote.CommandsContaining("docker manifest create"); len(manifests) != 0 {
+		t.Errorf("expected no manifest to be created, got %d", len(manifests))
+	}
+	if len(c.Instances) != 0 {
+		t.Errorf("expected all instances to be deleted, %d remaining", len(c.Instances))
+	}
+}
+
+func TestOrchestratorRun_reuseInstances(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.ReuseInstance = true
+
+	for i := 0; i < 2; i++ {
+		if err := o.Run(context.Background()); err != nil {
+			t.Fatalf("Run %d failed: %v", i, err)
+		}
+	}
+	if len(c.Instances) != 1 || len(c.Deleted) != 0 {
+		t.Errorf("expected a single instance to be kept, got %d instances, %d deleted", len(c.Instances), len(c.Deleted))
+	}
+	if cleanups := remote.CommandsContaining("-Recurse -Force"); len(cleanups) != 2 {
+		t.Errorf("expected the workspace folder to be cleaned after each run, got %d", len(cleanups))
+	}
+}
+
+func TestOrchestratorRun_reuseInstancesOfVersion(t *testing.T) {
+	o, c, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	o.ServerConfig.ReuseInstance = true
+	labels := "builder_version=ltsc2022"
+	o.ServerConfig.Labels = &labels
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	o.Versions = map[string]string{"ltsc2019": "windows-cloud/global/images/family/windows-2019-core"}
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(c.Inserted) != 2 {
+		t.Fatalf("expected an instance to be created per version, got %d", len(c.Inserted))
+	}
+	for _, inst := range c.Inserted {
+		if version := inst.Labels["builder_version"]; !strings.Contains(inst.Name, version) {
+			t.Errorf("expected instance %s to be labeled with its version, got %q", inst.Name, version)
+		}
+	}
+}
+
+func TestOrchestratorRun_workerProjects(t *testing.T) {
+	o, c, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	o.WorkerProjects = []string{"worker-a", "worker-b"}
+	o.Inventory = NewInventory(o.ProjectID)
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(c.Inserted) != 2 {
+		t.Fatalf("expected an instance per version, got %d", len(c.Inserted))
+	}
+	want := map[string]string{"ltsc2019": "worker-a", "ltsc2022": "worker-b"}
+	for _, inst := range c.Inserted {
+		prefix := computeUrlPrefix + want[inst.Labels["builder_version"]] + "/"
+		if !strings.HasPrefix(inst.Disks[0].InitializeParams.DiskType, prefix) {
+			t.Errorf("expected instance %s in %s, got disk type %s", inst.Name, prefix, inst.Disks[0].InitializeParams.DiskType)
+		}
+		if subnet := inst.NetworkInterfaces[0].Subnetwork; !strings.HasPrefix(subnet, prefix) {
+			t.Errorf("expected instance %s on the network of its project, got %s", inst.Name, subnet)
+		}
+	}
+	for _, i := range o.Inventory.Instances {
+		if i.Project != want[i.Version] {
+			t.Errorf("expected the inventory to record instance %s in %s, got %q", i.Name, want[i.Version], i.Project)
+		}
+	}
+}
+
+// hangingManifestExecutor hangs the first manifest creation until it is
+// cancelled.
+type hangingManifestExecutor struct {
+	RemoteExecutor
+	remote    *fake.Remote
+	mu        *sync.Mutex
+	cancelled chan error
+}
+
+func (e hangingManifestExecutor) Run(ctx context.Context, command string, path string, timeout time.Duration, stdout io.Writer, stderr io.Writer) error {
+	e.mu.Lock()
+	before := len(e.remote.CommandsContaining("docker manifest create"))
+	err := e.RemoteExecutor.Run(ctx, command, path, timeout, stdout, stderr)
+	first := before == 0 && len(e.remote.CommandsContaining("docker manifest create")) == 1
+	e.mu.Unlock()
+	if !first {
+		return err
+	}
+	<-ctx.Done()
+	e.cancelled <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestOrchestratorRun_manifestAttemptDelay(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	o.ManifestAttemptDelay = 10 * time.Millisecond
+	cancelled := make(chan error, 1)
+	mu := &sync.Mutex{}
+	o.NewRemoteExecutor = func(r *RemoteWindowsServer) RemoteExecutor {
+		return hangingManifestExecutor{remote.Executor(*r.Hostname), remote, mu, cancelled}
+	}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if manifests := remote.CommandsContaining("docker manifest create"); len(manifests) != 2 {
+		t.Errorf("expected the manifest to be attempted on both instances, got %d", len(manifests))
+	}
+	// The instances are only shut down once the hanging attempt stopped.
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("expected the hanging attempt to be cancelled, got %v", err)
+		}
+	default:
+		t.Error("expected the hanging attempt to be cancelled before Run returned")
+	}
+}
+
+// failingManifestExecutor hangs the first manifest creation until it is
+// cancelled and fails the second one, recording when they start.
+type failingManifestExecutor struct {
+	RemoteExecutor
+	remote *fake.Remote
+	mu     *sync.Mutex
+	starts *[]time.Time
+}
+
+func (e failingManifestExecutor) Run(ctx context.Context, command string, path string, timeout time.Duration, stdout io.Writer, stderr io.Writer) error {
+	e.mu.Lock()
+	before := len(e.remote.CommandsContaining("docker manifest create"))
+	err := e.RemoteExecutor.Run(ctx, command, path, timeout, stdout, stderr)
+	attempt := len(e.remote.CommandsContaining("docker manifest create"))
+	if attempt > before {
+		*e.starts = append(*e.starts, time.Now())
+	}
+	e.mu.Unlock()
+	switch {
+	case attempt == before:
+		return err
+	case attempt == 1:
+		<-ctx.Done()
+		return ctx.Err()
+	case attempt == 2:
+		return fmt.Errorf("manifest unknown")
+	}
+	return err
+}
+
+func TestOrchestratorRun_manifestAttemptFailed(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+		"20H2":     "windows-cloud/global/images/family/windows-20h2-core",
+	}, nil)
+	o.ManifestAttemptDelay = time.Second
+	var starts []time.Time
+	mu := &sync.Mutex{}
+	o.NewRemoteExecutor = func(r *RemoteWindowsServer) RemoteExecutor {
+		return failingManifestExecutor{remote.Executor(*r.Hostname), remote, mu, &starts}
+	}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(starts) != 3 {
+		t.Fatalf("expected the manifest to be attempted on the 3 instances, got %d", len(starts))
+	}
+	// The failed attempt is replaced right away, not after another delay.
+	if d := starts[2].Sub(starts[1]); d > o.ManifestAttemptDelay/2 {
+		t.Errorf("expected the third attempt to start right after the second failed, got %v", d)
+	}
+}
+
+func TestOrchestratorRun_useInstances(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.ReuseInstance = true
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var name string
+	for n := range c.Instances {
+		name = n
+	}
+
+	o.ServerConfig.ReuseInstance = false
+	o.UseInstances = map[string][]string{"ltsc2019": {"missing-instance", name}}
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(c.Inserted) != 1 || len(c.Instances) != 1 || len(c.Deleted) != 0 {
+		t.Errorf("expected the named instance to be used and kept, got %d inserted, %d instances, %d deleted", len(c.Inserted), len(c.Instances), len(c.Deleted))
+	}
+	if builds := remote.CommandsContaining("docker build"); len(builds) != 2 {
+		t.Errorf("expected a build on the named instance, got %d builds", len(builds))
+	}
+
+	o.UseInstances = map[string][]string{"ltsc2019": {"missing-instance"}}
+	if err := o.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "missing-instance") {
+		t.Errorf("expected Run to fail without a usable named instance, got %v", err)
+	}
+	if len(c.Inserted) != 1 {
+		t.Errorf("expected no instance to be created, got %d inserted", len(c.Inserted))
+	}
+}
+
+func TestOrchestratorRun_stopInstances(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.ReuseInstance = true
+	o.ServerConfig.StopInstances = true
+
+	var hosts []string
+	for i := 0; i < 2; i++ {
+		if err := o.Run(context.Background()); err != nil {
+			t.Fatalf("Run %d failed: %v", i, err)
+		}
+		builds := remote.CommandsContaining("docker build")
+		hosts = append(hosts, strings.SplitN(builds[len(builds)-1], ":", 2)[0])
+	}
+	if len(c.Instances) != 1 || len(c.Deleted) != 0 || len(c.Stopped) != 2 {
+		t.Fatalf("expected a single instance to be stopped after each run, got %d instances, %d deleted, %d stops", len(c.Instances), len(c.Deleted), len(c.Stopped))
+	}
+	for _, inst := range c.Instances {
+		if inst.Status != "TERMINATED" {
+			t.Errorf("expected instance %s to be stopped, got %s", inst.Name, inst.Status)
+		}
+	}
+	if hosts[0] == hosts[1] {
+		t.Errorf("expected the restarted instance to be reached at its new IP, got %s twice", hosts[0])
+	}
+}
+
+func TestOrchestratorRun_suspendInstances(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.ReuseInstance = true
+	o.ServerConfig.SuspendInstances = true
+
+	for i := 0; i < 2; i++ {
+		if err := o.Run(context.Background()); err != nil {
+			t.Fatalf("Run %d failed: %v", i, err)
+		}
+	}
+	if len(c.Instances) != 1 || len(c.Deleted) != 0 || len(c.Stopped) != 0 || len(c.Suspended) != 2 {
+		t.Fatalf("expected a single instance to be suspended after each run, got %d instances, %d deleted, %d stops, %d suspends", len(c.Instances), len(c.Deleted), len(c.Stopped), len(c.Suspended))
+	}
+	for _, inst := range c.Instances {
+		if inst.Status != "SUSPENDED" {
+			t.Errorf("expected instance %s to be suspended, got %s", inst.Name, inst.Status)
+		}
+	}
+	if builds := remote.CommandsContaining("docker build"); len(builds) != 2 {
+		t.Errorf("expected a build on the resumed instance, got %d builds", len(builds))
+	}
+}
+
+func TestOrchestratorRun_dockerCacheSnapshots(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.DockerCacheSnapshots = true
+	o.ServerConfig.DockerCacheDiskSizeGB = 100
+
+	for i := 0; i < 2; i++ {
+		if err := o.Run(context.Background()); err != nil {
+			t.Fatalf("Run %d failed: %v", i, err)
+		}
+		if len(c.Snapshots) != 1 {
+			t.Fatalf("expected a single docker cache snapshot after run %d, got %d", i, len(c.Snapshots))
+		}
+		for _, snapshot := range c.Snapshots {
+			if snapshot.Labels["docker-cache-version"] != "ltsc2019" {
+				t.Errorf("expected the snapshot to be labeled with the version, got %v", snapshot.Labels)
+			}
+		}
+	}
+	var seeds []string
+	for _, inst := range c.Inserted {
+		for _, d := range inst.Disks {
+			if d.DeviceName == "docker-cache" {
+				seeds = append(seeds, d.InitializeParams.SourceSnapshot)
+			}
+		}
+	}
+	if len(seeds) != 2 || seeds[0] != "" || seeds[1] == "" {
+		t.Errorf("expected the second instance only to be seeded from the first snapshot, got %q", seeds)
+	}
+	if stops := remote.CommandsContaining("Stop-Service docker"); len(stops) != 2 {
+		t.Errorf("expected docker to be stopped before each snapshot, got %d", len(stops))
+	}
+}
+
+func TestOrchestratorRun_clockSkew(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, &fake.Fixture{
+		Commands: []fake.CommandResult{
+			{Match: "w32tm /resync", ExitCode: 1, Output: "The clock is 300 seconds off metadata.google.internal after a resync"},
+		},
+	})
+	o.MaxClockSkew = 30 * time.Second
+
+	if err := o.Run(context.Background()); err == nil {
+		t.Fatal("expected Run to fail on clock skew")
+	}
+	if syncs := remote.CommandsContaining("-gt 30)"); len(syncs) != 1 {
+		t.Errorf("expected a single clock check with a 30s bound, got %d", len(syncs))
+	}
+	if builds := remote.CommandsContaining("docker login"); len(builds) != 0 {
+		t.Errorf("expected no registry authentication with a skewed clock, got %d", len(builds))
+	}
+}
+
+func TestOrchestratorRun_noCachePull(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.NoCache = true
+	o.Pull = true
+	o.BuildArgs = []string{"A=1"}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if builds := remote.CommandsContaining("--build-arg WINDOWS_VERSION=ltsc2019 --no-cache --pull --build-arg A=1 "); len(builds) != 1 {
+		t.Errorf("expected docker build to get --no-cache and --pull, got %q", remote.CommandsContaining("docker build"))
+	}
+}
+
+func TestOrchestratorRun_imageLabels(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ImageLabels = map[string]string{
+		"org.opencontainers.image.revision": "abc123",
+		"maintainer":                        "Team's builds <builds@example.com>",
+	}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if builds := remote.CommandsContaining("--label 'maintainer=Team''s builds <builds@example.com>' --label 'org.opencontainers.image.revision=abc123' "); len(builds) != 1 {
+		t.Errorf("expected docker build to get the quoted labels, got %q", remote.CommandsContaining("docker build"))
+	}
+}
+
+func TestOrchestratorRun_hostProcess(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, &fake.Fixture{
+		Commands: []fake.CommandResult{{Match: "docker image inspect 'gcr.io/test-project/image:tag_ltsc2022'", ExitCode: 1, Output: "The image is not a HostProcess container image"}},
+	})
+	o.HostProcess = true
+	o.BaseImageMirror = "us-docker.pkg.dev/mirror/"
+
+	if err := o.Run(context.Background()); err == nil {
+		t.Fatal("expected Run to fail")
+	}
+	if builds := remote.CommandsContaining("--label '" + HostProcessAnnotation + "=true' "); len(builds) != 2 {
+		t.Errorf("expected the builds to label the images, got %q", remote.CommandsContaining("docker build"))
+	}
+	if validations := remote.CommandsContaining("$base = 'us-docker.pkg.dev/mirror/oss/kubernetes/windows-host-process-containers-base-image:v1.0.0'"); len(validations) != 2 {
+		t.Errorf("expected both images to be validated against the mirrored base image, got %d", len(validations))
+	}
+	if pushes := remote.CommandsContaining("docker push gcr.io/test-project/image:tag_ltsc2019"); len(pushes) != 1 {
+		t.Errorf("expected the valid image to be pushed once, got %d", len(pushes))
+	}
+	if pushes := remote.CommandsContaining("docker push gcr.io/test-project/image:tag_ltsc2022"); len(pushes) != 0 {
+		t.Errorf("expected the invalid image not to be pushed, got %d", len(pushes))
+	}
+}
+
+func TestOrchestratorRun_tarballOnly(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	remote.Storage = o.Storage.(*fake.StorageClient)
+	tarballDir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tarballDir)
+	o.SkipPush = true
+	o.TarballDir = tarballDir
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, ver := range []string{"ltsc2019", "ltsc2022"} {
+		if _, err := os.Stat(filepath.Join(tarballDir, ver+".tar")); err != nil {
+			t.Errorf("expected the tarball of %s: %v", ver, err)
+		}
+	}
+	if saves := remote.CommandsContaining("docker save -o image.tar gcr.io/test-project/image:tag_"); len(saves) != 2 {
+		t.Errorf("expected the image of each version to be saved, got %d", len(saves))
+	}
+	if pushes := remote.CommandsContaining("docker push"); len(pushes) != 0 {
+		t.Errorf("expected no push, got %d", len(pushes))
+	}
+	if manifests := remote.CommandsContaining("docker manifest"); len(manifests) != 0 {
+		t.Errorf("expected no multi-arch manifest, got %d", len(manifests))
+	}
+	if objects := o.Storage.(*fake.StorageClient).Buckets["test-bucket"]; len(objects) != 2 {
+		t.Errorf("expected the staged tarballs to be deleted, leaving the workspaces, got %d objects", len(objects))
+	}
+}
+
+func TestOrchestratorRun_exportTo(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	storage := o.Storage.(*fake.StorageClient)
+	remote.Storage = storage
+	if err := storage.CreateBucket(context.Background(), "test-project", "export-bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	o.SkipPush = true
+	o.ExportTo = "gs://export-bucket/releases/1.0"
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	objects := storage.Buckets["export-bucket"]
+	for _, name := range []string{"ltsc2019.tar", "ltsc2019.json", "ltsc2022.tar", "ltsc2022.json", "index.json"} {
+		if _, ok := objects["releases/1.0/"+name]; !ok {
+			t.Errorf("expected releases/1.0/%s to be exported, got %d objects", name, len(objects))
+		}
+	}
+	var index ExportIndex
+	if err := json.Unmarshal(objects["releases/1.0/index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.Image != "gcr.io/test-project/image:tag" || len(index.Images) != 2 {
+		t.Fatalf("unexpected index %+v", index)
+	}
+	if got := index.Images[0]; got.Version != "ltsc2019" || got.Tag != "gcr.io/test-project/image:tag_ltsc2019" || got.Tarball != "gs://export-bucket/releases/1.0/ltsc2019.tar" {
+		t.Errorf("unexpected exported image %+v", got)
+	}
+	if pushes := remote.CommandsContaining("docker push"); len(pushes) != 0 {
+		t.Errorf("expected no push, got %d", len(pushes))
+	}
+}
+
+func TestOrchestratorRun_baseImageTarball(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	o.BaseImageTarball = "gs://base-images/servercore-{version}.tar"
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, ver := range []string{"ltsc2019", "ltsc2022"} {
+		if loads := remote.CommandsContaining("https://storage.googleapis.com/storage/v1/b/base-images/o/servercore-" + ver + ".tar?alt=media"); len(loads) != 1 {
+			t.Errorf("expected the base images of %s to be loaded once, got %d", ver, len(loads))
+		}
+	}
+	commands := strings.Join(remote.Commands(), "\n")
+	if strings.Index(commands, "docker load") > strings.Index(commands, "docker build") {
+		t.Errorf("expected the base images to be loaded before the build")
+	}
+}
+
+func TestOrchestratorRun_defenderExclusions(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.DefenderMode = "exclude"
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if exclusions := remote.CommandsContaining("Add-MpPreference -ExclusionPath C:\\"); len(exclusions) != 1 {
+		t.Errorf("expected the workspace folder to be excluded from Windows Defender, got %d", len(exclusions))
+	}
+}
+
+func TestOrchestratorRun_buildLogs(t *testing.T) {
+	o, _, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, &fake.Fixture{
+		Commands: []fake.CommandResult{
+			{Match: "tag_ltsc2019", Output: "Successfully built ltsc2019"},
+			{Match: "tag_ltsc2022", Output: "Successfully built ltsc2022"},
+		},
+	})
+	logsDir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logsDir)
+	o.LogsDir = logsDir
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, ver := range []string{"ltsc2019", "ltsc2022"} {
+		data, err := ioutil.ReadFile(filepath.Join(logsDir, "build-"+ver+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); got != "Successfully built "+ver+"\n" {
+			t.Errorf("unexpected %s build log %q", ver, got)
+		}
+	}
+}
+
+func TestOrchestratorRun_workspaceExcludes(t *testing.T) {
+	o, _, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.WorkspaceExcludes = []string{"", filepath.Join("testdata", "file-a.txt")}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var names []string
+	for object, data := range o.Storage.(*fake.StorageClient).Buckets["test-bucket"] {
+		if !strings.HasPrefix(object, "windows-builder-") {
+			continue
+		}
+		z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range z.File {
+			names = append(names, f.Name)
+		}
+	}
+	sort.Strings(names)
+	if expected := []string{"file-b.txt", "file-c.txt", "subdir/file-d.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected the workspace archive to contain %v, got %v", expected, names)
+	}
+}
+
+func TestOrchestratorRun_perVersionTimeout(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, &fake.Fixture{
+		Commands: []fake.CommandResult{{Match: "docker push gcr.io/test-project/image:tag_ltsc2022", Duration: "1m"}},
+	})
+	o.PerVersionTimeout = 500 * time.Millisecond
+	o.Results = NewResults(o.ContainerImageName)
+
+	start := time.Now()
+	err := o.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Windows ltsc2022 build timed out") {
+		t.Fatalf("expected the ltsc2022 build to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the stuck push to be aborted, Run took %v", elapsed)
+	}
+	if builds := remote.CommandsContaining("docker push gcr.io/test-project/image:tag_ltsc2019"); len(builds) != 1 {
+		t.Errorf("expected ltsc2019 to complete, got %d pushes", len(builds))
+	}
+	if len(c.Instances) != 0 || len(c.Deleted) != 2 {
+		t.Errorf("expected both instances to be deleted once, %d remaining, %d deleted", len(c.Instances), len(c.Deleted))
+	}
+	if manifests := remote.CommandsContaining("docker manifest create"); len(manifests) != 0 || o.Results.ManifestPushed {
+		t.Errorf("expected no manifest after a timed out version, got %q", manifests)
+	}
+	if v := o.Results.Versions; len(v) != 2 || v[0].Status != VersionSucceeded || v[1].Status != VersionFailed {
+		t.Errorf("expected ltsc2019 to succeed and ltsc2022 to be recorded as failed for retry-failed, got %+v", v)
+	}
+}
+
+func TestOrchestratorRun_remoteIdleTimeout(t *testing.T) {
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, &fake.Fixture{
+		Commands: []fake.CommandResult{
+			{Match: "docker build -t gcr.io/test-project/image:tag_ltsc2019", Output: "Step 1/2", Duration: "200ms"},
+			{Match: "docker build -t gcr.io/test-project/image:tag_ltsc2022", Output: "Pulling fs layer", Duration: "1m"},
+		},
+	})
+	o.RemoteIdleTimeout = 500 * time.Millisecond
+
+	start := time.Now()
+	err := o.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "wrote no output for 500ms") {
+		t.Fatalf("expected the ltsc2022 build to be aborted as idle, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the idle build to be aborted, Run took %v", elapsed)
+	}
+	if builds := remote.CommandsContaining("docker build -t gcr.io/test-project/image:tag_ltsc2019"); len(builds) != 1 {
+		t.Errorf("expected ltsc2019 to build, got %d builds", len(builds))
+	}
+}
+
+func TestOrchestratorRun_storageLabels(t *testing.T) {
+	o, _, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.ServerConfig.BuildID = "build-1"
+	o.StorageLabels = map[string]string{"team": "windows"}
+	s := o.Storage.(*fake.StorageClient)
+
+	if err := NewGCSBucketIfNotExists(context.Background(), s, o.ProjectID, "labeled-bucket", "", o.StorageLabels, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.BucketLabels["labeled-bucket"]["team"] != "windows" {
+		t.Errorf("expected the created bucket to be labeled, got %v", s.BucketLabels["labeled-bucket"])
+	}
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(s.ObjectMetadata) != 1 {
+		t.Fatalf("expected one workspace object, got %d", len(s.ObjectMetadata))
+	}
+	for object, metadata := range s.ObjectMetadata {
+		expected := map[string]string{
+			"build-id":        "build-1",
+			"image":           "gcr.io/test-project/image:tag",
+			"windows-version": "ltsc2019",
+			"team":            "windows",
+		}
+		if !reflect.DeepEqual(metadata, expected) {
+			t.Errorf("unexpected metadata of %s: %v, expected %v", object, metadata, expected)
+		}
+	}
+}
+
+func TestOrchestratorRun_remoteHost(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	o.RemoteHosts = map[string]*RemoteHost{
+		"ltsc2019": {Hostname: "build-host.example.com", Username: "builder", Password: "secret"},
+	}
+	o.Inventory = NewInventory(o.ProjectID)
+	o.MaxClockSkew = 30 * time.Second
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	hostCommands := remote.CommandsContaining("build-host.example.com: ")
+	var built, cleaned bool
+	for _, command := range hostCommands {
+		if strings.Contains(command, "docker login") {
+			t.Errorf("expected the remote host not to log in to the registry: %s", command)
+		}
+		if strings.Contains(command, "w32tm /resync") {
+			t.Errorf("expected the clock of the remote host not to be resynced: %s", command)
+		}
+		built = built || strings.Contains(command, "docker build -t gcr.io/test-project/image:tag_ltsc2019")
+		cleaned = cleaned || strings.Contains(command, "Remove-Item -Path C:\\")
+	}
+	if !built || !cleaned {
+		t.Errorf("expected ltsc2019 to be built on the remote host and its workspace removed, got %q", hostCommands)
+	}
+	if len(c.Deleted) != 1 || len(o.Inventory.Instances) != 1 || o.Inventory.Instances[0].Version != "ltsc2022" {
+		t.Errorf("expected only ltsc2022 to get an instance, %d deleted, inventory %+v", len(c.Deleted), o.Inventory.Instances)
+	}
+}
+
+// testProvider provides machines named after their version, at 192.0.2.x,
+// pinned ones when pinned is set.
+type testProvider struct {
+	pinned  bool
+	mu      sync.Mutex
+	created []string
+	deleted []string
+}
+
+func (p *testProvider) Create(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.created = append(p.created, *bs.ImageVersion)
+	return &Server{Name: "machine-" + *bs.ImageVersion, Data: len(p.created), Pinned: p.pinned}, nil
+}
+
+func (p *testProvider) FindExisting(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	return nil, nil
+}
+
+func (p *testProvider) Delete(ctx context.Context, s *Server) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deleted = append(p.deleted, s.Name)
+	return nil
+}
+
+func (p *testProvider) Credentials(ctx context.Context, s *Server) (string, string, error) {
+	return "admin", "password", nil
+}
+
+func (p *testProvider) IP(ctx context.Context, s *Server) (string, error) {
+	return fmt.Sprintf("192.0.2.%d", s.Data.(int)), nil
+}
+
+func TestOrchestratorRun_provider(t *testing.T) {
+	o, c, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}, nil)
+	p := &testProvider{}
+	o.Provider = p
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(c.Deleted) != 0 {
+		t.Errorf("expected no GCE instance, %d deleted", len(c.Deleted))
+	}
+	sort.Strings(p.deleted)
+	if expected := []string{"machine-ltsc2019", "machine-ltsc2022"}; !reflect.DeepEqual(p.deleted, expected) {
+		t.Errorf("expected the provider to delete %v, deleted %v", expected, p.deleted)
+	}
+	for _, ver := range []string{"ltsc2019", "ltsc2022"} {
+		builds := remote.CommandsContaining("docker build -t gcr.io/test-project/image:tag_" + ver)
+		if len(builds) != 1 || !strings.HasPrefix(builds[0], "192.0.2.") {
+			t.Errorf("expected %s to be built on a machine of the provider, got %q", ver, builds)
+		}
+	}
+}
+
+func TestOrchestratorRun_pinnedProvider(t *testing.T) {
+	o, _, _ := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	p := &testProvider{pinned: true}
+	o.Provider = p
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(p.created) != 1 || len(p.deleted) != 0 {
+		t.Errorf("expected the pinned machine to be kept, created %v, deleted %v", p.created, p.deleted)
+	}
+}
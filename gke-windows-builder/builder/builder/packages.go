@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The package managers of InstallPackage.
+const (
+	PackageManagerChoco  = "choco"
+	PackageManagerWinget = "winget"
+)
+
+// packageFieldRE matches the package names, winget IDs and versions, which
+// are passed unquoted to the package managers by the setup script.
+var packageFieldRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// InstallPackage is a package new instances install during setup.
+type InstallPackage struct {
+	Manager string
+	Name    string
+	// Version is the version to install, the latest when empty.
+	Version string
+}
+
+// String returns the package as [manager:]name[@version], which
+// ParseInstallPackage parses.
+func (p InstallPackage) String() string {
+	s := p.Manager + ":" + p.Name
+	if p.Version != "" {
+		s += "@" + p.Version
+	}
+	return s
+}
+
+// ParseInstallPackage parses a package as [manager:]name[@version], e.g. git,
+// 7zip@22.1 or winget:Microsoft.DotNet.SDK.8. The manager is choco when
+// omitted.
+func ParseInstallPackage(spec string) (InstallPackage, error) {
+	p := InstallPackage{Manager: PackageManagerChoco}
+	name := strings.TrimSpace(spec)
+	if i := strings.Index(name, ":"); i >= 0 {
+		p.Manager, name = strings.ToLower(name[:i]), name[i+1:]
+	}
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name, p.Version = name[:i], name[i+1:]
+		if !packageFieldRE.MatchString(p.Version) {
+			return InstallPackage{}, fmt.Errorf("Invalid version %q of package %q", p.Version, spec)
+		}
+	}
+	p.Name = name
+	if p.Manager != PackageManagerChoco && p.Manager != PackageManagerWinget {
+		return InstallPackage{}, fmt.Errorf("Invalid package manager %q of package %q, must be %s or %s", p.Manager, spec, PackageManagerChoco, PackageManagerWinget)
+	}
+	if !packageFieldRE.MatchString(p.Name) {
+		return InstallPackage{}, fmt.Errorf("Invalid package name %q", spec)
+	}
+	return p, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import "testing"
+
+func TestParseInstallPackage(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"git", "choco:git"},
+		{"7zip@22.1", "choco:7zip@22.1"},
+		{" choco:nuget.commandline ", "choco:nuget.commandline"},
+		{"WinGet:Microsoft.DotNet.SDK.8@8.0.100", "winget:Microsoft.DotNet.SDK.8@8.0.100"},
+	} {
+		p, err := ParseInstallPackage(tc.spec)
+		if err != nil {
+			t.Errorf("ParseInstallPackage(%q) failed: %v", tc.spec, err)
+			continue
+		}
+		if p.String() != tc.want {
+			t.Errorf("ParseInstallPackage(%q) = %s, want %s", tc.spec, p, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"", "apt:git", "git; Remove-Item C:\\", "git@", "git@1.0 --force", "winget:"} {
+		if _, err := ParseInstallPackage(spec); err == nil {
+			t.Errorf("expected ParseInstallPackage(%q) to fail", spec)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// PromoteImage copies the image or image index source, which must be
+// referenced by digest, to target without changing its digest: the manifests
+// are copied as they are and foreign layers are left to be pulled from their
+// URLs. It returns the digest, the same as the source's.
+func PromoteImage(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference) (string, error) {
+	if source.Digest == "" {
+		return "", fmt.Errorf("%s must be referenced by digest to be promoted", source)
+	}
+	m, err := c.GetManifest(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	if digest := sha256Digest(m.Body); digest != source.Digest {
+		return "", fmt.Errorf("%s was served with digest %s", source, digest)
+	}
+	switch m.MediaType {
+	case DockerManifestListMediaType, OCIIndexMediaType:
+		err = promoteIndex(ctx, c, source, target, m.Body)
+	case DockerManifestMediaType, OCIManifestMediaType:
+		err = promoteManifest(ctx, c, source, target, m.Body)
+	default:
+		return "", fmt.Errorf("%s has an unsupported media type: %s", source, m.MediaType)
+	}
+	if err != nil {
+		return "", err
+	}
+	digest, err := c.PutManifest(ctx, target, m.MediaType, m.Body)
+	if err != nil {
+		return "", err
+	}
+	if digest != source.Digest {
+		return "", fmt.Errorf("%s was stored with digest %s instead of %s", target, digest, source.Digest)
+	}
+	return digest, nil
+}
+
+// promoteIndex copies each manifest of an index, by digest.
+func promoteIndex(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference, body []byte) error {
+	var index struct {
+		Manifests []mirrorDescriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return fmt.Errorf("Failed to decode index %s: %+v", source, err)
+	}
+	for _, d := range index.Manifests {
+		childSource := &ImageReference{Registry: source.Registry, Repository: source.Repository, Digest: d.Digest}
+		childTarget := &ImageReference{Registry: target.Registry, Repository: target.Repository, Digest: d.Digest}
+		m, err := c.GetManifest(ctx, childSource)
+		if err != nil {
+			return err
+		}
+		if err := promoteManifest(ctx, c, childSource, childTarget, m.Body); err != nil {
+			return err
+		}
+		if _, err := c.PutManifest(ctx, childTarget, m.MediaType, m.Body); err != nil {
+			return err
+		}
+		log.Printf("Promoted %s", childSource)
+	}
+	return nil
+}
+
+// promoteManifest copies the config and the layers of a single-arch
+// manifest, except its foreign layers.
+func promoteManifest(ctx context.Context, c *RegistryClient, source *ImageReference, target *ImageReference, body []byte) error {
+	var manifest struct {
+		Config mirrorDescriptor   `json:"config"`
+		Layers []mirrorDescriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return fmt.Errorf("Failed to decode manifest %s: %+v", source, err)
+	}
+	for _, d := range append([]mirrorDescriptor{manifest.Config}, manifest.Layers...) {
+		if isForeignLayer(d.MediaType) {
+			continue
+		}
+		if err := mirrorBlob(ctx, c, source, target, &d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPromoteImage(t *testing.T) {
+	reg, s := newTestRegistry()
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "https://")
+	c := &RegistryClient{httpClient: s.Client(), tokens: map[string]string{}}
+
+	config := []byte(`{"architecture":"amd64","os":"windows"}`)
+	base, layer := []byte("base layer"), []byte("app layer")
+	reg.blobs["dev/app@"+sha256Digest(config)] = config
+	reg.blobs["dev/app@"+sha256Digest(layer)] = layer
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,
+		"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":%q},
+		"layers":[
+			{"mediaType":%q,"size":%d,"digest":%q,"urls":["https://mcr.microsoft.com/foreign"]},
+			{"mediaType":%q,"size":%d,"digest":%q}
+		]}`,
+		DockerManifestMediaType, len(config), sha256Digest(config),
+		dockerForeignLayerMediaType, len(base), sha256Digest(base),
+		dockerLayerMediaType, len(layer), sha256Digest(layer))
+	manifestDigest := reg.putManifest("dev/app", nil, DockerManifestMediaType, []byte(manifest))
+	list := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[
+		{"mediaType":%q,"size":%d,"digest":%q,"platform":{"architecture":"amd64","os":"windows","os.version":"10.0.20348.1"}}]}`,
+		DockerManifestListMediaType, DockerManifestMediaType, len(manifest), manifestDigest)
+	listDigest := reg.putManifest("dev/app", []string{"v1"}, DockerManifestListMediaType, []byte(list))
+
+	source := &ImageReference{Registry: host, Repository: "dev/app", Digest: listDigest}
+	target := &ImageReference{Registry: host, Repository: "prod/app", Tag: "v1"}
+	digest, err := PromoteImage(context.Background(), c, source, target)
+	if err != nil {
+		t.Fatalf("PromoteImage failed: %v", err)
+	}
+	if digest != listDigest {
+		t.Errorf("expected the promoted index to keep digest %s, got %s", listDigest, digest)
+	}
+	if m := reg.manifests["prod/app@v1"]; m == nil || m.Digest != listDigest {
+		t.Errorf("expected prod/app:v1 to be the promoted index, got %+v", m)
+	}
+	if m := reg.manifests["prod/app@"+manifestDigest]; m == nil || string(m.Body) != manifest {
+		t.Errorf("expected the manifest to be copied unchanged, got %+v", m)
+	}
+	for _, b := range [][]byte{config, layer} {
+		if _, ok := reg.blobs["prod/app@"+sha256Digest(b)]; !ok {
+			t.Errorf("expected blob %q to be copied", b)
+		}
+	}
+	if _, ok := reg.blobs["prod/app@"+sha256Digest(base)]; ok {
+		t.Errorf("expected the foreign layer not to be copied")
+	}
+
+	if _, err := PromoteImage(context.Background(), c, &ImageReference{Registry: host, Repository: "dev/app", Tag: "v1"}, target); err == nil {
+		t.Errorf("expected an error promoting an image by tag")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Provider creates and deletes the Windows machines that build the versions.
+// GCEProvider is the default. Backends for other clouds or hypervisors
+// implement it too, keeping their own state of a machine in Server.Data.
+type Provider interface {
+	// Create starts a new machine for the Windows version and image of bs.
+	Create(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error)
+	// FindExisting returns a running machine of bs to reuse, or nil if
+	// there is none.
+	FindExisting(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error)
+	// Delete deletes a machine returned by Create or FindExisting.
+	Delete(ctx context.Context, s *Server) error
+	// Credentials returns the WinRM username and password of the machine.
+	Credentials(ctx context.Context, s *Server) (string, string, error)
+	// IP returns the address to reach the machine at over WinRM.
+	IP(ctx context.Context, s *Server) (string, error)
+}
+
+// StartStopProvider is a Provider whose machines can be stopped after the
+// build and started again for reuse.
+type StartStopProvider interface {
+	Provider
+	// Start starts a stopped machine.
+	Start(ctx context.Context, s *Server) error
+	// Stop stops a machine, keeping its disks.
+	Stop(ctx context.Context, s *Server) error
+}
+
+// SuspendResumeProvider is a Provider whose machines can be suspended after
+// the build and resumed for reuse, with their memory, so running services
+// and caches, intact.
+type SuspendResumeProvider interface {
+	Provider
+	// Resume resumes a suspended machine.
+	Resume(ctx context.Context, s *Server) error
+	// Suspend suspends a machine, keeping its memory and disks.
+	Suspend(ctx context.Context, s *Server) error
+}
+
+// DockerCacheProvider is a Provider that can seed the docker data of new
+// machines from a snapshot of an earlier build of the same version.
+type DockerCacheProvider interface {
+	Provider
+	// SnapshotDockerCache snapshots the docker data of a machine after a
+	// successful build, docker is stopped meanwhile.
+	SnapshotDockerCache(ctx context.Context, s *Server, bs *WindowsBuildServerConfig) error
+}
+
+// connectServer sets the address, credentials and a new workspace folder
+// of the RemoteWindowsServer of s, a machine of p.
+func connectServer(ctx context.Context, p Provider, s *Server) error {
+	username, password, err := p.Credentials(ctx, s)
+	if err != nil {
+		log.Printf("Failed to get the credentials of %s: %+v", s.GetInstanceName(), err)
+		return err
+	}
+	ip, err := p.IP(ctx, s)
+	if err != nil {
+		log.Printf("Failed to get IP address: %+v", err)
+		return err
+	}
+	workspaceFolder := fmt.Sprintf(`C:\%s`, RandStringRunes(5))
+
+	s.Hostname = &ip
+	s.Username = &username
+	s.Password = &password
+	s.WorkspaceFolder = &workspaceFolder
+	return nil
+}
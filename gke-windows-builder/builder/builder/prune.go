@@ -0,0 +1,141 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RegistryTag is a tag of a repository. Uploaded is only known for
+// registries reporting it in the tag list, like Container Registry and
+// Artifact Registry, and zero otherwise.
+type RegistryTag struct {
+	Name     string
+	Digest   string
+	Uploaded time.Time
+}
+
+// tagList is the response of the tag list API, with the manifest details
+// added by Google registries.
+type tagList struct {
+	Tags     []string `json:"tags"`
+	Manifest map[string]struct {
+		Tag            []string `json:"tag"`
+		TimeUploadedMs string   `json:"timeUploadedMs"`
+	} `json:"manifest"`
+}
+
+var nextLinkRE = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ListTags lists the tags of the reference's repository.
+func (c *RegistryClient) ListTags(ctx context.Context, ref *ImageReference) ([]RegistryTag, error) {
+	var tags []RegistryTag
+	u := fmt.Sprintf("https://%s/v2/%s/tags/list", ref.Registry, ref.Repository)
+	for u != "" {
+		resp, body, err := c.do(ctx, ref, "pull", http.MethodGet, u, "", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed to list tags of %s, status: %s, body: %s", ref, resp.Status, body)
+		}
+		var list tagList
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("Failed to decode tags of %s: %+v", ref, err)
+		}
+		byTag := map[string]RegistryTag{}
+		for digest, m := range list.Manifest {
+			var uploaded time.Time
+			if ms, err := strconv.ParseInt(m.TimeUploadedMs, 10, 64); err == nil {
+				uploaded = time.Unix(0, ms*int64(time.Millisecond))
+			}
+			for _, tag := range m.Tag {
+				byTag[tag] = RegistryTag{Name: tag, Digest: digest, Uploaded: uploaded}
+			}
+		}
+		for _, tag := range list.Tags {
+			t, ok := byTag[tag]
+			if !ok {
+				t = RegistryTag{Name: tag}
+			}
+			tags = append(tags, t)
+		}
+
+		u = ""
+		if m := nextLinkRE.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next, err := resp.Request.URL.Parse(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid next link of the tags of %s: %+v", ref, err)
+			}
+			u = next.String()
+		}
+	}
+	return tags, nil
+}
+
+// DeleteTag deletes the tag of the reference. Images left without tags are
+// kept, to be cleaned up by the registry's own policies.
+func (c *RegistryClient) DeleteTag(ctx context.Context, ref *ImageReference) error {
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, url.PathEscape(ref.Tag))
+	resp, body, err := c.do(ctx, ref, "pull,push,delete", http.MethodDelete, u, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to delete tag %s, status: %s, body: %s", ref, resp.Status, body)
+	}
+	return nil
+}
+
+// TagsToPrune returns the tags matching the glob pattern to delete: those
+// uploaded before olderThan ago, except the keep most recent matching tags.
+// Tags without an upload time are never pruned. olderThan and keep are not
+// applied when 0.
+func TagsToPrune(tags []RegistryTag, pattern string, olderThan time.Duration, keep int, now time.Time) ([]RegistryTag, error) {
+	var matching []RegistryTag
+	for _, t := range tags {
+		ok, err := path.Match(pattern, t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern %q: %+v", pattern, err)
+		}
+		if ok && !t.Uploaded.IsZero() {
+			matching = append(matching, t)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].Uploaded.After(matching[j].Uploaded)
+	})
+
+	var prune []RegistryTag
+	for i, t := range matching {
+		if i < keep {
+			continue
+		}
+		if olderThan > 0 && now.Sub(t.Uploaded) < olderThan {
+			continue
+		}
+		prune = append(prune, t)
+	}
+	return prune, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListAndDeleteTags(t *testing.T) {
+	var deleted []string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodDelete:
+			deleted = append(deleted, req.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case req.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/ci/app/tags/list?last=v1_ltsc2022&n=2>; rel="next"`)
+			w.Write([]byte(`{"tags":["v1_ltsc2019","v1_ltsc2022"],"manifest":{
+				"sha256:a":{"tag":["v1_ltsc2019"],"timeUploadedMs":"1600000000000"},
+				"sha256:b":{"tag":["v1_ltsc2022"],"timeUploadedMs":"1600000001000"}}}`))
+		default:
+			w.Write([]byte(`{"tags":["v1"]}`))
+		}
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "https://")
+	c := &RegistryClient{httpClient: s.Client(), tokens: map[string]string{}}
+	ref := &ImageReference{Registry: host, Repository: "ci/app"}
+
+	tags, err := c.ListTags(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("ListTags failed: %v", err)
+	}
+	expected := []RegistryTag{
+		{Name: "v1_ltsc2019", Digest: "sha256:a", Uploaded: time.Unix(1600000000, 0)},
+		{Name: "v1_ltsc2022", Digest: "sha256:b", Uploaded: time.Unix(1600000001, 0)},
+		{Name: "v1"},
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %+v, got %+v", expected, tags)
+	}
+
+	if err := c.DeleteTag(context.Background(), &ImageReference{Registry: host, Repository: "ci/app", Tag: "v1_ltsc2019"}); err != nil {
+		t.Fatalf("DeleteTag failed: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"/v2/ci/app/manifests/v1_ltsc2019"}) {
+		t.Errorf("unexpected deletions %v", deleted)
+	}
+}
+
+func TestTagsToPrune(t *testing.T) {
+	now := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tags := []RegistryTag{
+		{Name: "a_ltsc2019", Uploaded: now.Add(-40 * day)},
+		{Name: "a", Uploaded: now.Add(-40 * day)},
+		{Name: "b_ltsc2019", Uploaded: now.Add(-20 * day)},
+		{Name: "c_ltsc2019", Uploaded: now.Add(-10 * day)},
+		{Name: "d_ltsc2019", Uploaded: now.Add(-1 * day)},
+		{Name: "e_ltsc2019"},
+	}
+	names := func(tags []RegistryTag) []string {
+		var n []string
+		for _, t := range tags {
+			n = append(n, t.Name)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name      string
+		olderThan time.Duration
+		keep      int
+		expected  []string
+	}{
+		{name: "older than", olderThan: 15 * day, expected: []string{"b_ltsc2019", "a_ltsc2019"}},
+		{name: "keep", keep: 3, expected: []string{"a_ltsc2019"}},
+		{name: "older than and keep", olderThan: 5 * day, keep: 3, expected: []string{"a_ltsc2019"}},
+		{name: "nothing old enough", olderThan: 50 * day},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prune, err := TagsToPrune(tags, "*_ltsc*", test.olderThan, test.keep, now)
+			if err != nil {
+				t.Fatalf("TagsToPrune failed: %v", err)
+			}
+			if got := names(prune); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v to be pruned, got %v", test.expected, got)
+			}
+		})
+	}
+
+	if _, err := TagsToPrune(tags, "[", 0, 1, now); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
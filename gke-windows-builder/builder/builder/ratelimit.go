@@ -0,0 +1,347 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// APILimiter rate limits the Compute Engine and Cloud Storage API calls of
+// all the clients it wraps, and retries the calls rejected by rate limits or
+// failing with transient errors, with jittered exponential backoff.
+type APILimiter struct {
+	// QPS is the maximum rate of calls shared by the wrapped clients,
+	// unlimited if 0.
+	QPS float64
+	// MaxRetries is the number of retries of a failing call.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry, doubled on every
+	// retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewAPILimiter returns an APILimiter allowing qps calls per second,
+// retried up to maxRetries times.
+func NewAPILimiter(qps float64, maxRetries int) *APILimiter {
+	return &APILimiter{
+		QPS:        qps,
+		MaxRetries: maxRetries,
+		BaseDelay:  time.Second,
+		MaxDelay:   32 * time.Second,
+	}
+}
+
+// wait blocks until the next call is allowed, or ctx is done.
+func (l *APILimiter) wait(ctx context.Context) error {
+	if l.QPS <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(time.Second) / l.QPS))
+	l.mu.Unlock()
+	return sleepContext(ctx, delay)
+}
+
+// sleepContext sleeps for d, or until ctx is done and returns its error.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// do runs call until it succeeds, fails with an error that can't be retried
+// or runs out of retries. Calls that are not idempotent are only retried
+// when rejected by a rate limit, as they may have been applied when failing
+// with a server error. It stops waiting, and returns the error of ctx, once
+// ctx is done.
+func (l *APILimiter) do(ctx context.Context, name string, idempotent bool, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+		err := call()
+		if err == nil || attempt >= l.MaxRetries || !isRetryableErr(err, idempotent) {
+			return err
+		}
+		delay := l.backoff(attempt, err)
+		log.Printf("Retrying %s in %v after error: %v", name, delay, err)
+		if serr := sleepContext(ctx, delay); serr != nil {
+			return fmt.Errorf("%s aborted while retrying after error %v: %w", name, err, serr)
+		}
+	}
+}
+
+// backoff returns the delay before retry attempt+1: the exponential delay
+// with jitter, or the delay asked by the server if longer.
+func (l *APILimiter) backoff(attempt int, err error) time.Duration {
+	delay := l.BaseDelay << uint(attempt)
+	if delay > l.MaxDelay || delay <= 0 {
+		delay = l.MaxDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Header != nil {
+		if seconds, perr := strconv.Atoi(apiErr.Header.Get("Retry-After")); perr == nil && time.Duration(seconds)*time.Second > delay {
+			delay = time.Duration(seconds) * time.Second
+		}
+	}
+	return delay
+}
+
+// Check if the error is a rate limit error, or a transient server error of
+// an idempotent call.
+func isRetryableErr(err error, idempotent bool) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		// googleapi: Error 403: Rate Limit Exceeded, rateLimitExceeded
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// Compute wraps c so its calls are limited by l.
+func (l *APILimiter) Compute(c ComputeClient) ComputeClient {
+	return &limitedComputeClient{c: c, l: l}
+}
+
+// Storage wraps c so its calls are limited by l.
+func (l *APILimiter) Storage(c StorageClient) StorageClient {
+	return &limitedStorageClient{c: c, l: l}
+}
+
+// limitedComputeClient implements ComputeClient with the calls of c limited by l.
+// ComputeClient calls take no context, so their retries are not cancelled.
+type limitedComputeClient struct {
+	c ComputeClient
+	l *APILimiter
+}
+
+func (c *limitedComputeClient) GetInstance(projectID string, zone string, name string) (instance *compute.Instance, err error) {
+	err = c.l.do(context.Background(), "GetInstance "+name, true, func() error {
+		instance, err = c.c.GetInstance(projectID, zone, name)
+		return err
+	})
+	return instance, err
+}
+
+func (c *limitedComputeClient) ListInstances(projectID string, zone string, filter string) (instances []*compute.Instance, err error) {
+	err = c.l.do(context.Background(), "ListInstances", true, func() error {
+		instances, err = c.c.ListInstances(projectID, zone, filter)
+		return err
+	})
+	return instances, err
+}
+
+func (c *limitedComputeClient) InsertInstance(projectID string, zone string, instance *compute.Instance) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "InsertInstance "+instance.Name, false, func() error {
+		op, err = c.c.InsertInstance(projectID, zone, instance)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) DeleteInstance(projectID string, zone string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "DeleteInstance "+name, false, func() error {
+		op, err = c.c.DeleteInstance(projectID, zone, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) StartInstance(projectID string, zone string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "StartInstance "+name, false, func() error {
+		op, err = c.c.StartInstance(projectID, zone, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) StopInstance(projectID string, zone string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "StopInstance "+name, false, func() error {
+		op, err = c.c.StopInstance(projectID, zone, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) SuspendInstance(projectID string, zone string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "SuspendInstance "+name, false, func() error {
+		op, err = c.c.SuspendInstance(projectID, zone, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) ResumeInstance(projectID string, zone string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "ResumeInstance "+name, false, func() error {
+		op, err = c.c.ResumeInstance(projectID, zone, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) SetInstanceMetadata(projectID string, zone string, name string, metadata *compute.Metadata) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "SetInstanceMetadata "+name, false, func() error {
+		op, err = c.c.SetInstanceMetadata(projectID, zone, name, metadata)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) ListSnapshots(projectID string, filter string) (snapshots []*compute.Snapshot, err error) {
+	err = c.l.do(context.Background(), "ListSnapshots", true, func() error {
+		snapshots, err = c.c.ListSnapshots(projectID, filter)
+		return err
+	})
+	return snapshots, err
+}
+
+func (c *limitedComputeClient) CreateSnapshot(projectID string, zone string, disk string, snapshot *compute.Snapshot) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "CreateSnapshot "+snapshot.Name, false, func() error {
+		op, err = c.c.CreateSnapshot(projectID, zone, disk, snapshot)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) DeleteSnapshot(projectID string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "DeleteSnapshot "+name, false, func() error {
+		op, err = c.c.DeleteSnapshot(projectID, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) GetSerialPortOutput(projectID string, zone string, name string, port int64) (output string, err error) {
+	err = c.l.do(context.Background(), "GetSerialPortOutput "+name, true, func() error {
+		output, err = c.c.GetSerialPortOutput(projectID, zone, name, port)
+		return err
+	})
+	return output, err
+}
+
+func (c *limitedComputeClient) GetZoneOperation(projectID string, zone string, name string) (op *compute.Operation, err error) {
+	err = c.l.do(context.Background(), "GetZoneOperation "+name, true, func() error {
+		op, err = c.c.GetZoneOperation(projectID, zone, name)
+		return err
+	})
+	return op, err
+}
+
+func (c *limitedComputeClient) ListFirewalls(projectID string) (firewalls []*compute.Firewall, err error) {
+	err = c.l.do(context.Background(), "ListFirewalls", true, func() error {
+		firewalls, err = c.c.ListFirewalls(projectID)
+		return err
+	})
+	return firewalls, err
+}
+
+// limitedStorageClient implements StorageClient with the calls of c limited by l.
+type limitedStorageClient struct {
+	c StorageClient
+	l *APILimiter
+}
+
+func (c *limitedStorageClient) GetBucketAttrs(ctx context.Context, bucket string) (attrs *storage.BucketAttrs, err error) {
+	err = c.l.do(ctx, "GetBucketAttrs "+bucket, true, func() error {
+		attrs, err = c.c.GetBucketAttrs(ctx, bucket)
+		return err
+	})
+	return attrs, err
+}
+
+func (c *limitedStorageClient) CreateBucket(ctx context.Context, projectID string, bucket string, attrs *storage.BucketAttrs) error {
+	return c.l.do(ctx, "CreateBucket "+bucket, false, func() error {
+		return c.c.CreateBucket(ctx, projectID, bucket, attrs)
+	})
+}
+
+// WriteObject retries the write only if r can be rewound.
+func (c *limitedStorageClient) WriteObject(ctx context.Context, bucket string, object string, r io.Reader, metadata map[string]string) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		if err := c.l.wait(ctx); err != nil {
+			return err
+		}
+		return c.c.WriteObject(ctx, bucket, object, r, metadata)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return c.l.do(ctx, "WriteObject "+object, true, func() error {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		return c.c.WriteObject(ctx, bucket, object, r, metadata)
+	})
+}
+
+func (c *limitedStorageClient) ReadObject(ctx context.Context, bucket string, object string) (rc io.ReadCloser, err error) {
+	err = c.l.do(ctx, "ReadObject "+object, true, func() error {
+		rc, err = c.c.ReadObject(ctx, bucket, object)
+		return err
+	})
+	return rc, err
+}
+
+func (c *limitedStorageClient) DeleteObject(ctx context.Context, bucket string, object string) error {
+	return c.l.do(ctx, "DeleteObject "+object, false, func() error {
+		return c.c.DeleteObject(ctx, bucket, object)
+	})
+}
+
+func (c *limitedStorageClient) Close() error {
+	return c.c.Close()
+}
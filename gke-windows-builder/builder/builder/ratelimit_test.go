@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"gke-windows-builder/builder/builder/fake"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// flakyComputeClient fails the first calls of GetInstance and InsertInstance
+// with err.
+type flakyComputeClient struct {
+	*fake.ComputeClient
+	err      error
+	failures int
+	calls    int
+}
+
+func (c *flakyComputeClient) GetInstance(projectID string, zone string, name string) (*compute.Instance, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return &compute.Instance{Name: name}, nil
+}
+
+func (c *flakyComputeClient) InsertInstance(projectID string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return &compute.Operation{Name: "insert"}, nil
+}
+
+func newTestAPILimiter() *APILimiter {
+	l := NewAPILimiter(0, 3)
+	l.BaseDelay = time.Millisecond
+	l.MaxDelay = 4 * time.Millisecond
+	return l
+}
+
+func TestAPILimiter_retries(t *testing.T) {
+	rateLimited := &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	notFound := &googleapi.Error{Code: http.StatusNotFound}
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		insert    bool
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "rate limited", err: rateLimited, failures: 2, wantCalls: 3},
+		{name: "too many requests", err: &googleapi.Error{Code: http.StatusTooManyRequests}, failures: 3, wantCalls: 4},
+		{name: "out of retries", err: rateLimited, failures: 4, wantErr: true, wantCalls: 4},
+		{name: "not found", err: notFound, failures: 1, wantErr: true, wantCalls: 1},
+		{name: "server error", err: unavailable, failures: 1, wantCalls: 2},
+		{name: "server error on insert", err: unavailable, failures: 1, insert: true, wantErr: true, wantCalls: 1},
+		{name: "rate limited insert", err: rateLimited, failures: 1, insert: true, wantCalls: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flaky := &flakyComputeClient{ComputeClient: fake.NewComputeClient(nil), err: test.err, failures: test.failures}
+			c := newTestAPILimiter().Compute(flaky)
+			var err error
+			if test.insert {
+				_, err = c.InsertInstance("project", "zone", &compute.Instance{Name: "instance"})
+			} else {
+				_, err = c.GetInstance("project", "zone", "instance")
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("expected error %v, got %v", test.wantErr, err)
+			}
+			if flaky.calls != test.wantCalls {
+				t.Errorf("expected %d calls, got %d", test.wantCalls, flaky.calls)
+			}
+		})
+	}
+}
+
+func TestAPILimiter_qps(t *testing.T) {
+	l := NewAPILimiter(100, 0)
+	c := l.Compute(fake.NewComputeClient(nil))
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		c.ListFirewalls("project")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected 11 calls at 100 QPS to take at least 100ms, took %v", elapsed)
+	}
+}
+
+func TestAPILimiter_cancel(t *testing.T) {
+	l := NewAPILimiter(0, 5)
+	l.BaseDelay = time.Minute
+	l.MaxDelay = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := l.do(ctx, "GetBucketAttrs", true, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusTooManyRequests}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the retry to be aborted by the context, got %v", err)
+	}
+	if elapsed := time.Since(start); calls != 1 || elapsed > 10*time.Second {
+		t.Errorf("expected a single call aborted in its backoff, got %d calls in %v", calls, elapsed)
+	}
+	if err := l.do(ctx, "GetBucketAttrs", true, func() error { return nil }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected no call with a done context, got %v", err)
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Manifest and index media types understood by the registry client.
+const (
+	DockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	DockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	OCIManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	OCIIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+)
+
+var acceptedManifestMediaTypes = []string{
+	DockerManifestMediaType,
+	DockerManifestListMediaType,
+	OCIManifestMediaType,
+	OCIIndexMediaType,
+}
+
+// ErrManifestNotFound is returned when the registry has no manifest for a reference.
+var ErrManifestNotFound = errors.New("manifest not found")
+
+var (
+	repositoryRE = regexp.MustCompile(`^[a-z0-9]+(([._]|__|-+)[a-z0-9]+)*(/[a-z0-9]+(([._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRE        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRE     = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// ImageReference is a parsed container image reference such as
+// us-docker.pkg.dev/project/repo/image:tag or gcr.io/project/image@sha256:abc.
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseImageReference splits an image reference into registry, repository,
+// tag and digest. A missing tag defaults to "latest". The registry host is
+// required, as the builder never pushes to Docker Hub implicitly. As in the
+// docker reference grammar, the first path component is a host if it has a
+// "." or a ":", or is localhost.
+func ParseImageReference(ref string) (*ImageReference, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || (!strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost") {
+		return nil, fmt.Errorf("image reference %q must include a registry host", ref)
+	}
+	r := &ImageReference{Registry: strings.ToLower(parts[0])}
+	name := parts[1]
+	if i := strings.Index(name, "@"); i >= 0 {
+		r.Digest = name[i+1:]
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		r.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("image reference %q has an empty repository", ref)
+	}
+	if !repositoryRE.MatchString(name) {
+		return nil, fmt.Errorf("image reference %q has an invalid repository %q, it must be lowercase", ref, name)
+	}
+	if r.Tag != "" && !tagRE.MatchString(r.Tag) {
+		return nil, fmt.Errorf("image reference %q has an invalid tag %q", ref, r.Tag)
+	}
+	if r.Digest != "" && !digestRE.MatchString(r.Digest) {
+		return nil, fmt.Errorf("image reference %q has an invalid digest %q", ref, r.Digest)
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+	r.Repository = name
+	return r, nil
+}
+
+// Reference returns the tag or digest part of the reference as used in
+// registry API manifest URLs. The digest wins when both are set.
+func (r *ImageReference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r *ImageReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// isGoogleRegistry returns true for Container Registry and Artifact Registry
+// hosts, which accept Google OAuth2 access tokens.
+func isGoogleRegistry(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, ".pkg.dev")
+}
+
+// metadataTokenPS1 is a PowerShell expression for an access token of the
+// service account of the instance, from the metadata server. It replaces
+// gcloud and gsutil, which minimal custom images may not have.
+const metadataTokenPS1 = `(Invoke-RestMethod -Headers @{'Metadata-Flavor'='Google'} -Uri 'http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token').access_token`
+
+// dockerAuthScript returns the PowerShell command that logs docker on a
+// build instance in to host, with an access token of the instance service
+// account. Container Registry and Artifact Registry hosts, regional ones
+// included, and custom domains in front of them all accept it. The token
+// expires after an hour, so long builds must log in again before pushing.
+func dockerAuthScript(host string) string {
+	return fmt.Sprintf("%s | docker login -u oauth2accesstoken --password-stdin https://%s", metadataTokenPS1, host)
+}
+
+// RegistryManifest is a manifest or index fetched from a registry.
+type RegistryManifest struct {
+	MediaType string
+	Digest    string
+	Body      []byte
+}
+
+// RegistryClient talks to the Docker Registry HTTP API V2. Google registries
+// are authenticated with application default credentials, other registries
+// anonymously.
+type RegistryClient struct {
+	httpClient  *http.Client
+	tokenSource oauth2.TokenSource
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewRegistryClient creates a RegistryClient. Failing to find application
+// default credentials is not an error, anonymous access is used instead.
+func NewRegistryClient(ctx context.Context) *RegistryClient {
+	c := &RegistryClient{
+		httpClient: http.DefaultClient,
+		tokens:     map[string]string{},
+	}
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		log.Printf("No application default credentials found, using anonymous registry access: %v", err)
+	} else {
+		c.tokenSource = ts
+	}
+	return c
+}
+
+// GetManifest fetches the manifest for the given reference.
+func (c *RegistryClient) GetManifest(ctx context.Context, ref *ImageReference) (*RegistryManifest, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, ref.Reference())
+	resp, body, err := c.do(ctx, ref, "pull", http.MethodGet, u, "", nil, acceptedManifestMediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", ref, ErrManifestNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get manifest %s, status: %s, body: %s", ref, resp.Status, body)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = sha256Digest(body)
+	}
+	return &RegistryManifest{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest,
+		Body:      body,
+	}, nil
+}
+
+// PutManifest uploads body as the manifest for the given reference and
+// returns its digest.
+func (c *RegistryClient) PutManifest(ctx context.Context, ref *ImageReference, mediaType string, body []byte) (string, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, ref.Reference())
+	resp, respBody, err := c.do(ctx, ref, "pull,push", http.MethodPut, u, mediaType, body, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to put manifest %s, status: %s, body: %s", ref, resp.Status, respBody)
+	}
+	return sha256Digest(body), nil
+}
+
+// GetBlob fetches the blob with the given digest from the reference's repository.
+func (c *RegistryClient) GetBlob(ctx context.Context, ref *ImageReference, digest string) ([]byte, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
+	resp, body, err := c.do(ctx, ref, "pull", http.MethodGet, u, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get blob %s from %s, status: %s", digest, ref, resp.Status)
+	}
+	return body, nil
+}
+
+// BlobExists checks whether the reference's repository has the blob with the given digest.
+func (c *RegistryClient) BlobExists(ctx context.Context, ref *ImageReference, digest string) (bool, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
+	resp, _, err := c.do(ctx, ref, "pull", http.MethodHead, u, "", nil, nil)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("Failed to check blob %s in %s, status: %s", digest, ref, resp.Status)
+}
+
+// OpenBlob streams the blob with the given digest from the reference's
+// repository. The caller must close it.
+func (c *RegistryClient) OpenBlob(ctx context.Context, ref *ImageReference, digest string) (io.ReadCloser, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, digest)
+	resp, err := c.stream(ctx, ref, "pull", http.MethodGet, u, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to get blob %s from %s, status: %s", digest, ref, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// PutBlob uploads size bytes from r as the blob with the given digest to the
+// reference's repository, in a single request.
+func (c *RegistryClient) PutBlob(ctx context.Context, ref *ImageReference, digest string, size int64, r io.Reader) error {
+	u := fmt.Sprintf("https://%s/v2/%s/blobs/uploads/", ref.Registry, ref.Repository)
+	resp, body, err := c.do(ctx, ref, "pull,push", http.MethodPost, u, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Failed to start blob upload to %s, status: %s, body: %s", ref, resp.Status, body)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("Blob upload to %s returned no location: %+v", ref, err)
+	}
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	// The upload was authorized by the request above, r can't be re-read for a retry.
+	used := false
+	header := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	resp, err = c.stream(ctx, ref, "pull,push", http.MethodPut, location.String(), header, func() io.Reader {
+		if used {
+			return strings.NewReader("")
+		}
+		used = true
+		return r
+	}, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Failed to upload blob %s to %s, status: %s, body: %s", digest, ref, resp.Status, body)
+	}
+	return nil
+}
+
+// do sends a registry request, answering a Bearer or Basic authentication
+// challenge once if the registry asks for one.
+func (c *RegistryClient) do(ctx context.Context, ref *ImageReference, actions string, method string, u string, contentType string, body []byte, accept []string) (*http.Response, []byte, error) {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if len(accept) > 0 {
+		header.Set("Accept", strings.Join(accept, ","))
+	}
+	resp, err := c.stream(ctx, ref, actions, method, u, header, func() io.Reader { return bytes.NewReader(body) }, int64(len(body)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp, respBody, err
+}
+
+// stream sends a registry request and returns the response with its body
+// unread, for blobs too large to hold in memory. newBody is called for each
+// attempt, it is retried once after answering an authentication challenge.
+func (c *RegistryClient) stream(ctx context.Context, ref *ImageReference, actions string, method string, u string, header http.Header, newBody func() io.Reader, size int64) (*http.Response, error) {
+	scope := fmt.Sprintf("repository:%s:%s", ref.Repository, actions)
+	send := func(authorization string) (*http.Response, error) {
+		var body io.Reader
+		if newBody != nil {
+			body = newBody()
+		}
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.ContentLength = size
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return c.httpClient.Do(req)
+	}
+
+	c.mu.Lock()
+	authorization := c.tokens[ref.Registry+" "+scope]
+	c.mu.Unlock()
+
+	resp, err := send(authorization)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	authorization, err = c.authorize(ctx, ref.Registry, scope, resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.tokens[ref.Registry+" "+scope] = authorization
+	c.mu.Unlock()
+	return send(authorization)
+}
+
+// authorize answers a WWW-Authenticate challenge and returns the value of
+// the Authorization header to use.
+func (c *RegistryClient) authorize(ctx context.Context, host string, scope string, challenge string) (string, error) {
+	user, password, err := c.credentials(host)
+	if err != nil {
+		return "", err
+	}
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if user == "" {
+			return "", fmt.Errorf("Registry %s requires basic authentication but no credentials are available", host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)), nil
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return "", fmt.Errorf("Registry %s returned an invalid auth challenge: %q", host, challenge)
+		}
+		q := realm.Query()
+		if params["service"] != "" {
+			q.Set("service", params["service"])
+		}
+		q.Set("scope", scope)
+		realm.RawQuery = q.Encode()
+		req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		req = req.WithContext(ctx)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Failed to get a registry token from %s, status: %s", realm.Host, resp.Status)
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", fmt.Errorf("Failed to decode registry token response: %+v", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	}
+	return "", fmt.Errorf("Registry %s returned an unsupported auth challenge: %q", host, challenge)
+}
+
+// credentials returns the username and password to present to host, or
+// empty strings for anonymous access.
+func (c *RegistryClient) credentials(host string) (string, string, error) {
+	if !isGoogleRegistry(host) || c.tokenSource == nil {
+		return "", "", nil
+	}
+	token, err := c.tokenSource.Token()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get an access token for %s: %+v", host, err)
+	}
+	return "oauth2accesstoken", token.AccessToken, nil
+}
+
+// parseAuthChallenge parses a header such as
+// `Bearer realm="https://gcr.io/v2/token",service="gcr.io"`.
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	// Values may be quoted and contain commas, e.g. scope="repository:a:pull,push".
+	var key, value strings.Builder
+	inKey, inQuotes := true, false
+	flush := func() {
+		if k := strings.TrimSpace(key.String()); k != "" {
+			params[k] = strings.TrimSpace(value.String())
+		}
+		key.Reset()
+		value.Reset()
+		inKey = true
+	}
+	for _, ch := range parts[1] {
+		switch {
+		case ch == '"':
+			inQuotes = !inQuotes
+		case ch == '=' && inKey && !inQuotes:
+			inKey = false
+		case ch == ',' && !inQuotes:
+			flush()
+		case inKey:
+			key.WriteRune(ch)
+		default:
+			value.WriteRune(ch)
+		}
+	}
+	flush()
+	return parts[0], params
+}
+
+func sha256Digest(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	for ref, expected := range map[string]ImageReference{
+		"gcr.io/project/image:tag": {
+			Registry: "gcr.io", Repository: "project/image", Tag: "tag",
+		},
+		"us-docker.pkg.dev/project/repo/image": {
+			Registry: "us-docker.pkg.dev", Repository: "project/repo/image", Tag: "latest",
+		},
+		"localhost:5000/image:v1_ltsc2019": {
+			Registry: "localhost:5000", Repository: "image", Tag: "v1_ltsc2019",
+		},
+		"gcr.io/project/image@sha256:abc": {
+			Registry: "gcr.io", Repository: "project/image", Digest: "sha256:abc",
+		},
+		"europe-west4-docker.pkg.dev/project/repo/team/image:1.0-ltsc2022": {
+			Registry: "europe-west4-docker.pkg.dev", Repository: "project/repo/team/image", Tag: "1.0-ltsc2022",
+		},
+		"localhost/image:tag": {
+			Registry: "localhost", Repository: "image", Tag: "tag",
+		},
+		"localhost/team/image@sha256:abc": {
+			Registry: "localhost", Repository: "team/image", Digest: "sha256:abc",
+		},
+	} {
+		actual, err := ParseImageReference(ref)
+		if err != nil {
+			t.Fatalf("ParseImageReference(%q) failed: %v", ref, err)
+		}
+		if *actual != expected {
+			t.Errorf("ParseImageReference(%q) = %+v, expected %+v", ref, *actual, expected)
+		}
+		if actual.String() != ref && expected.Tag != "latest" {
+			t.Errorf("expected %+v to format as %q, got %q", expected, ref, actual.String())
+		}
+	}
+
+	for _, ref := range []string{"image:tag", "project/image", "gcr.io/", "gcr.io/Project/image", "gcr.io/project/image:-tag", "gcr.io/project/image@abc", "localhosts/image:tag"} {
+		if _, err := ParseImageReference(ref); err == nil {
+			t.Errorf("expected ParseImageReference(%q) to fail", ref)
+		}
+	}
+}
+
+func TestDockerAuthScript(t *testing.T) {
+	for _, host := range []string{"gcr.io", "eu.gcr.io", "us-central1-docker.pkg.dev", "images.example.com"} {
+		expected := metadataTokenPS1 + " | docker login -u oauth2accesstoken --password-stdin https://" + host
+		if actual := dockerAuthScript(host); actual != expected {
+			t.Errorf("dockerAuthScript(%q) = %q, expected %q", host, actual, expected)
+		}
+		if strings.Contains(dockerAuthScript(host), "gcloud") {
+			t.Errorf("expected dockerAuthScript(%q) not to need gcloud", host)
+		}
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://gcr.io/v2/token",service="gcr.io",scope="repository:p/i:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("expected scheme Bearer, got %q", scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://gcr.io/v2/token",
+		"service": "gcr.io",
+		"scope":   "repository:p/i:pull,push",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, params[k])
+		}
+	}
+	if len(params) != len(expected) {
+		t.Errorf("expected %d params, got %v", len(expected), params)
+	}
+}
+
+func TestCreateOCIIndex(t *testing.T) {
+	reg, s := newTestRegistry()
+	defer s.Close()
+	reg.token = "test-token"
+	host := strings.TrimPrefix(s.URL, "https://")
+	c := &RegistryClient{httpClient: s.Client(), tokens: map[string]string{}}
+
+	config := []byte(`{"architecture":"amd64","os":"windows","os.version":"10.0.20348.1"}`)
+	reg.blobs["app@"+sha256Digest(config)] = config
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":%q},"layers":[]}`,
+		DockerManifestMediaType, len(config), sha256Digest(config)))
+	manifestDigest := reg.putManifest("app", []string{"v1_ltsc2022"}, DockerManifestMediaType, manifest)
+
+	target := host + "/app:v1"
+	sources := []string{target + "_ltsc2022", target + "_ltsc2019"}
+	annotations := map[string]string{"org.opencontainers.image.revision": "abc"}
+	if err := createOCIIndex(context.Background(), c, target, sources, annotations); err != nil {
+		t.Fatalf("createOCIIndex failed: %v", err)
+	}
+
+	pushed := reg.manifests["app@v1"]
+	if pushed == nil {
+		t.Fatalf("expected the index to be pushed as app:v1, got %v", reg.manifests)
+	}
+	if pushed.MediaType != OCIIndexMediaType {
+		t.Errorf("expected the index to be pushed as %s, got %s", OCIIndexMediaType, pushed.MediaType)
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(pushed.Body, &index); err != nil {
+		t.Fatalf("failed to decode the pushed index: %v", err)
+	}
+	want := []OCIDescriptor{{
+		MediaType: DockerManifestMediaType,
+		Digest:    manifestDigest,
+		Size:      int64(len(manifest)),
+		Platform:  &OCIPlatform{Architecture: "amd64", OS: "windows", OSVersion: "10.0.20348.1"},
+	}}
+	if index.MediaType != OCIIndexMediaType || !reflect.DeepEqual(index.Manifests, want) || !reflect.DeepEqual(index.Annotations, annotations) {
+		t.Errorf("unexpected index, the missing ltsc2019 image should be skipped: %s", pushed.Body)
+	}
+	wantScopes := []string{"repository:app:pull", "repository:app:pull,push"}
+	if !reflect.DeepEqual(reg.scopes, wantScopes) {
+		t.Errorf("expected a token per scope, got %v", reg.scopes)
+	}
+
+	if err := createOCIIndex(context.Background(), c, target, []string{target + "_ltsc2019"}, nil); err == nil {
+		t.Error("expected an index without any existing image to fail")
+	}
+}
@@ -20,10 +20,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"gke-windows-builder/builder/builder/archive"
+
 	"github.com/masterzen/winrm"
 	"github.com/packer-community/winrmcp/winrmcp"
 )
@@ -35,39 +39,306 @@ type RemoteWindowsServer struct {
 	Password        *string
 	WorkspaceBucket *string
 	WorkspaceFolder *string
+	// Storage is used to stage the workspace in WorkspaceBucket.
+	Storage StorageClient
+	// Executor runs commands on the server. Defaults to WinRM when nil.
+	Executor RemoteExecutor
+	// Output, when set, gets a copy of the output of the remote commands
+	// in addition to stdout and stderr.
+	Output io.Writer
+	// WorkspaceExcludes are local paths left out of the workspace when
+	// copying it via WorkspaceBucket.
+	WorkspaceExcludes []string
+	// WorkspaceIncludes, when set, are the glob patterns of the paths,
+	// relative to the workspace, that are copied via WorkspaceBucket.
+	WorkspaceIncludes []string
+	// WorkspaceSymlinks is how symlinks of the workspace are copied via
+	// WorkspaceBucket: skip (the default), follow or error.
+	WorkspaceSymlinks string
+	// WorkspaceLimits guard against copying a huge workspace via
+	// WorkspaceBucket.
+	WorkspaceLimits archive.Limits
+	// ObjectMetadata is the custom metadata of the objects written to
+	// WorkspaceBucket, e.g. for cost attribution.
+	ObjectMetadata map[string]string
+	// Inventory, when set, records the objects written to WorkspaceBucket.
+	Inventory *Inventory
+	// Deadline, when set, cancels the remote commands still running at that
+	// time and shortens the timeouts of the later ones.
+	Deadline time.Time
+	// RegistryLoggedIn is set when docker on the server is already logged in
+	// to the registries, so the builds don't log in with the access tokens
+	// of the GCE metadata server.
+	RegistryLoggedIn bool
+	// IdleTimeout, when set, aborts the remote commands that write no output
+	// for that long.
+	IdleTimeout time.Duration
+	// ClientCert and ClientKey, when set, are the PEM encoded WinRM client
+	// certificate and key of Username, used instead of Password.
+	ClientCert []byte
+	ClientKey  []byte
+	// WinRMTLS is the TLS configuration of the WinRM connections.
+	WinRMTLS WinRMTLS
+	// Scripts, when set, override the default CopyWorkspaceScript.
+	Scripts *Scripts
+	// ReadyPollInterval is the first wait between the readiness checks of
+	// WaitForServerBeReady, doubled after each failed check up to
+	// ReadyPollMaxInterval. They default to DefaultReadyPollInterval and
+	// DefaultReadyPollMaxInterval.
+	ReadyPollInterval    time.Duration
+	ReadyPollMaxInterval time.Duration
+	// InstanceStatus, when set, returns the status of the GCE instance of
+	// the server, WaitForServerBeReady stops waiting once the instance is
+	// stopped, suspended or terminated.
+	InstanceStatus func() (string, error)
+}
+
+// Defaults of RemoteWindowsServer.ReadyPollInterval and ReadyPollMaxInterval.
+const (
+	DefaultReadyPollInterval    = 5 * time.Second
+	DefaultReadyPollMaxInterval = 30 * time.Second
+)
+
+// terminalInstanceStatuses are the GCE instance statuses in which a server
+// won't become ready.
+var terminalInstanceStatuses = map[string]bool{
+	"STOPPING":   true,
+	"STOPPED":    true,
+	"SUSPENDING": true,
+	"SUSPENDED":  true,
+	"TERMINATED": true,
+}
+
+// RemoteExecutor runs commands on, and copies files to, a remote Windows server.
+type RemoteExecutor interface {
+	// Run runs command in the remote directory path within timeout, writing
+	// its output to stdout and stderr. The command is aborted when ctx is done.
+	Run(ctx context.Context, command string, path string, timeout time.Duration, stdout io.Writer, stderr io.Writer) error
+	// Copy copies the local directory inputPath to the remote directory remotePath.
+	Copy(inputPath string, remotePath string, timeout time.Duration) error
+}
+
+// winRMExecutor implements RemoteExecutor over WinRM HTTPS.
+type winRMExecutor struct {
+	hostname string
+	username string
+	password string
+	// clientCert and clientKey, when set, authenticate instead of the
+	// password.
+	clientCert []byte
+	clientKey  []byte
+	tls        WinRMTLS
+}
+
+// NewWinRMExecutor returns a RemoteExecutor connecting to hostname over WinRM HTTPS.
+func NewWinRMExecutor(hostname string, username string, password string) RemoteExecutor {
+	return &winRMExecutor{hostname: hostname, username: username, password: password}
+}
+
+// NewWinRMCertExecutor returns a RemoteExecutor connecting to hostname over
+// WinRM HTTPS with the PEM encoded client certificate and key of username.
+func NewWinRMCertExecutor(hostname string, username string, clientCert []byte, clientKey []byte) RemoteExecutor {
+	return &winRMExecutor{hostname: hostname, username: username, clientCert: clientCert, clientKey: clientKey}
+}
+
+// transportDecorator returns the transport enforcing the TLS configuration
+// of the executor, which also authenticates with its client certificate.
+func (e *winRMExecutor) transportDecorator() func() winrm.Transporter {
+	return func() winrm.Transporter {
+		return &winRMTransporter{tls: e.tls, username: e.username, password: e.password, cert: e.clientCert, key: e.clientKey}
+	}
 }
 
 // WindowsBuildServerConfig stores the configs of windows build server.
 type WindowsBuildServerConfig struct {
 	InstanceNamePrefix *string
-	ImageVersion       *string
-	ImageURL           *string
-	Zone               *string
-	NetworkConfig      *InstanceNetworkConfig
-	Labels             *string
-	MachineType        *string
-	ServiceAccount     *string
-	BootDiskType       *string
-	BootDiskSizeGB     int64
-	UseInternalIP      bool
-	ExternalNAT        bool
-	ReuseInstance      bool
+	// InstanceNameTemplate names the new instances, DefaultInstanceNameTemplate
+	// is used if empty. BuildID is the value of its {buildid} placeholder.
+	InstanceNameTemplate string
+	BuildID              string
+	ImageVersion         *string
+	ImageURL             *string
+	Zone                 *string
+	NetworkConfig        *InstanceNetworkConfig
+	Labels               *string
+	MachineType          *string
+	ServiceAccount       *string
+	BootDiskType         *string
+	BootDiskSizeGB       int64
+	UseInternalIP        bool
+	ExternalNAT          bool
+	ReuseInstance        bool
+	// UseInstances, when set, are the names of existing instances of the
+	// version to build on, one of them is picked. They are never deleted.
+	UseInstances []string
+	// StopInstances stops the instances after the build instead of deleting
+	// them or keeping them running, with ReuseInstance stopped instances are
+	// started for reuse. Stopped instances keep their disks, and so the
+	// docker image cache, at the cost of the disks only.
+	StopInstances bool
+	// SuspendInstances suspends the instances after the build instead, with
+	// ReuseInstance suspended instances are resumed for reuse. Unlike stopped
+	// ones they keep their memory, so docker is ready soon after resuming.
+	SuspendInstances bool
+	// DockerDaemonConfig is the daemon.json content written on the instance
+	// before docker starts, Docker defaults are kept if empty. It only
+	// applies to new instances, reused ones keep their configuration.
+	DockerDaemonConfig string
+	// TrustedCACerts, when set, is a PEM bundle of CA certificates new
+	// instances add to their root store, and to the docker certs.d folders
+	// of TrustedCARegistries, e.g. of a private registry or proxy, see
+	// ReadTrustedCACerts.
+	TrustedCACerts      []byte
+	TrustedCARegistries []string
+	// DockerCacheSnapshots puts the docker data-root on a separate disk of
+	// DockerCacheDiskSizeGB, seeded from the latest snapshot of the version
+	// and snapshotted after successful builds, so that new instances start
+	// with the layer cache of the previous build.
+	DockerCacheSnapshots  bool
+	DockerCacheDiskSizeGB int64
+	// DefenderMode is "uninstall" to remove Windows Defender from the
+	// instance, or "exclude" to keep it with exclusions for the docker and
+	// workspace folders.
+	DefenderMode string
+	// InstallWindowsUpdates installs the pending Windows updates, rebooting
+	// as needed, before docker is set up on new instances.
+	InstallWindowsUpdates bool
+	// InstallPackages are the Chocolatey or winget packages new instances
+	// install during setup, e.g. git or an SDK the build needs on the host.
+	InstallPackages []InstallPackage
+	// The Skip* options leave the corresponding step of the setup script out,
+	// for images that are already provisioned or hardened.
+	SkipDockerInstall   bool
+	SkipDefenderRemoval bool
+	SkipWinRMConfig     bool
+	// WinRMClientCert and WinRMClientKey, when set, are the PEM encoded
+	// client certificate and key that new instances map to their builder
+	// user for WinRM certificate authentication, instead of enabling basic
+	// authentication and resetting the password.
+	WinRMClientCert []byte
+	WinRMClientKey  []byte
+	// WinRMTLS is the TLS configuration of the WinRM connections, which new
+	// instances also apply to their WinRM HTTPS listener.
+	WinRMTLS WinRMTLS
+	// Scripts, when set, override the default SetupScript of new instances.
+	Scripts *Scripts
+	// AutomaticRestart, OnHostMaintenance (MIGRATE or TERMINATE) and
+	// ProvisioningModel (STANDARD or PREEMPTIBLE) set the instance scheduling,
+	// GCE defaults are used when unset.
+	AutomaticRestart  *bool
+	OnHostMaintenance string
+	ProvisioningModel string
+	// PlacementPolicy is a resource policy attached to the instances, e.g. a
+	// compact placement policy to keep the parallel builds close together.
+	PlacementPolicy string
+}
+
+// NewWindowsBuildServerConfig returns the configuration of GCE instances in
+// zone of projectID, on its default network with an external IP, with the
+// defaults of the builder flags. ImageVersion and ImageURL are set per
+// version by the Orchestrator.
+func NewWindowsBuildServerConfig(projectID string, zone string) WindowsBuildServerConfig {
+	prefix, labels, machineType, diskType, serviceAccount := "windows-builder-", "", "", "pd-standard", "default"
+	network, subnet, networkProject := "default", "default", ""
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	return WindowsBuildServerConfig{
+		InstanceNamePrefix:   &prefix,
+		InstanceNameTemplate: DefaultInstanceNameTemplate,
+		Zone:                 &zone,
+		NetworkConfig:        NewInstanceNetworkConfig(&projectID, &network, &networkProject, &subnet, &region),
+		Labels:               &labels,
+		MachineType:          &machineType,
+		BootDiskType:         &diskType,
+		BootDiskSizeGB:       75,
+		ServiceAccount:       &serviceAccount,
+		ExternalNAT:          true,
+	}
 }
 
 // Wait for server to be available for Winrm connection and Docker setup.
+// The server is polled with an exponential backoff, see ReadyPollInterval.
 func (r *RemoteWindowsServer) WaitForServerBeReady(setupTimeout time.Duration) error {
 	log.Printf("Waiting at most %+v for WinRM connection and Docker to be available.", setupTimeout)
 	timeout := time.Now().Add(setupTimeout)
-	for time.Now().Before(timeout) {
-		err := r.RunCommand("docker -v", *r.WorkspaceFolder, setupTimeout)
+	interval, maxInterval := r.ReadyPollInterval, r.ReadyPollMaxInterval
+	if interval <= 0 {
+		interval = DefaultReadyPollInterval
+	}
+	if maxInterval <= 0 {
+		maxInterval = DefaultReadyPollMaxInterval
+	}
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	var lastErr string
+	for attempt := 1; time.Now().Before(timeout); attempt++ {
+		// A check hanging on a server still booting must not use up the
+		// setup timeout.
+		runTimeout := maxInterval
+		if left := time.Until(timeout); left < runTimeout {
+			runTimeout = left
+		}
+		err := r.checkReady(interval, runTimeout)
 		if err == nil {
 			return nil
 		}
-		time.Sleep(10 * time.Second)
+		// Dial and command timeouts are expected while the server boots,
+		// only the deadline of the server ends the wait early.
+		if errors.Is(err, context.DeadlineExceeded) && !r.Deadline.IsZero() && !time.Now().Before(r.Deadline) {
+			return err
+		}
+		// Only log changes, the same error is expected until the instance booted.
+		if err.Error() != lastErr {
+			log.Printf("Instance: %s not ready yet (attempt %d): %v", *r.Hostname, attempt, err)
+			lastErr = err.Error()
+		}
+		if r.InstanceStatus != nil {
+			if status, err := r.InstanceStatus(); err == nil && terminalInstanceStatuses[status] {
+				return fmt.Errorf("Instance of %s is %s, it will not become available for WinRM connection and Docker", *r.Hostname, status)
+			}
+		}
+		wait := interval
+		if left := time.Until(timeout); left < wait {
+			wait = left
+		}
+		time.Sleep(wait)
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
 	}
 	return fmt.Errorf("Timed out waiting for server to be available for WinRM connection and Docker within %v", setupTimeout)
 }
 
+// dialReady opens the TCP connections of checkReady, replaced by tests.
+var dialReady = net.DialTimeout
+
+// checkReady checks once that docker can be run on the server. WinRM servers
+// are first probed with a plain TCP connection within dialTimeout, cheaper
+// than a WinRM command while the instance boots.
+func (r *RemoteWindowsServer) checkReady(dialTimeout time.Duration, runTimeout time.Duration) error {
+	if _, ok := r.executor().(*winRMExecutor); ok {
+		conn, err := dialReady("tcp", net.JoinHostPort(*r.Hostname, "5986"), dialTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return r.RunCommand("docker -v", *r.WorkspaceFolder, runTimeout)
+}
+
+// executor returns the RemoteExecutor for the server, creating a WinRM one if none was set.
+func (r *RemoteWindowsServer) executor() RemoteExecutor {
+	if r.Executor == nil && r.ClientCert != nil {
+		r.Executor = &winRMExecutor{hostname: *r.Hostname, username: *r.Username, clientCert: r.ClientCert, clientKey: r.ClientKey, tls: r.WinRMTLS}
+	} else if r.Executor == nil {
+		r.Executor = &winRMExecutor{hostname: *r.Hostname, username: *r.Username, password: *r.Password, tls: r.WinRMTLS}
+	}
+	return r.Executor
+}
+
 // Copy workspace from Linux to Windows.
 func (r *RemoteWindowsServer) Copy(inputPath string, copyTimeout time.Duration) error {
 	defer func() {
@@ -79,24 +350,9 @@ func (r *RemoteWindowsServer) Copy(inputPath string, copyTimeout time.Duration)
 		return errors.New("copy timeout must be greater than 0")
 	}
 
-	hostport := fmt.Sprintf("%s:5986", *r.Hostname)
-	c, err := winrmcp.New(hostport, &winrmcp.Config{
-		Auth:                  winrmcp.Auth{User: *r.Username, Password: *r.Password},
-		Https:                 true,
-		Insecure:              true,
-		TLSServerName:         "",
-		CACertBytes:           nil,
-		OperationTimeout:      copyTimeout,
-		MaxOperationsPerShell: 15,
-	})
-	if err != nil {
-		log.Printf("Error creating connection to remote for copy: %+v", err)
-		return err
-	}
-
 	// First try to create a bucket and have the Windows VM download it via a
 	// GS URL. If that fails, use the remote copy method.
-	err = r.copyViaBucket(
+	err := r.copyViaBucket(
 		context.Background(),
 		inputPath,
 		copyTimeout,
@@ -109,7 +365,11 @@ func (r *RemoteWindowsServer) Copy(inputPath string, copyTimeout time.Duration)
 
 	log.Printf("Failed to copy data via GCE bucket: %v", err)
 
-	err = c.Copy(inputPath, *r.WorkspaceFolder)
+	copyTimeout, err = r.capTimeout(copyTimeout)
+	if err != nil {
+		return err
+	}
+	err = r.executor().Copy(inputPath, *r.WorkspaceFolder, copyTimeout)
 	if err != nil {
 		log.Printf("Error copying workspace to remote: %+v", err)
 		return err
@@ -118,6 +378,26 @@ func (r *RemoteWindowsServer) Copy(inputPath string, copyTimeout time.Duration)
 	return nil
 }
 
+// Copy copies the local directory inputPath to remotePath with winrmcp.
+func (e *winRMExecutor) Copy(inputPath string, remotePath string, copyTimeout time.Duration) error {
+	hostport := fmt.Sprintf("%s:5986", e.hostname)
+	c, err := winrmcp.New(hostport, &winrmcp.Config{
+		Auth:                  winrmcp.Auth{User: e.username, Password: e.password},
+		Https:                 true,
+		Insecure:              true,
+		TLSServerName:         "",
+		CACertBytes:           nil,
+		OperationTimeout:      copyTimeout,
+		MaxOperationsPerShell: 15,
+		TransportDecorator:    e.transportDecorator(),
+	})
+	if err != nil {
+		log.Printf("Error creating connection to remote for copy: %+v", err)
+		return err
+	}
+	return c.Copy(inputPath, remotePath)
+}
+
 func (r *RemoteWindowsServer) CleanFolder() error {
 	log.Printf("Instance: %s cleaning up workspace folder: %s", *r.Hostname, *r.WorkspaceFolder)
 
@@ -131,42 +411,206 @@ Remove-Item -Path %s -Recurse -Force
 	return r.RunCommand(winrm.Powershell(pwrScript), "C:\\", 30*time.Second)
 }
 
+// Exclude the workspace folder from Windows Defender scans, which may lock
+// files of the build context.
+func (r *RemoteWindowsServer) ExcludeWorkspaceFromDefender() error {
+	log.Printf("Instance: %s excluding workspace folder %s from Windows Defender", *r.Hostname, *r.WorkspaceFolder)
+
+	pwrScript := fmt.Sprintf(`
+$ErrorActionPreference = "Stop"
+if (Get-Command Add-MpPreference -ErrorAction SilentlyContinue) {
+	Add-MpPreference -ExclusionPath %s
+}
+`, *r.WorkspaceFolder)
+
+	return r.RunCommand(winrm.Powershell(pwrScript), "C:\\", 30*time.Second)
+}
+
+// Force a resync of the Windows time service and check that the clock is
+// within maxSkew of its time source, as the skew after a reboot may fail the
+// registry authentication and TLS.
+func (r *RemoteWindowsServer) SyncClock(maxSkew time.Duration) error {
+	log.Printf("Instance: %s resyncing the clock", *r.Hostname)
+
+	pwrScript := fmt.Sprintf(`
+$ErrorActionPreference = "Stop"
+Start-Service w32time
+# The time service may have no time data yet right after it started.
+for ($i = 0; $i -lt 5; $i++) {
+	w32tm /resync /force | Out-Null
+	if ($LASTEXITCODE -eq 0) {
+		break
+	}
+	Start-Sleep 2
+}
+$source = ((w32tm /query /source) | Out-String).Trim() -replace ',0x[0-9a-fA-F]+$', ''
+if ($source -like 'Local CMOS Clock' -or $source -like 'Free-running System Clock') {
+	Write-Host "The clock has no time source, skipping the clock skew check"
+	exit 0
+}
+$sample = w32tm /stripchart /computer:$source /samples:1 /dataonly | Select-String '([+-]\d+\.\d+)s' | Select-Object -Last 1
+if (-not $sample) {
+	throw "Could not measure the clock skew against $source"
+}
+$skew = [math]::Abs([double]$sample.Matches[0].Groups[1].Value)
+if ($skew -gt %g) {
+	throw "The clock is $skew seconds off $source after a resync, more than %v. Registry authentication and TLS would fail"
+}
+Write-Host "The clock is $skew seconds off $source"
+`, maxSkew.Seconds(), maxSkew)
+
+	return r.RunCommand(winrm.Powershell(pwrScript), "C:\\", time.Minute)
+}
+
 func (r *RemoteWindowsServer) copyViaBucket(ctx context.Context, inputPath string, copyTimeout time.Duration) error {
+	if r.Storage == nil || r.WorkspaceBucket == nil {
+		return errors.New("no workspace bucket configured")
+	}
 	object := fmt.Sprintf("windows-builder-%d", time.Now().UnixNano())
 
-	gsURL, err := writeZipToBucket(
+	_, err := writeZipToBucket(
 		ctx,
+		r.Storage,
 		*r.WorkspaceBucket,
 		object,
 		inputPath,
+		archive.Options{
+			Excludes: r.WorkspaceExcludes,
+			Includes: r.WorkspaceIncludes,
+			Symlinks: r.WorkspaceSymlinks,
+			Limits:   r.WorkspaceLimits,
+		},
+		r.ObjectMetadata,
 	)
 	if err != nil {
 		return err
 	}
+	r.Inventory.AddObject(*r.WorkspaceBucket, object)
 
-	pwrScript := fmt.Sprintf(`
-$ErrorActionPreference = "Stop"
-$ProgressPreference = 'SilentlyContinue'
-gsutil cp %q %s.zip
-Set-ItemProperty 'HKLM:\System\CurrentControlSet\Control\FileSystem' -Name 'LongPathsEnabled' -value 1
-Add-Type -Assembly "System.IO.Compression.Filesystem";
-[System.IO.Compression.ZipFile]::ExtractToDirectory("%s.zip", "%s");
-Remove-Item -Path %s.zip -Force
-`, gsURL, *r.WorkspaceFolder, *r.WorkspaceFolder, *r.WorkspaceFolder, *r.WorkspaceFolder)
+	pwrScript, err := r.Scripts.Render(CopyWorkspaceScript, CopyWorkspaceScriptData{
+		TokenCommand: metadataTokenPS1,
+		URL:          objectMediaURL(*r.WorkspaceBucket, object),
+		Folder:       *r.WorkspaceFolder,
+	})
+	if err != nil {
+		return err
+	}
 
 	// Now tell the Windows VM to download it.
 	return r.RunCommand(winrm.Powershell(pwrScript), *r.WorkspaceFolder, copyTimeout)
 }
 
-// Run command against Windows Server thru WinRM within specific timeout
+// Run command against Windows Server within specific timeout
 func (r *RemoteWindowsServer) RunCommand(command string, path string, runTimeout time.Duration) error {
+	return r.RunCommandContext(context.Background(), command, path, runTimeout)
+}
+
+// RunCommandContext runs command like RunCommand, aborting it when ctx is
+// done.
+func (r *RemoteWindowsServer) RunCommandContext(ctx context.Context, command string, path string, runTimeout time.Duration) error {
 	if runTimeout <= 0 {
 		return errors.New("runTimeout must be greater than 0")
 	}
+	runTimeout, err := r.capTimeout(runTimeout)
+	if err != nil {
+		return err
+	}
+	if !r.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, r.Deadline)
+		defer cancel()
+	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if r.Output != nil {
+		stdout = io.MultiWriter(os.Stdout, r.Output)
+		stderr = io.MultiWriter(os.Stderr, r.Output)
+	}
+	if r.IdleTimeout <= 0 {
+		return r.executor().Run(ctx, command, path, runTimeout, stdout, stderr)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := newIdleWatcher(r.IdleTimeout, cancel)
+	defer w.stop()
+	err = r.executor().Run(ctx, command, path, runTimeout, w.wrap(stdout), w.wrap(stderr))
+	if err != nil && w.isIdle() {
+		return fmt.Errorf("Remote command on %s wrote no output for %v and was aborted: %+v", *r.Hostname, r.IdleTimeout, err)
+	}
+	return err
+}
+
+// idleWatcher calls cancel when none of the writers it wraps is written to
+// for timeout.
+type idleWatcher struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	timer   *time.Timer
+	idle    bool
+}
+
+func newIdleWatcher(timeout time.Duration, cancel func()) *idleWatcher {
+	w := &idleWatcher{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+		w.idle = true
+		w.mu.Unlock()
+		cancel()
+	})
+	return w
+}
+
+// wrap returns a writer to out that resets the idle timer on each write.
+func (w *idleWatcher) wrap(out io.Writer) io.Writer {
+	return &idleWriter{out: out, watcher: w}
+}
+
+func (w *idleWatcher) isIdle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.idle
+}
+
+func (w *idleWatcher) stop() {
+	w.timer.Stop()
+}
+
+type idleWriter struct {
+	out     io.Writer
+	watcher *idleWatcher
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	iw.watcher.mu.Lock()
+	if !iw.watcher.idle {
+		iw.watcher.timer.Reset(iw.watcher.timeout)
+	}
+	iw.watcher.mu.Unlock()
+	return iw.out.Write(p)
+}
+
+// capTimeout shortens timeout to the time left until the Deadline, if any.
+func (r *RemoteWindowsServer) capTimeout(timeout time.Duration) (time.Duration, error) {
+	if r.Deadline.IsZero() {
+		return timeout, nil
+	}
+	left := time.Until(r.Deadline)
+	if left <= 0 {
+		return 0, fmt.Errorf("Deadline of instance %s exceeded: %w", *r.Hostname, context.DeadlineExceeded)
+	}
+	if left < timeout {
+		return left, nil
+	}
+	return timeout, nil
+}
 
+// Run command against Windows Server thru WinRM within specific timeout
+func (e *winRMExecutor) Run(ctx context.Context, command string, path string, runTimeout time.Duration, stdout io.Writer, stderr io.Writer) error {
 	cmdstring := fmt.Sprintf(`cd %s & %s`, path, command)
-	endpoint := winrm.NewEndpoint(*r.Hostname, 5986, true, true, nil, nil, nil, runTimeout)
-	w, err := winrm.NewClient(endpoint, *r.Username, *r.Password)
+	endpoint := winrm.NewEndpoint(e.hostname, 5986, true, true, nil, e.clientCert, e.clientKey, runTimeout)
+	params := *winrm.DefaultParameters
+	params.TransportDecorator = e.transportDecorator()
+	w, err := winrm.NewClientWithParameters(endpoint, e.username, e.password, &params)
 	if err != nil {
 		return err
 	}
@@ -180,12 +624,27 @@ func (r *RemoteWindowsServer) RunCommand(command string, path string, runTimeout
 		return err
 	}
 
-	go io.Copy(os.Stdout, cmd.Stdout)
-	go io.Copy(os.Stderr, cmd.Stderr)
+	go io.Copy(stdout, cmd.Stdout)
+	go io.Copy(stderr, cmd.Stderr)
+
+	// Abort the command when ctx is done.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Close()
+		case <-done:
+		}
+	}()
 
 	cmd.Wait()
+	close(done)
 	shell.Close()
 
+	if ctx.Err() != nil {
+		return fmt.Errorf("command aborted: %w", ctx.Err())
+	}
+
 	if cmd.ExitCode() != 0 {
 		return fmt.Errorf("command failed with exit-code:%d", cmd.ExitCode())
 	}
@@ -201,32 +660,46 @@ func (bs *WindowsBuildServerConfig) GetServiceAccountEmail(projectID string) str
 	return fmt.Sprintf("%s@%s.iam.gserviceaccount.com", *bs.ServiceAccount, projectID)
 }
 
-func (bs *WindowsBuildServerConfig) GetLabelsMap() map[string]string {
-	var labelsMap = map[string]string{}
-
-	if bs.ReuseInstance {
-		labelsMap["builder_version"] = strings.ToLower(*bs.ImageVersion)
+// skipSetupSteps returns the skip-setup-steps metadata value of the setup script.
+func (bs *WindowsBuildServerConfig) skipSetupSteps() string {
+	var steps []string
+	if bs.SkipDockerInstall {
+		steps = append(steps, "docker-install")
 	}
-
-	if *bs.Labels == "" {
-		return labelsMap
+	if bs.SkipDefenderRemoval {
+		steps = append(steps, "defender")
+	}
+	if bs.SkipWinRMConfig {
+		steps = append(steps, "winrm-config")
 	}
+	return strings.Join(steps, ",")
+}
 
-	for _, label := range strings.Split(*bs.Labels, ",") {
-		labelSpl := strings.Split(label, "=")
-		if len(labelSpl) != 2 {
-			log.Printf("Error: Label needs to be key=value template. %s label ignored", label)
-			continue
-		}
+// GetLabelsMap returns the Labels of the instances, with the Windows version
+// they are reused for.
+func (bs *WindowsBuildServerConfig) GetLabelsMap() map[string]string {
+	var labelsMap = map[string]string{}
 
-		var key = strings.TrimSpace(labelSpl[0])
-		if len(key) == 0 {
-			log.Printf("Error: Label key can't be empty. %s label ignored", label)
-			continue
+	if *bs.Labels != "" {
+		for _, label := range strings.Split(*bs.Labels, ",") {
+			labelSpl := strings.Split(label, "=")
+			if len(labelSpl) != 2 {
+				log.Printf("Error: Label needs to be key=value template. %s label ignored", label)
+				continue
+			}
+
+			var key = strings.TrimSpace(labelSpl[0])
+			if len(key) == 0 {
+				log.Printf("Error: Label key can't be empty. %s label ignored", label)
+				continue
+			}
+			var value = strings.TrimSpace(labelSpl[1])
+
+			labelsMap[key] = value
 		}
-		var value = strings.TrimSpace(labelSpl[1])
-
-		labelsMap[key] = value
 	}
+
+	// Set last, Labels can't override the version.
+	labelsMap[windowsVersionLabel] = strings.ToLower(*bs.ImageVersion)
 	return labelsMap
 }
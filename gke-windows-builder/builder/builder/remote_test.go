@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gke-windows-builder/builder/builder/fake"
+)
+
+func TestWaitForServerBeReady(t *testing.T) {
+	hostname, folder := "10.0.0.1", `C:\workspace`
+	for _, tc := range []struct {
+		name     string
+		exitCode int
+		duration string
+		statuses []string
+		err      string
+		attempts int
+	}{
+		{
+			name:     "ready",
+			attempts: 1,
+		},
+		{
+			name:     "terminated",
+			exitCode: 1,
+			statuses: []string{"RUNNING", "RUNNING", "TERMINATED"},
+			err:      "is TERMINATED",
+			attempts: 3,
+		},
+		{
+			name:     "timeout",
+			exitCode: 1,
+			err:      "Timed out",
+		},
+		{
+			// Each check is cut at the 40ms max interval, not the 500ms
+			// setup timeout.
+			name:     "hanging",
+			duration: "1s",
+			err:      "Timed out",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remote := fake.NewRemote(&fake.Fixture{
+				Commands: []fake.CommandResult{{Match: "docker -v", ExitCode: tc.exitCode, Duration: tc.duration}},
+			})
+			r := &RemoteWindowsServer{
+				Hostname:             &hostname,
+				WorkspaceFolder:      &folder,
+				Executor:             remote.Executor(hostname),
+				ReadyPollInterval:    10 * time.Millisecond,
+				ReadyPollMaxInterval: 40 * time.Millisecond,
+			}
+			if tc.statuses != nil {
+				r.InstanceStatus = func() (string, error) {
+					status := tc.statuses[0]
+					if len(tc.statuses) > 1 {
+						tc.statuses = tc.statuses[1:]
+					}
+					return status, nil
+				}
+			}
+
+			start := time.Now()
+			err := r.WaitForServerBeReady(500 * time.Millisecond)
+			if tc.err == "" && err != nil {
+				t.Fatalf("WaitForServerBeReady failed: %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("WaitForServerBeReady took %v", elapsed)
+			}
+			attempts := len(remote.CommandsContaining("docker -v"))
+			if tc.attempts > 0 && attempts != tc.attempts {
+				t.Errorf("expected %d readiness checks, got %d", tc.attempts, attempts)
+			}
+			// 10, 20, then 40ms between the checks, at most 14 within 500ms.
+			if tc.name == "timeout" && (attempts < 2 || attempts > 14) {
+				t.Errorf("expected at most 14 readiness checks with the backoff, got %d", attempts)
+			}
+			if tc.name == "hanging" && attempts < 2 {
+				t.Errorf("expected the readiness checks to go on after a hanging one, got %d", attempts)
+			}
+		})
+	}
+}
+
+func TestWaitForServerBeReady_blackholed(t *testing.T) {
+	defer func(dial func(string, string, time.Duration) (net.Conn, error)) { dialReady = dial }(dialReady)
+	var dials int
+	// A blackholed address times out the dials.
+	dialReady = func(network string, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		time.Sleep(timeout)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: context.DeadlineExceeded}
+	}
+
+	hostname, folder, user, password := "10.0.0.1", `C:\workspace`, "builder", "password"
+	r := &RemoteWindowsServer{
+		Hostname:             &hostname,
+		WorkspaceFolder:      &folder,
+		Username:             &user,
+		Password:             &password,
+		ReadyPollInterval:    10 * time.Millisecond,
+		ReadyPollMaxInterval: 40 * time.Millisecond,
+	}
+	err := r.WaitForServerBeReady(300 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	if dials < 2 {
+		t.Errorf("expected the polling to go on after a dial timeout, got %d dials", dials)
+	}
+
+	r.Deadline = time.Now().Add(-time.Second)
+	if err := r.WaitForServerBeReady(300 * time.Millisecond); err == nil || strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("expected the wait to end at the deadline of the server, got %v", err)
+	}
+}
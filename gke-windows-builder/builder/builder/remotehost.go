@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// RemoteHost is an existing Windows machine, on-premises or in another
+// cloud, that builds a version instead of a GCE instance. It is reached over
+// WinRM HTTPS on port 5986 and its docker must already be logged in to the
+// registries, as it has no GCE metadata server to get access tokens from.
+type RemoteHost struct {
+	Hostname string
+	Username string
+	Password string
+}
+
+// remoteHostProvider provides a RemoteHost. Its workspace folder is removed
+// after the build, the host itself is left as it is.
+type remoteHostProvider struct {
+	host *RemoteHost
+}
+
+func (p *remoteHostProvider) Create(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	return &Server{
+		Name:                p.host.Hostname,
+		External:            true,
+		RemoteWindowsServer: RemoteWindowsServer{RegistryLoggedIn: true},
+	}, nil
+}
+
+func (p *remoteHostProvider) FindExisting(ctx context.Context, bs *WindowsBuildServerConfig) (*Server, error) {
+	return p.Create(ctx, bs)
+}
+
+func (p *remoteHostProvider) Delete(ctx context.Context, s *Server) error {
+	return nil
+}
+
+func (p *remoteHostProvider) Credentials(ctx context.Context, s *Server) (string, string, error) {
+	return p.host.Username, p.host.Password, nil
+}
+
+func (p *remoteHostProvider) IP(ctx context.Context, s *Server) (string, error) {
+	return p.host.Hostname, nil
+}
+
+// AccessSecret returns the payload of a Secret Manager secret version, e.g.
+// projects/PROJECT/secrets/NAME/versions/latest.
+func AccessSecret(ctx context.Context, name string) (string, error) {
+	service, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create Secret Manager service: %+v", err)
+	}
+	resp, err := service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Failed to access secret %s: %+v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode secret %s: %+v", name, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The statuses of the versions of Results.
+const (
+	VersionSucceeded = "succeeded"
+	VersionFailed    = "failed"
+	// VersionSkipped is the status of a version whose GCE image doesn't
+	// exist anymore, left out of the manifest.
+	VersionSkipped = "skipped"
+)
+
+// Results records the outcome of each version of a build and whether the
+// multi-arch manifest was pushed, so a later build can retry the failed
+// versions only, see Retry.
+type Results struct {
+	Image     string    `json:"image"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+
+	Versions []*VersionResult `json:"versions"`
+	// ManifestPushed is set when the multi-arch manifest was pushed.
+	ManifestPushed bool `json:"manifestPushed"`
+	// SkipPush is set when the build doesn't push the images, nor the
+	// manifest.
+	SkipPush bool `json:"skipPush,omitempty"`
+
+	mu sync.Mutex
+}
+
+// VersionResult is the outcome of the build of a version.
+type VersionResult struct {
+	Version string `json:"version"`
+	// Image is the single-arch image of the version, set when it succeeded.
+	Image  string `json:"image,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Seconds is how long the build of the version took.
+	Seconds float64 `json:"seconds"`
+	// Previous is set when the outcome is the one of an earlier build, the
+	// version was not built again.
+	Previous bool      `json:"previous,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// NewResults returns empty Results of a build of image starting now.
+func NewResults(image string) *Results {
+	return &Results{Image: image, StartTime: time.Now()}
+}
+
+// SetVersion records the outcome of version ver, built in duration, replacing
+// an earlier one. Nil results record nothing, like SetManifestPushed.
+func (res *Results) SetVersion(ver string, image string, status string, duration time.Duration, err error) {
+	if res == nil {
+		return
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	v := &VersionResult{Version: ver, Status: status, Seconds: duration.Seconds(), Time: time.Now()}
+	if status == VersionSucceeded {
+		v.Image = image
+	}
+	if err != nil {
+		v.Error = err.Error()
+	}
+	for i, r := range res.Versions {
+		if r.Version == ver {
+			res.Versions[i] = v
+			return
+		}
+	}
+	res.Versions = append(res.Versions, v)
+	sort.Slice(res.Versions, func(i, j int) bool { return res.Versions[i].Version < res.Versions[j].Version })
+}
+
+// SetManifestPushed records that the multi-arch manifest was pushed.
+func (res *Results) SetManifestPushed() {
+	if res == nil {
+		return
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.ManifestPushed = true
+}
+
+// SetSkipPush records that the images and the manifest are not pushed.
+func (res *Results) SetSkipPush() {
+	if res == nil {
+		return
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.SkipPush = true
+}
+
+// Write writes the results as JSON to path.
+func (res *Results) Write(path string) error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.EndTime = time.Now()
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write results %s: %+v", path, err)
+	}
+	return nil
+}
+
+// LoadResults reads Results written by Write.
+func LoadResults(path string) (*Results, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res Results
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("Failed to parse results %s: %+v", path, err)
+	}
+	return &res, nil
+}
+
+// Retry returns the versions of versions to build again after the build of
+// previous, those that failed or that previous didn't build, and the versions
+// whose images previous pushed. The versions previous succeeded or skipped
+// are recorded in res as previous. It fails when previous built another
+// image, or pushed its images and res doesn't or the other way around, as
+// the images of previous are then not the ones res would combine. SetSkipPush
+// must be called on res first when it doesn't push.
+func (res *Results) Retry(previous *Results, versions []string) (failed []string, succeeded []string, err error) {
+	if previous.Image != res.Image {
+		return nil, nil, fmt.Errorf("Failed to retry the build of %s, the previous results are of %s", res.Image, previous.Image)
+	}
+	if previous.SkipPush && !res.SkipPush {
+		return nil, nil, fmt.Errorf("Failed to retry the build of %s, the previous build didn't push its images, rebuild all versions instead", res.Image)
+	}
+	if !previous.SkipPush && res.SkipPush {
+		return nil, nil, fmt.Errorf("Failed to retry the build of %s, the previous build pushed its images but this one doesn't", res.Image)
+	}
+	done := map[string]*VersionResult{}
+	for _, v := range previous.Versions {
+		if v.Status == VersionSucceeded || v.Status == VersionSkipped {
+			done[v.Version] = v
+		}
+	}
+	for _, ver := range versions {
+		v, ok := done[ver]
+		if !ok {
+			failed = append(failed, ver)
+			continue
+		}
+		if v.Status == VersionSucceeded {
+			succeeded = append(succeeded, ver)
+		}
+		res.SetVersion(ver, v.Image, v.Status, time.Duration(v.Seconds*float64(time.Second)), nil)
+	}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	for _, v := range res.Versions {
+		if done[v.Version] != nil {
+			v.Previous = true
+			v.Time = done[v.Version].Time
+		}
+	}
+	return failed, succeeded, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gke-windows-builder/builder/builder/fake"
+)
+
+func TestResultsRetry(t *testing.T) {
+	versions := map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
+	}
+	o, _, _ := newTestOrchestrator(t, versions, &fake.Fixture{
+		Commands: []fake.CommandResult{{Match: "tag_ltsc2022", ExitCode: 1}},
+	})
+	o.Results = NewResults(o.ContainerImageName)
+	if err := o.Run(context.Background()); err == nil {
+		t.Fatal("expected Run to fail")
+	}
+	if o.Results.ManifestPushed || len(o.Results.Versions) != 2 ||
+		o.Results.Versions[0].Status != VersionSucceeded || o.Results.Versions[1].Status != VersionFailed {
+		t.Fatalf("expected ltsc2019 to succeed and ltsc2022 to fail, got %+v", o.Results.Versions)
+	}
+
+	dir, err := ioutil.TempDir("", "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "build-results.json")
+	if err := o.Results.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := LoadResults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retry, _, remote := newTestOrchestrator(t, versions, nil)
+	retry.Results = NewResults(retry.ContainerImageName)
+	failed, succeeded, err := retry.Results.Retry(previous, []string{"ltsc2019", "ltsc2022"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failed, []string{"ltsc2022"}) || !reflect.DeepEqual(succeeded, []string{"ltsc2019"}) {
+		t.Fatalf("expected to retry ltsc2022 only, got failed %v and succeeded %v", failed, succeeded)
+	}
+	retry.Versions = map[string]string{"ltsc2022": versions["ltsc2022"]}
+	retry.ManifestVersions = succeeded
+	if err := retry.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if builds := remote.CommandsContaining("docker build"); len(builds) != 1 || !strings.Contains(builds[0], "tag_ltsc2022") {
+		t.Errorf("expected only ltsc2022 to be built, got %q", builds)
+	}
+	manifests := remote.CommandsContaining("docker manifest create")
+	if len(manifests) != 1 || !strings.Contains(manifests[0], "tag_ltsc2019") || !strings.Contains(manifests[0], "tag_ltsc2022") {
+		t.Errorf("expected the manifest of both versions, got %q", manifests)
+	}
+	if !retry.Results.ManifestPushed || !retry.Results.Versions[0].Previous || retry.Results.Versions[1].Status != VersionSucceeded {
+		t.Errorf("expected ltsc2019 from the previous build and ltsc2022 rebuilt, got %+v", retry.Results.Versions)
+	}
+
+	junitPath := filepath.Join(dir, "junit.xml")
+	if err := retry.Results.WriteJUnit(junitPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatalf("failed to parse the JUnit report: %v\n%s", err, data)
+	}
+	if report.Tests != 3 || report.Failures != 0 || len(report.Suites) != 1 || report.Suites[0].Name != retry.ContainerImageName {
+		t.Errorf("expected a suite of the image with 2 passed versions and the manifest, got %s", data)
+	}
+
+	previousJUnit := filepath.Join(dir, "previous.xml")
+	if err := previous.WriteJUnit(previousJUnit); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadFile(previousJUnit); err != nil {
+		t.Fatal(err)
+	}
+	var previousReport junitTestSuites
+	if err := xml.Unmarshal(data, &previousReport); err != nil {
+		t.Fatal(err)
+	}
+	cases := previousReport.Suites[0].Cases
+	if previousReport.Failures != 2 || len(cases) != 3 || cases[0].Failure != nil || cases[1].Name != "ltsc2022" || cases[1].Failure == nil || cases[1].Failure.Message == "" {
+		t.Errorf("expected ltsc2022 to be reported as failed, got %s", data)
+	}
+	if cases[2].Name != "manifest" || cases[2].Failure == nil {
+		t.Errorf("expected the manifest not pushed to be reported as failed, got %s", data)
+	}
+
+	previous.SetSkipPush()
+	if err := previous.WriteJUnit(previousJUnit); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadFile(previousJUnit); err != nil {
+		t.Fatal(err)
+	}
+	var skipPushReport junitTestSuites
+	if err := xml.Unmarshal(data, &skipPushReport); err != nil {
+		t.Fatal(err)
+	}
+	if cases := skipPushReport.Suites[0].Cases; skipPushReport.Failures != 1 || skipPushReport.Skipped != 1 || cases[2].Skipped == nil {
+		t.Errorf("expected the manifest of a build not pushing to be reported as skipped, got %s", data)
+	}
+
+	// previous doesn't push anymore, so its succeeded versions were never
+	// pushed and can't be combined by a build that pushes.
+	pushing := NewResults(retry.ContainerImageName)
+	if _, _, err := pushing.Retry(previous, []string{"ltsc2019", "ltsc2022"}); err == nil {
+		t.Error("expected the results of a build not pushing to be rejected by a build pushing")
+	}
+	notPushing := NewResults(retry.ContainerImageName)
+	notPushing.SetSkipPush()
+	if _, _, err := notPushing.Retry(previous, []string{"ltsc2019", "ltsc2022"}); err != nil {
+		t.Errorf("expected the results of a build not pushing to be retried without pushing, got %v", err)
+	}
+	if _, _, err := notPushing.Retry(retry.Results, []string{"ltsc2019", "ltsc2022"}); err == nil {
+		t.Error("expected the results of a build pushing to be rejected by a build not pushing")
+	}
+
+	other := NewResults("gcr.io/test-project/other:tag")
+	other.SetSkipPush()
+	if _, _, err := other.Retry(previous, []string{"ltsc2019"}); err == nil {
+		t.Error("expected the results of another image to be rejected")
+	}
+}
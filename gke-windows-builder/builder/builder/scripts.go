@@ -0,0 +1,477 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// The names of the PowerShell scripts run on the build servers, see Scripts.
+const (
+	// SetupScript sets up new GCE instances, as their startup script: it
+	// configures WinRM and Windows Defender and installs docker, following
+	// the instance metadata. Its data is a SetupScriptData.
+	SetupScript = "setup.ps1"
+	// CopyWorkspaceScript downloads the workspace archive from the workspace
+	// bucket and extracts it. Its data is a CopyWorkspaceScriptData.
+	CopyWorkspaceScript = "copy-workspace.ps1"
+	// BuildScript builds, and pushes, the single-arch image of a version. Its
+	// data is a BuildScriptData.
+	BuildScript = "build.ps1"
+	// ManifestScript creates and pushes the multi-arch Docker manifest list.
+	// Its data is a ManifestScriptData.
+	ManifestScript = "manifest.ps1"
+)
+
+// SetupScriptData are the variables of the SetupScript.
+type SetupScriptData struct {
+	// Version is the Windows version of the instance, e.g. ltsc2019.
+	Version string
+}
+
+// CopyWorkspaceScriptData are the variables of the CopyWorkspaceScript.
+type CopyWorkspaceScriptData struct {
+	// TokenCommand is the PowerShell expression returning an access token of
+	// the service account of the instance, to download the archive.
+	TokenCommand string
+	// URL is the Cloud Storage JSON API URL of the zip archive.
+	URL string
+	// Folder is the workspace folder to extract the archive to.
+	Folder string
+}
+
+// BuildScriptData are the variables of the BuildScript.
+type BuildScriptData struct {
+	// Image is the single-arch image to build, e.g.
+	// gcr.io/project/image:tag_ltsc2019.
+	Image string
+	// Version is the Windows version, passed as the WINDOWS_VERSION build
+	// argument.
+	Version string
+	// BuildArgs are the extra docker build options, each followed by a space,
+	// e.g. "--no-cache --build-arg A=1 ".
+	BuildArgs string
+	// Login is the PowerShell command logging docker in to the registry of
+	// Image, empty when docker is logged in already. Tokens expire after an
+	// hour, so it is run again before pushing.
+	Login string
+	// RewriteFrom, when set, are the PowerShell commands rewriting the FROM
+	// lines of the Dockerfile to the base image mirror.
+	RewriteFrom string
+	// Push is set when the image is to be pushed.
+	Push bool
+}
+
+// ManifestScriptData are the variables of the ManifestScript.
+type ManifestScriptData struct {
+	// Image is the multi-arch image.
+	Image string
+	// Sources are the single-arch images listed by the manifest.
+	Sources []string
+	// Login is the PowerShell command logging docker in to the registry of
+	// Image, empty when docker is logged in already.
+	Login string
+}
+
+var defaultScripts = map[string]string{
+	SetupScript: `
+# Returns the value of the instance metadata attribute $Key, or $null if unset.
+function Get-InstanceAttribute([string]$Key) {
+	try {
+		$response = Invoke-WebRequest -UseBasicParsing -Headers @{'Metadata-Flavor'='Google'} -Uri "http://metadata.google.internal/computeMetadata/v1/instance/attributes/$Key"
+		return [System.Text.Encoding]::UTF8.GetString($response.RawContentStream.ToArray())
+	} catch {
+		return $null
+	}
+}
+# Trust the CA certificates of the trusted-ca-certs metadata, e.g. of a private
+# registry or proxy, in the root store and for docker in the certs.d folders of
+# the trusted-ca-registries, before the network steps that may need them.
+if ($caCerts = Get-InstanceAttribute 'trusted-ca-certs') {
+	$certFile = "$env:Temp\trusted-ca.crt"
+	foreach ($match in [regex]::Matches($caCerts, '-----BEGIN CERTIFICATE-----[\s\S]+?-----END CERTIFICATE-----')) {
+		Set-Content -Path $certFile -Value $match.Value
+		Import-Certificate -FilePath $certFile -CertStoreLocation Cert:\LocalMachine\Root | Out-Null
+	}
+	Remove-Item $certFile
+	if ($registries = Get-InstanceAttribute 'trusted-ca-registries') {
+		foreach ($registry in $registries -split ',') {
+			# Docker on Windows drops the ':' of registries with a port.
+			$dir = "$env:ProgramData\docker\certs.d\" + ($registry -replace ':', '')
+			New-Item -ItemType Directory -Force -Path $dir | Out-Null
+			[System.IO.File]::WriteAllText("$dir\ca.crt", $caCerts)
+		}
+	}
+	Write-Host 'Installed the trusted CA certificates'
+}
+$daemonConfig = Get-InstanceAttribute 'docker-daemon-config'
+# Put the docker data-root on the disk named by docker-cache-disk, formatting
+# it unless it was seeded from a snapshot of an earlier build.
+if ($cacheDisk = Get-InstanceAttribute 'docker-cache-disk') {
+	$disk = Get-Disk | Where-Object { $_.SerialNumber -eq $cacheDisk }
+	if ($disk.PartitionStyle -eq 'RAW') {
+		Write-Host "Formatting docker cache disk"
+		$disk | Initialize-Disk -PartitionStyle GPT -PassThru | New-Partition -UseMaximumSize -DriveLetter D | Format-Volume -FileSystem NTFS -Confirm:$false | Out-Null
+	} else {
+		$disk | Set-Disk -IsOffline $false
+		$disk | Set-Disk -IsReadOnly $false
+		$partition = $disk | Get-Partition | Where-Object { $_.Type -eq 'Basic' }
+		if ($partition.DriveLetter -ne 'D') {
+			$partition | Set-Partition -NewDriveLetter D
+		}
+	}
+	$config = if ($daemonConfig) { $daemonConfig | ConvertFrom-Json } else { New-Object PSObject }
+	$config | Add-Member -Force -NotePropertyName 'data-root' -NotePropertyValue 'D:\docker'
+	$daemonConfig = $config | ConvertTo-Json -Depth 10
+}
+# Setup steps to leave out on pre-provisioned images, see skip-setup-steps.
+$skipSteps = @()
+if ($skip = Get-InstanceAttribute 'skip-setup-steps') {
+	$skipSteps = $skip -split ','
+}
+
+# Windows Defender may scan the C:\ProgramData\Docker\ folder, make it locked from docker build.
+# https://github.com/docker/for-win/issues/2117
+if (($skipSteps -notcontains 'defender') -and (Get-WindowsFeature -Name 'Windows-Defender').Installed) {
+	if ((Get-InstanceAttribute 'defender-mode') -eq 'exclude') {
+		Write-Host "Excluding docker folders from Windows Defender"
+		$exclusions = @("$env:ProgramData\docker")
+		if ($daemonConfig -and ($daemonConfig | ConvertFrom-Json).'data-root') {
+			$exclusions += ($daemonConfig | ConvertFrom-Json).'data-root'
+		}
+		Add-MpPreference -ExclusionPath $exclusions
+		Add-MpPreference -ExclusionProcess @('dockerd.exe', 'docker.exe')
+	} else {
+		Write-Host "Disabling Windows Defender service"
+		Set-MpPreference -DisableRealtimeMonitoring $true
+		Uninstall-WindowsFeature -Name 'Windows-Defender'
+		Restart-Computer -Force
+		exit 0
+	}
+}
+
+# Installs the pending software updates with the Windows Update Agent API.
+# Returns whether the computer must be restarted to complete them.
+function Install-WindowsUpdates {
+	$session = New-Object -ComObject Microsoft.Update.Session
+	$result = $session.CreateUpdateSearcher().Search("IsInstalled=0 and IsHidden=0 and Type='Software'")
+	if ($result.Updates.Count -eq 0) {
+		Write-Host 'No pending Windows updates'
+		return $false
+	}
+	$updates = New-Object -ComObject Microsoft.Update.UpdateColl
+	foreach ($update in $result.Updates) {
+		if (-not $update.EulaAccepted) {
+			$update.AcceptEula()
+		}
+		Write-Host "Installing $($update.Title)"
+		$updates.Add($update) | Out-Null
+	}
+	$downloader = $session.CreateUpdateDownloader()
+	$downloader.Updates = $updates
+	$downloader.Download() | Out-Null
+	$installer = $session.CreateUpdateInstaller()
+	$installer.Updates = $updates
+	$installResult = $installer.Install()
+	Write-Host "Installed Windows updates with result code $($installResult.ResultCode)"
+	return $installResult.RebootRequired
+}
+# Some updates are only offered once others are installed, so repeat the
+# passes across reboots, at most 5 times in case an update keeps failing.
+if ((Get-InstanceAttribute 'install-windows-updates') -eq 'true') {
+	$passesFile = "$env:ProgramData\windows-builder-update-passes"
+	$passes = 0
+	if (Test-Path $passesFile) {
+		$passes = [int](Get-Content $passesFile)
+	}
+	if ($passes -lt 5) {
+		Set-Content -Path $passesFile -Value ($passes + 1)
+		if (Install-WindowsUpdates) {
+			Write-Host 'Restarting computer after installing Windows updates'
+			Restart-Computer -Force
+			exit 0
+		}
+	} else {
+		Write-Host "Gave up installing Windows updates after $passes passes"
+	}
+}
+
+# Restrict Schannel, which serves the WinRM HTTPS listener, to the minimum TLS
+# version and the cipher suites of the builder. Disabling cipher suites also
+# applies to the connections of the instance, e.g. to the registries. The
+# changes only take effect after a restart.
+$tlsRestart = $false
+if ($skipSteps -notcontains 'winrm-config') {
+	$disabledProtocols = switch (Get-InstanceAttribute 'winrm-min-tls-version') {
+		'1.2' { @('SSL 3.0', 'TLS 1.0', 'TLS 1.1') }
+		'1.3' { @('SSL 3.0', 'TLS 1.0', 'TLS 1.1', 'TLS 1.2') }
+		default { @() }
+	}
+	foreach ($protocol in $disabledProtocols) {
+		$key = "HKLM:\SYSTEM\CurrentControlSet\Control\SecurityProviders\SCHANNEL\Protocols\$protocol\Server"
+		if ((Get-ItemProperty -Path $key -Name Enabled -ErrorAction SilentlyContinue).Enabled -ne 0) {
+			New-Item -Path $key -Force | Out-Null
+			New-ItemProperty -Path $key -Name Enabled -Value 0 -PropertyType DWord -Force | Out-Null
+			New-ItemProperty -Path $key -Name DisabledByDefault -Value 1 -PropertyType DWord -Force | Out-Null
+			Write-Host "Disabled $protocol for the WinRM HTTPS listener"
+			$tlsRestart = $true
+		}
+	}
+	if ($cipherSuites = Get-InstanceAttribute 'winrm-cipher-suites') {
+		$allowed = $cipherSuites -split ','
+		# The TLS 1.3 cipher suites are kept, Go doesn't allow configuring them.
+		foreach ($suite in Get-TlsCipherSuite | Where-Object { $_.Name -like 'TLS_*_WITH_*' }) {
+			if ($allowed -notcontains $suite.Name) {
+				Disable-TlsCipherSuite -Name $suite.Name
+				Write-Host "Disabled cipher suite $($suite.Name)"
+				$tlsRestart = $true
+			}
+		}
+	}
+}
+
+# Writes $Message to the console. Terminates the script if $Fatal is set.
+function Test-ContainersFeatureInstalled {
+	return (Get-WindowsFeature Containers).Installed
+}
+# After this function returns, the computer must be restarted to complete
+# the installation!
+function Install-ContainersFeature {
+	Write-Host "Installing Windows 'Containers' feature"
+	Install-WindowsFeature Containers
+}
+function Test-DockerIsInstalled {
+	$service = Get-Service -Name docker -ErrorAction SilentlyContinue
+	return ($service -ne $null)
+}
+function Test-DockerIsRunning {
+	return ((Get-Service docker).Status -eq 'Running')
+}
+# Installs Docker EE via the DockerMsftProvider. Ensure that the Windows
+# Containers feature is installed before calling this function; otherwise,
+# a restart may be needed after this function returns.
+function Install-Docker {
+	# Based on https://learn.microsoft.com/virtualization/windowscontainers/quick-start/set-up-environment?tabs=dockerce#windows-server-1
+	Write-Host "Installing latest Docker CE version"
+	$scriptFile = "$env:Temp\install-docker-ce.ps1"
+	Invoke-WebRequest -UseBasicParsing "https://raw.githubusercontent.com/microsoft/Windows-Containers/Main/helpful_tools/Install-DockerCE/install-docker-ce.ps1" -o $scriptFile
+	.$scriptFile
+	Remove-Item $scriptFile
+}
+if (($skipSteps -notcontains 'docker-install') -and -not (Test-ContainersFeatureInstalled)) {
+	Install-ContainersFeature
+	Write-Host 'Restarting computer after enabling Windows Containers feature'
+	Restart-Computer -Force
+	# Restart-Computer does not stop the rest of the script from executing.
+	exit 0
+}
+if (($skipSteps -notcontains 'docker-install') -and -not (Test-DockerIsInstalled)) {
+	Install-Docker
+}
+if ($tlsRestart) {
+	Write-Host 'Restarting computer to apply the TLS configuration'
+	Restart-Computer -Force
+	exit 0
+}
+# Install the packages of the install-packages metadata, as manager:name or
+# manager:name@version separated by comma, once. Chocolatey is installed
+# first if needed, winget must come with the image.
+if ($packages = Get-InstanceAttribute 'install-packages') {
+	$packagesFile = "$env:ProgramData\windows-builder-packages"
+	if ((Test-Path $packagesFile) -and ((Get-Content $packagesFile) -eq $packages)) {
+		Write-Host 'Packages already installed'
+	} else {
+		foreach ($package in $packages -split ',') {
+			$manager, $name = $package -split ':', 2
+			$name, $version = $name -split '@', 2
+			if ($manager -eq 'winget') {
+				if (-not (Get-Command winget -ErrorAction SilentlyContinue)) {
+					throw "winget is not available to install $name"
+				}
+				$installArgs = @('install', '--exact', '--id', $name, '--silent', '--scope', 'machine', '--accept-package-agreements', '--accept-source-agreements')
+			} else {
+				if (-not (Get-Command choco -ErrorAction SilentlyContinue)) {
+					Write-Host 'Installing Chocolatey'
+					[Net.ServicePointManager]::SecurityProtocol = [Net.ServicePointManager]::SecurityProtocol -bor [Net.SecurityProtocolType]::Tls12
+					Invoke-Expression ((New-Object System.Net.WebClient).DownloadString('https://community.chocolatey.org/install.ps1'))
+					$env:Path += ";$env:ProgramData\chocolatey\bin"
+				}
+				$installArgs = @('install', $name, '--yes', '--no-progress')
+			}
+			if ($version) {
+				$installArgs += @('--version', $version)
+			}
+			Write-Host "Installing $manager package $name"
+			& $manager @installArgs
+			if ($LASTEXITCODE -ne 0) {
+				throw "$manager install $name failed with exit code $LASTEXITCODE"
+			}
+		}
+		Set-Content -Path $packagesFile -Value $packages
+	}
+}
+# Write the Docker daemon configuration from the docker-daemon-config
+# metadata, if any, before (re)starting docker.
+if ($daemonConfig) {
+	New-Item -ItemType Directory -Force -Path "$env:ProgramData\docker\config" | Out-Null
+	# WriteAllText doesn't add a BOM, which dockerd fails to parse.
+	[System.IO.File]::WriteAllText("$env:ProgramData\docker\config\daemon.json", $daemonConfig)
+	Write-Host 'Wrote Docker daemon configuration'
+}
+# For some reason the docker service may not be started automatically on the
+# first reboot, although it seems to work fine on subsequent reboots.
+Restart-Service docker
+Start-Sleep 5
+if (-not (Test-DockerIsRunning)) {
+	throw "docker service failed to start or stay running"
+}
+
+# Setup Winrm
+$clientCert = Get-InstanceAttribute 'winrm-client-cert'
+if (($skipSteps -notcontains 'winrm-config') -and -not $clientCert) {
+	winrm set winrm/config/service/auth '@{Basic="true"}'
+}
+# Map the client certificate of the builder to the builder user, whose
+# password never leaves the instance.
+if ($clientCert) {
+	$certFile = "$env:Temp\winrm-client.cer"
+	Set-Content -Path $certFile -Value $clientCert
+	$cert = Import-Certificate -FilePath $certFile -CertStoreLocation Cert:\LocalMachine\Root
+	Import-Certificate -FilePath $certFile -CertStoreLocation Cert:\LocalMachine\TrustedPeople | Out-Null
+	Remove-Item $certFile
+	$bytes = New-Object byte[] 24
+	[Security.Cryptography.RandomNumberGenerator]::Create().GetBytes($bytes)
+	$password = ConvertTo-SecureString ([Convert]::ToBase64String($bytes) + 'aA1!') -AsPlainText -Force
+	if (Get-LocalUser -Name builder -ErrorAction SilentlyContinue) {
+		Set-LocalUser -Name builder -Password $password
+	} else {
+		New-LocalUser -Name builder -Password $password -PasswordNeverExpires | Out-Null
+		Add-LocalGroupMember -Group Administrators -Member builder
+	}
+	$credential = New-Object System.Management.Automation.PSCredential('builder', $password)
+	Get-ChildItem WSMan:\localhost\ClientCertificate | Remove-Item -Recurse -Force
+	New-Item -Path WSMan:\localhost\ClientCertificate -Subject 'builder@localhost' -URI * -Issuer $cert.Thumbprint -Credential $credential -Force | Out-Null
+	Set-Item WSMan:\localhost\Service\Auth\Certificate -Value $true
+	Write-Host 'Mapped the WinRM client certificate to the builder user'
+}
+
+Write-Host 'Windows instance setup is completed'
+`,
+	CopyWorkspaceScript: `
+$ErrorActionPreference = "Stop"
+$ProgressPreference = 'SilentlyContinue'
+$token = {{.TokenCommand}}
+Invoke-WebRequest -UseBasicParsing -Headers @{Authorization = "Bearer $token"} -Uri "{{.URL}}" -OutFile {{.Folder}}.zip
+Set-ItemProperty 'HKLM:\System\CurrentControlSet\Control\FileSystem' -Name 'LongPathsEnabled' -value 1
+Add-Type -Assembly "System.IO.Compression.Filesystem";
+[System.IO.Compression.ZipFile]::ExtractToDirectory("{{.Folder}}.zip", "{{.Folder}}");
+# ExtractToDirectory restores the modification times but not the attributes:
+# set the read-only and hidden MS-DOS attributes of the entries.
+$zip = [System.IO.Compression.ZipFile]::OpenRead("{{.Folder}}.zip")
+foreach ($entry in $zip.Entries) {
+	$attributes = $entry.ExternalAttributes -band 0x03
+	if ($attributes -ne 0) {
+		$file = Get-Item -LiteralPath (Join-Path "{{.Folder}}" $entry.FullName) -Force
+		$file.Attributes = $file.Attributes -bor $attributes
+	}
+}
+$zip.Dispose()
+Remove-Item -Path {{.Folder}}.zip -Force
+`,
+	BuildScript: `
+	$env:DOCKER_CLI_EXPERIMENTAL = 'enabled'
+	{{.Login}}
+	{{.RewriteFrom}}
+	docker build -t {{.Image}} --build-arg WINDOWS_VERSION={{.Version}} {{.BuildArgs}}.
+	{{if .Push}}{{.Login}}
+	docker push {{.Image}}{{end}}
+	`,
+	ManifestScript: `
+	$env:DOCKER_CLI_EXPERIMENTAL = 'enabled'
+	{{.Login}}
+	docker manifest create {{.Image}}{{range .Sources}} {{.}}{{end}}
+	docker manifest push {{.Image}}
+	`,
+}
+
+// Scripts are the PowerShell scripts run on the build servers, text/template
+// templates executed with the data of each script, see SetupScript,
+// CopyWorkspaceScript, BuildScript and ManifestScript. A nil Scripts has the
+// default scripts.
+type Scripts struct {
+	templates map[string]*template.Template
+}
+
+// LoadScripts returns the default scripts, overridden by the files of dir
+// named after them, e.g. build.ps1. Other .ps1 files are an error, to catch
+// misnamed overrides.
+func LoadScripts(dir string) (*Scripts, error) {
+	s := &Scripts{templates: map[string]*template.Template{}}
+	for name, text := range defaultScripts {
+		s.templates[name] = template.Must(template.New(name).Parse(text))
+	}
+	if dir == "" {
+		return s, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.ps1"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if _, ok := defaultScripts[name]; !ok {
+			var names []string
+			for n := range defaultScripts {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unknown script %s, expected one of %s", file, strings.Join(names, ", "))
+		}
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(name).Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse script %s: %+v", file, err)
+		}
+		s.templates[name] = t
+	}
+	return s, nil
+}
+
+// builtinScripts are the default scripts, used by a nil Scripts.
+var builtinScripts, _ = LoadScripts("")
+
+// Render executes the script name with data.
+func (s *Scripts) Render(name string, data interface{}) (string, error) {
+	if s == nil {
+		s = builtinScripts
+	}
+	t, ok := s.templates[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown script %s", name)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("Failed to render script %s: %+v", name, err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderDefaultScripts(t *testing.T) {
+	var s *Scripts
+	build, err := s.Render(BuildScript, BuildScriptData{
+		Image:     "gcr.io/p/app:v1_ltsc2019",
+		Version:   "ltsc2019",
+		BuildArgs: "--no-cache ",
+		Login:     "login",
+		Push:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"docker build -t gcr.io/p/app:v1_ltsc2019 --build-arg WINDOWS_VERSION=ltsc2019 --no-cache .",
+		"login\n\tdocker push gcr.io/p/app:v1_ltsc2019",
+	} {
+		if !strings.Contains(build, expected) {
+			t.Errorf("expected the build script to contain %q:\n%s", expected, build)
+		}
+	}
+
+	manifest, err := s.Render(ManifestScript, ManifestScriptData{Image: "gcr.io/p/app:v1", Sources: []string{"gcr.io/p/app:v1_ltsc2019", "gcr.io/p/app:v1_ltsc2022"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(manifest, "docker manifest create gcr.io/p/app:v1 gcr.io/p/app:v1_ltsc2019 gcr.io/p/app:v1_ltsc2022\n") {
+		t.Errorf("unexpected manifest script:\n%s", manifest)
+	}
+
+	setup, err := s.Render(SetupScript, SetupScriptData{Version: "ltsc2019"})
+	if err != nil {
+		t.Fatalf("failed to render the setup script: %v", err)
+	}
+	// The CA certificates may be needed to reach the network.
+	trust := strings.Index(setup, "'trusted-ca-certs'")
+	for _, step := range []string{"'install-windows-updates'", "Install-Docker\n", "community.chocolatey.org"} {
+		if i := strings.Index(setup, step); trust < 0 || i < trust {
+			t.Errorf("expected the trusted CA certificates to be installed before %s", step)
+		}
+	}
+}
+
+func TestLoadScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, BuildScript), []byte("custom-build {{.Image}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scripts, err := LoadScripts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _, remote := newTestOrchestrator(t, map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
+	}, nil)
+	o.Scripts = scripts
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if builds := remote.CommandsContaining("custom-build gcr.io/test-project/image:tag_ltsc2019"); len(builds) != 1 {
+		t.Errorf("expected the overridden build script to run once, got %d", len(builds))
+	}
+	if manifests := remote.CommandsContaining("docker manifest create"); len(manifests) != 1 {
+		t.Errorf("expected the default manifest script to be kept, got %d runs", len(manifests))
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "biuld.ps1"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadScripts(dir); err == nil || !strings.Contains(err.Error(), "biuld.ps1") {
+		t.Errorf("expected an error for an unknown script, got %v", err)
+	}
+}
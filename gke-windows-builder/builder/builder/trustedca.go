@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// ReadTrustedCACerts reads the PEM encoded CA certificates of the files at
+// paths and returns them as a single PEM bundle, for
+// WindowsBuildServerConfig.TrustedCACerts. Each file must hold at least one
+// certificate and nothing else.
+func ReadTrustedCACerts(paths []string) ([]byte, error) {
+	var bundle bytes.Buffer
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read trusted-ca-file %s: %+v", path, err)
+		}
+		var certs int
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				return nil, fmt.Errorf("Failed to read %s: unexpected PEM block %s, only certificates are trusted", path, block.Type)
+			}
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, fmt.Errorf("Failed to parse certificate %d of %s: %+v", certs+1, path, err)
+			}
+			if err := pem.Encode(&bundle, block); err != nil {
+				return nil, err
+			}
+			certs++
+		}
+		if certs == 0 || len(bytes.TrimSpace(data)) > 0 {
+			return nil, fmt.Errorf("Failed to read %s: expected PEM encoded certificates", path)
+		}
+	}
+	return bundle.Bytes(), nil
+}
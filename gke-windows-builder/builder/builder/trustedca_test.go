@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTrustedCACerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certA, key, err := NewWinRMClientCertificate("ca-a", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certB, _, err := NewWinRMClientCertificate("ca-b", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"a.pem":      certA,
+		"bundle.crt": append(append([]byte("# corporate CAs\n"), certA...), certB...),
+		"key.pem":    key,
+		"empty.pem":  nil,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle, err := ReadTrustedCACerts([]string{filepath.Join(dir, "a.pem"), filepath.Join(dir, "bundle.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(append(append([]byte(nil), certA...), certA...), certB...); !bytes.Equal(bundle, expected) {
+		t.Errorf("expected the certificates of both files, got:\n%s", bundle)
+	}
+
+	for _, name := range []string{"key.pem", "empty.pem", "missing.pem"} {
+		if _, err := ReadTrustedCACerts([]string{filepath.Join(dir, name)}); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected an error for %s, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func TestNewWinRMClientCertificate(t *testing.T) {
+	certPEM, keyPEM, err := NewWinRMClientCertificate("builder", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("expected a usable key pair, got %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("expected the client authentication usage only, got %v", cert.ExtKeyUsage)
+	}
+
+	var upn string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0].Tag != 0 {
+			t.Fatalf("expected a single otherName, got %v", names)
+		}
+		var typeID asn1.ObjectIdentifier
+		rest, err := asn1.Unmarshal(names[0].Bytes, &typeID)
+		if err != nil || !typeID.Equal(oidUPN) {
+			t.Fatalf("expected a UPN otherName, got %v, %v", typeID, err)
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(rest, &value); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := asn1.Unmarshal(value.Bytes, &upn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if upn != "builder@localhost" {
+		t.Errorf("expected the UPN builder@localhost, got %q", upn)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+)
+
+// WinRMTLS is the TLS configuration of the WinRM connections. New instances
+// configure their WinRM HTTPS listener, i.e. Schannel, to match it.
+type WinRMTLS struct {
+	// MinVersion is the minimum TLS version, tls.VersionTLS12 when 0.
+	MinVersion uint16
+	// CipherSuites, when set, are the only TLS 1.2 cipher suites allowed, by
+	// their IANA names. TLS 1.3 cipher suites are not configurable.
+	CipherSuites []string
+}
+
+// winRMCipherSuites are the cipher suites WinRMTLS.CipherSuites may allow,
+// those both Go and Schannel support, without RC4 and 3DES.
+var winRMCipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// ParseWinRMTLS parses the minimum TLS version, 1.2 or 1.3, and the comma
+// separated cipher suites of a WinRMTLS.
+func ParseWinRMTLS(minVersion string, cipherSuites string) (WinRMTLS, error) {
+	var t WinRMTLS
+	switch minVersion {
+	case "1.2":
+		t.MinVersion = tls.VersionTLS12
+	case "1.3":
+		t.MinVersion = tls.VersionTLS13
+	default:
+		return t, fmt.Errorf("Invalid minimum TLS version %q, expected 1.2 or 1.3", minVersion)
+	}
+	for _, name := range strings.Split(cipherSuites, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := winRMCipherSuites[name]; !ok {
+			var names []string
+			for n := range winRMCipherSuites {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return t, fmt.Errorf("Unsupported cipher suite %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		t.CipherSuites = append(t.CipherSuites, name)
+	}
+	return t, nil
+}
+
+// tls13Versions are the Windows versions whose Schannel supports TLS 1.3.
+var tls13Versions = map[string]bool{"ltsc2022": true}
+
+// CheckVersions returns an error if the minimum TLS version is 1.3 and one of
+// the Windows versions doesn't support it. Its WinRM HTTPS listener would
+// accept no TLS version at all once setup disables the older ones.
+func (t WinRMTLS) CheckVersions(versions []string) error {
+	if t.MinVersion != tls.VersionTLS13 {
+		return nil
+	}
+	var unsupported []string
+	for _, ver := range versions {
+		if !tls13Versions[ver] {
+			unsupported = append(unsupported, ver)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("TLS 1.3 is not supported by Windows versions %s, only by ltsc2022", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// VersionName returns the minimum TLS version as used in the instance
+// metadata, e.g. "1.2".
+func (t WinRMTLS) VersionName() string {
+	if t.MinVersion == tls.VersionTLS13 {
+		return "1.3"
+	}
+	return "1.2"
+}
+
+// clientConfig returns the client TLS configuration.
+func (t WinRMTLS) clientConfig() *tls.Config {
+	config := &tls.Config{MinVersion: t.MinVersion}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	for _, name := range t.CipherSuites {
+		config.CipherSuites = append(config.CipherSuites, winRMCipherSuites[name])
+	}
+	return config
+}
+
+// winRMTransporter is the WinRM HTTPS transport of both the winrm and
+// winrmcp clients, whose own transports don't expose their TLS
+// configuration. It authenticates with the client certificate when set,
+// with basic authentication otherwise.
+type winRMTransporter struct {
+	tls      WinRMTLS
+	username string
+	password string
+	cert     []byte
+	key      []byte
+
+	url       string
+	transport http.RoundTripper
+}
+
+func (t *winRMTransporter) Transport(endpoint *winrm.Endpoint) error {
+	config := t.tls.clientConfig()
+	config.InsecureSkipVerify = endpoint.Insecure
+	config.ServerName = endpoint.TLSServerName
+	if t.cert != nil {
+		cert, err := tls.X509KeyPair(t.cert, t.key)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		config.Renegotiation = tls.RenegotiateOnceAsClient
+	}
+	if len(endpoint.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(endpoint.CACert) {
+			return fmt.Errorf("Unable to read the WinRM CA certificates")
+		}
+		config.RootCAs = pool
+	}
+
+	t.url = fmt.Sprintf("https://%s/wsman", net.JoinHostPort(endpoint.Host, fmt.Sprint(endpoint.Port)))
+	t.transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ResponseHeaderTimeout: endpoint.Timeout,
+	}
+	return nil
+}
+
+func (t *winRMTransporter) Post(client *winrm.Client, request *soap.SoapMessage) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, t.url, strings.NewReader(request.String()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	if t.cert != nil {
+		req.Header.Set("Authorization", "http://schemas.dmtf.org/wbem/wsman/1/wsman/secprofile/https/mutual")
+	} else {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	resp, err := (&http.Client{Transport: t.transport}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the WinRM response: %+v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http error %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "application/soap+xml") {
+		return "", fmt.Errorf("invalid content type %q", resp.Header.Get("Content-Type"))
+	}
+	return string(body), nil
+}
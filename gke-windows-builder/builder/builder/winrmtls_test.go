@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
+)
+
+func TestParseWinRMTLS(t *testing.T) {
+	c, err := ParseWinRMTLS("1.2", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := c.clientConfig()
+	if config.MinVersion != tls.VersionTLS12 || len(config.CipherSuites) != 2 || config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("unexpected client configuration %+v", config)
+	}
+	if c.VersionName() != "1.2" {
+		t.Errorf("expected version 1.2, got %q", c.VersionName())
+	}
+
+	if _, err := ParseWinRMTLS("1.1", ""); err == nil {
+		t.Errorf("expected an error for TLS 1.1")
+	}
+	if _, err := ParseWinRMTLS("1.2", "TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Errorf("expected an error for an RC4 cipher suite")
+	}
+	if err := c.CheckVersions([]string{"ltsc2019", "ltsc2022"}); err != nil {
+		t.Errorf("expected TLS 1.2 to be supported by all versions, got %v", err)
+	}
+	tls13, err := ParseWinRMTLS("1.3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tls13.CheckVersions([]string{"ltsc2022"}); err != nil {
+		t.Errorf("expected TLS 1.3 to be supported by ltsc2022, got %v", err)
+	}
+	if err := tls13.CheckVersions([]string{"ltsc2022", "ltsc2019", "20H2"}); err == nil {
+		t.Errorf("expected an error for TLS 1.3 with ltsc2019 and 20H2")
+	}
+	if config := (WinRMTLS{}).clientConfig(); config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 by default, got %x", config.MinVersion)
+	}
+}
+
+func TestWinRMTransporter(t *testing.T) {
+	for _, test := range []struct {
+		maxVersion uint16
+		ok         bool
+	}{
+		{maxVersion: tls.VersionTLS11},
+		{maxVersion: tls.VersionTLS12, ok: true},
+	} {
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if user, password, _ := req.BasicAuth(); user != "builder" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+			w.Write([]byte("<response/>"))
+		}))
+		s.TLS = &tls.Config{MaxVersion: test.maxVersion}
+		s.StartTLS()
+		host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := strconv.Atoi(port)
+		endpoint := winrm.NewEndpoint(host, p, true, true, nil, nil, nil, 10*time.Second)
+
+		tr := &winRMTransporter{username: "builder", password: "secret"}
+		if err := tr.Transport(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		body, err := tr.Post(nil, soap.NewMessage())
+		s.Close()
+		if !test.ok {
+			if err == nil {
+				t.Errorf("expected the handshake with a server of TLS version %x to fail", test.maxVersion)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Post failed: %v", err)
+		}
+		if body != "<response/>" {
+			t.Errorf("unexpected response %q", body)
+		}
+	}
+}
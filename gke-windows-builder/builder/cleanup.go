@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"gke-windows-builder/builder/builder"
+)
+
+// cleanupMain implements the cleanup command, which deletes the resources
+// left by a build from its inventory:
+//
+//	gke-windows-builder cleanup --inventory=/workspace/inventory.json
+func cleanupMain(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	inventoryPath := fs.String("inventory", "", "The inventory file written by the build, see --inventory-file")
+	deleteReused := fs.Bool("delete-reused-instances", false, "Also delete the instances the build reused rather than created")
+	dryRun := fs.Bool("dry-run", false, "Only log the resources that would be deleted")
+	apiQPS := fs.Float64("api-qps", 20, "Maximum rate of the Compute Engine and Cloud Storage API calls. Unlimited if 0")
+	apiMaxRetries := fs.Int("api-max-retries", 5, "Number of retries of the API calls rejected by rate limits or failing with transient errors")
+	setFlagsFromEnv(fs, "cleanup")
+	fs.Parse(args)
+	if *inventoryPath == "" {
+		log.Fatalf("Error inventory flag is required but was not set")
+	}
+
+	inventory, err := builder.LoadInventory(*inventoryPath)
+	if err != nil {
+		log.Fatalf("Failed to load inventory: %+v", err)
+	}
+
+	ctx := context.Background()
+	computeClient, err := builder.NewComputeClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to start GCE service: %+v", err)
+	}
+	storageClient, err := builder.NewStorageClient(ctx)
+	if err != nil {
+		log.Fatalf("Storage client creation failed: %+v", err)
+	}
+	limiter := builder.NewAPILimiter(*apiQPS, *apiMaxRetries)
+	computeClient = limiter.Compute(computeClient)
+	storageClient = limiter.Storage(storageClient)
+	defer storageClient.Close()
+
+	if err := inventory.Cleanup(ctx, computeClient, storageClient, *deleteReused, *dryRun); err != nil {
+		log.Fatalf("Cleanup failed with error: %+v", err)
+	}
+	log.Printf("Cleanup of the resources in %s is completed", *inventoryPath)
+}
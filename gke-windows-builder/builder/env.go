@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// envPrefix prefixes the environment variables setting the flags.
+const envPrefix = "BUILDER_"
+
+// noEnvFlags are the flags not set from the environment: action flags, like
+// --version, would replace the build with another action, and
+// BUILDER_VERSION is too close to BUILDER_VERSIONS.
+var noEnvFlags = map[string]bool{"version": true}
+
+// setFlagsFromEnv sets each flag of fs from the environment variable named
+// after it, e.g. --zone from BUILDER_ZONE, --boot-disk-size-GB from
+// BUILDER_BOOT_DISK_SIZE_GB and --machineType from BUILDER_MACHINE_TYPE. The
+// flags of a command get its name in their prefix, e.g. --dry-run of cleanup
+// is set from BUILDER_CLEANUP_DRY_RUN. It must be called before fs.Parse, so
+// command line flags win over the environment. Repeatable flags take one value
+// per line. The flags of noEnvFlags are left out.
+func setFlagsFromEnv(fs *flag.FlagSet, command string) {
+	prefix := envPrefix
+	if command != "" {
+		prefix += envVarName(command) + "_"
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if noEnvFlags[f.Name] {
+			return
+		}
+		name := prefix + envVarName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*buildArgsArray); repeatable {
+			values = strings.Split(strings.TrimSpace(value), "\n")
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, v); err != nil {
+				log.Fatalf("Error invalid value %q of %s for flag %s: %v", v, name, f.Name, err)
+			}
+		}
+	})
+}
+
+// envVarName returns the environment variable name of a flag name: upper
+// case, with dashes and camel case word boundaries as underscores.
+func envVarName(flagName string) string {
+	var b strings.Builder
+	var prev rune
+	for _, r := range flagName {
+		switch {
+		case r == '-':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
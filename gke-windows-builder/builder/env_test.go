@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestEnvVarName(t *testing.T) {
+	for name, want := range map[string]string{
+		"zone":                 "ZONE",
+		"boot-disk-size-GB":    "BOOT_DISK_SIZE_GB",
+		"machineType":          "MACHINE_TYPE",
+		"container-image-name": "CONTAINER_IMAGE_NAME",
+		"mirror-base-images":   "MIRROR_BASE_IMAGES",
+	} {
+		if got := envVarName(name); got != want {
+			t.Errorf("envVarName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"BUILDER_ZONE":            "europe-west1-b",
+		"BUILDER_MACHINE_TYPE":    "e2-standard-4",
+		"BUILDER_VERSIONS":        "ltsc2019",
+		"BUILDER_VERSION":         "ltsc2022",
+		"BUILDER_BUILD_ARG":       "A=1\nB=2\n",
+		"BUILDER_CLEANUP_DRY_RUN": "true",
+		"BUILDER_REUSE_INSTANCES": "true",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	fs := flag.NewFlagSet("builder", flag.ContinueOnError)
+	zone := fs.String("zone", "us-central1-f", "")
+	machineType := fs.String("machineType", "", "")
+	versions := fs.String("versions", "", "")
+	version := fs.Bool("version", false, "")
+	reuse := fs.Bool("reuse-instances", false, "")
+	var args buildArgsArray
+	fs.Var(&args, "build-arg", "")
+	setFlagsFromEnv(fs, "")
+	if err := fs.Parse([]string{"--zone=us-east1-b"}); err != nil {
+		t.Fatal(err)
+	}
+	if *zone != "us-east1-b" {
+		t.Errorf("expected the command line zone to win over the environment, got %q", *zone)
+	}
+	if *machineType != "e2-standard-4" || *versions != "ltsc2019" || !*reuse {
+		t.Errorf("unexpected flags from the environment: machineType %q, versions %q, reuse-instances %v", *machineType, *versions, *reuse)
+	}
+	if *version {
+		t.Errorf("expected version not to be set from the environment")
+	}
+	if len(args) != 2 || args[0] != "A=1" || args[1] != "B=2" {
+		t.Errorf("expected one build-arg per line, got %q", args)
+	}
+
+	cleanup := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	dryRun := cleanup.Bool("dry-run", false, "")
+	setFlagsFromEnv(cleanup, "cleanup")
+	if !*dryRun {
+		t.Errorf("expected dry-run to be set from BUILDER_CLEANUP_DRY_RUN")
+	}
+}
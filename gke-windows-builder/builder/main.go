@@ -16,23 +16,41 @@ package main
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"gke-windows-builder/builder/builder"
-
-	"github.com/masterzen/winrm"
-	"google.golang.org/api/googleapi"
+	"gke-windows-builder/builder/builder/archive"
+	"gke-windows-builder/builder/builder/fake"
 )
 
 var (
-	projectID               = flag.String("project", "", "The project Id to use when creating the Windows Instance (uses gcloud default if not specified)")
+	showVersion             = flag.Bool("version", false, "Print the version of the builder and the Windows versions it builds for, and exit")
+	projectID               = flag.String("project", "", "The project Id to use when creating the Windows Instance (uses the project of the metadata server or of the application default credentials if not specified)")
 	workspacePath           = flag.String("workspace-path", "/workspace", "The directory to copy data from")
+	resultsFile             = flag.String("results-file", "/workspace/build-results.json", "The file to write the JSON results of the build of each version to, see retry-failed. It is left out of the copied workspace. Empty to skip it")
+	junitFile               = flag.String("junit-file", "", "The file to write a JUnit XML report of the build to, with a test case per Windows version, e.g. for CI systems to show the status of each version")
+	retryFailed             = flag.Bool("retry-failed", false, "Rebuild only the versions that failed according to the results-file of a previous build of the same image, and push the manifest with the images of the versions that succeeded then")
+	inventoryFile           = flag.String("inventory-file", "/workspace/inventory.json", "The file to write the JSON inventory of the cloud resources created and used by the build to, see the cleanup command. It is left out of the copied workspace. Empty to skip it")
+	scriptsDir              = flag.String("scripts-dir", "", "Directory of PowerShell script templates overriding the default ones run on the Windows instances, by name: setup.ps1, copy-workspace.ps1, build.ps1 and manifest.ps1")
+	symlinks                = flag.String("symlinks", "skip", "How to copy the symlinks of the build context to the instances: 'skip' leaves them out, 'follow' copies the files and directories they point to in their place, 'error' fails the build")
+	warnFileSize            = flag.String("warn-file-size", "100MB", "Log the files of the build context larger than this size, e.g. 100MB, as they slow down the copy to the instances. 0 disables it")
+	skipLargeFiles          = flag.Bool("skip-large-files", false, "Leave the files larger than warn-file-size out of the copy of the build context")
+	maxArchiveSize          = flag.String("max-archive-size", "0", "Fail the build before copying the build context when its compressed archive is larger than this size, e.g. 2GB, listing the largest files. 0 disables it")
+	contextDir              = flag.String("context-dir", "", "The directory within workspace-path to use as the docker build context. Only this directory is copied to the instances")
+	imageOutput             = flag.String("image-output", "push", "Comma separated outputs of the build of each version: 'push' pushes the images and the multi-arch manifest, 'tarball' saves the images with docker save to tarball-dir, e.g. to scan or sign them before pushing, 'export' exports them to export-to")
+	exportTo                = flag.String("export-to", "", "gs://bucket/path/ to export the image of each version to with image-output=export, as <version>.tar with its docker image inspect output in <version>.json, and an index.json of all versions")
+	tarballDir              = flag.String("tarball-dir", "/workspace/images", "The directory to save the image of each version to, as <version>.tar, with image-output=tarball")
+	logsDir                 = flag.String("logs-dir", "/workspace/logs", "The directory to write the full remote output of each version to, as build-<version>.log. Empty to only stream the output")
 	workspaceBucket         = flag.String("workspace-bucket", "", "The bucket to copy the directory to. Defaults to {project-id}_builder_tmp")
 	workspaceBucketLocation = flag.String("workspace-bucket-location", "", "The location of the bucket. Defaults to 'us' which is the GCS API default location'")
 	network                 = flag.String("network", "default", "The VPC network to use when creating the Windows Instance (uses 'default' if not specified)")
@@ -42,20 +60,74 @@ var (
 	region                  = flag.String("region", "us-central1", "The region to create the Windows Instance in (where the Subnetwork is located)")
 	zone                    = flag.String("zone", "us-central1-f", "The zone name to use when creating the Windows Instance")
 	labels                  = flag.String("labels", "", "List of label KEY=VALUE pairs separated by comma to add when creating the Windows Instance")
+	storageLabels           = flag.String("storage-labels", "", "List of label KEY=VALUE pairs separated by comma to add to the workspace bucket when creating it, and as metadata to the uploaded workspace objects. Defaults to labels")
 	machineType             = flag.String("machineType", "", "The machine type to use when creating the Windows Instance")
 	bootDiskType            = flag.String("boot-disk-type", "pd-standard", "Windows instance boot disk type. Default value is pd-standard, other values include pd-ssd and pd-balanced")
 	bootDiskSizeGB          = flag.Int64("boot-disk-size-GB", 75, "Instance boot disk size (in GB). Must be at least 40 GB")
 	copyTimeout             = flag.Duration("copy-timeout", 5*time.Minute, "The workspace copy timeout in minutes")
 	serviceAccount          = flag.String("serviceAccount", "default", "The service account to use when creating the Windows Instance")
 	containerImageName      = flag.String("container-image-name", "", "The target container image:tag name")
-	pickedVersions          = flag.String("versions", "", "List of Windows Server versions user wants to support. If not provided, the container will be built to support all Windows versions that GKE supports")
+	imageVariant            = flag.String("image-variant", "core", "GCE image variant of the Windows instances: 'core' for Server Core, or 'full' for Desktop Experience images that include GDI and other desktop components (LTSC versions only)")
+	imageFamilies           = flag.String("image-families", "", "List of VERSION=IMAGE pairs separated by comma overriding the GCE image per version, e.g. ltsc2019=windows-2019-for-containers. IMAGE is a family in windows-cloud or a full PROJECT/global/images/... path")
+	baseImageMirror         = flag.String("base-image-mirror", "", "Registry repository with copies of the mcr.microsoft.com base images made by the mirror-base-images command. The Dockerfile FROM lines are rewritten to use it during the build")
+	baseImageTarball        = flag.String("base-image-tarball", "", "gs:// URL of a docker save tarball of the base images to docker load on the Windows instances before the build, e.g. when they have no route to mcr.microsoft.com. A {version} placeholder is replaced with the Windows version")
+	hostProcess             = flag.Bool("hostprocess", false, "Validate the images as Windows HostProcess container images before pushing them: built FROM hostprocess-base-image, with an ENTRYPOINT or CMD that is not an absolute path of the host, and no USER nor VOLUME. Validated images are labeled "+builder.HostProcessAnnotation+"=true, as is the OCI image index")
+	hostProcessBaseImage    = flag.String("hostprocess-base-image", builder.DefaultHostProcessBaseImage, "Base image of the HostProcess container images validated with hostprocess")
+	dockerfileCheck         = flag.String("dockerfile-check", "error", "How to handle problems found in the workspace Dockerfile before creating instances: 'error' fails the build, 'warn' only logs them, 'off' skips the check")
+	pickedVersions          = flag.String("versions", "", "List of Windows Server versions user wants to support. If not provided, the container will be built to support all Windows versions that GKE supports. 'auto' infers them from the FROM lines of the Dockerfile")
+	onComplete              = flag.String("on-complete", "delete", "What to do with the created instances after the build: 'delete' them, or 'stop' them to keep their disks and docker cache, and start them again in later builds with reuse-builder-instances, or 'suspend' them to also keep their memory and resume them in about a minute. Instances are kept running with reuse-builder-instances and 'delete'")
 	reuseBuilderInstances   = flag.Bool("reuse-builder-instances", false, "Look for existing instances by labels and instance-name-prefix and reuse them for build, create new instance only if none were found. Avoid when queuing parallel builds.")
+	instanceNameTemplate    = flag.String("instance-name-template", builder.DefaultInstanceNameTemplate, "Template of the names of the created GCE instances, with the placeholders {prefix}, {version}, {buildid} (first 8 characters of build-id), {rand} and {uuid}")
+	buildID                 = flag.String("build-id", os.Getenv("BUILD_ID"), "Identifier of the build for the {buildid} placeholder of instance-name-template, e.g. $BUILD_ID in Cloud Build. Defaults to the BUILD_ID environment variable")
 	instanceNamePrefix      = flag.String("instance-name-prefix", "windows-builder-", "Prefix to use for created GCE instances. Defaults to 'windows-builder-'")
 	testObsoleteVersion     = flag.Bool("testonly-test-obsolete-versions", false, "If true, verify the obsolete Windows versions won't fail the builder. For testing purposes only")
+	maxClockSkew            = flag.Duration("max-clock-skew", 30*time.Second, "Resync the clock of the Windows instances and fail the build of a version when it is still further off its time source, as skew breaks registry authentication and TLS. 0 skips the check")
+	noCache                 = flag.Bool("no-cache", false, "Pass --no-cache to docker build, not to use the layer cache of the Windows instances")
+	pull                    = flag.Bool("pull", false, "Pass --pull to docker build, to always pull newer versions of the base images")
+	manifestAttemptDelay    = flag.Duration("manifest-attempt-delay", 2*time.Minute, "How long the creation of the multi-arch manifest on an instance runs before it is also attempted on the next instance, the first to succeed wins. 0 only tries the next instance after a failed attempt")
 	setupTimeout            = flag.Duration("setup-timeout", 20*time.Minute, "Time out to wait for Windows instance to be ready for winrm connection and Docker setup")
+	readyPollInterval       = flag.Duration("ready-poll-interval", builder.DefaultReadyPollInterval, "First wait between the checks of a Windows instance being ready, doubled after each failed check up to ready-poll-max-interval")
+	readyPollMaxInterval    = flag.Duration("ready-poll-max-interval", builder.DefaultReadyPollMaxInterval, "Longest wait between the checks of a Windows instance being ready")
+	remoteIdleTimeout       = flag.Duration("remote-idle-timeout", 0, "Abort the build of a version when docker writes no output for this long, e.g. 15m to catch hung pulls and pushes. No idle time out if 0")
+	perVersionTimeout       = flag.Duration("per-version-timeout", 0, "Time out for setting up, copying and building each version. A version running late is aborted and its instance released while the other versions complete, but it still fails the build and no manifest is pushed, see retry-failed. No time out if 0")
 	useInternalIP           = flag.Bool("use-internal-ip", false, "Use internal IP addresses (for shared VPCs), also implies no need for firewall rules")
 	ExternalIP              = flag.Bool("external-ip", true, "Create external IP addresses for VMs, If false then Cloud NAT must be enabled, see README for details.")
+	remoteHost              = flag.String("remote-host", "", "Existing Windows host to build on over WinRM HTTPS (port 5986) instead of a GCE instance, as HOST when building a single version or as VERSION=HOST pairs separated by comma. Docker on the host must already be logged in to the registries")
+	workerProjects          = flag.String("worker-projects", "", "Projects to create the build instances in instead of --project, separated by comma. The versions are spread round-robin across them, each project using its own quota")
+	useInstance             = flag.String("use-instance", "", "Existing GCE instances in zone to build on, never deleted, as NAME when building a single version or as VERSION=NAME pairs separated by comma. A version may have several instances, a running one is picked")
+	remoteUser              = flag.String("remote-user", "", "The WinRM user of remote-host")
+	remotePassword          = flag.String("remote-password", "", "The WinRM password of remote-host")
+	remotePasswordSecret    = flag.String("remote-password-secret", "", "Secret Manager secret version holding the WinRM password of remote-host, e.g. projects/PROJECT/secrets/NAME/versions/latest")
 	skipFirewallCheck       = flag.Bool("skip-firewall-check", false, "Skip checking that the project has a firewall rule permitting WinRM ingress")
+	executor                = flag.String("executor", "winrm", "How the builder reaches GCP and the Windows instances: 'winrm', or 'fake' to simulate instances, buckets and remote command results in memory for testing")
+	fakeFixture             = flag.String("fake-fixture", "", "JSON file describing the simulated results for --executor=fake, see the builder/fake package")
+	defender                = flag.String("defender", "exclude", "How to keep Windows Defender from locking docker files on the Windows instances: 'exclude' keeps it enabled with exclusions for the docker and workspace folders, 'uninstall' removes it, which needs an extra reboot")
+	automaticRestart        = flag.Bool("automatic-restart", true, "Restart the Windows instances if they are terminated by GCE, e.g. on hardware failure")
+	onHostMaintenance       = flag.String("on-host-maintenance", "MIGRATE", "What GCE does with the Windows instances on host maintenance: 'MIGRATE' them live, or 'TERMINATE' them")
+	provisioningModel       = flag.String("provisioning-model", "STANDARD", "Provisioning model of the Windows instances: 'STANDARD', or 'PREEMPTIBLE' for cheaper instances that GCE may stop at any time, which implies --automatic-restart=false and --on-host-maintenance=TERMINATE")
+	placementPolicy         = flag.String("placement-policy", "", "Name of a resource policy in the region of --zone, or projects/PROJECT/regions/REGION/resourcePolicies/NAME, to attach to the Windows instances, e.g. a compact or spread placement policy")
+	skipDockerInstall       = flag.Bool("skip-docker-install", false, "Don't install the Containers feature and Docker on the Windows instances, for images that already have them")
+	skipDefenderRemoval     = flag.Bool("skip-defender-removal", false, "Leave Windows Defender on the Windows instances as it is, --defender is ignored")
+	installPackages         = flag.String("install-packages", "", "Packages new Windows instances install during setup, e.g. git,7zip@22.1,winget:Microsoft.DotNet.SDK.8, separated by comma. Packages are installed with Chocolatey unless prefixed with winget:, and at their latest version unless suffixed with @version")
+	installWindowsUpdates   = flag.Bool("install-windows-updates", false, "Install the pending Windows updates, with reboots, when setting up new Windows instances, before building. This may take much longer than the default setup-timeout")
+	winrmAuth               = flag.String("winrm-auth", "basic", "How the builder authenticates to WinRM on new Windows instances: 'basic' enables basic authentication and resets the password of the builder user, 'cert' maps a client certificate generated for the build to the user instead. Remote hosts always use basic authentication")
+	skipWinRMConfig         = flag.Bool("skip-winrm-config", false, "Don't enable WinRM basic authentication nor restrict the TLS versions and cipher suites of WinRM on the Windows instances, for images that are already configured")
+	winrmMinTLSVersion      = flag.String("winrm-min-tls-version", "1.2", "Minimum TLS version of the WinRM connections, 1.2 or 1.3, which only ltsc2022 supports. New Windows instances disable the older versions for their WinRM HTTPS listener")
+	winrmCipherSuites       = flag.String("winrm-cipher-suites", "", "TLS 1.2 cipher suites allowed for the WinRM connections, by IANA name separated by comma, e.g. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384. New Windows instances disable the other ones. All the secure suites are allowed if empty")
+	dockerDaemonConfig      = flag.String("docker-daemon-config", "", "daemon.json file to configure Docker with on the Windows instances. The --docker-* flags below take precedence over its settings")
+	dockerCacheSnapshots    = flag.Bool("docker-cache-snapshots", false, "Put the docker data-root of new instances on a separate disk, seeded from a snapshot taken after the last successful build of the same version, for a warm layer cache")
+	dockerCacheDiskSizeGB   = flag.Int64("docker-cache-disk-size-gb", 100, "Size of the docker cache disk in GB with docker-cache-snapshots, at least the size of the snapshot it is seeded from")
+	dockerDataRoot          = flag.String("docker-data-root", "", "Docker data-root on the Windows instances, e.g. D:\\docker")
+	dockerMaxDownloads      = flag.Int("docker-max-concurrent-downloads", 0, "Docker max-concurrent-downloads on the Windows instances (Docker default if 0)")
+	dockerMaxUploads        = flag.Int("docker-max-concurrent-uploads", 0, "Docker max-concurrent-uploads on the Windows instances (Docker default if 0)")
+	dockerInsecureRegistry  = flag.String("docker-insecure-registries", "", "List of insecure registries separated by comma for Docker on the Windows instances")
+	dockerRegistryMirrors   = flag.String("docker-registry-mirrors", "", "List of registry mirror URLs separated by comma for Docker on the Windows instances")
+	dockerStorageOpts       = flag.String("docker-storage-opts", "", "List of storage driver options separated by comma for Docker on the Windows instances, e.g. size=120GB")
+	diskPreflight           = flag.String("disk-preflight", "bump", "How to handle a boot-disk-size-GB smaller than the disk space estimated for the workspace, base images and build of a version: 'bump' raises it for the new instances, 'error' fails the build before creating instances, 'off' skips the check")
+	iamPreflight            = flag.Bool("iam-preflight", true, "Before creating any resource, check with testIamPermissions that the builder and the service account of the instances have the permissions the build needs, and fail listing the missing ones")
+	apiQPS                  = flag.Float64("api-qps", 20, "Maximum rate of the Compute Engine and Cloud Storage API calls of the builder, shared by all the versions. Unlimited if 0")
+	apiMaxRetries           = flag.Int("api-max-retries", 5, "Number of retries, with exponential backoff, of the Compute Engine and Cloud Storage API calls rejected by rate limits or failing with transient errors")
+	manifestMediaType       = flag.String("manifest-media-type", "docker", "Media type of the published multi-arch image: 'docker' for a Docker manifest list created on a builder instance, or 'oci' for an OCI image index assembled by the builder")
 	// Windows version and GCE container image family map
 	// Note:
 	// 1. Mapping between version <-> image family name, NOT specific image name
@@ -66,12 +138,23 @@ var (
 		"ltsc2019": "windows-cloud/global/images/family/windows-2019-core",
 		"ltsc2022": "windows-cloud/global/images/family/windows-2022-core",
 	}
+	// Windows version and GCE Desktop Experience (non-core) image family map, used with --image-variant=full
+	fullVersionMap = map[string]string{
+		"ltsc2019": "windows-cloud/global/images/family/windows-2019",
+		"ltsc2022": "windows-cloud/global/images/family/windows-2022",
+	}
 	commandTimeout = 10 * time.Minute
 )
 
 type buildArgsArray []string
 
-var buildArgs buildArgsArray
+var (
+	buildArgs           buildArgsArray
+	includes            buildArgsArray
+	manifestAnnotations buildArgsArray
+	imageBuildLabels    buildArgsArray
+	trustedCAFiles      buildArgsArray
+)
 
 func (i *buildArgsArray) String() string {
 	return "my string representation"
@@ -82,19 +165,131 @@ func (i *buildArgsArray) Set(value string) error {
 	return nil
 }
 
-// builderServerStatus contains builder server and associated error.
-type builderServerStatus struct {
-	s   *builder.Server
-	err error
-}
-
 func main() {
-	log.Print("Starting Windows multi-arch container builder")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cleanup":
+			cleanupMain(os.Args[2:])
+			return
+		case "mirror-base-images":
+			mirrorBaseImagesMain(os.Args[2:])
+			return
+		case "promote":
+			promoteMain(os.Args[2:])
+			return
+		case "prune-tags":
+			pruneTagsMain(os.Args[2:])
+			return
+		case "version":
+			printVersion(os.Stdout)
+			return
+		}
+	}
+
+	log.Printf("Starting Windows multi-arch container builder, %s", versionString())
 	flag.Var(&buildArgs, "build-arg", "The list of parameters to pass to the docker build command")
+	flag.Var(&manifestAnnotations, "manifest-annotation", "KEY=VALUE annotation to add to the published OCI image index, may be repeated. Requires --manifest-media-type=oci")
+	flag.Var(&imageBuildLabels, "image-build-label", "KEY=VALUE label to set with --label on the docker build of each version, may be repeated")
+	flag.Var(&trustedCAFiles, "trusted-ca-file", "PEM file of CA certificates, e.g. of a private registry or proxy, that new instances add to their root store and to the docker certs.d folders of the registries of container-image-name and base-image-mirror, may be repeated")
+	flag.Var(&includes, "include", "Glob pattern of the paths, relative to the build context, to copy to the instances instead of the whole context, e.g. 'bin/*.exe', may be repeated. A matching directory is copied with all its content. The Dockerfile is always copied")
+	setFlagsFromEnv(flag.CommandLine, "")
 	flag.Parse()
+	if *showVersion {
+		printVersion(os.Stdout)
+		return
+	}
 	if *containerImageName == "" {
 		log.Fatalf("Error container-image-name flag is required but was not set")
 	}
+	if _, err := builder.ParseImageReference(*containerImageName); err != nil {
+		log.Fatalf("Error container-image-name: %+v", err)
+	}
+
+	if *manifestMediaType != "docker" && *manifestMediaType != "oci" {
+		log.Fatalf("Error manifest-media-type must be 'docker' or 'oci', got %q", *manifestMediaType)
+	}
+	if *retryFailed && *resultsFile == "" {
+		log.Fatalf("Error retry-failed reads the results of the previous build from results-file, which is empty")
+	}
+	if len(manifestAnnotations) > 0 && *manifestMediaType != "oci" {
+		log.Fatalf("Error manifest-annotation requires manifest-media-type=oci")
+	}
+	annotations, err := parseKeyValuePairs(manifestAnnotations)
+	if err != nil {
+		log.Fatalf("Error parsing manifest-annotation: %+v", err)
+	}
+	imageLabels, err := parseKeyValuePairs(imageBuildLabels)
+	if err != nil {
+		log.Fatalf("Error parsing image-build-label: %+v", err)
+	}
+	bucketLabels, err := getStorageLabels()
+	if err != nil {
+		log.Fatalf("Error parsing storage-labels: %+v", err)
+	}
+	if *executor != "winrm" && *executor != "fake" {
+		log.Fatalf("Error executor must be 'winrm' or 'fake', got %q", *executor)
+	}
+	if *defender != "exclude" && *defender != "uninstall" {
+		log.Fatalf("Error defender must be 'exclude' or 'uninstall', got %q", *defender)
+	}
+	if *onHostMaintenance != "MIGRATE" && *onHostMaintenance != "TERMINATE" {
+		log.Fatalf("Error on-host-maintenance must be 'MIGRATE' or 'TERMINATE', got %q", *onHostMaintenance)
+	}
+	if *provisioningModel != "STANDARD" && *provisioningModel != "PREEMPTIBLE" {
+		log.Fatalf("Error provisioning-model must be 'STANDARD' or 'PREEMPTIBLE', got %q", *provisioningModel)
+	}
+	buildContext, err := getBuildContext(*workspacePath, *contextDir)
+	if err != nil {
+		log.Fatalf("Error context-dir: %+v", err)
+	}
+	if *onComplete != "delete" && *onComplete != "stop" && *onComplete != "suspend" {
+		log.Fatalf("Error on-complete must be 'delete', 'stop' or 'suspend', got %q", *onComplete)
+	}
+	if *dockerCacheSnapshots && *dockerDataRoot != "" {
+		log.Fatalf("Error docker-cache-snapshots puts the docker data-root on the cache disk, it can't be used with docker-data-root")
+	}
+	outputs := map[string]bool{}
+	for _, output := range strings.Split(*imageOutput, ",") {
+		if output != "push" && output != "tarball" && output != "export" {
+			log.Fatalf("Error image-output must be a list of 'push', 'tarball' and 'export', got %q", *imageOutput)
+		}
+		outputs[output] = true
+	}
+	if outputs["tarball"] && *tarballDir == "" {
+		log.Fatalf("Error image-output=tarball requires tarball-dir")
+	}
+	if outputs["export"] != (*exportTo != "") {
+		log.Fatalf("Error image-output=export and export-to must be set together")
+	}
+	if *baseImageTarball != "" {
+		if _, object, err := builder.ParseGCSURL(*baseImageTarball); err != nil || object == "" {
+			log.Fatalf("Error base-image-tarball must be a gs://bucket/object URL, got %q", *baseImageTarball)
+		}
+	}
+	if *exportTo != "" {
+		if _, _, err := builder.ParseGCSURL(*exportTo); err != nil {
+			log.Fatalf("Error export-to: %+v", err)
+		}
+	}
+	if *winrmAuth != "basic" && *winrmAuth != "cert" {
+		log.Fatalf("Error winrm-auth must be 'basic' or 'cert', got %q", *winrmAuth)
+	}
+	winrmTLS, err := builder.ParseWinRMTLS(*winrmMinTLSVersion, *winrmCipherSuites)
+	if err != nil {
+		log.Fatalf("Error WinRM TLS configuration: %+v", err)
+	}
+	if *winrmAuth == "cert" && *reuseBuilderInstances {
+		log.Fatalf("Error winrm-auth=cert can't be used with reuse-builder-instances, the certificate is mapped when new instances are set up")
+	}
+	if *dockerfileCheck != "error" && *dockerfileCheck != "warn" && *dockerfileCheck != "off" {
+		log.Fatalf("Error dockerfile-check must be 'error', 'warn' or 'off', got %q", *dockerfileCheck)
+	}
+	if *diskPreflight != "bump" && *diskPreflight != "error" && *diskPreflight != "off" {
+		log.Fatalf("Error disk-preflight must be 'bump', 'error' or 'off', got %q", *diskPreflight)
+	}
+	if *fakeFixture != "" && *executor != "fake" {
+		log.Fatalf("Error fake-fixture requires executor=fake")
+	}
 
 	if *networkProject != "" && *subnetworkProject != "" && *networkProject != *subnetworkProject {
 		log.Fatalf("When both network and subnetwork projects are set, they must be identical")
@@ -104,16 +299,130 @@ func main() {
 		*networkProject = *subnetworkProject
 	}
 
-	pickedVersionMap := getPickedVersionMap(*pickedVersions)
+	versions := *pickedVersions
+	if versions == "auto" {
+		if versions, err = getDockerfileVersions(buildContext); err != nil {
+			log.Fatalf("Error versions=auto: %+v", err)
+		}
+	}
+	pickedVersionMap, err := getImageFamilies(getPickedVersionMap(versions), *imageVariant, *imageFamilies)
+	if err != nil {
+		log.Fatalf("Error selecting Windows images: %+v", err)
+	}
+	if *symlinks != "skip" && *symlinks != "follow" && *symlinks != "error" {
+		log.Fatalf("Error symlinks must be 'skip', 'follow' or 'error', got %q", *symlinks)
+	}
+	var workspaceLimits archive.Limits
+	if workspaceLimits.WarnFileSize, err = archive.ParseSize(*warnFileSize); err != nil {
+		log.Fatalf("Error warn-file-size: %+v", err)
+	}
+	if workspaceLimits.MaxSize, err = archive.ParseSize(*maxArchiveSize); err != nil {
+		log.Fatalf("Error max-archive-size: %+v", err)
+	}
+	var scripts *builder.Scripts
+	if *scriptsDir != "" {
+		if scripts, err = builder.LoadScripts(*scriptsDir); err != nil {
+			log.Fatalf("Error scripts-dir: %+v", err)
+		}
+	}
+	if *skipLargeFiles && workspaceLimits.WarnFileSize == 0 {
+		log.Fatalf("Error skip-large-files requires warn-file-size")
+	}
+	workspaceLimits.SkipLargeFiles = *skipLargeFiles
+	var workspaceIncludes []string
+	for _, pattern := range includes {
+		pattern = path.Clean(strings.TrimPrefix(filepath.ToSlash(pattern), "./"))
+		if _, err := path.Match(pattern, ""); err != nil || path.IsAbs(pattern) || strings.HasPrefix(pattern, "../") {
+			log.Fatalf("Error include must be a glob pattern relative to the build context, got %q", pattern)
+		}
+		workspaceIncludes = append(workspaceIncludes, pattern)
+	}
+
+	if err := checkDockerfile(buildContext, pickedVersionMap); err != nil {
+		log.Fatalf("Error in the Dockerfile: %+v", err)
+	}
+	var winrmClientCert, winrmClientKey []byte
+	if *winrmAuth == "cert" {
+		if winrmClientCert, winrmClientKey, err = builder.NewWinRMClientCertificate("builder", 24*time.Hour); err != nil {
+			log.Fatalf("Error creating the WinRM client certificate: %+v", err)
+		}
+	}
+	daemonConfig, err := getDockerDaemonConfig()
+	if err != nil {
+		log.Fatalf("Error reading Docker daemon configuration: %+v", err)
+	}
+	trustedCACerts, err := builder.ReadTrustedCACerts(trustedCAFiles)
+	if err != nil {
+		log.Fatalf("Error reading the trusted CA certificates: %+v", err)
+	}
+	packages, err := getInstallPackages()
+	if err != nil {
+		log.Fatalf("Error install-packages: %+v", err)
+	}
+
 	// Add obsolete 1809 version for test
 	if *testObsoleteVersion {
 		pickedVersionMap["1809"] = "windows-cloud/global/images/family/windows-1809-core-for-containers"
 	}
+	var tlsVersions []string
+	for ver := range pickedVersionMap {
+		tlsVersions = append(tlsVersions, ver)
+	}
+	if err := winrmTLS.CheckVersions(tlsVersions); err != nil {
+		log.Fatalf("Error winrm-min-tls-version: %+v", err)
+	}
 
-	var err error
-	// Fetch builder project ID from metadata or gcloud command, if it's not set in flags
+	results := builder.NewResults(*containerImageName)
+	if !outputs["push"] {
+		results.SetSkipPush()
+	}
+	var manifestVersions []string
+	if *retryFailed {
+		previous, err := builder.LoadResults(*resultsFile)
+		if err != nil {
+			log.Fatalf("Error retry-failed: %+v", err)
+		}
+		if pickedVersionMap, manifestVersions, err = getRetryVersions(results, previous, pickedVersionMap); err != nil {
+			log.Fatalf("Error retry-failed: %+v", err)
+		}
+		if len(pickedVersionMap) == 0 && previous.ManifestPushed {
+			log.Printf("No version failed in %s and the manifest was pushed, nothing to retry", *resultsFile)
+			writeResults(results)
+			return
+		}
+		if len(pickedVersionMap) == 0 && *manifestMediaType != "oci" {
+			log.Fatalf("Error retry-failed: no version failed in %s, pushing only the manifest requires manifest-media-type=oci", *resultsFile)
+		}
+	}
+
+	ctx := context.Background()
+	remoteHosts, err := getRemoteHosts(ctx, pickedVersionMap)
+	if err != nil {
+		log.Fatalf("Error remote-host: %+v", err)
+	}
+	var useInstances map[string][]string
+	if *useInstance != "" {
+		if useInstances, err = parseVersionValues(*useInstance, pickedVersionMap); err != nil {
+			log.Fatalf("Error use-instance: %+v", err)
+		}
+		for ver := range useInstances {
+			if _, ok := remoteHosts[ver]; ok {
+				log.Fatalf("Error version %s has both a use-instance and a remote-host", ver)
+			}
+		}
+		if *winrmAuth == "cert" {
+			log.Fatalf("Error winrm-auth=cert can't be used with use-instance, the certificate is mapped when new instances are set up")
+		}
+	}
+	// No GCE resources are needed when remote hosts build all versions.
+	onlyRemoteHosts := len(remoteHosts) == len(pickedVersionMap)
+
+	if *executor == "fake" && *projectID == "" {
+		*projectID = "fake-project"
+	}
+	// Fetch builder project ID from metadata or the default credentials, if it's not set in flags
 	if *projectID == "" {
-		if *projectID, err = builder.GetProject(); err != nil {
+		if *projectID, err = builder.GetProject(); err != nil && !onlyRemoteHosts {
 			log.Fatalf("Failed to get builder project ID: %+v", err)
 		}
 	}
@@ -122,19 +431,145 @@ func main() {
 		*workspaceBucket = *projectID + "_builder_tmp"
 	}
 
-	if err = setupProjectForBuilder(context.Background()); err != nil {
-		log.Fatalf("Failed to setup builder project with error: %+v", err)
+	var computeClient builder.ComputeClient
+	var storageClient builder.StorageClient
+	var newRemoteExecutor func(r *builder.RemoteWindowsServer) builder.RemoteExecutor
+	if *executor == "fake" {
+		log.Printf("Using the fake executor, no cloud resources will be created")
+		var fixture *fake.Fixture
+		if *fakeFixture != "" {
+			if fixture, err = fake.LoadFixture(*fakeFixture); err != nil {
+				log.Fatalf("Failed to load fake fixture: %+v", err)
+			}
+		}
+		computeClient = fake.NewComputeClient(fixture)
+		storageClient = fake.NewStorageClient()
+		remote := fake.NewRemote(fixture)
+		remote.Storage = storageClient.(*fake.StorageClient)
+		newRemoteExecutor = func(r *builder.RemoteWindowsServer) builder.RemoteExecutor {
+			return remote.Executor(*r.Hostname)
+		}
+	} else {
+		if computeClient, err = builder.NewComputeClient(ctx); err != nil {
+			log.Fatalf("Failed to start GCE service: %+v", err)
+		}
+		if storageClient, err = builder.NewStorageClient(ctx); err != nil {
+			log.Fatalf("Storage client creation failed: %+v", err)
+		}
+	}
+	limiter := builder.NewAPILimiter(*apiQPS, *apiMaxRetries)
+	computeClient = limiter.Compute(computeClient)
+	storageClient = limiter.Storage(storageClient)
+	defer storageClient.Close()
+
+	inventory := builder.NewInventory(*projectID)
+	o := &builder.Orchestrator{
+		ProjectID:          *projectID,
+		ContainerImageName: *containerImageName,
+		Versions:           pickedVersionMap,
+		ManifestVersions:   manifestVersions,
+		ServerConfig: builder.WindowsBuildServerConfig{
+			InstanceNamePrefix:    instanceNamePrefix,
+			InstanceNameTemplate:  *instanceNameTemplate,
+			BuildID:               *buildID,
+			Zone:                  zone,
+			NetworkConfig:         builder.NewInstanceNetworkConfig(projectID, network, networkProject, subnetwork, region),
+			Labels:                labels,
+			MachineType:           machineType,
+			BootDiskType:          bootDiskType,
+			BootDiskSizeGB:        *bootDiskSizeGB,
+			ServiceAccount:        serviceAccount,
+			UseInternalIP:         *useInternalIP,
+			ExternalNAT:           *ExternalIP,
+			ReuseInstance:         *reuseBuilderInstances,
+			StopInstances:         *onComplete == "stop",
+			SuspendInstances:      *onComplete == "suspend",
+			DockerDaemonConfig:    daemonConfig,
+			TrustedCACerts:        trustedCACerts,
+			TrustedCARegistries:   getTrustedCARegistries(),
+			DockerCacheSnapshots:  *dockerCacheSnapshots,
+			DockerCacheDiskSizeGB: *dockerCacheDiskSizeGB,
+			DefenderMode:          *defender,
+			SkipDockerInstall:     *skipDockerInstall,
+			SkipDefenderRemoval:   *skipDefenderRemoval,
+			SkipWinRMConfig:       *skipWinRMConfig,
+			WinRMClientCert:       winrmClientCert,
+			WinRMClientKey:        winrmClientKey,
+			WinRMTLS:              winrmTLS,
+			InstallWindowsUpdates: *installWindowsUpdates,
+			InstallPackages:       packages,
+			AutomaticRestart:      automaticRestart,
+			OnHostMaintenance:     *onHostMaintenance,
+			ProvisioningModel:     *provisioningModel,
+			PlacementPolicy:       *placementPolicy,
+		},
+		WorkspacePath:        buildContext,
+		WorkspaceIncludes:    workspaceIncludes,
+		WorkspaceExcludes:    []string{*resultsFile, *inventoryFile},
+		WorkspaceSymlinks:    *symlinks,
+		WorkspaceLimits:      workspaceLimits,
+		LogsDir:              *logsDir,
+		WorkspaceBucket:      *workspaceBucket,
+		BuildArgs:            buildArgs,
+		NoCache:              *noCache,
+		Pull:                 *pull,
+		ImageLabels:          imageLabels,
+		SkipPush:             !outputs["push"],
+		TarballDir:           tarballDirFor(outputs),
+		ExportTo:             *exportTo,
+		BaseImageMirror:      *baseImageMirror,
+		BaseImageTarball:     *baseImageTarball,
+		HostProcess:          *hostProcess,
+		HostProcessBaseImage: *hostProcessBaseImage,
+		Scripts:              scripts,
+		ManifestMediaType:    *manifestMediaType,
+		ManifestAnnotations:  annotations,
+		StorageLabels:        bucketLabels,
+		SetupTimeout:         *setupTimeout,
+		ManifestAttemptDelay: *manifestAttemptDelay,
+		ReadyPollInterval:    *readyPollInterval,
+		ReadyPollMaxInterval: *readyPollMaxInterval,
+		CopyTimeout:          *copyTimeout,
+		CommandTimeout:       commandTimeout,
+		PerVersionTimeout:    *perVersionTimeout,
+		RemoteIdleTimeout:    *remoteIdleTimeout,
+		MaxClockSkew:         *maxClockSkew,
+		Compute:              computeClient,
+		Storage:              storageClient,
+		RemoteHosts:          remoteHosts,
+		WorkerProjects:       getWorkerProjects(),
+		UseInstances:         useInstances,
+		NewRemoteExecutor:    newRemoteExecutor,
+		Inventory:            inventory,
+		Results:              results,
+	}
+	if onlyRemoteHosts {
+		log.Printf("Building all versions on remote hosts, skipping the project setup")
+	} else {
+		if *diskPreflight != "off" {
+			checkDiskSize(o)
+		}
+		if *iamPreflight && *executor != "fake" {
+			checkIAMPermissions(ctx, o)
+		}
+		if err = setupProjectForBuilder(ctx, computeClient, storageClient, bucketLabels, inventory); err != nil {
+			writeInventory(inventory)
+			log.Fatalf("Failed to setup builder project with error: %+v", err)
+		}
 	}
 
-	if err = process(pickedVersionMap); err != nil {
+	err = o.Run(ctx)
+	writeInventory(inventory)
+	writeResults(results)
+	if err != nil {
 		log.Fatalf("Windows multi-arch container building process failed with error: %+v", err)
 	}
 	log.Println("Windows multi-arch container building process is completed")
 }
 
-func setupProjectForBuilder(ctx context.Context) error {
+func setupProjectForBuilder(ctx context.Context, computeClient builder.ComputeClient, storageClient builder.StorageClient, bucketLabels map[string]string, inventory *builder.Inventory) error {
 	var err error
-	if err = builder.NewGCSBucketIfNotExists(ctx, *projectID, *workspaceBucket, *workspaceBucketLocation); err != nil {
+	if err = builder.NewGCSBucketIfNotExists(ctx, storageClient, *projectID, *workspaceBucket, *workspaceBucketLocation, bucketLabels, inventory); err != nil {
 		return fmt.Errorf("Failed creating bucket: %v, with error: %+v", *workspaceBucket, err)
 	}
 
@@ -146,173 +581,79 @@ func setupProjectForBuilder(ctx context.Context) error {
 		log.Printf("skipping checks that WinRM firewall rules exist")
 		return nil
 	}
-	return builder.CheckProjectFirewalls(ctx, builder.NewInstanceNetworkConfig(projectID, network, networkProject, subnetwork, region))
-}
-
-// Main building process
-func process(pickedVersionMap map[string]string) error {
-	var bss []builderServerStatus
-	defer func() {
-		shutdownBuildServers(bss)
-	}()
-
-	if err := buildSingleArchContainers(pickedVersionMap, &bss); err != nil {
-		return err
+	projects := getWorkerProjects()
+	if len(projects) == 0 {
+		projects = []string{*projectID}
 	}
-	if err := buildMultiArchContainer(pickedVersionMap, bss); err != nil {
-		return err
+	for i := range projects {
+		if err = builder.CheckProjectFirewalls(computeClient, builder.NewInstanceNetworkConfig(&projects[i], network, networkProject, subnetwork, region)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Bring up Windows Build Servers & build single-arch containers in parallel
-func buildSingleArchContainers(pickedVersionMap map[string]string, bss *[]builderServerStatus) error {
-	ch := make(chan builderServerStatus, len(pickedVersionMap))
-	wg := sync.WaitGroup{}
-	for ver, imageFamily := range pickedVersionMap {
-		wg.Add(1)
-		go func(ver string, imageFamily string) {
-			defer wg.Done()
-			ctx := context.Background()
-			ch <- buildSingleArchContainer(ctx, ver, imageFamily)
-		}(ver, imageFamily)
-	}
-	// Wait until all builder server statuses returned.
-	wg.Wait()
-	chLen := len(ch)
-	if chLen != len(pickedVersionMap) {
-		return fmt.Errorf("Unexpected discrepancy happened, the number of builder server statuses in channel is not equal to length of pickedVersionMap")
-	}
-	for i := 0; i < chLen; i++ {
-		*bss = append(*bss, <-ch)
-	}
-	// If any fatal error happens, exit the process
-	for _, bs := range *bss {
-		if bs.err != nil {
-			return fmt.Errorf("Error happened when building single-arch containers: %+v", bs.err)
+// getWorkerProjects returns the projects of worker-projects, if set.
+func getWorkerProjects() []string {
+	var projects []string
+	for _, project := range strings.Split(*workerProjects, ",") {
+		if project = strings.TrimSpace(project); project != "" {
+			projects = append(projects, project)
 		}
 	}
-	return nil
+	return projects
 }
 
-// Build multi-arch container on any available server.
-// If the pickedVersionMap has obsolete image version, it's still working fine, as `docker manifest create` command is resilient for non-existing containers.
-// E.g. `docker manifest create container container_1909 container_2019` works if container_1909 doesn't exist. The resulting multi-arch container will have the only manifest of container_2019.
-func buildMultiArchContainer(pickedVersionMap map[string]string, bss []builderServerStatus) error {
-	var isManifestCreated bool
-	for _, bs := range bss {
-		if bs.s != nil && !isManifestCreated {
-			manifestCreateCmdArgs := constructArgsOfManifestCreateCommand(pickedVersionMap)
-			err := createMultiArchContainerOnRemote(&bs.s.RemoteWindowsServer, *containerImageName, manifestCreateCmdArgs, commandTimeout)
-			if err != nil {
-				log.Printf("Error executing createMultiArchContainerOnRemote on instance: %v, with error: %+v", *bs.s.RemoteWindowsServer.Hostname, err)
-			} else {
-				isManifestCreated = true
-			}
-		}
+// getRetryVersions returns the versions of versions that failed or were not
+// built according to previous, and the versions whose images previous pushed.
+func getRetryVersions(results *builder.Results, previous *builder.Results, versions map[string]string) (map[string]string, []string, error) {
+	var sorted []string
+	for ver := range versions {
+		sorted = append(sorted, ver)
 	}
-	if !isManifestCreated {
-		return fmt.Errorf("Failed to create the final multi-arch manifest")
+	sort.Strings(sorted)
+	failed, succeeded, err := results.Retry(previous, sorted)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	retry := map[string]string{}
+	for _, ver := range failed {
+		retry[ver] = versions[ver]
+	}
+	log.Printf("Retrying the versions [%s], keeping the images of [%s]", strings.Join(failed, ", "), strings.Join(succeeded, ", "))
+	return retry, succeeded, nil
 }
 
-func shutdownBuildServers(bss []builderServerStatus) {
-	if *reuseBuilderInstances {
-		log.Printf("Keeping instances for reuse")
-		wg := sync.WaitGroup{}
-		for _, bsc := range bss {
-			if bsc.s != nil {
-				wg.Add(1)
-				go func(bsc builderServerStatus) {
-					defer wg.Done()
-					bsc.s.RemoteWindowsServer.CleanFolder()
-				}(bsc)
-			}
+// Write the results of the build to the results-file and the junit-file, if
+// set. Failing to write them doesn't fail the build.
+func writeResults(results *builder.Results) {
+	if *resultsFile != "" {
+		if err := results.Write(*resultsFile); err != nil {
+			log.Printf("Error writing the build results: %+v", err)
+		} else {
+			log.Printf("Wrote the build results to %s", *resultsFile)
 		}
-		wg.Wait()
-		return
 	}
-
-	log.Printf("Deleting created instances")
-	wg := sync.WaitGroup{}
-	for _, bsc := range bss {
-		if bsc.s != nil {
-			wg.Add(1)
-			go func(bsc builderServerStatus) {
-				defer wg.Done()
-				bsc.s.DeleteInstance()
-			}(bsc)
+	if *junitFile != "" {
+		if err := results.WriteJUnit(*junitFile); err != nil {
+			log.Printf("Error writing the JUnit report: %+v", err)
+		} else {
+			log.Printf("Wrote the JUnit report to %s", *junitFile)
 		}
 	}
-	wg.Wait()
 }
 
-// Brings up a Windows Server Instance, build single-arch container and return the buider status.
-// If that status's err is nil, the server is still running.
-// If err is non-nil, then the server has been stopped.
-// So please be aware of cleaning up the running instances after calling this function.
-func buildSingleArchContainer(ctx context.Context, ver string, imageFamily string) builderServerStatus {
-	var s *builder.Server
-	var err error
-
-	netConfig := builder.NewInstanceNetworkConfig(projectID, network, networkProject, subnetwork, region)
-	bsc := &builder.WindowsBuildServerConfig{
-		InstanceNamePrefix: instanceNamePrefix,
-		ImageVersion:       &ver,
-		ImageURL:           &imageFamily,
-		Zone:               zone,
-		NetworkConfig:      netConfig,
-		Labels:             labels,
-		MachineType:        machineType,
-		BootDiskType:       bootDiskType,
-		BootDiskSizeGB:     *bootDiskSizeGB,
-		ServiceAccount:     serviceAccount,
-		UseInternalIP:      *useInternalIP,
-		ExternalNAT:        *ExternalIP,
-		ReuseInstance:      *reuseBuilderInstances,
-	}
-
-	if *reuseBuilderInstances {
-		log.Printf("Looking for an exiting %s instance to reuse", ver)
-		s, err = builder.FindExistingInstance(ctx, bsc, *projectID)
-	}
-
-	if s == nil {
-		s, err = builder.NewServer(ctx, bsc, *projectID)
-		if err != nil {
-			if isImageNotFoundErr(err, imageFamily) {
-				log.Printf("Failed to create Windows %[1]s instance, it may be expired, so skip it to continue without stamping Windows %[1]s manifest", ver)
-				return builderServerStatus{nil, nil}
-			}
-			return builderServerStatus{nil, err}
-		}
-	}
-
-	r := &s.RemoteWindowsServer
-
-	log.Printf("Waiting for Windows %s instance: %s (%s) to become available", ver, *r.Hostname, s.GetInstanceName())
-	err = r.WaitForServerBeReady(*setupTimeout)
-	if err != nil {
-		log.Printf("Error setup Windows %s instance: %s with error: %+v", ver, *r.Hostname, err)
-		return builderServerStatus{s, err}
-	}
-
-	r.WorkspaceBucket = workspaceBucket
-	// Copy workspace to remote machine
-	log.Printf("Copying local workspace to remote machine: %v", *r.Hostname)
-	err = r.Copy(*workspacePath, *copyTimeout)
-	if err != nil {
-		log.Printf("Error copying workspace to %v : %+v", *r.Hostname, err)
-		return builderServerStatus{s, err}
+// Write the inventory to the inventory-file, if set. Failing to write it
+// doesn't fail the build.
+func writeInventory(inventory *builder.Inventory) {
+	if *inventoryFile == "" {
+		return
 	}
-
-	err = buildSingleArchContainerOnRemote(r, *containerImageName, ver, commandTimeout)
-	if err != nil {
-		log.Printf("Error building single arch container on remote %v : %+v", *r.Hostname, err)
-		return builderServerStatus{s, err}
+	if err := inventory.Write(*inventoryFile); err != nil {
+		log.Printf("Error writing the inventory: %+v", err)
+		return
 	}
-	return builderServerStatus{s, nil}
+	log.Printf("Wrote the inventory of the build resources to %s", *inventoryFile)
 }
 
 // Get the version map for picked versions
@@ -339,68 +680,290 @@ func getPickedVersionMap(pickedVersions string) map[string]string {
 	return pickedVersionMap
 }
 
-// Check if the error is image not found error.
-func isImageNotFoundErr(err error, imageFamily string) bool {
-	var gceAPIErr *googleapi.Error
-	if errors.As(err, &gceAPIErr) {
-		// Image not found error sample:
-		// googleapi: Error 404: The resource 'projects/windows-cloud/global/images/family/windows-1809-core-for-containers' was not found
-		if gceAPIErr.Code == 404 && strings.Contains(gceAPIErr.Message, imageFamily) {
-			return true
+// Get the versions, as a list for getPickedVersionMap, that the Dockerfile of
+// the build context supports, as set by versions=auto.
+func getDockerfileVersions(buildContext string) (string, error) {
+	var supported []string
+	for ver := range versionMap {
+		supported = append(supported, ver)
+	}
+	sort.Strings(supported)
+	versions, err := builder.DockerfileVersions(filepath.Join(buildContext, "Dockerfile"), supported)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Building the versions of the Dockerfile: %s", strings.Join(versions, ","))
+	return strings.Join(versions, ","), nil
+}
+
+// Get the GCE image for each picked version, according to the image variant
+// and the per-version overrides in imageFamilies.
+func getImageFamilies(pickedVersionMap map[string]string, imageVariant string, imageFamilies string) (map[string]string, error) {
+	images := map[string]string{}
+	for ver, image := range pickedVersionMap {
+		switch imageVariant {
+		case "core":
+			images[ver] = image
+		case "full":
+			if fullVersionMap[ver] == "" {
+				return nil, fmt.Errorf("Windows %s has no full image variant, only Server Core", ver)
+			}
+			images[ver] = fullVersionMap[ver]
+		default:
+			return nil, fmt.Errorf("image-variant must be 'core' or 'full', got %q", imageVariant)
 		}
 	}
-	return false
+	if imageFamilies == "" {
+		return images, nil
+	}
+	overrides, err := parseKeyValuePairs(strings.Split(imageFamilies, ","))
+	if err != nil {
+		return nil, err
+	}
+	for ver, image := range overrides {
+		if _, ok := images[ver]; !ok {
+			return nil, fmt.Errorf("image-families has an image for %s, which is not a picked version", ver)
+		}
+		if !strings.Contains(image, "/") {
+			image = "windows-cloud/global/images/family/" + image
+		}
+		images[ver] = image
+	}
+	return images, nil
+}
+
+// Get the directory copied to the instances and used as the docker build
+// context: the workspace, or its subdirectory contextDir.
+func getBuildContext(workspace string, contextDir string) (string, error) {
+	if contextDir == "" {
+		return workspace, nil
+	}
+	if filepath.IsAbs(contextDir) {
+		return "", fmt.Errorf("%q must be relative to the workspace", contextDir)
+	}
+	path := filepath.Join(workspace, contextDir)
+	if rel, err := filepath.Rel(workspace, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is outside of the workspace", contextDir)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+	return path, nil
 }
 
-// Construct the args of `docker manifest create` cmd
-// e.g. `docker manifest create demo:cloudbuild demo:cloudbuild_ltsc2019 demo:cloudbuild_1909`
-func constructArgsOfManifestCreateCommand(pickedVersionMap map[string]string) string {
-	args := *containerImageName
+// Check the Dockerfile of the build context before spending time on
+// instances, as set by dockerfile-check.
+func checkDockerfile(buildContext string, pickedVersionMap map[string]string) error {
+	if *dockerfileCheck == "off" {
+		return nil
+	}
+	var versions []string
 	for ver := range pickedVersionMap {
-		args += fmt.Sprint(" ", *containerImageName, "_", ver)
+		versions = append(versions, ver)
+	}
+	p, err := builder.ValidateDockerfile(filepath.Join(buildContext, "Dockerfile"), versions)
+	if err != nil {
+		return err
+	}
+	for _, w := range p.Warnings {
+		log.Printf("Warning: Dockerfile %s", w)
+	}
+	for _, e := range p.Errors {
+		log.Printf("Error: Dockerfile %s", e)
+	}
+	if len(p.Errors) > 0 && *dockerfileCheck == "error" {
+		return fmt.Errorf("%d problems found, use --dockerfile-check=warn to build anyway", len(p.Errors))
+	}
+	return nil
+}
+
+// getInstallPackages returns the packages of install-packages, if set.
+func getInstallPackages() ([]builder.InstallPackage, error) {
+	var packages []builder.InstallPackage
+	for _, spec := range strings.Split(*installPackages, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		p, err := builder.ParseInstallPackage(spec)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+// Get the registries whose docker certs.d folders get the trusted-ca-file
+// certificates: those of container-image-name and base-image-mirror.
+func getTrustedCARegistries() []string {
+	var registries []string
+	for _, image := range []string{*containerImageName, *baseImageMirror} {
+		if image == "" {
+			continue
+		}
+		ref, err := builder.ParseImageReference(image)
+		if err != nil {
+			log.Printf("Not trusting the CA certificates for %s: %+v", image, err)
+			continue
+		}
+		if len(registries) == 0 || registries[0] != ref.Registry {
+			registries = append(registries, ref.Registry)
+		}
+	}
+	return registries
+}
+
+// Get the daemon.json content for Docker on the Windows instances from the
+// --docker-daemon-config file and the --docker-* flags, or "" to keep the
+// Docker defaults.
+func getDockerDaemonConfig() (string, error) {
+	config := map[string]interface{}{}
+	if *dockerDaemonConfig != "" {
+		data, err := ioutil.ReadFile(*dockerDaemonConfig)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return "", fmt.Errorf("Failed to parse %s as a JSON object: %+v", *dockerDaemonConfig, err)
+		}
+	}
+	if *dockerDataRoot != "" {
+		config["data-root"] = *dockerDataRoot
+	}
+	if *dockerMaxDownloads > 0 {
+		config["max-concurrent-downloads"] = *dockerMaxDownloads
+	}
+	if *dockerMaxUploads > 0 {
+		config["max-concurrent-uploads"] = *dockerMaxUploads
+	}
+	if *dockerInsecureRegistry != "" {
+		config["insecure-registries"] = strings.Split(*dockerInsecureRegistry, ",")
+	}
+	if *dockerRegistryMirrors != "" {
+		config["registry-mirrors"] = strings.Split(*dockerRegistryMirrors, ",")
+	}
+	if *dockerStorageOpts != "" {
+		config["storage-opts"] = strings.Split(*dockerStorageOpts, ",")
+	}
+	if len(config) == 0 {
+		return "", nil
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Get the existing hosts that build versions instead of GCE instances, from
+// remote-host, with their credentials.
+func getRemoteHosts(ctx context.Context, pickedVersionMap map[string]string) (map[string]*builder.RemoteHost, error) {
+	if *remoteHost == "" {
+		return nil, nil
 	}
-	return args
+	hostnames, err := parseVersionValues(*remoteHost, pickedVersionMap)
+	if err != nil {
+		return nil, err
+	}
+	if *remoteUser == "" {
+		return nil, fmt.Errorf("remote-user is required")
+	}
+	password := *remotePassword
+	if *remotePasswordSecret != "" {
+		if password != "" {
+			return nil, fmt.Errorf("remote-password and remote-password-secret can't both be set")
+		}
+		var err error
+		if password, err = builder.AccessSecret(ctx, *remotePasswordSecret); err != nil {
+			return nil, err
+		}
+	}
+	if password == "" {
+		return nil, fmt.Errorf("remote-password or remote-password-secret is required")
+	}
+	hosts := map[string]*builder.RemoteHost{}
+	for ver, names := range hostnames {
+		if len(names) > 1 {
+			return nil, fmt.Errorf("Windows %s has %d remote hosts %s, only one is allowed", ver, len(names), strings.Join(names, ", "))
+		}
+		hosts[ver] = &builder.RemoteHost{Hostname: names[0], Username: *remoteUser, Password: password}
+	}
+	return hosts, nil
 }
 
-func buildSingleArchContainerOnRemote(
-	r *builder.RemoteWindowsServer,
-	containerImageName string,
-	version string,
-	timeout time.Duration,
-) error {
-	registry := strings.Split(containerImageName, "/")[0]
-	if registry == "gcr.io" {
-		registry = ""
-	}
-	buildargs := ""
-	for _, arg := range buildArgs {
-		buildargs += "--build-arg " + arg + " "
-	}
-	buildSingleArchContainerScript := fmt.Sprintf(`
-	$env:DOCKER_CLI_EXPERIMENTAL = 'enabled'
-	gcloud auth --quiet configure-docker %[3]s
-	docker build -t %[1]s_%[2]s --build-arg WINDOWS_VERSION=%[2]s %[4]s .
-	docker push %[1]s_%[2]s
-	`, containerImageName, version, registry, buildargs)
-
-	log.Printf("Start to build single-arch container with commands: %s", buildSingleArchContainerScript)
-	return r.RunCommand(winrm.Powershell(buildSingleArchContainerScript), *r.WorkspaceFolder, timeout)
+// Parse the VALUE or VERSION=VALUE items separated by comma of list, by
+// version. Values without a version are only allowed when building a single
+// version. Empty items, e.g. of a trailing comma, are skipped.
+func parseVersionValues(list string, pickedVersionMap map[string]string) (map[string][]string, error) {
+	values := map[string][]string{}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 1 {
+			if len(pickedVersionMap) != 1 {
+				return nil, fmt.Errorf("%q has no version, which is only allowed when building a single version", pair)
+			}
+			for ver := range pickedVersionMap {
+				values[ver] = append(values[ver], pair)
+			}
+			continue
+		}
+		if _, ok := pickedVersionMap[kv[0]]; !ok {
+			return nil, fmt.Errorf("%q is for version %s, which is not built", pair, kv[0])
+		}
+		if strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("%q has no value", pair)
+		}
+		values[kv[0]] = append(values[kv[0]], kv[1])
+	}
+	return values, nil
+}
+
+// Get the labels of the workspace bucket and objects, from storage-labels or
+// else labels.
+func getStorageLabels() (map[string]string, error) {
+	list := *storageLabels
+	if list == "" {
+		list = *labels
+	}
+	if list == "" {
+		return nil, nil
+	}
+	var pairs []string
+	for _, pair := range strings.Split(list, ",") {
+		pairs = append(pairs, strings.TrimSpace(pair))
+	}
+	return parseKeyValuePairs(pairs)
 }
 
-// This function assumes that the remote server has already performed gcloud docker authentication.
-// https://cloud.google.com/artifact-registry/docs/docker/authentication#gcloud-helper
-func createMultiArchContainerOnRemote(
-	r *builder.RemoteWindowsServer,
-	containerImageName string,
-	manifestCreateCmdArgs string,
-	timeout time.Duration,
-) error {
-	createMultiarchContainerScript := fmt.Sprintf(`
-	$env:DOCKER_CLI_EXPERIMENTAL = 'enabled'
-	docker manifest create %s
-	docker manifest push %s
-	`, manifestCreateCmdArgs, containerImageName)
-
-	log.Printf("Start to create multi-arch container with commands: %s", createMultiarchContainerScript)
-	return r.RunCommand(winrm.Powershell(createMultiarchContainerScript), *r.WorkspaceFolder, timeout)
+// tarballDirFor returns the directory to save the image tarballs to, or ""
+// when outputs doesn't include them.
+func tarballDirFor(outputs map[string]bool) string {
+	if !outputs["tarball"] {
+		return ""
+	}
+	return *tarballDir
+}
+
+// Parse KEY=VALUE pairs into a map.
+func parseKeyValuePairs(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%q is not a KEY=VALUE pair", pair)
+		}
+		m[strings.TrimSpace(kv[0])] = kv[1]
+	}
+	return m, nil
 }
@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+
+	"gke-windows-builder/builder/builder"
+)
+
+// Tags of the nanoserver base image that differ from the Windows version.
+var nanoserverTags = map[string]string{
+	"ltsc2019": "1809",
+}
+
+// mirrorBaseImagesMain implements the mirror-base-images command, which
+// copies the Windows base images of the picked versions to a registry
+// reachable by the build, e.g.:
+//
+//	gke-windows-builder mirror-base-images --target=us-docker.pkg.dev/PROJECT/mirror
+//
+// mcr.microsoft.com/windows/servercore:ltsc2022 is copied to
+// us-docker.pkg.dev/PROJECT/mirror/windows/servercore:ltsc2022. Build with
+// --base-image-mirror=us-docker.pkg.dev/PROJECT/mirror to use the copies.
+func mirrorBaseImagesMain(args []string) {
+	fs := flag.NewFlagSet("mirror-base-images", flag.ExitOnError)
+	target := fs.String("target", "", "The registry repository to copy the base images to, e.g. us-docker.pkg.dev/PROJECT/REPOSITORY")
+	source := fs.String("source", "mcr.microsoft.com", "The registry to copy the base images from")
+	versions := fs.String("versions", "", "List of Windows Server versions separated by comma to copy the base images of. Defaults to all the versions the builder supports")
+	images := fs.String("images", "windows/servercore,windows/nanoserver", "List of base image repositories separated by comma to copy")
+	setFlagsFromEnv(fs, "mirror-base-images")
+	fs.Parse(args)
+	if *target == "" {
+		log.Fatalf("Error target flag is required but was not set")
+	}
+
+	ctx := context.Background()
+	c := builder.NewRegistryClient(ctx)
+	for ver := range getPickedVersionMap(*versions) {
+		for _, image := range strings.Split(*images, ",") {
+			tag := ver
+			if strings.HasSuffix(image, "/nanoserver") && nanoserverTags[ver] != "" {
+				tag = nanoserverTags[ver]
+			}
+			sourceRef, err := builder.ParseImageReference(*source + "/" + image + ":" + tag)
+			if err != nil {
+				log.Fatalf("Invalid source image: %+v", err)
+			}
+			targetRef, err := builder.ParseImageReference(*target + "/" + image + ":" + tag)
+			if err != nil {
+				log.Fatalf("Invalid target image: %+v", err)
+			}
+			log.Printf("Copying %s to %s", sourceRef, targetRef)
+			digest, err := builder.MirrorImage(ctx, c, sourceRef, targetRef)
+			if err != nil {
+				log.Fatalf("Failed to copy %s: %+v", sourceRef, err)
+			}
+			log.Printf("Copied %s to %s@%s", sourceRef, targetRef, digest)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"gke-windows-builder/builder/builder"
+)
+
+// checkIAMPermissions fails the build before any resource is created when the
+// builder or the service account of the instances is missing permissions the
+// build needs. Permissions that can't be tested, e.g. because the builder may
+// not impersonate the service account, are logged and skipped.
+func checkIAMPermissions(ctx context.Context, o *builder.Orchestrator) {
+	_, err := o.Storage.GetBucketAttrs(ctx, o.WorkspaceBucket)
+	builderReq, instancesReq := o.RequiredPermissions(!errors.Is(err, storage.ErrBucketNotExist))
+
+	builderIAM, err := builder.NewIAMClient(ctx, "")
+	if err != nil {
+		log.Printf("Skipping the IAM preflight, failed to create the IAM client: %+v", err)
+		return
+	}
+	var problems []string
+	if missing, err := builder.CheckIAMPermissions(ctx, builderIAM, builderReq); err != nil {
+		log.Printf("Skipping the IAM preflight of the builder: %+v", err)
+	} else if len(missing) > 0 {
+		problems = append(problems, builder.FormatMissingPermissions("The builder", missing))
+	}
+
+	email := o.ServerConfig.GetServiceAccountEmail(o.ProjectID)
+	if email == "default" {
+		if email, err = builder.DefaultServiceAccountEmail(ctx, builderIAM, o.ProjectID); err != nil {
+			log.Printf("Skipping the IAM preflight of the instances, failed to get the default service account: %+v", err)
+		}
+	}
+	if email != "default" && email != "" {
+		instancesIAM, err := builder.NewIAMClient(ctx, email)
+		if err == nil {
+			var missing []string
+			if missing, err = builder.CheckIAMPermissions(ctx, instancesIAM, instancesReq); err == nil && len(missing) > 0 {
+				problems = append(problems, builder.FormatMissingPermissions("The service account "+email+" of the instances", missing))
+			}
+		}
+		if err != nil {
+			log.Printf("Skipping the IAM preflight of %s, it needs the builder to have roles/iam.serviceAccountTokenCreator on it: %+v", email, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		log.Fatalf("Error IAM preflight failed, grant the missing permissions or skip the check with --iam-preflight=false:\n%s", strings.Join(problems, "\n"))
+	}
+	log.Printf("IAM preflight passed")
+}
+
+// checkDiskSize estimates the disk space each version needs on a new instance
+// and, as set by disk-preflight, raises the boot disk size to fit or fails the
+// build before any instance is created, rather than have docker run out of
+// space mid-build. Remote hosts and named instances keep their disks.
+func checkDiskSize(o *builder.Orchestrator) {
+	workspaceBytes, err := dirSize(o.WorkspacePath)
+	if err != nil {
+		log.Printf("Skipping the disk preflight, failed to size the workspace: %+v", err)
+		return
+	}
+	var needed int64
+	var largest string
+	for ver := range o.Versions {
+		if _, ok := o.RemoteHosts[ver]; ok || len(o.UseInstances[ver]) > 0 {
+			continue
+		}
+		e, err := builder.EstimateDiskSize(filepath.Join(o.WorkspacePath, "Dockerfile"), ver, *imageVariant, workspaceBytes)
+		if err != nil {
+			log.Printf("Skipping the disk preflight: %+v", err)
+			return
+		}
+		log.Printf("Estimated disk space of Windows %s: %v", ver, e)
+		total := e.TotalGB()
+		if o.ServerConfig.DockerCacheSnapshots {
+			// The docker data is on the docker cache disk.
+			total -= e.BaseImagesGB + e.BuildGB
+		}
+		if total > needed {
+			needed, largest = total, ver
+		}
+	}
+	if needed <= o.ServerConfig.BootDiskSizeGB {
+		log.Printf("Disk preflight passed")
+		return
+	}
+	if *diskPreflight == "error" {
+		log.Fatalf("Error disk preflight failed, Windows %s needs about %dGB of disk but boot-disk-size-GB is %d. Raise it or skip the check with --disk-preflight=off", largest, needed, o.ServerConfig.BootDiskSizeGB)
+	}
+	log.Printf("Raising boot-disk-size-GB from %d to %d, the estimated disk space of Windows %s. Reused instances keep their disks", o.ServerConfig.BootDiskSizeGB, needed, largest)
+	o.ServerConfig.BootDiskSizeGB = needed
+}
+
+// dirSize returns the total size of the regular files under path.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"gke-windows-builder/builder/builder"
+)
+
+// promoteMain implements the promote command, which copies a published
+// multi-arch image and all its single-arch images to another registry
+// without rebuilding, keeping its digest, e.g.:
+//
+//	gke-windows-builder promote --from=us-docker.pkg.dev/dev/repo/app@sha256:... --to=us-docker.pkg.dev/prod/repo/app:v1
+func promoteMain(args []string) {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	from := fs.String("from", "", "The image to promote, referenced by digest, e.g. REGISTRY/REPOSITORY/IMAGE@sha256:DIGEST")
+	to := fs.String("to", "", "The image to create, e.g. REGISTRY/REPOSITORY/IMAGE:TAG")
+	setFlagsFromEnv(fs, "promote")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		log.Fatalf("Error from and to flags are required")
+	}
+
+	source, err := builder.ParseImageReference(*from)
+	if err != nil {
+		log.Fatalf("Invalid source image: %+v", err)
+	}
+	if source.Digest == "" {
+		log.Fatalf("Error from must reference the image by digest, got %q", *from)
+	}
+	target, err := builder.ParseImageReference(*to)
+	if err != nil {
+		log.Fatalf("Invalid target image: %+v", err)
+	}
+	if target.Digest != "" {
+		log.Fatalf("Error to must reference the image by tag, got %q", *to)
+	}
+
+	ctx := context.Background()
+	log.Printf("Promoting %s to %s", source, target)
+	digest, err := builder.PromoteImage(ctx, builder.NewRegistryClient(ctx), source, target)
+	if err != nil {
+		log.Fatalf("Failed to promote %s: %+v", source, err)
+	}
+	log.Printf("Promoted %s to %s@%s", source, target, digest)
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"gke-windows-builder/builder/builder"
+)
+
+// pruneTagsMain implements the prune-tags command, which deletes the old
+// tags of an image matching a pattern, e.g. the per-version tags of CI
+// builds:
+//
+//	gke-windows-builder prune-tags --repository=us-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE --pattern='*_ltsc*' --older-than-days=30 --keep=5
+func pruneTagsMain(args []string) {
+	fs := flag.NewFlagSet("prune-tags", flag.ExitOnError)
+	repository := fs.String("repository", "", "The image repository to prune the tags of, e.g. us-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE")
+	pattern := fs.String("pattern", "", "Glob pattern of the tags to prune, e.g. '*_ltsc*' for the per-version tags")
+	olderThanDays := fs.Int("older-than-days", 0, "Only prune the tags uploaded more than this many days ago")
+	keep := fs.Int("keep", 0, "Keep this many of the most recently uploaded matching tags")
+	dryRun := fs.Bool("dry-run", false, "Only log the tags that would be deleted")
+	setFlagsFromEnv(fs, "prune-tags")
+	fs.Parse(args)
+	if *repository == "" || *pattern == "" {
+		log.Fatalf("Error repository and pattern flags are required")
+	}
+	if *olderThanDays <= 0 && *keep <= 0 {
+		log.Fatalf("Error at least one of older-than-days and keep must be set, refusing to delete all the matching tags")
+	}
+
+	ref, err := builder.ParseImageReference(*repository)
+	if err != nil {
+		log.Fatalf("Invalid repository: %+v", err)
+	}
+	if ref.Digest != "" || ref.Tag != "latest" {
+		log.Fatalf("Error repository must not have a tag or digest, got %q", *repository)
+	}
+
+	ctx := context.Background()
+	c := builder.NewRegistryClient(ctx)
+	tags, err := c.ListTags(ctx, ref)
+	if err != nil {
+		log.Fatalf("Failed to list tags: %+v", err)
+	}
+	prune, err := builder.TagsToPrune(tags, *pattern, time.Duration(*olderThanDays)*24*time.Hour, *keep, time.Now())
+	if err != nil {
+		log.Fatalf("Error %+v", err)
+	}
+	log.Printf("Pruning %d of the %d tags of %s", len(prune), len(tags), ref.Registry+"/"+ref.Repository)
+
+	failed := 0
+	for _, t := range prune {
+		tagRef := &builder.ImageReference{Registry: ref.Registry, Repository: ref.Repository, Tag: t.Name}
+		if *dryRun {
+			log.Printf("Would delete %s, uploaded %s", tagRef, t.Uploaded.Format(time.RFC3339))
+			continue
+		}
+		if err := c.DeleteTag(ctx, tagRef); err != nil {
+			log.Printf("Failed to delete %s: %+v", tagRef, err)
+			failed++
+			continue
+		}
+		log.Printf("Deleted %s", tagRef)
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to delete %d tags", failed)
+	}
+}
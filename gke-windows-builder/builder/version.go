@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+)
+
+// Build metadata, set with -ldflags "-X main.version=... -X main.gitCommit=..."
+// by the Dockerfile.
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+)
+
+// versionString returns the version and git commit of the builder.
+func versionString() string {
+	return fmt.Sprintf("gke-windows-builder %s (commit %s, %s)", version, gitCommit, runtime.Version())
+}
+
+// printVersion writes the version of the builder and the default Windows
+// versions it builds for with their GCE image families.
+func printVersion(w io.Writer) {
+	fmt.Fprintln(w, versionString())
+	fmt.Fprintln(w, "Windows versions:")
+	printImageFamilies(w, versionMap)
+	fmt.Fprintln(w, "Windows versions with --image-variant=full:")
+	printImageFamilies(w, fullVersionMap)
+}
+
+func printImageFamilies(w io.Writer, families map[string]string) {
+	var versions []string
+	for ver := range families {
+		versions = append(versions, ver)
+	}
+	sort.Strings(versions)
+	for _, ver := range versions {
+		fmt.Fprintf(w, "  %s: %s\n", ver, families[ver])
+	}
+}